@@ -0,0 +1,116 @@
+// Package audit records authenticated and administrative
+// actions.
+package audit
+
+import (
+	"time"
+)
+
+// ActorType is the type of principal which performed an action.
+type ActorType string
+
+const (
+	// ActorAccount is an account authenticated with its key.
+	ActorAccount ActorType = "account"
+
+	// ActorDevice is a device authenticated with its device
+	// credential. The id is '<account id>/<device id>'.
+	ActorDevice ActorType = "device"
+
+	// ActorEnrollment is a request authenticated with an enrollment
+	// token. The id is '<account id>/<token id>'.
+	ActorEnrollment ActorType = "enrollment"
+
+	// ActorToken is a request authenticated with an api token. The
+	// id is '<account id>/<token id>'.
+	ActorToken ActorType = "token"
+
+	// ActorAdmin is a request authenticated with the admin token.
+	ActorAdmin ActorType = "admin"
+
+	// ActorAnonymous is a request which failed authentication.
+	ActorAnonymous ActorType = "anonymous"
+)
+
+// Result is the outcome of an action.
+type Result string
+
+const (
+	// ResultSuccess actions completed with a 2xx or 3xx status.
+	ResultSuccess Result = "success"
+
+	// ResultFailure actions were rejected or failed.
+	ResultFailure Result = "failure"
+)
+
+// Actor is the principal which performed an action.
+type Actor struct {
+	Type ActorType `json:"type"`
+	ID   string    `json:"id,omitempty"`
+}
+
+// Entry is a single audited action.
+type Entry struct {
+	// Time is when the action was requested.
+	Time time.Time `json:"time"`
+
+	Actor Actor `json:"actor"`
+
+	// Action names the action, such as 'device.register'.
+	Action string `json:"action"`
+
+	// Target is the resource acted on, such as
+	// 'account:abc/device:device-a'.
+	Target string `json:"target,omitempty"`
+
+	SourceIP  string `json:"source_ip"`
+	RequestID string `json:"request_id"`
+	Result    Result `json:"result"`
+
+	// Status is the http response status code.
+	Status int `json:"status"`
+}
+
+// Filter selects entries. Zero values match all entries.
+type Filter struct {
+	// Since matches entries at or after Since.
+	Since time.Time
+
+	// Until matches entries before Until.
+	Until time.Time
+
+	// ActorID matches entries with the actor id.
+	ActorID string
+
+	// Action matches entries with the action.
+	Action string
+
+	// Limit is the maximum number of entries returned.
+	Limit int
+}
+
+// Match returns true if e matches the filter, ignoring Limit.
+func (f Filter) Match(e Entry) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	if f.ActorID != "" && e.Actor.ID != f.ActorID {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	return true
+}
+
+// Sink stores audit entries.
+type Sink interface {
+	// Write records an entry.
+	Write(e Entry) error
+
+	// Query returns the entries matching f, newest first.
+	Query(f Filter) ([]Entry, error)
+}
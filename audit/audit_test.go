@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinks(t *testing.T) {
+	fileSink, err := NewFileSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, fileSink.Close()) })
+
+	sinks := []struct {
+		name string
+		sink Sink
+	}{
+		{"memory", NewMemorySink(0)},
+		{"file", fileSink},
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{start, Actor{ActorAccount, "abc"}, "subscription.validate", "account:abc", "10.0.0.1", "1", ResultSuccess, 200},
+		{start.Add(time.Minute), Actor{ActorAnonymous, ""}, "device.register", "account:abc", "10.0.0.2", "2", ResultFailure, 401},
+		{start.Add(time.Minute * 2), Actor{ActorAccount, "go"}, "device.register", "account:go/device:x", "10.0.0.1", "3", ResultSuccess, 200},
+		{start.Add(time.Minute * 3), Actor{ActorAdmin, ""}, "snapshot.export", "", "10.0.0.3", "4", ResultSuccess, 200},
+	}
+
+	cases := []struct {
+		name      string
+		filter    Filter
+		expectIDs []string
+	}{
+		{"all", Filter{}, []string{"4", "3", "2", "1"}},
+		{"since", Filter{Since: start.Add(time.Minute)}, []string{"4", "3", "2"}},
+		{"until", Filter{Until: start.Add(time.Minute * 2)}, []string{"2", "1"}},
+		{"range", Filter{Since: start.Add(time.Minute), Until: start.Add(time.Minute * 3)}, []string{"3", "2"}},
+		{"actor", Filter{ActorID: "abc"}, []string{"1"}},
+		{"action", Filter{Action: "device.register"}, []string{"3", "2"}},
+		{"limit", Filter{Limit: 2}, []string{"4", "3"}},
+		{"none", Filter{Since: start.Add(time.Hour)}, []string{}},
+	}
+
+	for _, sc := range sinks {
+		for _, e := range entries {
+			require.NoError(t, sc.sink.Write(e))
+		}
+
+		for _, tc := range cases {
+			t.Run(sc.name+"-"+tc.name, func(t *testing.T) {
+				got, err := sc.sink.Query(tc.filter)
+				require.NoError(t, err)
+
+				ids := []string{}
+				for _, e := range got {
+					ids = append(ids, e.RequestID)
+				}
+				require.Equal(t, tc.expectIDs, ids)
+			})
+		}
+	}
+
+	got, err := fileSink.Query(Filter{Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, entries[3], got[0])
+}
+
+func TestMemorySinkMax(t *testing.T) {
+	sink := NewMemorySink(2)
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, sink.Write(Entry{RequestID: id}))
+	}
+
+	got, err := sink.Query(Filter{})
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	require.Equal(t, "3", got[0].RequestID)
+	require.Equal(t, "2", got[1].RequestID)
+}
+
+func TestFileSinkReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(Entry{RequestID: "1"}))
+	require.NoError(t, sink.Close())
+
+	sink, err = NewFileSink(path)
+	require.NoError(t, err)
+	defer sink.Close()
+	require.NoError(t, sink.Write(Entry{RequestID: "2"}))
+
+	got, err := sink.Query(Filter{})
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+
+	require.NoError(t, os.WriteFile(path, []byte("{\n"), 0o600))
+	_, err = sink.Query(Filter{})
+	require.ErrorContains(t, err, "invalid audit entry on line 1")
+}
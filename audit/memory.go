@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"sync"
+)
+
+// DefaultMemoryEntries is the default number of entries
+// kept by a memory sink.
+const DefaultMemoryEntries = 100000
+
+// NewMemorySink returns a sink which keeps the latest n
+// entries in memory. DefaultMemoryEntries is used when n
+// is not greater than zero.
+func NewMemorySink(n int) *MemorySink {
+	if n <= 0 {
+		n = DefaultMemoryEntries
+	}
+	return &MemorySink{maxEntries: n}
+}
+
+// MemorySink is an in memory table of audit entries.
+type MemorySink struct {
+	maxEntries int
+
+	mu      sync.RWMutex
+	entries []Entry
+}
+
+var _ Sink = (*MemorySink)(nil)
+
+// Write records an entry, discarding the oldest entry
+// when the sink is full.
+func (m *MemorySink) Write(e Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.entries) >= m.maxEntries {
+		copy(m.entries, m.entries[1:])
+		m.entries = m.entries[:len(m.entries)-1]
+	}
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+// Query returns the entries matching f, newest first.
+func (m *MemorySink) Query(f Filter) ([]Entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := []Entry{}
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(entries) >= f.Limit {
+			break
+		}
+		if f.Match(m.entries[i]) {
+			entries = append(entries, m.entries[i])
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,440 @@
+// Package client is a Go client for the accounts api.
+package client
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/signing"
+)
+
+const (
+	// DefaultRetries is the default number of times a failed
+	// request is retried.
+	DefaultRetries = 3
+
+	// DefaultMinBackoff is the default delay before the first retry.
+	DefaultMinBackoff = time.Millisecond * 100
+
+	// DefaultMaxBackoff is the default upper bound of the delay
+	// between retries.
+	DefaultMaxBackoff = time.Second * 5
+
+	// DefaultTimeout is the default http client timeout.
+	DefaultTimeout = time.Second * 15
+
+	// headerIdempotencyKey lets the server recognize retries of a
+	// mutating request.
+	headerIdempotencyKey = "Idempotency-Key"
+)
+
+// Option is a function that configures a Client option.
+type Option func(*Client) error
+
+// WithHTTPClient configures the http client used to make requests.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) error {
+		if httpClient == nil {
+			return errors.New("http client cannot be nil")
+		}
+		c.httpClient = httpClient
+		return nil
+	}
+}
+
+// WithRetries configures the number of times a failed request
+// is retried. Zero disables retries.
+func WithRetries(retries int) Option {
+	return func(c *Client) error {
+		if retries < 0 {
+			return fmt.Errorf("retries cannot be negative: %d", retries)
+		}
+		c.retries = retries
+		return nil
+	}
+}
+
+// WithBackoff configures the exponential backoff between retries.
+// The delay starts at initial and doubles with each attempt up to
+// limit.
+// A random jitter is applied to each delay.
+func WithBackoff(initial, limit time.Duration) Option {
+	return func(c *Client) error {
+		if initial <= 0 || limit <= 0 {
+			return fmt.Errorf("backoff must be greater than zero: min %s, max %s", initial, limit)
+		}
+		if initial > limit {
+			return fmt.Errorf("min backoff %s cannot be greater than max backoff %s", initial, limit)
+		}
+		c.minBackoff = initial
+		c.maxBackoff = limit
+		return nil
+	}
+}
+
+// WithRequestSigning signs requests with the account key, using the
+// signing package, instead of sending the key as a bearer token.
+func WithRequestSigning() Option {
+	return func(c *Client) error {
+		c.sign = true
+		return nil
+	}
+}
+
+// New returns a Client for the api at baseURL which authenticates
+// as the given account.
+func New(baseURL, accountID, accountKey string, ops ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url '%s': %w", baseURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base url '%s': scheme must be http or https", baseURL)
+	}
+
+	if accountID == "" {
+		return nil, errors.New("account id is required")
+	}
+
+	if accountKey == "" {
+		return nil, errors.New("account key is required")
+	}
+
+	c := &Client{
+		baseURL:    u,
+		accountID:  accountID,
+		accountKey: accountKey,
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+		retries:    DefaultRetries,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		// #nosec G404 jitter does not require a secure random source
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, op := range ops {
+		if err := op(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Client is a client for the accounts api. A Client is safe
+// for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	accountID  string
+	accountKey string
+	httpClient *http.Client
+	sign       bool
+
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// ValidateSubscription returns the account's validation result.
+// ErrSubscriptionInactive is returned when the account does not
+// have an active subscription.
+func (c *Client) ValidateSubscription(ctx context.Context) (*model.Validation, error) {
+	v := &model.Validation{}
+	if err := c.do(ctx, http.MethodPost, c.accountPath("validate"), nil, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// RegisterDevice creates or replaces a device and returns the
+// stored device. The registration's conflict is set when the device's
+// id was registered with a different fingerprint.
+func (c *Client) RegisterDevice(ctx context.Context, device model.Device) (*model.DeviceRegistration, error) {
+	r := &model.DeviceRegistration{}
+	if err := c.do(ctx, http.MethodPut, c.accountPath("device"), device, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Enroll exchanges an enrollment token for a device credential and
+// registers device. The returned credential's token is used as the key
+// of a Client for the device, which may only access its own resources.
+func Enroll(ctx context.Context, baseURL, accountID, enrollmentToken string, device model.Device, ops ...Option) (*model.Enrollment, error) {
+	c, err := New(baseURL, accountID, enrollmentToken, ops...)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &model.Enrollment{}
+	if err := c.do(ctx, http.MethodPost, c.accountPath("enroll"), device, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ListDevices returns all of the account's devices.
+func (c *Client) ListDevices(ctx context.Context) ([]model.Device, error) {
+	devices := []model.Device{}
+	if err := c.do(ctx, http.MethodGet, c.accountPath("devices"), nil, &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// GetDevice returns a single device. ErrNotFound is returned
+// when the device does not exist.
+func (c *Client) GetDevice(ctx context.Context, deviceID string) (*model.Device, error) {
+	d := &model.Device{}
+	if err := c.do(ctx, http.MethodGet, c.accountPath("devices", deviceID), nil, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// GetAccount returns the account. The account key is not
+// included in the response.
+func (c *Client) GetAccount(ctx context.Context) (*model.Account, error) {
+	a := &model.Account{}
+	if err := c.do(ctx, http.MethodGet, c.accountPath(), nil, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// CreateToken creates an api token with the given name and scopes,
+// which expires after ttl, or never when ttl is zero. The returned
+// token may be used in place of the account key with New.
+func (c *Client) CreateToken(ctx context.Context, name string, scopes []model.Scope, ttl time.Duration) (*model.IssuedCredential, error) {
+	req := map[string]interface{}{
+		"name":        name,
+		"scopes":      scopes,
+		"ttl_seconds": int64(ttl / time.Second),
+	}
+
+	t := &model.IssuedCredential{}
+	if err := c.do(ctx, http.MethodPost, c.accountPath("tokens"), req, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListTokens returns the account's api tokens, without their secrets.
+func (c *Client) ListTokens(ctx context.Context) ([]model.Credential, error) {
+	tokens := []model.Credential{}
+	if err := c.do(ctx, http.MethodGet, c.accountPath("tokens"), nil, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// DeleteToken revokes an api token. ErrNotFound is returned when the
+// token does not exist.
+func (c *Client) DeleteToken(ctx context.Context, tokenID string) error {
+	return c.do(ctx, http.MethodDelete, c.accountPath("tokens", tokenID), nil, nil)
+}
+
+// accountPath returns the api path for the client's account
+// joined with elems.
+func (c *Client) accountPath(elems ...string) string {
+	parts := []string{"v1", "accounts", url.PathEscape(c.accountID)}
+	for _, e := range elems {
+		parts = append(parts, url.PathEscape(e))
+	}
+	return strings.Join(parts, "/")
+}
+
+// do sends a request, retrying network errors and retryable status
+// codes, and decodes a successful response body into out. Every
+// attempt of a request other than GET carries the same idempotency
+// key, so that the server applies it at most once. A retryable error
+// is returned without retrying when the server asks the client to wait
+// longer than the max backoff.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to encode request body: %w", err)
+		}
+		body = b
+	}
+
+	u := c.baseURL.JoinPath(path)
+
+	var idempotencyKey string
+	if method != http.MethodGet {
+		key, err := newIdempotencyKey()
+		if err != nil {
+			return err
+		}
+		idempotencyKey = key
+	}
+
+	var (
+		lastErr error
+		after   time.Duration
+	)
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			if err := c.wait(ctx, attempt, after); err != nil {
+				return err
+			}
+		}
+
+		retry, retryAfter, err := c.send(ctx, method, u.String(), idempotencyKey, body, out)
+		if err == nil {
+			return nil
+		}
+		if !retry || retryAfter > c.maxBackoff {
+			return err
+		}
+		lastErr, after = err, retryAfter
+	}
+
+	return lastErr
+}
+
+// send performs a single request. Returns true with the error when
+// the request may be retried, along with the server requested delay
+// before retrying.
+func (c *Client) send(ctx context.Context, method, u, idempotencyKey string, body []byte, out interface{}) (bool, time.Duration, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set(headerIdempotencyKey, idempotencyKey)
+	}
+
+	if c.sign {
+		// Each attempt is signed with a new date, as the server
+		// rejects reused signatures.
+		if err := signing.Sign(req, c.accountID, c.accountKey, time.Now()); err != nil {
+			return false, 0, fmt.Errorf("failed to sign request: %w", err)
+		}
+	} else {
+		req.Header.Set("Authorization", "Bearer "+c.accountKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, 0, ctx.Err()
+		}
+		return true, 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if out == nil {
+			return false, 0, nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return false, 0, fmt.Errorf("failed to decode response body: %w", err)
+		}
+		return false, 0, nil
+	}
+
+	apiErr := &Error{StatusCode: resp.StatusCode, RetryAfter: retryAfter(resp)}
+	// The problem body is best effort, the status code is
+	// sufficient to describe the error.
+	_ = json.NewDecoder(resp.Body).Decode(&apiErr.Problem)
+
+	return retryable(resp.StatusCode), apiErr.RetryAfter, apiErr
+}
+
+// wait sleeps before a retry attempt, returning early with an
+// error if the context is canceled. The server requested delay
+// is used when it is longer than the backoff.
+func (c *Client) wait(ctx context.Context, attempt int, after time.Duration) error {
+	delay := c.backoff(attempt)
+	if after > delay {
+		delay = after
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// backoff returns the delay before the given retry attempt using
+// exponential backoff. The delay is randomized between half and
+// all of the exponential value to avoid synchronized retries.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.minBackoff << uint(attempt-1)
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+
+	half := d / 2
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return half + time.Duration(c.rand.Int63n(int64(half)+1))
+}
+
+// newIdempotencyKey returns a random idempotency key.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate idempotency key: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// retryable returns true for status codes which indicate a
+// transient failure.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the duration from the response's Retry-After
+// header, or zero if the header is missing or is not a number of
+// seconds.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,374 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/server"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		name      string
+		baseURL   string
+		accountID string
+		key       string
+		ops       []Option
+		expectErr string
+	}{
+		{"valid", "http://localhost:8000", "abc", "xyz", nil, ""},
+		{"invalid-scheme", "ftp://localhost", "abc", "xyz", nil, "scheme must be http or https"},
+		{"missing-account", "http://localhost", "", "xyz", nil, "account id is required"},
+		{"missing-key", "http://localhost", "abc", "", nil, "account key is required"},
+		{"negative-retries", "http://localhost", "abc", "xyz", []Option{WithRetries(-1)}, "retries cannot be negative"},
+		{"invalid-backoff", "http://localhost", "abc", "xyz", []Option{WithBackoff(time.Second, time.Millisecond)}, "min backoff 1s cannot be greater than max backoff 1ms"},
+		{"nil-http-client", "http://localhost", "abc", "xyz", []Option{WithHTTPClient(nil)}, "http client cannot be nil"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := New(tc.baseURL, tc.accountID, tc.key, tc.ops...)
+			if tc.expectErr != "" {
+				require.Error(t, err)
+				require.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, c)
+		})
+	}
+}
+
+func TestClientEndToEnd(t *testing.T) {
+	url := testServer(t)
+	ctx := context.Background()
+
+	c, err := New(url, "abc", "xyz")
+	require.NoError(t, err)
+
+	v, err := c.ValidateSubscription(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.Validation{AccountID: "abc", Active: true, State: model.SubscriptionActive, MaxOfflineSeconds: 86400}, v)
+
+	a, err := c.GetAccount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.Account{ID: "abc", Active: true}, a)
+
+	r, err := c.RegisterDevice(ctx, model.Device{ID: "device-c", Hostname: "host-c"})
+	require.NoError(t, err)
+	require.Equal(t, &model.DeviceRegistration{Device: model.Device{ID: "device-c", AccountID: "abc", Hostname: "host-c"}}, r)
+
+	d, err := c.GetDevice(ctx, "device-c")
+	require.NoError(t, err)
+	require.Equal(t, "host-c", d.Hostname)
+
+	devices, err := c.ListDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, devices, 3)
+
+	_, err = c.GetDevice(ctx, "missing")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	apiErr := &Error{}
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	require.Contains(t, apiErr.Problem.Detail, "does not have device with id missing")
+}
+
+func TestClientErrors(t *testing.T) {
+	url := testServer(t)
+	ctx := context.Background()
+
+	cases := []struct {
+		name      string
+		accountID string
+		key       string
+		expectErr error
+	}{
+		{"invalid-key", "abc", "bad", ErrUnauthorized},
+		{"invalid-account", "missing", "xyz", ErrUnauthorized},
+		{"inactive", "go", "095", ErrSubscriptionInactive},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := New(url, tc.accountID, tc.key)
+			require.NoError(t, err)
+
+			_, err = c.ValidateSubscription(ctx)
+			require.Error(t, err)
+			require.ErrorIs(t, err, tc.expectErr)
+		})
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"account_id":"abc","active":true}`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, "abc", "xyz", WithBackoff(time.Millisecond, time.Millisecond*5))
+	require.NoError(t, err)
+
+	v, err := c.ValidateSubscription(context.Background())
+	require.NoError(t, err)
+	require.True(t, v.Active)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestClientRetriesExhausted(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, "abc", "xyz", WithRetries(2), WithBackoff(time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = c.ValidateSubscription(context.Background())
+	require.ErrorIs(t, err, ErrServer)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestClientDoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, "abc", "xyz", WithBackoff(time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = c.ValidateSubscription(context.Background())
+	require.ErrorIs(t, err, ErrUnauthorized)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestClientContextCanceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, "abc", "xyz", WithBackoff(time.Second, time.Second))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err = c.ValidateSubscription(ctx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "expected context deadline, got %v", err)
+}
+
+func TestClientIdempotencyKey(t *testing.T) {
+	var (
+		calls int32
+		keys  = make(chan string, 10)
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get("Idempotency-Key")
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(`[]`))
+			return
+		}
+		if atomic.AddInt32(&calls, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"t1"}`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, "abc", "xyz", WithBackoff(time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = c.CreateToken(context.Background(), "ci", nil, 0)
+	require.NoError(t, err)
+	first, retry := <-keys, <-keys
+	require.NotEmpty(t, first)
+	require.Equal(t, first, retry, "expected each attempt to send the same key")
+
+	_, err = c.CreateToken(context.Background(), "ci", nil, 0)
+	require.NoError(t, err)
+	second := <-keys
+	require.NotEqual(t, first, second, "expected a new key for each call")
+	<-keys
+
+	_, err = c.ListTokens(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, <-keys, "expected no key on GET requests")
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	cases := []struct {
+		name             string
+		retryAfter       string
+		expectCalls      int32
+		expectRetryAfter time.Duration
+	}{
+		{"within-backoff", "0", 2, 0},
+		{"exceeds-backoff", "86400", 1, time.Hour * 24},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.Header().Set("Retry-After", tc.retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+			}))
+			defer ts.Close()
+
+			c, err := New(ts.URL, "abc", "xyz", WithRetries(1), WithBackoff(time.Millisecond, time.Second))
+			require.NoError(t, err)
+
+			_, err = c.ValidateSubscription(context.Background())
+			apiErr := &Error{}
+			require.ErrorAs(t, err, &apiErr)
+			require.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+			require.Equal(t, tc.expectCalls, atomic.LoadInt32(&calls))
+			require.Equal(t, tc.expectRetryAfter, apiErr.RetryAfter)
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c, err := New("http://localhost", "abc", "xyz", WithBackoff(time.Millisecond*100, time.Millisecond*400))
+	require.NoError(t, err)
+
+	cases := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{1, time.Millisecond * 50, time.Millisecond * 100},
+		{2, time.Millisecond * 100, time.Millisecond * 200},
+		{3, time.Millisecond * 200, time.Millisecond * 400},
+		{10, time.Millisecond * 200, time.Millisecond * 400},
+	}
+
+	for _, tc := range cases {
+		for i := 0; i < 100; i++ {
+			d := c.backoff(tc.attempt)
+			require.GreaterOrEqual(t, d, tc.min)
+			require.LessOrEqual(t, d, tc.max)
+		}
+	}
+}
+
+// testServer returns the url of a seeded api server.
+func TestEnroll(t *testing.T) {
+	url := testServer(t)
+	ctx := context.Background()
+
+	req, err := http.NewRequest(http.MethodPost, url+"/admin/v1/accounts/abc/enrollment-tokens", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	token := model.IssuedCredential{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+
+	e, err := Enroll(ctx, url, "abc", token.Token, model.Device{ID: "laptop"})
+	require.NoError(t, err)
+	require.Equal(t, "laptop", e.Device.ID)
+
+	_, err = Enroll(ctx, url, "abc", token.Token, model.Device{ID: "other"})
+	apiErr := &Error{}
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+
+	c, err := New(url, "abc", e.Credential.Token)
+	require.NoError(t, err)
+	d, err := c.GetDevice(ctx, "laptop")
+	require.NoError(t, err)
+	require.Equal(t, "laptop", d.ID)
+
+	_, err = c.ListDevices(ctx)
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+}
+
+func TestTokens(t *testing.T) {
+	url := testServer(t)
+	ctx := context.Background()
+
+	c, err := New(url, "abc", "xyz")
+	require.NoError(t, err)
+
+	token, err := c.CreateToken(ctx, "reader", []model.Scope{model.ScopeDevicesRead}, time.Hour)
+	require.NoError(t, err)
+	require.NotNil(t, token.ExpiresAt)
+
+	reader, err := New(url, "abc", token.Token)
+	require.NoError(t, err)
+	devices, err := reader.ListDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	_, err = reader.RegisterDevice(ctx, model.Device{ID: "device-c"})
+	require.ErrorIs(t, err, ErrForbidden)
+
+	tokens, err := c.ListTokens(ctx)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, "reader", tokens[0].Name)
+
+	require.NoError(t, c.DeleteToken(ctx, token.ID))
+	require.ErrorIs(t, c.DeleteToken(ctx, token.ID), ErrNotFound)
+	_, err = reader.ListDevices(ctx)
+	require.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestRequestSigning(t *testing.T) {
+	url := testServer(t)
+	ctx := context.Background()
+
+	c, err := New(url, "abc", "xyz", WithRequestSigning())
+	require.NoError(t, err)
+
+	// Identical requests are signed with unique nonces.
+	for i := 0; i < 2; i++ {
+		_, err = c.RegisterDevice(ctx, model.Device{ID: "device-c"})
+		require.NoError(t, err)
+	}
+
+	c, err = New(url, "abc", "wrong", WithRequestSigning())
+	require.NoError(t, err)
+	_, err = c.ValidateSubscription(ctx)
+	require.ErrorIs(t, err, ErrUnauthorized)
+}
+
+const testAdminToken = "admin-token-0123456789"
+
+func testServer(t *testing.T) string {
+	t.Helper()
+	s, err := server.New(zap.NewNop(), server.WithMemoryStore(true), server.WithAdminToken(testAdminToken))
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(s.Router)
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jsirianni/server/model"
+)
+
+var (
+	// ErrBadRequest is returned when the api rejects a
+	// malformed request.
+	ErrBadRequest = errors.New("bad request")
+
+	// ErrUnauthorized is returned when the account id or
+	// account key is invalid.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrSubscriptionInactive is returned when the account
+	// does not have an active subscription.
+	ErrSubscriptionInactive = errors.New("subscription is not active")
+
+	// ErrForbidden is returned when the credentials are valid
+	// but not permitted to perform the request.
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrNotFound is returned when a resource does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrServer is returned when the api fails to handle
+	// a request.
+	ErrServer = errors.New("server error")
+)
+
+// Error is returned when the api responds with an unsuccessful
+// status code. Error matches the package's sentinel errors with
+// errors.Is based on the status code.
+type Error struct {
+	// StatusCode is the http status code.
+	StatusCode int
+
+	// Problem is the problem details response. Fields are empty
+	// when the api did not return a problem details body.
+	Problem model.Problem
+
+	// RetryAfter is the delay the api asked for before the request
+	// is retried, or zero when it did not ask for one.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	if e.Problem.Detail != "" {
+		return fmt.Sprintf("api returned status %d: %s", e.StatusCode, e.Problem.Detail)
+	}
+	return fmt.Sprintf("api returned status %d", e.StatusCode)
+}
+
+// Is reports whether target is the sentinel error for the
+// error's status code.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrSubscriptionInactive:
+		return e.StatusCode == http.StatusPaymentRequired
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrServer:
+		return e.StatusCode >= http.StatusInternalServerError
+	}
+	return false
+}
@@ -0,0 +1,294 @@
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jsirianni/server/model"
+)
+
+const (
+	// DefaultRefreshInterval is the default interval between
+	// background validations.
+	DefaultRefreshInterval = time.Hour
+)
+
+// ErrOfflineExpired is returned by a Validator when the api is
+// unavailable and the cached validation is missing or older than
+// the server provided max offline duration.
+var ErrOfflineExpired = errors.New("offline validation window expired")
+
+// ValidatorOption is a function that configures a Validator option.
+type ValidatorOption func(*Validator) error
+
+// WithRefreshInterval configures the interval between background
+// validations performed by Run.
+func WithRefreshInterval(interval time.Duration) ValidatorOption {
+	return func(v *Validator) error {
+		if interval <= 0 {
+			return fmt.Errorf("refresh interval must be greater than zero: %s", interval)
+		}
+		v.refresh = interval
+		return nil
+	}
+}
+
+// NewValidator returns a Validator which validates using c and caches
+// successful results at cachePath.
+func NewValidator(c *Client, cachePath string, ops ...ValidatorOption) (*Validator, error) {
+	if c == nil {
+		return nil, errors.New("client cannot be nil")
+	}
+
+	if cachePath == "" {
+		return nil, errors.New("cache path is required")
+	}
+
+	v := &Validator{
+		client:  c,
+		path:    cachePath,
+		refresh: DefaultRefreshInterval,
+		now:     time.Now,
+	}
+
+	for _, op := range ops {
+		if err := op(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// Validator validates an account's subscription and caches the last
+// successful result on disk. When the api is unavailable, the cached
+// result is trusted until the server provided max offline duration
+// expires. Rejections from the api are never overridden by the cache.
+// A Validator is safe for concurrent use.
+type Validator struct {
+	client  *Client
+	path    string
+	refresh time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	cached *cachedValidation
+}
+
+// cachedValidation is a successful validation and the time it
+// was received.
+type cachedValidation struct {
+	Validation  model.Validation `json:"validation"`
+	ValidatedAt time.Time        `json:"validated_at"`
+}
+
+// cacheFile is the on disk representation of a cachedValidation. The
+// signature is an HMAC of the validation using the account key, which
+// prevents the cache from being edited to extend the offline window.
+type cacheFile struct {
+	Cached    json.RawMessage `json:"cached"`
+	Signature string          `json:"signature"`
+}
+
+// Validate validates the subscription online, falling back to the
+// cached validation when the api is unavailable. ErrOfflineExpired
+// is returned when the api is unavailable and the cache cannot
+// be trusted. A successful validation which cannot be written to the
+// cache is returned as an error, as it would not survive a restart.
+func (v *Validator) Validate(ctx context.Context) (*model.Validation, error) {
+	result, err := v.client.ValidateSubscription(ctx)
+	if err == nil {
+		cached := &cachedValidation{
+			Validation:  *result,
+			ValidatedAt: v.now(),
+		}
+		v.mu.Lock()
+		v.cached = cached
+		v.mu.Unlock()
+
+		if err := v.write(cached); err != nil {
+			return nil, fmt.Errorf("validation succeeded but failed to write cache: %w", err)
+		}
+		return result, nil
+	}
+
+	if rejected(err) {
+		v.mu.Lock()
+		v.cached = nil
+		v.mu.Unlock()
+
+		if rmErr := os.Remove(v.path); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: failed to remove cache: %v", err, rmErr)
+		}
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		return nil, err
+	}
+
+	return v.offline(err)
+}
+
+// Run validates every refresh interval until ctx is canceled. Results
+// are available with Validate's offline fallback, so errors are
+// reported to onError, which may be nil.
+func (v *Validator) Run(ctx context.Context, onError func(error)) {
+	t := time.NewTicker(v.refresh)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := v.Validate(ctx); err != nil && onError != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// offline returns the cached validation if it is within the max
+// offline window and the subscription has not expired. cause is the
+// error from the online attempt.
+func (v *Validator) offline(cause error) (*model.Validation, error) {
+	v.mu.Lock()
+	cached := v.cached
+	v.mu.Unlock()
+
+	if cached == nil {
+		c, err := v.read()
+		if err != nil {
+			return nil, &offlineError{reason: err.Error(), cause: cause}
+		}
+		cached = c
+	}
+
+	maxOffline := time.Duration(cached.Validation.MaxOfflineSeconds) * time.Second
+	if v.now().After(cached.ValidatedAt.Add(maxOffline)) {
+		reason := fmt.Sprintf("last validated at %s", cached.ValidatedAt.Format(time.RFC3339))
+		return nil, &offlineError{reason: reason, cause: cause}
+	}
+
+	if expires := cached.Validation.ExpiresAt; expires != nil && !v.now().Before(*expires) {
+		reason := fmt.Sprintf("subscription expired at %s", expires.Format(time.RFC3339))
+		return nil, &offlineError{reason: reason, cause: cause}
+	}
+
+	result := cached.Validation
+	return &result, nil
+}
+
+// write atomically writes the cache file.
+func (v *Validator) write(cached *cachedValidation) error {
+	b, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+
+	f, err := json.Marshal(cacheFile{
+		Cached:    b,
+		Signature: v.sign(b),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), filepath.Base(v.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(f); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), v.path)
+}
+
+// read returns the cached validation from the cache file. An error is
+// returned if the file is missing, has an invalid signature or belongs
+// to a different account.
+func (v *Validator) read() (*cachedValidation, error) {
+	// #nosec G304 the cache path is provided by the caller
+	b, err := os.ReadFile(v.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %w", err)
+	}
+
+	f := cacheFile{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse cache: %w", err)
+	}
+
+	expected := v.sign(f.Cached)
+	if !hmac.Equal([]byte(expected), []byte(f.Signature)) {
+		return nil, errors.New("cache signature is invalid")
+	}
+
+	cached := &cachedValidation{}
+	if err := json.Unmarshal(f.Cached, cached); err != nil {
+		return nil, fmt.Errorf("failed to parse cache: %w", err)
+	}
+
+	if cached.Validation.AccountID != v.client.accountID {
+		return nil, fmt.Errorf("cache belongs to account %s", cached.Validation.AccountID)
+	}
+
+	return cached, nil
+}
+
+func (v *Validator) sign(b []byte) string {
+	mac := hmac.New(sha256.New, []byte(v.client.accountKey))
+	_, _ = mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// offlineError is returned when the cached validation cannot be
+// trusted. It matches ErrOfflineExpired and wraps the error from
+// the online validation attempt.
+type offlineError struct {
+	reason string
+	cause  error
+}
+
+func (e *offlineError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", ErrOfflineExpired, e.reason, e.cause)
+}
+
+func (e *offlineError) Is(target error) bool {
+	return target == ErrOfflineExpired
+}
+
+func (e *offlineError) Unwrap() error {
+	return e.cause
+}
+
+// rejected returns true when err is a definitive answer from the
+// api, as opposed to the api being unavailable.
+func rejected(err error) bool {
+	for _, target := range []error{ErrBadRequest, ErrUnauthorized, ErrSubscriptionInactive, ErrForbidden, ErrNotFound} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/server"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// flakyServer serves the api until down is set, after which every
+// request fails with status code 503.
+type flakyServer struct {
+	*httptest.Server
+	store *store.Memory
+	down  int32
+	calls int32
+}
+
+func newFlakyServer(t *testing.T, ops ...server.Option) *flakyServer {
+	t.Helper()
+	f := &flakyServer{store: store.NewTestingMemory()}
+
+	ops = append([]server.Option{server.WithStore(f.store)}, ops...)
+	s, err := server.New(zap.NewNop(), ops...)
+	require.NoError(t, err)
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.calls, 1)
+		if atomic.LoadInt32(&f.down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.Router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *flakyServer) setDown(down bool) {
+	v := int32(0)
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&f.down, v)
+}
+
+func newTestValidator(t *testing.T, url, path string, ops ...ValidatorOption) (*Validator, *time.Time) {
+	t.Helper()
+	c, err := New(url, "abc", "xyz", WithRetries(0))
+	require.NoError(t, err)
+
+	v, err := NewValidator(c, path, ops...)
+	require.NoError(t, err)
+
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	return v, &now
+}
+
+func TestNewValidator(t *testing.T) {
+	c, err := New("http://localhost", "abc", "xyz")
+	require.NoError(t, err)
+
+	_, err = NewValidator(nil, "cache")
+	require.ErrorContains(t, err, "client cannot be nil")
+
+	_, err = NewValidator(c, "")
+	require.ErrorContains(t, err, "cache path is required")
+
+	_, err = NewValidator(c, "cache", WithRefreshInterval(0))
+	require.ErrorContains(t, err, "refresh interval must be greater than zero")
+}
+
+func TestValidatorOfflineFallback(t *testing.T) {
+	srv := newFlakyServer(t, server.WithMaxOffline(time.Hour))
+	path := filepath.Join(t.TempDir(), "validation.json")
+	ctx := context.Background()
+
+	v, now := newTestValidator(t, srv.URL, path)
+
+	result, err := v.Validate(ctx)
+	require.NoError(t, err)
+	require.True(t, result.Active)
+	require.FileExists(t, path)
+
+	// The cached result is trusted within the max offline window.
+	srv.setDown(true)
+	*now = now.Add(time.Minute * 59)
+	result, err = v.Validate(ctx)
+	require.NoError(t, err)
+	require.True(t, result.Active)
+
+	// A restarted agent trusts the cache file.
+	restarted, restartedNow := newTestValidator(t, srv.URL, path)
+	*restartedNow = *now
+	result, err = restarted.Validate(ctx)
+	require.NoError(t, err)
+	require.True(t, result.Active)
+
+	// The validator fails closed after the window expires.
+	*now = now.Add(time.Minute * 2)
+	_, err = v.Validate(ctx)
+	require.ErrorIs(t, err, ErrOfflineExpired)
+	require.ErrorIs(t, err, ErrServer)
+
+	// Coming back online refreshes the window.
+	srv.setDown(false)
+	_, err = v.Validate(ctx)
+	require.NoError(t, err)
+	srv.setDown(true)
+	_, err = v.Validate(ctx)
+	require.NoError(t, err)
+}
+
+func TestValidatorNoCache(t *testing.T) {
+	srv := newFlakyServer(t)
+	srv.setDown(true)
+	path := filepath.Join(t.TempDir(), "validation.json")
+
+	v, _ := newTestValidator(t, srv.URL, path)
+	_, err := v.Validate(context.Background())
+	require.ErrorIs(t, err, ErrOfflineExpired)
+}
+
+func TestValidatorServerUnreachable(t *testing.T) {
+	srv := newFlakyServer(t)
+	path := filepath.Join(t.TempDir(), "validation.json")
+
+	v, _ := newTestValidator(t, srv.URL, path)
+	_, err := v.Validate(context.Background())
+	require.NoError(t, err)
+
+	srv.Close()
+	result, err := v.Validate(context.Background())
+	require.NoError(t, err)
+	require.True(t, result.Active)
+}
+
+func TestValidatorZeroMaxOffline(t *testing.T) {
+	srv := newFlakyServer(t, server.WithMaxOffline(0))
+	path := filepath.Join(t.TempDir(), "validation.json")
+
+	v, now := newTestValidator(t, srv.URL, path)
+	_, err := v.Validate(context.Background())
+	require.NoError(t, err)
+
+	srv.setDown(true)
+	*now = now.Add(time.Second)
+	_, err = v.Validate(context.Background())
+	require.ErrorIs(t, err, ErrOfflineExpired)
+}
+
+func TestValidatorOfflineSubscriptionExpiry(t *testing.T) {
+	srv := newFlakyServer(t, server.WithMaxOffline(time.Hour))
+	path := filepath.Join(t.TempDir(), "validation.json")
+
+	account, err := srv.store.Account("abc")
+	require.NoError(t, err)
+	expires := time.Now().Add(time.Minute * 30)
+	account.ExpiresAt = &expires
+	require.NoError(t, srv.store.UpdateAccount(account))
+
+	v, now := newTestValidator(t, srv.URL, path)
+	_, err = v.Validate(context.Background())
+	require.NoError(t, err)
+
+	srv.setDown(true)
+	*now = now.Add(time.Minute * 29)
+	_, err = v.Validate(context.Background())
+	require.NoError(t, err)
+
+	// The subscription expires within the max offline window.
+	*now = now.Add(time.Minute * 2)
+	_, err = v.Validate(context.Background())
+	require.ErrorIs(t, err, ErrOfflineExpired)
+	require.ErrorContains(t, err, "subscription expired")
+}
+
+func TestValidatorCacheWriteError(t *testing.T) {
+	srv := newFlakyServer(t)
+	path := filepath.Join(t.TempDir(), "missing", "validation.json")
+
+	v, _ := newTestValidator(t, srv.URL, path)
+	result, err := v.Validate(context.Background())
+	require.ErrorContains(t, err, "failed to write cache")
+	require.Nil(t, result)
+}
+
+func TestValidatorTamperedCache(t *testing.T) {
+	srv := newFlakyServer(t)
+	path := filepath.Join(t.TempDir(), "validation.json")
+
+	v, _ := newTestValidator(t, srv.URL, path)
+	_, err := v.Validate(context.Background())
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	tampered := []byte(string(b[:len(b)-3]) + `0"}`)
+	require.NoError(t, os.WriteFile(path, tampered, 0o600))
+
+	srv.setDown(true)
+	restarted, _ := newTestValidator(t, srv.URL, path)
+	_, err = restarted.Validate(context.Background())
+	require.ErrorIs(t, err, ErrOfflineExpired)
+	require.ErrorContains(t, err, "cache signature is invalid")
+}
+
+func TestValidatorRejectionClearsCache(t *testing.T) {
+	srv := newFlakyServer(t)
+	path := filepath.Join(t.TempDir(), "validation.json")
+
+	v, _ := newTestValidator(t, srv.URL, path)
+	_, err := v.Validate(context.Background())
+	require.NoError(t, err)
+
+	account, err := srv.store.Account("abc")
+	require.NoError(t, err)
+	account.Active = false
+	require.NoError(t, srv.store.UpdateAccount(account))
+
+	_, err = v.Validate(context.Background())
+	require.ErrorIs(t, err, ErrSubscriptionInactive)
+	require.NoFileExists(t, path)
+
+	// A rejected subscription is not trusted offline.
+	srv.setDown(true)
+	_, err = v.Validate(context.Background())
+	require.ErrorIs(t, err, ErrOfflineExpired)
+}
+
+func TestValidatorRun(t *testing.T) {
+	srv := newFlakyServer(t)
+	path := filepath.Join(t.TempDir(), "validation.json")
+
+	v, _ := newTestValidator(t, srv.URL, path, WithRefreshInterval(time.Millisecond*10))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.Run(ctx, func(err error) {
+			t.Errorf("unexpected validation error: %v", err)
+		})
+	}()
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&srv.calls) >= 3
+	}, time.Second*5, time.Millisecond*10)
+	require.FileExists(t, path)
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+)
+
+// account dispatches account sub commands.
+func account(args []string, stdout io.Writer) error {
+	return subcommand("account", args, stdout, map[string]func([]string, io.Writer) error{
+		"create":  accountCreate,
+		"list":    accountList,
+		"suspend": accountSuspend,
+	})
+}
+
+// accountView is the output representation of an account.
+// The key is only displayed when an account is created.
+type accountView struct {
+	ID         string     `json:"id"`
+	Key        string     `json:"key,omitempty"`
+	Active     bool       `json:"active"`
+	MaxDevices int        `json:"max_devices,omitempty"`
+	Plan       string     `json:"plan,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+
+	FingerprintPolicy model.FingerprintPolicy `json:"fingerprint_policy,omitempty"`
+	AllowedCIDRs      []string                `json:"allowed_cidrs,omitempty"`
+}
+
+func accountCreate(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("account create", flag.ContinueOnError)
+	p := newPrinter(fs, stdout)
+	id := fs.String("id", "", "account id (required)")
+	key := fs.String("key", "", "account key, generated when not set")
+	inactive := fs.Bool("inactive", false, "create the account without an active subscription")
+	maxDevices := fs.Int("max-devices", 0, "maximum number of devices, unlimited when zero")
+	plan := fs.String("plan", "", "subscription plan name")
+	expires := fs.String("expires", "", "subscription expiry as an RFC 3339 timestamp, never expires when not set")
+	fingerprintPolicy := fs.String("fingerprint-policy", string(model.FingerprintAllow), "handling of devices which re-register with a different fingerprint: allow, reject or fork")
+	st, err := openDurableStore(fs, args)
+	if err != nil {
+		return err
+	}
+	defer store.Close(st)
+
+	if *id == "" {
+		return errors.New("account id is required")
+	}
+
+	if *key == "" {
+		*key, err = generateKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	if *maxDevices < 0 {
+		return fmt.Errorf("max devices cannot be negative: %d", *maxDevices)
+	}
+
+	policy, err := store.ParseFingerprintPolicy(*fingerprintPolicy)
+	if err != nil {
+		return err
+	}
+
+	a := model.Account{
+		ID:                *id,
+		Key:               *key,
+		Active:            !*inactive,
+		MaxDevices:        *maxDevices,
+		Plan:              *plan,
+		FingerprintPolicy: policy,
+	}
+
+	if *expires != "" {
+		expiresAt, err := time.Parse(time.RFC3339, *expires)
+		if err != nil {
+			return fmt.Errorf("invalid expires '%s': must be an RFC 3339 timestamp", *expires)
+		}
+		a.ExpiresAt = &expiresAt
+	}
+	if err := st.CreateAccount(a); err != nil {
+		return fmt.Errorf("failed to create account: %w", err)
+	}
+
+	v := accountView(a)
+	return p.print(v, []string{"ID", "KEY", "ACTIVE"}, [][]string{
+		{v.ID, v.Key, strconv.FormatBool(v.Active)},
+	})
+}
+
+func accountList(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("account list", flag.ContinueOnError)
+	p := newPrinter(fs, stdout)
+	st, err := openStore(fs, args)
+	if err != nil {
+		return err
+	}
+	defer store.Close(st)
+
+	accounts, err := st.Accounts()
+	if err != nil {
+		return fmt.Errorf("failed to list accounts: %w", err)
+	}
+
+	views := make([]accountView, 0, len(accounts))
+	rows := make([][]string, 0, len(accounts))
+	for _, a := range accounts {
+		views = append(views, accountView{ID: a.ID, Active: a.Active})
+		rows = append(rows, []string{a.ID, strconv.FormatBool(a.Active)})
+	}
+	return p.print(views, []string{"ID", "ACTIVE"}, rows)
+}
+
+func accountSuspend(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("account suspend", flag.ContinueOnError)
+	p := newPrinter(fs, stdout)
+	id := fs.String("id", "", "account id (required)")
+	st, err := openDurableStore(fs, args)
+	if err != nil {
+		return err
+	}
+	defer store.Close(st)
+
+	if *id == "" {
+		return errors.New("account id is required")
+	}
+
+	a, err := st.Account(*id)
+	if err != nil {
+		return fmt.Errorf("failed to lookup account: %w", err)
+	}
+
+	a.Active = false
+	if err := st.UpdateAccount(a); err != nil {
+		return fmt.Errorf("failed to suspend account: %w", err)
+	}
+
+	v := accountView{ID: a.ID, Active: a.Active}
+	return p.print(v, []string{"ID", "ACTIVE"}, [][]string{
+		{v.ID, strconv.FormatBool(v.Active)},
+	})
+}
+
+// generateKey returns a random 32 byte hex encoded key.
+func generateKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate account key: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jsirianni/server/labels"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+)
+
+// device dispatches device sub commands.
+func device(args []string, stdout io.Writer) error {
+	return subcommand("device", args, stdout, map[string]func([]string, io.Writer) error{
+		"list":   deviceList,
+		"delete": deviceDelete,
+	})
+}
+
+func deviceList(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("device list", flag.ContinueOnError)
+	p := newPrinter(fs, stdout)
+	accountID := fs.String("account", "", "account id (required)")
+	selectorFlag := fs.String("selector", "", "label selector, such as 'env=prod,role!=db'")
+	st, err := openStore(fs, args)
+	if err != nil {
+		return err
+	}
+	defer store.Close(st)
+
+	if *accountID == "" {
+		return errors.New("account id is required")
+	}
+
+	selector, err := labels.Parse(*selectorFlag)
+	if err != nil {
+		return err
+	}
+
+	devices, err := st.Devices(*accountID, selector)
+	if err != nil {
+		return fmt.Errorf("failed to list devices: %w", err)
+	}
+
+	rows := make([][]string, 0, len(devices))
+	for _, d := range devices {
+		rows = append(rows, []string{d.ID, d.AccountID, d.Hostname, formatLabels(d.Labels)})
+	}
+	return p.print(devices, []string{"ID", "ACCOUNT", "HOSTNAME", "LABELS"}, rows)
+}
+
+func deviceDelete(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("device delete", flag.ContinueOnError)
+	p := newPrinter(fs, stdout)
+	accountID := fs.String("account", "", "account id (required)")
+	deviceID := fs.String("id", "", "device id (required)")
+	st, err := openDurableStore(fs, args)
+	if err != nil {
+		return err
+	}
+	defer store.Close(st)
+
+	if *accountID == "" || *deviceID == "" {
+		return errors.New("account id and device id are required")
+	}
+
+	if err := st.DeleteDevice(*accountID, *deviceID); err != nil {
+		return fmt.Errorf("failed to delete device: %w", err)
+	}
+
+	d := model.Device{ID: *deviceID, AccountID: *accountID}
+	return p.print(d, []string{"ID", "ACCOUNT", "DELETED"}, [][]string{
+		{d.ID, d.AccountID, "true"},
+	})
+}
+
+// formatLabels returns labels as 'key=value' pairs ordered by key.
+func formatLabels(l map[string]string) string {
+	pairs := make([]string, 0, len(l))
+	for k, v := range l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
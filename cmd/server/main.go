@@ -1,76 +1,82 @@
 package main
 
 import (
-	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
-
-	"github.com/jsirianni/server/logging"
-	"github.com/jsirianni/server/server"
-	"go.uber.org/zap"
+	"strings"
 )
 
+const usage = `Usage: server <command> [flags]
+
+Commands:
+  serve                 start the http server (default)
+  migrate               apply storage backend migrations
+  seed                  seed the store with development data
+  export                export a snapshot of the store
+  import                import a snapshot into the store
+  account create        create an account
+  account list          list accounts
+  account suspend       suspend an account's subscription
+  device list           list an account's devices
+  device delete         delete a device from an account
+
+Run 'server <command> -h' for a command's flags.
+`
+
 func main() {
-	// Configure a Zap logger, which will be used for
-	// unified logging between your business logic
-	// logging and the Gin server's request logging.
-	logger, err := logging.New(logging.DebugLevel)
-	if err != nil {
-		fmt.Printf("failed to configure logger: %s\n", err)
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	}
+}
 
-	// Create the server with the logger and options.
-	s, err := server.New(
-		logger,
-		server.WithBindAddress("", 8000),
-		server.WithMemoryStore(true),
-	)
-	if err != nil {
-		logger.Sugar().Errorf("failed to initialize server: %s", err)
-		os.Exit(1)
+// run dispatches args to a command. The serve command is
+// used when no command is given.
+func run(args []string, stdout io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serve(args)
 	}
 
-	// Configure a context which will be cancled by SIGINT and
-	// SIGTERM signals. This will allow for graceful shutdown.
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
-	go func() {
-		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-		<-quit
-		cancel()
-	}()
-
-	// Start the server within a goroutine.
-	var startErr error
-	go func() {
-		defer cancel()
-		logger.Sugar().Infof("starting server on %s", s.Addr())
-		startErr = s.Start()
-	}()
-
-	// Pause here until the context is cancled. This can happen
-	// via 'ctrl+c', 'kill <pid>', or 'systemctl stop <service name>'.
-	<-ctx.Done()
-
-	// If there was an error during startup or runtime, log it here.
-	if startErr != nil {
-		logger.Error("runtime error", zap.Error(startErr))
-		os.Exit(1)
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return serve(args)
+	case "migrate":
+		return migrate(args, stdout)
+	case "seed":
+		return seed(args, stdout)
+	case "export":
+		return export(args, stdout)
+	case "import":
+		return importSnapshot(args, stdout)
+	case "account":
+		return account(args, stdout)
+	case "device":
+		return device(args, stdout)
+	case "help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command '%s'\n\n%s", command, usage)
 	}
+}
 
-	// Stop the server with a 60 second timeout to allow for existing
-	// requests to finish.
-	logger.Info("stopping server")
-	if err := s.Stop(time.Second * 60); err != nil {
-		logger.Error("failed to stop server gracefully", zap.Error(err))
-		os.Exit(1)
+// subcommand dispatches args to one of the given sub commands
+// of a command such as 'account' or 'device'.
+func subcommand(name string, args []string, stdout io.Writer, commands map[string]func([]string, io.Writer) error) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s requires a sub command\n\n%s", name, usage)
 	}
 
-	// Exit with 0 if there were no runtime or shutdown errors.
-	os.Exit(0)
+	f, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown %s command '%s'\n\n%s", name, args[0], usage)
+	}
+	return f(args[1:], stdout)
 }
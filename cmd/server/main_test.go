@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunAccountList(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := run([]string{"account", "list", "-store-seed=true"}, out)
+	require.NoError(t, err)
+	require.Equal(t, "ID   ACTIVE\nabc  true\ngo   false\n", out.String())
+
+	out.Reset()
+	err = run([]string{"account", "list", "-store-seed=true", "-o", "json"}, out)
+	require.NoError(t, err)
+
+	accounts := []accountView{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &accounts))
+	require.Equal(t, []accountView{{ID: "abc", Active: true}, {ID: "go", Active: false}}, accounts)
+}
+
+func TestRunAccountCreate(t *testing.T) {
+	dir := t.TempDir()
+	out := &bytes.Buffer{}
+	err := run([]string{"account", "create", "-id", "new", "-o", "json", "-store-wal-dir", dir}, out)
+	require.NoError(t, err)
+
+	account := accountView{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &account))
+	require.Equal(t, "new", account.ID)
+	require.Len(t, account.Key, 64, "expected a generated hex encoded key")
+	require.True(t, account.Active)
+
+	err = run([]string{"account", "create", "-id", "abc", "-store-seed=true", "-store-wal-dir", dir}, out)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "already exists")
+}
+
+func TestRunDevice(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := run([]string{"device", "list", "-store-seed=true", "-account", "abc"}, out)
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "device-a  abc      testname")
+
+	err = run([]string{"device", "delete", "-store-seed=true", "-store-wal-dir", t.TempDir(), "-account", "abc", "-id", "missing"}, out)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "not found")
+}
+
+func TestRunSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+	out := &bytes.Buffer{}
+	err := run([]string{"export", "-store-seed=true", "-f", path}, out)
+	require.NoError(t, err)
+
+	err = run([]string{"import", "-f", path, "-mode", "dry-run"}, out)
+	require.NoError(t, err)
+	require.Equal(t, "MODE     ACCOUNTS  DEVICES\ndry-run  2         2\n", out.String())
+
+	out.Reset()
+	err = run([]string{"account", "list", "-store-snapshot-file", path}, out)
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "abc  true")
+
+	out.Reset()
+	err = run([]string{"export", "-store-snapshot-file", path}, out)
+	require.NoError(t, err)
+	require.Contains(t, out.String(), `"id":"device-a"`)
+}
+
+func TestRunWAL(t *testing.T) {
+	dir := t.TempDir()
+	out := &bytes.Buffer{}
+	err := run([]string{"account", "create", "-id", "new", "-store-wal-dir", dir}, out)
+	require.NoError(t, err)
+
+	out.Reset()
+	err = run([]string{"account", "suspend", "-id", "new", "-store-wal-dir", dir}, out)
+	require.NoError(t, err)
+
+	out.Reset()
+	err = run([]string{"account", "list", "-store-wal-dir", dir}, out)
+	require.NoError(t, err)
+	require.Equal(t, "ID   ACTIVE\nnew  false\n", out.String())
+
+	// Commands refuse a wal directory in use by a running server.
+	st, err := store.OpenMemory(dir)
+	require.NoError(t, err)
+	defer st.Close()
+	err = run([]string{"account", "create", "-id", "other", "-store-wal-dir", dir}, out)
+	require.ErrorContains(t, err, "store is in use by a running server")
+}
+
+func TestRunSeedWAL(t *testing.T) {
+	dir := t.TempDir()
+	out := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		err := run([]string{"seed", "-store-wal-dir", dir}, out)
+		require.NoError(t, err, "seeding twice should leave existing devices unchanged")
+	}
+
+	out.Reset()
+	err := run([]string{"device", "list", "-account", "abc", "-store-wal-dir", dir}, out)
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "device-a  abc      testname")
+}
+
+func TestRunErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		args      []string
+		expectErr string
+	}{
+		{"unknown-command", []string{"launch"}, "unknown command 'launch'"},
+		{"missing-sub-command", []string{"account"}, "account requires a sub command"},
+		{"unknown-sub-command", []string{"device", "wipe"}, "unknown device command 'wipe'"},
+		{"missing-account-id", []string{"account", "suspend", "-store-wal-dir", t.TempDir()}, "account id is required"},
+		{"missing-snapshot-file", []string{"import"}, "snapshot file is required"},
+		{"create-memory", []string{"account", "create", "-id", "new"}, "account create changes a memory store which is discarded on exit"},
+		{"suspend-memory", []string{"account", "suspend", "-id", "abc", "-store-seed=true"}, "account suspend changes a memory store"},
+		{"delete-memory", []string{"device", "delete", "-account", "abc", "-id", "device-a"}, "device delete changes a memory store"},
+		{"seed-memory", []string{"seed"}, "seed changes a memory store"},
+		{"import-memory", []string{"import", "-f", "x"}, "import changes a memory store"},
+		{"invalid-import-mode", []string{"import", "-f", "x", "-mode", "upsert"}, "invalid import mode 'upsert'"},
+		{"invalid-output", []string{"account", "list", "-o", "yaml"}, "invalid output format 'yaml'"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := run(tc.args, &bytes.Buffer{})
+			require.Error(t, err)
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+}
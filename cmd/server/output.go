@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// printer writes command output as a table or as JSON.
+type printer struct {
+	w      io.Writer
+	format *string
+}
+
+// newPrinter registers the output flag with fs and returns
+// a printer which writes to w.
+func newPrinter(fs *flag.FlagSet, w io.Writer) *printer {
+	p := &printer{w: w}
+	p.format = fs.String("o", outputTable, "output format: table or json")
+	return p
+}
+
+// print writes v as JSON, or headers and rows as a table,
+// depending on the output format.
+func (p *printer) print(v interface{}, headers []string, rows [][]string) error {
+	switch *p.format {
+	case outputJSON:
+		e := json.NewEncoder(p.w)
+		e.SetIndent("", "  ")
+		return e.Encode(v)
+	case outputTable:
+		tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(headers, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("invalid output format '%s'", *p.format)
+	}
+}
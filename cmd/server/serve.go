@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jsirianni/server/config"
+	"github.com/jsirianni/server/server"
+	"github.com/jsirianni/server/store"
+	"go.uber.org/zap"
+)
+
+// serve runs the http server until SIGINT or SIGTERM
+// is received.
+func serve(args []string) error {
+	// Load configuration from the config file, environment
+	// and command line flags.
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	conf, err := config.Load(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// Configure a Zap logger, which will be used for
+	// unified logging between your business logic
+	// logging and the Gin server's request logging.
+	logger, err := conf.Logger()
+	if err != nil {
+		return fmt.Errorf("failed to configure logger: %w", err)
+	}
+
+	st, err := conf.OpenStore()
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer func() {
+		if err := store.Close(st); err != nil {
+			logger.Error("failed to close store", zap.Error(err))
+		}
+	}()
+
+	ops := conf.ServerOptions(st)
+
+	hooks, err := conf.WebhookManager(logger, st)
+	if err != nil {
+		return fmt.Errorf("failed to configure webhooks: %w", err)
+	}
+	if hooks != nil {
+		ops = append(ops, server.WithWebhooks(hooks))
+	}
+
+	sink, err := conf.AuditSink()
+	if err != nil {
+		return fmt.Errorf("failed to configure audit log: %w", err)
+	}
+	if sink != nil {
+		ops = append(ops, server.WithAuditSink(sink))
+		if closer, ok := sink.(io.Closer); ok {
+			defer func() {
+				if err := closer.Close(); err != nil {
+					logger.Error("failed to close audit log", zap.Error(err))
+				}
+			}()
+		}
+	}
+
+	// Create the server with the logger and options.
+	s, err := server.New(logger, ops...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize server: %w", err)
+	}
+
+	// Configure a context which will be cancled by SIGINT and
+	// SIGTERM signals. This will allow for graceful shutdown.
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		<-quit
+		cancel()
+	}()
+
+	// Deliver webhooks until the server stops.
+	if hooks != nil {
+		hooksCtx, stopHooks := context.WithCancel(context.Background())
+		hooksDone := make(chan struct{})
+		go func() {
+			defer close(hooksDone)
+			if err := hooks.Run(hooksCtx); err != nil {
+				logger.Error("webhook delivery failed", zap.Error(err))
+			}
+		}()
+		defer func() {
+			stopHooks()
+			<-hooksDone
+		}()
+	}
+
+	// Start the server within a goroutine.
+	var startErr error
+	go func() {
+		defer cancel()
+		logger.Sugar().Infof("starting server on %s", s.Addr())
+		startErr = s.Start()
+	}()
+
+	// Pause here until the context is cancled. This can happen
+	// via 'ctrl+c', 'kill <pid>', or 'systemctl stop <service name>'.
+	<-ctx.Done()
+
+	// If there was an error during startup or runtime, return it here.
+	if startErr != nil {
+		logger.Error("runtime error", zap.Error(startErr))
+		return startErr
+	}
+
+	// Stop the server with the configured shutdown timeout to allow
+	// for existing requests to finish.
+	logger.Info("stopping server")
+	if err := s.Stop(conf.Server.ShutdownTimeout); err != nil {
+		logger.Error("failed to stop server gracefully", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
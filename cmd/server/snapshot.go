@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/jsirianni/server/config"
+	"github.com/jsirianni/server/store"
+)
+
+// export writes a snapshot of the configured store to a file,
+// or to stdout when no file is given.
+func export(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	path := fs.String("f", "", "snapshot file to write, stdout when empty")
+	st, err := openStore(fs, args)
+	if err != nil {
+		return err
+	}
+	defer store.Close(st)
+
+	if *path == "" {
+		return store.Export(st, stdout)
+	}
+
+	// #nosec G304 the snapshot path is provided by the operator
+	f, err := os.OpenFile(*path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+
+	if err := store.Export(st, f); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to export snapshot: %w", err)
+	}
+	return f.Close()
+}
+
+// importSnapshot applies a snapshot file to the configured store.
+func importSnapshot(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	p := newPrinter(fs, stdout)
+	path := fs.String("f", "", "snapshot file to import (required)")
+	mode := fs.String("mode", string(store.ImportMerge), "import mode: merge, replace or dry-run")
+	conf, err := config.Load(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *path == "" {
+		return errors.New("snapshot file is required")
+	}
+
+	m, err := store.ParseImportMode(*mode)
+	if err != nil {
+		return err
+	}
+
+	if m != store.ImportDryRun {
+		if err := requireDurable(conf, fs.Name()); err != nil {
+			return err
+		}
+	}
+
+	st, err := openConfigStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close(st)
+
+	// #nosec G304 the snapshot path is provided by the operator
+	f, err := os.Open(*path)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer f.Close()
+
+	stats, err := store.Import(st, f, m)
+	if err != nil {
+		return fmt.Errorf("failed to import snapshot: %w", err)
+	}
+
+	return p.print(stats, []string{"MODE", "ACCOUNTS", "DEVICES"}, [][]string{
+		{string(stats.Mode), strconv.Itoa(stats.Accounts), strconv.Itoa(stats.Devices)},
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/jsirianni/server/config"
+	"github.com/jsirianni/server/store"
+)
+
+// openStore loads configuration using fs and args and returns
+// the configured store.
+func openStore(fs *flag.FlagSet, args []string) (store.Store, error) {
+	conf, err := config.Load(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	return openConfigStore(conf)
+}
+
+// openDurableStore is openStore for commands which change the
+// store. It returns an error rather than open a memory store
+// which is discarded when the command exits.
+func openDurableStore(fs *flag.FlagSet, args []string) (store.Store, error) {
+	conf, err := config.Load(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireDurable(conf, fs.Name()); err != nil {
+		return nil, err
+	}
+	return openConfigStore(conf)
+}
+
+// requireDurable returns an error if changes made by command to the
+// configured store would be lost on exit.
+func requireDurable(conf *config.Config, command string) error {
+	if conf.Store.Durable() {
+		return nil
+	}
+	return fmt.Errorf("%s changes a memory store which is discarded on exit: stop the server and set -store-wal-dir to its wal directory", command)
+}
+
+// openConfigStore opens the configured store. A wal directory in use
+// by a running server is refused, as the server would not see the
+// command's changes.
+func openConfigStore(conf *config.Config) (store.Store, error) {
+	st, err := conf.OpenStore()
+	if err != nil {
+		if errors.Is(err, store.ErrWALLocked) {
+			return nil, fmt.Errorf("store is in use by a running server: stop the server before running commands against %s", conf.Store.WALDir)
+		}
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	return st, nil
+}
+
+// migrate applies migrations when the configured store
+// requires them.
+func migrate(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	st, err := openStore(fs, args)
+	if err != nil {
+		return err
+	}
+	defer store.Close(st)
+
+	m, ok := st.(store.Migrator)
+	if !ok {
+		fmt.Fprintln(stdout, "store does not require migrations")
+		return nil
+	}
+
+	if err := m.Migrate(); err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	fmt.Fprintln(stdout, "migrations applied")
+	return nil
+}
+
+// seed stores development data in the configured store.
+func seed(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	st, err := openDurableStore(fs, args)
+	if err != nil {
+		return err
+	}
+	defer store.Close(st)
+
+	if err := store.Seed(st); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "store seeded")
+	return nil
+}
@@ -0,0 +1,1066 @@
+// Package config loads server configuration from a YAML file,
+// environment variables and command line flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jsirianni/server/audit"
+	"github.com/jsirianni/server/logging"
+	"github.com/jsirianni/server/server"
+	"github.com/jsirianni/server/store"
+	"github.com/jsirianni/server/webhook"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix is the prefix used by all configuration
+	// environment variables.
+	EnvPrefix = "SERVER_"
+
+	// EnvConfigFile is the environment variable used to
+	// locate the configuration file when the config flag
+	// is not set.
+	EnvConfigFile = EnvPrefix + "CONFIG"
+
+	// StoreTypeMemory is the in memory storage backend.
+	StoreTypeMemory = "memory"
+
+	// AuditSinkMemory keeps audit entries in memory.
+	AuditSinkMemory = "memory"
+
+	// AuditSinkFile appends audit entries to a file.
+	AuditSinkFile = "file"
+
+	// DefaultPort is the default TCP port.
+	DefaultPort = 8000
+
+	// DefaultShutdownTimeout is the default amount of time
+	// allowed for active requests to finish during shutdown.
+	DefaultShutdownTimeout = time.Second * 60
+)
+
+// Config is the server configuration.
+type Config struct {
+	Server   Server   `yaml:"server"`
+	Logging  Logging  `yaml:"logging"`
+	Store    Store    `yaml:"store"`
+	Admin    Admin    `yaml:"admin"`
+	Webhooks Webhooks `yaml:"webhooks"`
+	Audit    Audit    `yaml:"audit"`
+
+	DeviceAuth DeviceAuth `yaml:"device_auth"`
+	Lockout    Lockout    `yaml:"lockout"`
+	CORS       CORS       `yaml:"cors"`
+}
+
+// Audit configures the audit log.
+type Audit struct {
+	// Sink is where audit entries are recorded, either 'memory'
+	// or 'file'. Auditing is disabled when empty.
+	Sink string `yaml:"sink"`
+
+	// File is the audit log path used by the file sink.
+	File string `yaml:"file"`
+}
+
+// Webhooks configures outbound webhooks.
+type Webhooks struct {
+	// Enabled enables the webhook endpoints and deliveries.
+	Enabled bool `yaml:"enabled"`
+
+	// QueueFile persists webhook endpoints and queued deliveries.
+	// They are kept in memory when empty.
+	QueueFile string `yaml:"queue_file"`
+
+	// MaxAttempts is the number of delivery attempts before a
+	// delivery is dead lettered.
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+// DeviceAuth configures the OAuth device authorization grant.
+type DeviceAuth struct {
+	// VerificationURI is where users enter user codes to approve
+	// devices. The grant is disabled when empty.
+	VerificationURI string `yaml:"verification_uri"`
+}
+
+// Lockout configures brute force protection of account keys.
+type Lockout struct {
+	// Threshold is the number of failed attempts within Window
+	// which locks an account or source IP out. Brute force
+	// protection is disabled when zero.
+	Threshold int           `yaml:"threshold"`
+	Window    time.Duration `yaml:"window"`
+
+	// Duration is the length of the first lockout. Each lockout
+	// doubles, up to MaxDuration.
+	Duration    time.Duration `yaml:"duration"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+
+	// Delay is the delay before answering the first failed
+	// attempt. Each failure doubles it, up to MaxDelay.
+	Delay    time.Duration `yaml:"delay"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+// CORS configures cross origin requests from browsers.
+type CORS struct {
+	// AllowedOrigins are the origins which may call the api, such
+	// as https://console.example.com, or '*' for any origin. CORS
+	// is disabled when empty.
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// Policy returns the server CORS policy.
+func (c CORS) Policy() server.CORSPolicy {
+	return server.CORSPolicy{
+		AllowedOrigins:   c.AllowedOrigins,
+		AllowedMethods:   c.AllowedMethods,
+		AllowedHeaders:   c.AllowedHeaders,
+		AllowCredentials: c.AllowCredentials,
+		MaxAge:           c.MaxAge,
+	}
+}
+
+// Policy returns the server lockout policy.
+func (l Lockout) Policy() server.LockoutPolicy {
+	return server.LockoutPolicy{
+		Threshold:   l.Threshold,
+		Window:      l.Window,
+		Duration:    l.Duration,
+		MaxDuration: l.MaxDuration,
+		Delay:       l.Delay,
+		MaxDelay:    l.MaxDelay,
+	}
+}
+
+// Admin configures the admin API.
+type Admin struct {
+	// Token is the bearer token required by the admin API. The
+	// admin API is disabled when empty.
+	Token string `yaml:"token"`
+}
+
+// Server configures the http server.
+type Server struct {
+	// BindAddress is the IP address to listen on. All
+	// addresses are used when empty.
+	BindAddress string `yaml:"bind_address"`
+
+	// Port is the TCP port to listen on.
+	Port uint `yaml:"port"`
+
+	// TLS configures HTTPS.
+	TLS TLS `yaml:"tls"`
+
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+
+	MaxHeaderBytes int   `yaml:"max_header_bytes"`
+	MaxBodyBytes   int64 `yaml:"max_body_bytes"`
+
+	// MaxImportBytes is the maximum size of a snapshot imported
+	// with the admin api, which is not limited by MaxBodyBytes.
+	MaxImportBytes int64 `yaml:"max_import_bytes"`
+
+	// MaxOffline is how long clients may trust a successful
+	// validation while the server is unavailable.
+	MaxOffline time.Duration `yaml:"max_offline"`
+
+	// EventHeartbeat is the interval between heartbeats
+	// on idle event streams.
+	EventHeartbeat time.Duration `yaml:"event_heartbeat"`
+
+	// IdempotencyWindow is how long responses to requests with
+	// an idempotency key are kept for replay.
+	IdempotencyWindow time.Duration `yaml:"idempotency_window"`
+
+	// SignatureSkew is how far a signed request's date may be
+	// from the server's clock.
+	SignatureSkew time.Duration `yaml:"signature_skew"`
+
+	// TrustedProxies are the IP addresses and CIDRs of proxies
+	// whose forwarded headers set the request's source IP.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// TLS configures HTTPS. Both files are required
+// when either is set.
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// Enabled returns true when TLS is configured.
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// Logging configures the logger.
+type Logging struct {
+	Level  logging.LogLevel  `yaml:"level"`
+	Format logging.LogFormat `yaml:"format"`
+}
+
+// Store configures the storage backend.
+type Store struct {
+	// Type is the storage backend type.
+	Type string `yaml:"type"`
+
+	// DSN is the backend specific data source name. The memory
+	// store does not have one.
+	DSN string `yaml:"dsn"`
+
+	// WALDir enables a write-ahead log for the memory store
+	// in the given directory, making it durable.
+	WALDir string `yaml:"wal_dir"`
+
+	// Seed seeds the store with test data when true.
+	Seed bool `yaml:"seed"`
+
+	// CacheTTL enables a read through cache of account lookups
+	// when greater than zero.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+
+	// CacheNegativeTTL is how long missing accounts and invalid
+	// keys are cached. Defaults to CacheTTL when not set.
+	CacheNegativeTTL time.Duration `yaml:"cache_negative_ttl"`
+
+	// SnapshotFile is a snapshot which is imported into the
+	// store when it is opened with no accounts.
+	SnapshotFile string `yaml:"snapshot_file"`
+}
+
+// Durable returns true if changes to the store outlive the
+// process. A memory store is only durable with a WAL directory.
+func (s Store) Durable() bool {
+	return s.Type != StoreTypeMemory || s.WALDir != ""
+}
+
+// Default returns a Config with default values.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:              DefaultPort,
+			ReadTimeout:       server.DefaultTimeout,
+			ReadHeaderTimeout: server.DefaultTimeout,
+			WriteTimeout:      server.DefaultTimeout,
+			IdleTimeout:       server.DefaultIdleTimeout,
+			ShutdownTimeout:   DefaultShutdownTimeout,
+			MaxHeaderBytes:    server.DefaultMaxHeaderBytes,
+			MaxBodyBytes:      server.DefaultMaxBodyBytes,
+			MaxImportBytes:    server.DefaultMaxImportBytes,
+			MaxOffline:        server.DefaultMaxOffline,
+			EventHeartbeat:    server.DefaultEventHeartbeat,
+			IdempotencyWindow: server.DefaultIdempotencyWindow,
+			SignatureSkew:     server.DefaultSignatureSkew,
+		},
+		// The server previously always logged at debug level
+		// and served a seeded memory store. Neither is a safe
+		// default for a deployment, so both are opt in.
+		Logging: Logging{
+			Level:  logging.InfoLevel,
+			Format: logging.JSONFormat,
+		},
+		Store: Store{
+			Type: StoreTypeMemory,
+		},
+		Webhooks: Webhooks{
+			MaxAttempts: webhook.DefaultMaxAttempts,
+		},
+		Lockout: defaultLockout(),
+		CORS:    defaultCORS(),
+	}
+}
+
+func defaultCORS() CORS {
+	p := server.DefaultCORSPolicy()
+	return CORS{
+		AllowedMethods: p.AllowedMethods,
+		AllowedHeaders: p.AllowedHeaders,
+		MaxAge:         p.MaxAge,
+	}
+}
+
+func defaultLockout() Lockout {
+	p := server.DefaultLockoutPolicy()
+	return Lockout{
+		Threshold:   p.Threshold,
+		Window:      p.Window,
+		Duration:    p.Duration,
+		MaxDuration: p.MaxDuration,
+		Delay:       p.Delay,
+		MaxDelay:    p.MaxDelay,
+	}
+}
+
+// Load registers configuration flags with fs, parses args and
+// returns the resulting Config. Values are read from the config
+// file, then environment variables, then flags, with later sources
+// taking precedence. The returned Config has been validated.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	configFile := fs.String("config", "", "path to a YAML configuration file")
+	flagValues := make(map[string]*string, len(fields))
+	for _, f := range fields {
+		flagValues[f.flag] = fs.String(f.flag, "", f.usage)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(EnvConfigFile)
+	}
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fields {
+		value, ok := os.LookupEnv(f.env)
+		if !ok {
+			continue
+		}
+		if err := f.set(c, value); err != nil {
+			return nil, fmt.Errorf("invalid environment variable %s: %w", f.env, err)
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(fl *flag.Flag) {
+		value, ok := flagValues[fl.Name]
+		if !ok || flagErr != nil {
+			return
+		}
+		for _, f := range fields {
+			if f.flag == fl.Name {
+				if err := f.set(c, *value); err != nil {
+					flagErr = fmt.Errorf("invalid flag -%s: %w", f.flag, err)
+				}
+				return
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) readFile(path string) error {
+	// #nosec G304 the config path is provided by the operator
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c *Config) Validate() error {
+	if c.Server.BindAddress != "" && net.ParseIP(c.Server.BindAddress) == nil {
+		return fmt.Errorf("invalid bind address '%s': must be an IP address", c.Server.BindAddress)
+	}
+
+	if c.Server.Port > 65535 {
+		return fmt.Errorf("invalid port %d: port must be between 0 and 65535", c.Server.Port)
+	}
+
+	tls := c.Server.TLS
+	if tls.Enabled() {
+		if tls.CertFile == "" || tls.KeyFile == "" {
+			return errors.New("tls requires both cert_file and key_file")
+		}
+		for _, path := range []string{tls.CertFile, tls.KeyFile} {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("invalid tls configuration: %w", err)
+			}
+		}
+	}
+
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read_timeout", c.Server.ReadTimeout},
+		{"read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"write_timeout", c.Server.WriteTimeout},
+		{"idle_timeout", c.Server.IdleTimeout},
+		{"shutdown_timeout", c.Server.ShutdownTimeout},
+		{"max_offline", c.Server.MaxOffline},
+		{"cache_ttl", c.Store.CacheTTL},
+		{"cache_negative_ttl", c.Store.CacheNegativeTTL},
+	}
+	for _, t := range timeouts {
+		if t.value < 0 {
+			return fmt.Errorf("invalid %s %s: cannot be negative", t.name, t.value)
+		}
+	}
+
+	if c.Server.ReadTimeout > 0 && c.Server.ReadHeaderTimeout > c.Server.ReadTimeout {
+		return fmt.Errorf("read_header_timeout %s cannot be greater than read_timeout %s", c.Server.ReadHeaderTimeout, c.Server.ReadTimeout)
+	}
+
+	if c.Server.EventHeartbeat <= 0 {
+		return fmt.Errorf("invalid event_heartbeat %s: must be greater than zero", c.Server.EventHeartbeat)
+	}
+
+	// Event streams which cannot extend their write deadline are
+	// closed at 90% of the write timeout, so a heartbeat must fit
+	// within it.
+	if lifetime := c.Server.WriteTimeout * 9 / 10; lifetime > 0 && c.Server.EventHeartbeat >= lifetime {
+		return fmt.Errorf("invalid event_heartbeat %s: must be shorter than 90%% of write_timeout (%s)", c.Server.EventHeartbeat, lifetime)
+	}
+
+	if c.Server.IdempotencyWindow <= 0 {
+		return fmt.Errorf("invalid idempotency_window %s: must be greater than zero", c.Server.IdempotencyWindow)
+	}
+
+	if c.Server.SignatureSkew <= 0 {
+		return fmt.Errorf("invalid signature_skew %s: must be greater than zero", c.Server.SignatureSkew)
+	}
+
+	for _, proxy := range c.Server.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("invalid trusted_proxies entry '%s': must be an IP address or CIDR", proxy)
+			}
+		}
+	}
+
+	if c.Server.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("invalid max_header_bytes %d: must be greater than zero", c.Server.MaxHeaderBytes)
+	}
+
+	if c.Server.MaxBodyBytes <= 0 {
+		return fmt.Errorf("invalid max_body_bytes %d: must be greater than zero", c.Server.MaxBodyBytes)
+	}
+
+	if c.Server.MaxImportBytes <= 0 {
+		return fmt.Errorf("invalid max_import_bytes %d: must be greater than zero", c.Server.MaxImportBytes)
+	}
+
+	if c.Webhooks.MaxAttempts <= 0 {
+		return fmt.Errorf("invalid webhooks max_attempts %d: must be greater than zero", c.Webhooks.MaxAttempts)
+	}
+
+	if uri := c.DeviceAuth.VerificationURI; uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid device_auth verification_uri '%s': must be an absolute http or https url", uri)
+		}
+	}
+
+	if c.Lockout.Threshold < 0 {
+		return fmt.Errorf("invalid lockout threshold %d: cannot be negative", c.Lockout.Threshold)
+	}
+	if c.Lockout.Threshold > 0 {
+		if err := c.Lockout.Policy().Validate(); err != nil {
+			return fmt.Errorf("invalid lockout: %w", err)
+		}
+	}
+
+	if len(c.CORS.AllowedOrigins) > 0 {
+		if err := c.CORS.Policy().Validate(); err != nil {
+			return fmt.Errorf("invalid cors: %w", err)
+		}
+	}
+
+	switch c.Audit.Sink {
+	case "", AuditSinkMemory:
+	case AuditSinkFile:
+		if c.Audit.File == "" {
+			return errors.New("audit file is required with the file audit sink")
+		}
+	default:
+		return fmt.Errorf("invalid audit sink '%s'", c.Audit.Sink)
+	}
+
+	switch c.Logging.Level {
+	case logging.InfoLevel, logging.ErrorLevel, logging.DebugLevel:
+	default:
+		return fmt.Errorf("invalid log level '%s'", c.Logging.Level)
+	}
+
+	switch c.Logging.Format {
+	case logging.JSONFormat, logging.ConsoleFormat:
+	default:
+		return fmt.Errorf("invalid log format '%s'", c.Logging.Format)
+	}
+
+	switch c.Store.Type {
+	case StoreTypeMemory:
+		if c.Store.DSN != "" {
+			return fmt.Errorf("store dsn is not supported by store type '%s'", c.Store.Type)
+		}
+	default:
+		return fmt.Errorf("invalid store type '%s'", c.Store.Type)
+	}
+
+	return nil
+}
+
+// Logger returns a logger configured with the logging
+// configuration.
+func (c *Config) Logger() (*zap.Logger, error) {
+	return logging.NewWithFormat(c.Logging.Level, c.Logging.Format)
+}
+
+// OpenStore returns the storage backend described by the
+// store configuration. The snapshot file is only imported into an
+// empty store, so that it seeds a new store on first boot without
+// overwriting changes made since. Seed data is stored after the
+// snapshot.
+func (c *Config) OpenStore() (store.Store, error) {
+	var st store.Store
+	switch c.Store.Type {
+	case StoreTypeMemory:
+		if c.Store.WALDir == "" {
+			st = store.NewMemory()
+			break
+		}
+		m, err := store.OpenMemory(c.Store.WALDir)
+		if err != nil {
+			return nil, err
+		}
+		st = m
+	default:
+		return nil, fmt.Errorf("invalid store type '%s'", c.Store.Type)
+	}
+
+	if c.Store.SnapshotFile != "" {
+		if err := importFile(st, c.Store.SnapshotFile); err != nil {
+			_ = store.Close(st)
+			return nil, err
+		}
+	}
+
+	if c.Store.Seed {
+		if err := store.Seed(st); err != nil {
+			_ = store.Close(st)
+			return nil, err
+		}
+	}
+
+	if c.Store.CacheTTL > 0 {
+		ops := []store.CachedOption{}
+		if c.Store.CacheNegativeTTL > 0 {
+			ops = append(ops, store.WithNegativeTTL(c.Store.CacheNegativeTTL))
+		}
+		cached, err := store.NewCached(st, c.Store.CacheTTL, ops...)
+		if err != nil {
+			_ = store.Close(st)
+			return nil, err
+		}
+		return cached, nil
+	}
+
+	return st, nil
+}
+
+// importFile merges the snapshot at path into st if st has
+// no accounts.
+func importFile(st store.Store, path string) error {
+	accounts, err := st.Accounts()
+	if err != nil {
+		return fmt.Errorf("failed to list accounts: %w", err)
+	}
+	if len(accounts) > 0 {
+		return nil
+	}
+
+	// #nosec G304 the snapshot path is provided by the operator
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := store.Import(st, f, store.ImportMerge); err != nil {
+		return fmt.Errorf("failed to import snapshot file %s: %w", path, err)
+	}
+	return nil
+}
+
+// ServerOptions translates the configuration into server
+// Option functions which serve the given store.
+func (c *Config) ServerOptions(st store.Store) []server.Option {
+	ops := []server.Option{
+		server.WithBindAddress(c.Server.BindAddress, c.Server.Port),
+		server.WithReadTimeout(c.Server.ReadTimeout),
+		server.WithReadHeaderTimeout(c.Server.ReadHeaderTimeout),
+		server.WithWriteTimeout(c.Server.WriteTimeout),
+		server.WithIdleTimeout(c.Server.IdleTimeout),
+		server.WithMaxHeaderBytes(c.Server.MaxHeaderBytes),
+		server.WithMaxBodyBytes(c.Server.MaxBodyBytes),
+		server.WithMaxImportBytes(c.Server.MaxImportBytes),
+		server.WithMaxOffline(c.Server.MaxOffline),
+		server.WithEventHeartbeat(c.Server.EventHeartbeat),
+		server.WithIdempotencyWindow(c.Server.IdempotencyWindow),
+		server.WithSignatureSkew(c.Server.SignatureSkew),
+		server.WithTrustedProxies(c.Server.TrustedProxies),
+	}
+
+	if c.Server.TLS.Enabled() {
+		ops = append(ops, server.WithTLS(c.Server.TLS.CertFile, c.Server.TLS.KeyFile))
+	}
+
+	if c.Admin.Token != "" {
+		ops = append(ops, server.WithAdminToken(c.Admin.Token))
+	}
+
+	if c.DeviceAuth.VerificationURI != "" {
+		ops = append(ops, server.WithDeviceAuthorization(c.DeviceAuth.VerificationURI))
+	}
+
+	if c.Lockout.Threshold > 0 {
+		ops = append(ops, server.WithLockout(c.Lockout.Policy()))
+	}
+
+	if len(c.CORS.AllowedOrigins) > 0 {
+		ops = append(ops, server.WithCORS(c.CORS.Policy()))
+	}
+
+	return append(ops, server.WithStore(st))
+}
+
+// WebhookManager returns a webhook manager for st, or nil
+// when webhooks are disabled.
+func (c *Config) WebhookManager(logger *zap.Logger, st store.Store) (*webhook.Manager, error) {
+	if !c.Webhooks.Enabled {
+		return nil, nil
+	}
+
+	ops := []webhook.Option{webhook.WithMaxAttempts(c.Webhooks.MaxAttempts)}
+	if c.Webhooks.QueueFile != "" {
+		ops = append(ops, webhook.WithQueueFile(c.Webhooks.QueueFile))
+	}
+	return webhook.New(logger, st, ops...)
+}
+
+// AuditSink returns the configured audit sink, or nil when
+// auditing is disabled.
+func (c *Config) AuditSink() (audit.Sink, error) {
+	switch c.Audit.Sink {
+	case "":
+		return nil, nil
+	case AuditSinkMemory:
+		return audit.NewMemorySink(0), nil
+	case AuditSinkFile:
+		return audit.NewFileSink(c.Audit.File)
+	default:
+		return nil, fmt.Errorf("invalid audit sink '%s'", c.Audit.Sink)
+	}
+}
+
+// field maps a configuration value to its environment
+// variable and flag.
+type field struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var fields = []field{
+	{
+		flag:  "bind-address",
+		env:   EnvPrefix + "BIND_ADDRESS",
+		usage: "IP address to listen on",
+		set:   setString(func(c *Config) *string { return &c.Server.BindAddress }),
+	},
+	{
+		flag:  "port",
+		env:   EnvPrefix + "PORT",
+		usage: "TCP port to listen on",
+		set: func(c *Config, value string) error {
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid port '%s'", value)
+			}
+			c.Server.Port = uint(port)
+			return nil
+		},
+	},
+	{
+		flag:  "tls-cert-file",
+		env:   EnvPrefix + "TLS_CERT_FILE",
+		usage: "path to a TLS certificate",
+		set:   setString(func(c *Config) *string { return &c.Server.TLS.CertFile }),
+	},
+	{
+		flag:  "tls-key-file",
+		env:   EnvPrefix + "TLS_KEY_FILE",
+		usage: "path to a TLS private key",
+		set:   setString(func(c *Config) *string { return &c.Server.TLS.KeyFile }),
+	},
+	{
+		flag:  "read-timeout",
+		env:   EnvPrefix + "READ_TIMEOUT",
+		usage: "maximum duration for reading a request",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Server.ReadTimeout }),
+	},
+	{
+		flag:  "read-header-timeout",
+		env:   EnvPrefix + "READ_HEADER_TIMEOUT",
+		usage: "maximum duration for reading request headers",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Server.ReadHeaderTimeout }),
+	},
+	{
+		flag:  "write-timeout",
+		env:   EnvPrefix + "WRITE_TIMEOUT",
+		usage: "maximum duration for writing a response",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Server.WriteTimeout }),
+	},
+	{
+		flag:  "idle-timeout",
+		env:   EnvPrefix + "IDLE_TIMEOUT",
+		usage: "maximum duration to wait for the next keep-alive request",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Server.IdleTimeout }),
+	},
+	{
+		flag:  "shutdown-timeout",
+		env:   EnvPrefix + "SHUTDOWN_TIMEOUT",
+		usage: "maximum duration to wait for active requests during shutdown",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout }),
+	},
+	{
+		flag:  "max-header-bytes",
+		env:   EnvPrefix + "MAX_HEADER_BYTES",
+		usage: "maximum size of request headers",
+		set: func(c *Config, value string) error {
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid size '%s'", value)
+			}
+			c.Server.MaxHeaderBytes = size
+			return nil
+		},
+	},
+	{
+		flag:  "max-body-bytes",
+		env:   EnvPrefix + "MAX_BODY_BYTES",
+		usage: "maximum size of a request body",
+		set: func(c *Config, value string) error {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid size '%s'", value)
+			}
+			c.Server.MaxBodyBytes = size
+			return nil
+		},
+	},
+	{
+		flag:  "max-import-bytes",
+		env:   EnvPrefix + "MAX_IMPORT_BYTES",
+		usage: "maximum size of a snapshot imported with the admin api",
+		set: func(c *Config, value string) error {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid size '%s'", value)
+			}
+			c.Server.MaxImportBytes = size
+			return nil
+		},
+	},
+	{
+		flag:  "max-offline",
+		env:   EnvPrefix + "MAX_OFFLINE",
+		usage: "how long clients may trust a validation while the server is unavailable",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Server.MaxOffline }),
+	},
+	{
+		flag:  "event-heartbeat",
+		env:   EnvPrefix + "EVENT_HEARTBEAT",
+		usage: "interval between heartbeats on idle event streams",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Server.EventHeartbeat }),
+	},
+	{
+		flag:  "idempotency-window",
+		env:   EnvPrefix + "IDEMPOTENCY_WINDOW",
+		usage: "duration responses to requests with an idempotency key are kept for replay",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Server.IdempotencyWindow }),
+	},
+	{
+		flag:  "signature-skew",
+		env:   EnvPrefix + "SIGNATURE_SKEW",
+		usage: "maximum difference between a signed request's date and the server's clock",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Server.SignatureSkew }),
+	},
+	{
+		flag:  "trusted-proxies",
+		env:   EnvPrefix + "TRUSTED_PROXIES",
+		usage: "comma separated IP addresses and CIDRs of proxies trusted to set the client IP",
+		set:   setList(func(c *Config) *[]string { return &c.Server.TrustedProxies }),
+	},
+	{
+		flag:  "log-level",
+		env:   EnvPrefix + "LOG_LEVEL",
+		usage: "log level: debug, info or error",
+		set: func(c *Config, value string) error {
+			c.Logging.Level = logging.LogLevel(value)
+			return nil
+		},
+	},
+	{
+		flag:  "log-format",
+		env:   EnvPrefix + "LOG_FORMAT",
+		usage: "log format: json or console",
+		set: func(c *Config, value string) error {
+			c.Logging.Format = logging.LogFormat(value)
+			return nil
+		},
+	},
+	{
+		flag:  "store-type",
+		env:   EnvPrefix + "STORE_TYPE",
+		usage: "storage backend type: memory",
+		set:   setString(func(c *Config) *string { return &c.Store.Type }),
+	},
+	{
+		flag:  "store-dsn",
+		env:   EnvPrefix + "STORE_DSN",
+		usage: "storage backend data source name, not used by the memory store",
+		set:   setString(func(c *Config) *string { return &c.Store.DSN }),
+	},
+	{
+		flag:  "store-wal-dir",
+		env:   EnvPrefix + "STORE_WAL_DIR",
+		usage: "directory for the memory store's write-ahead log, disabled when empty",
+		set:   setString(func(c *Config) *string { return &c.Store.WALDir }),
+	},
+	{
+		flag:  "store-seed",
+		env:   EnvPrefix + "STORE_SEED",
+		usage: "seed the store with test data",
+		set: func(c *Config, value string) error {
+			seed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid boolean '%s'", value)
+			}
+			c.Store.Seed = seed
+			return nil
+		},
+	},
+	{
+		flag:  "store-cache-ttl",
+		env:   EnvPrefix + "STORE_CACHE_TTL",
+		usage: "cache account lookups for this duration, disabled when zero",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Store.CacheTTL }),
+	},
+	{
+		flag:  "store-cache-negative-ttl",
+		env:   EnvPrefix + "STORE_CACHE_NEGATIVE_TTL",
+		usage: "cache missing accounts and invalid keys for this duration",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Store.CacheNegativeTTL }),
+	},
+	{
+		flag:  "store-snapshot-file",
+		env:   EnvPrefix + "STORE_SNAPSHOT_FILE",
+		usage: "path to a snapshot which is imported into an empty store at startup",
+		set:   setString(func(c *Config) *string { return &c.Store.SnapshotFile }),
+	},
+	{
+		flag:  "webhooks-enabled",
+		env:   EnvPrefix + "WEBHOOKS_ENABLED",
+		usage: "enable outbound webhooks",
+		set: func(c *Config, value string) error {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid boolean '%s'", value)
+			}
+			c.Webhooks.Enabled = enabled
+			return nil
+		},
+	},
+	{
+		flag:  "webhooks-queue-file",
+		env:   EnvPrefix + "WEBHOOKS_QUEUE_FILE",
+		usage: "path to the webhook delivery queue, kept in memory when empty",
+		set:   setString(func(c *Config) *string { return &c.Webhooks.QueueFile }),
+	},
+	{
+		flag:  "webhooks-max-attempts",
+		env:   EnvPrefix + "WEBHOOKS_MAX_ATTEMPTS",
+		usage: "webhook delivery attempts before a delivery is dead lettered",
+		set: func(c *Config, value string) error {
+			attempts, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid number '%s'", value)
+			}
+			c.Webhooks.MaxAttempts = attempts
+			return nil
+		},
+	},
+	{
+		flag:  "audit-sink",
+		env:   EnvPrefix + "AUDIT_SINK",
+		usage: "audit log sink, one of memory or file, disabled when empty",
+		set:   setString(func(c *Config) *string { return &c.Audit.Sink }),
+	},
+	{
+		flag:  "audit-file",
+		env:   EnvPrefix + "AUDIT_FILE",
+		usage: "path to the audit log used by the file audit sink",
+		set:   setString(func(c *Config) *string { return &c.Audit.File }),
+	},
+	{
+		flag:  "admin-token",
+		env:   EnvPrefix + "ADMIN_TOKEN",
+		usage: "bearer token for the admin API, disabled when empty",
+		set:   setString(func(c *Config) *string { return &c.Admin.Token }),
+	},
+	{
+		flag:  "device-auth-verification-uri",
+		env:   EnvPrefix + "DEVICE_AUTH_VERIFICATION_URI",
+		usage: "url where users approve devices with the device authorization grant, disabled when empty",
+		set:   setString(func(c *Config) *string { return &c.DeviceAuth.VerificationURI }),
+	},
+	{
+		flag:  "lockout-threshold",
+		env:   EnvPrefix + "LOCKOUT_THRESHOLD",
+		usage: "failed authentication attempts which lock an account or source IP out, disabled when zero",
+		set: func(c *Config, value string) error {
+			threshold, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid number '%s'", value)
+			}
+			c.Lockout.Threshold = threshold
+			return nil
+		},
+	},
+	{
+		flag:  "lockout-window",
+		env:   EnvPrefix + "LOCKOUT_WINDOW",
+		usage: "duration in which failed authentication attempts are counted",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Lockout.Window }),
+	},
+	{
+		flag:  "lockout-duration",
+		env:   EnvPrefix + "LOCKOUT_DURATION",
+		usage: "length of the first lockout, which doubles with each lockout",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Lockout.Duration }),
+	},
+	{
+		flag:  "lockout-max-duration",
+		env:   EnvPrefix + "LOCKOUT_MAX_DURATION",
+		usage: "maximum length of a lockout",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Lockout.MaxDuration }),
+	},
+	{
+		flag:  "lockout-delay",
+		env:   EnvPrefix + "LOCKOUT_DELAY",
+		usage: "delay before answering a failed authentication attempt, which doubles with each failure",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Lockout.Delay }),
+	},
+	{
+		flag:  "lockout-max-delay",
+		env:   EnvPrefix + "LOCKOUT_MAX_DELAY",
+		usage: "maximum delay before answering a failed authentication attempt",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Lockout.MaxDelay }),
+	},
+	{
+		flag:  "cors-allowed-origins",
+		env:   EnvPrefix + "CORS_ALLOWED_ORIGINS",
+		usage: "comma separated origins which browsers may call the api from, or '*' for any origin",
+		set:   setList(func(c *Config) *[]string { return &c.CORS.AllowedOrigins }),
+	},
+	{
+		flag:  "cors-allowed-methods",
+		env:   EnvPrefix + "CORS_ALLOWED_METHODS",
+		usage: "comma separated methods allowed in cross origin requests",
+		set:   setList(func(c *Config) *[]string { return &c.CORS.AllowedMethods }),
+	},
+	{
+		flag:  "cors-allowed-headers",
+		env:   EnvPrefix + "CORS_ALLOWED_HEADERS",
+		usage: "comma separated request headers allowed in cross origin requests",
+		set:   setList(func(c *Config) *[]string { return &c.CORS.AllowedHeaders }),
+	},
+	{
+		flag:  "cors-allow-credentials",
+		env:   EnvPrefix + "CORS_ALLOW_CREDENTIALS",
+		usage: "allow cross origin requests with credentials",
+		set: func(c *Config, value string) error {
+			allow, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid boolean '%s'", value)
+			}
+			c.CORS.AllowCredentials = allow
+			return nil
+		},
+	},
+	{
+		flag:  "cors-max-age",
+		env:   EnvPrefix + "CORS_MAX_AGE",
+		usage: "how long browsers may cache a preflight response",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.CORS.MaxAge }),
+	},
+}
+
+func setString(target func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*target(c) = value
+		return nil
+	}
+}
+
+// setList sets a comma separated list. An empty value sets an
+// empty list.
+func setList(target func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		list := []string{}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+		*target(c) = list
+		return nil
+	}
+}
+
+func setDuration(target func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration '%s'", value)
+		}
+		*target(c) = d
+		return nil
+	}
+}
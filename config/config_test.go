@@ -0,0 +1,424 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/audit"
+	"github.com/jsirianni/server/logging"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/server"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := load(t, nil)
+	require.NoError(t, err)
+	require.Equal(t, Default(), c)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+server:
+  bind_address: 127.0.0.1
+  port: 9000
+  read_timeout: 20s
+logging:
+  level: debug
+store:
+  type: memory
+  seed: true
+`)
+
+	c, err := load(t, []string{"-config", path})
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", c.Server.BindAddress)
+	require.Equal(t, uint(9000), c.Server.Port)
+	require.Equal(t, time.Second*20, c.Server.ReadTimeout)
+	require.Equal(t, logging.DebugLevel, c.Logging.Level)
+	require.True(t, c.Store.Seed)
+
+	// Environment overrides the config file.
+	t.Setenv("SERVER_PORT", "9001")
+	t.Setenv("SERVER_LOG_LEVEL", "error")
+	c, err = load(t, []string{"-config", path})
+	require.NoError(t, err)
+	require.Equal(t, uint(9001), c.Server.Port)
+	require.Equal(t, logging.ErrorLevel, c.Logging.Level)
+	require.Equal(t, "127.0.0.1", c.Server.BindAddress)
+
+	// Flags override the environment.
+	c, err = load(t, []string{"-config", path, "-port", "9002", "-log-format", "console"})
+	require.NoError(t, err)
+	require.Equal(t, uint(9002), c.Server.Port)
+	require.Equal(t, logging.ErrorLevel, c.Logging.Level)
+	require.Equal(t, logging.ConsoleFormat, c.Logging.Format)
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	path := writeConfig(t, "server:\n  trusted_proxies: [10.0.0.0/8]\n")
+	c, err := load(t, []string{"-config", path})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.0/8"}, c.Server.TrustedProxies)
+
+	t.Setenv("SERVER_TRUSTED_PROXIES", "192.0.2.10, 2001:db8::/32")
+	c, err = load(t, []string{"-config", path})
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.0.2.10", "2001:db8::/32"}, c.Server.TrustedProxies)
+
+	c, err = load(t, []string{"-config", path, "-trusted-proxies", ""})
+	require.NoError(t, err)
+	require.Empty(t, c.Server.TrustedProxies)
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	path := writeConfig(t, "server:\n  port: 9100\n")
+	t.Setenv(EnvConfigFile, path)
+
+	c, err := load(t, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint(9100), c.Server.Port)
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		config    string
+		env       map[string]string
+		args      []string
+		expectErr string
+	}{
+		{
+			"unknown-field",
+			"server:\n  prot: 80\n",
+			nil,
+			nil,
+			"field prot not found",
+		},
+		{
+			"invalid-env-port",
+			"",
+			map[string]string{"SERVER_PORT": "http"},
+			nil,
+			"invalid environment variable SERVER_PORT: invalid port 'http'",
+		},
+		{
+			"invalid-flag-duration",
+			"",
+			nil,
+			[]string{"-write-timeout", "soon"},
+			"invalid flag -write-timeout: invalid duration 'soon'",
+		},
+		{
+			"invalid-bind-address",
+			"server:\n  bind_address: localhost\n",
+			nil,
+			nil,
+			"invalid bind address 'localhost'",
+		},
+		{
+			"invalid-log-level",
+			"",
+			nil,
+			[]string{"-log-level", "trace"},
+			"invalid log level 'trace'",
+		},
+		{
+			"invalid-log-format",
+			"",
+			nil,
+			[]string{"-log-format", "xml"},
+			"invalid log format 'xml'",
+		},
+		{
+			"invalid-store-type",
+			"store:\n  type: postgres\n",
+			nil,
+			nil,
+			"invalid store type 'postgres'",
+		},
+		{
+			"memory-store-dsn",
+			"",
+			nil,
+			[]string{"-store-dsn", "postgres://localhost/server"},
+			"store dsn is not supported by store type 'memory'",
+		},
+		{
+			"tls-missing-key",
+			"",
+			nil,
+			[]string{"-tls-cert-file", "cert.pem"},
+			"tls requires both cert_file and key_file",
+		},
+		{
+			"tls-missing-files",
+			"",
+			nil,
+			[]string{"-tls-cert-file", "missing.pem", "-tls-key-file", "missing.key"},
+			"invalid tls configuration",
+		},
+		{
+			"header-timeout-exceeds-read-timeout",
+			"server:\n  read_timeout: 5s\n  read_header_timeout: 10s\n",
+			nil,
+			nil,
+			"read_header_timeout 10s cannot be greater than read_timeout 5s",
+		},
+		{
+			"negative-timeout",
+			"",
+			nil,
+			[]string{"-idle-timeout", "-1s"},
+			"invalid idle_timeout -1s: cannot be negative",
+		},
+		{
+			"invalid-event-heartbeat",
+			"server:\n  event_heartbeat: 0s\n",
+			nil,
+			nil,
+			"invalid event_heartbeat 0s: must be greater than zero",
+		},
+		{
+			"event-heartbeat-exceeds-stream",
+			"server:\n  write_timeout: 10s\n  event_heartbeat: 9s\n",
+			nil,
+			nil,
+			"invalid event_heartbeat 9s: must be shorter than 90% of write_timeout (9s)",
+		},
+		{
+			"invalid-idempotency-window",
+			"",
+			nil,
+			[]string{"-idempotency-window", "0s"},
+			"invalid idempotency_window 0s: must be greater than zero",
+		},
+		{
+			"invalid-signature-skew",
+			"",
+			nil,
+			[]string{"-signature-skew", "0s"},
+			"invalid signature_skew 0s: must be greater than zero",
+		},
+		{
+			"invalid-trusted-proxies",
+			"",
+			nil,
+			[]string{"-trusted-proxies", "10.0.0.1, proxy.example.com"},
+			"invalid trusted_proxies entry 'proxy.example.com': must be an IP address or CIDR",
+		},
+		{
+			"invalid-cors-origin",
+			"",
+			nil,
+			[]string{"-cors-allowed-origins", "https://example.com/console"},
+			"invalid cors: invalid cors origin 'https://example.com/console': must be a scheme and host, such as https://example.com",
+		},
+		{
+			"invalid-cors-credentials",
+			"cors:\n  allowed_origins: ['*']\n  allow_credentials: true\n",
+			nil,
+			nil,
+			"invalid cors: cors cannot allow credentials from any origin",
+		},
+		{
+			"invalid-webhooks-max-attempts",
+			"",
+			nil,
+			[]string{"-webhooks-max-attempts", "0"},
+			"invalid webhooks max_attempts 0: must be greater than zero",
+		},
+		{
+			"invalid-audit-sink",
+			"",
+			nil,
+			[]string{"-audit-sink", "syslog"},
+			"invalid audit sink 'syslog'",
+		},
+		{
+			"audit-file-required",
+			"audit:\n  sink: file\n",
+			nil,
+			nil,
+			"audit file is required with the file audit sink",
+		},
+		{
+			"invalid-device-auth-verification-uri",
+			"device_auth:\n  verification_uri: /device\n",
+			nil,
+			nil,
+			"invalid device_auth verification_uri '/device'",
+		},
+		{
+			"invalid-lockout-threshold",
+			"",
+			nil,
+			[]string{"-lockout-threshold", "-1"},
+			"invalid lockout threshold -1: cannot be negative",
+		},
+		{
+			"invalid-lockout-max-duration",
+			"lockout:\n  duration: 1h\n  max_duration: 30m\n",
+			nil,
+			nil,
+			"invalid lockout: lockout max duration 30m0s cannot be less than duration 1h0m0s",
+		},
+		{
+			"invalid-max-body-bytes",
+			"",
+			nil,
+			[]string{"-max-body-bytes", "0"},
+			"invalid max_body_bytes 0",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			args := tc.args
+			if tc.config != "" {
+				args = append([]string{"-config", writeConfig(t, tc.config)}, args...)
+			}
+
+			_, err := load(t, args)
+			require.Error(t, err)
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	c := Default()
+	c.Server.Port = 9200
+	c.Store.Seed = true
+
+	logger, err := c.Logger()
+	require.NoError(t, err)
+
+	st, err := c.OpenStore()
+	require.NoError(t, err)
+
+	s, err := server.New(logger, c.ServerOptions(st)...)
+	require.NoError(t, err)
+	require.Equal(t, ":9200", s.Addr())
+}
+
+func TestOpenStoreCached(t *testing.T) {
+	c := Default()
+	st, err := c.OpenStore()
+	require.NoError(t, err)
+	require.IsType(t, &store.Memory{}, st)
+
+	c.Store.CacheTTL = time.Minute
+	c.Store.CacheNegativeTTL = time.Second
+	st, err = c.OpenStore()
+	require.NoError(t, err)
+	require.IsType(t, &store.Cached{}, st)
+}
+
+func TestOpenStoreWAL(t *testing.T) {
+	c := Default()
+	c.Store.WALDir = t.TempDir()
+	c.Store.Seed = true
+	st, err := c.OpenStore()
+	require.NoError(t, err)
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "go", Key: "095", Active: true}))
+	require.NoError(t, store.Close(st))
+
+	st, err = c.OpenStore()
+	require.NoError(t, err)
+	defer store.Close(st)
+
+	account, err := st.Account("go")
+	require.NoError(t, err)
+	require.True(t, account.Active)
+}
+
+func TestWebhookManager(t *testing.T) {
+	c := Default()
+	m, err := c.WebhookManager(zap.NewNop(), store.NewMemory())
+	require.NoError(t, err)
+	require.Nil(t, m)
+
+	c.Webhooks.Enabled = true
+	c.Webhooks.QueueFile = filepath.Join(t.TempDir(), "webhooks.json")
+	m, err = c.WebhookManager(zap.NewNop(), store.NewMemory())
+	require.NoError(t, err)
+	require.NotNil(t, m)
+}
+
+func TestAuditSink(t *testing.T) {
+	c := Default()
+	sink, err := c.AuditSink()
+	require.NoError(t, err)
+	require.Nil(t, sink)
+
+	c.Audit.Sink = AuditSinkMemory
+	sink, err = c.AuditSink()
+	require.NoError(t, err)
+	require.IsType(t, &audit.MemorySink{}, sink)
+
+	c.Audit.Sink = AuditSinkFile
+	c.Audit.File = filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err = c.AuditSink()
+	require.NoError(t, err)
+	require.IsType(t, &audit.FileSink{}, sink)
+	require.NoError(t, sink.(*audit.FileSink).Close())
+}
+
+func TestOpenStoreSnapshotFile(t *testing.T) {
+	c := Default()
+	c.Store.SnapshotFile = writeConfig(t, "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"account\",\"account\":{\"id\":\"abc\",\"key\":\"key\",\"active\":true}}\n")
+	st, err := c.OpenStore()
+	require.NoError(t, err)
+
+	account, err := st.Account("abc")
+	require.NoError(t, err)
+	require.True(t, account.Active)
+
+	c.Store.SnapshotFile = writeConfig(t, "{}")
+	_, err = c.OpenStore()
+	require.ErrorIs(t, err, store.ErrInvalidSnapshot)
+
+	// The snapshot is not imported over an existing store.
+	c.Store.WALDir = t.TempDir()
+	c.Store.SnapshotFile = writeConfig(t, "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"account\",\"account\":{\"id\":\"abc\",\"key\":\"key\",\"active\":true}}\n")
+	st, err = c.OpenStore()
+	require.NoError(t, err)
+	account.Active = false
+	require.NoError(t, st.UpdateAccount(account))
+	require.NoError(t, store.Close(st))
+
+	st, err = c.OpenStore()
+	require.NoError(t, err)
+	account, err = st.Account("abc")
+	require.NoError(t, err)
+	require.False(t, account.Active, "expected the snapshot to be skipped")
+	require.NoError(t, store.Close(st))
+	c.Store.WALDir = ""
+
+	c.Store.SnapshotFile = filepath.Join(t.TempDir(), "missing.jsonl")
+	_, err = c.OpenStore()
+	require.ErrorContains(t, err, "failed to open snapshot file")
+}
+
+func load(t *testing.T, args []string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	return Load(fs, args)
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
@@ -0,0 +1,94 @@
+// Package labels validates device labels and annotations and
+// matches labels with Kubernetes style selectors.
+package labels
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxNameLength is the maximum length of a key's name
+	// and of a label value.
+	maxNameLength = 63
+
+	// maxPrefixLength is the maximum length of a key's
+	// optional DNS subdomain prefix.
+	maxPrefixLength = 253
+
+	// MaxAnnotationsSize is the maximum total size of a device's
+	// annotation keys and values.
+	MaxAnnotationsSize = 64 * 1024
+)
+
+// ErrInvalid is returned when a label, annotation or
+// selector is invalid.
+var ErrInvalid = errors.New("invalid label")
+
+var (
+	nameRegexp   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	prefixRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// ValidateKey returns an error if key is not a valid label or
+// annotation key. Keys are a name with an optional DNS subdomain
+// prefix, such as 'role' or 'example.com/role'.
+func ValidateKey(key string) error {
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		if prefix == "" || len(prefix) > maxPrefixLength || !prefixRegexp.MatchString(prefix) {
+			return fmt.Errorf("%w: key '%s' must have a lowercase DNS subdomain prefix", ErrInvalid, key)
+		}
+	}
+
+	if name == "" || len(name) > maxNameLength || !nameRegexp.MatchString(name) {
+		return fmt.Errorf("%w: key '%s' must be at most %d alphanumeric characters, '-', '_' or '.', starting and ending with an alphanumeric character", ErrInvalid, key, maxNameLength)
+	}
+	return nil
+}
+
+// ValidateValue returns an error if value is not a valid label
+// value. Values may be empty.
+func ValidateValue(value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(value) > maxNameLength || !nameRegexp.MatchString(value) {
+		return fmt.Errorf("%w: value '%s' must be at most %d alphanumeric characters, '-', '_' or '.', starting and ending with an alphanumeric character", ErrInvalid, value, maxNameLength)
+	}
+	return nil
+}
+
+// Validate returns an error if any label is invalid.
+func Validate(labels map[string]string) error {
+	for k, v := range labels {
+		if err := ValidateKey(k); err != nil {
+			return err
+		}
+		if err := ValidateValue(v); err != nil {
+			return fmt.Errorf("label '%s': %w", k, err)
+		}
+	}
+	return nil
+}
+
+// ValidateAnnotations returns an error if any annotation key is
+// invalid or the annotations are larger than MaxAnnotationsSize.
+// Annotation values are free-form.
+func ValidateAnnotations(annotations map[string]string) error {
+	size := 0
+	for k, v := range annotations {
+		if err := ValidateKey(k); err != nil {
+			return err
+		}
+		size += len(k) + len(v)
+	}
+	if size > MaxAnnotationsSize {
+		return fmt.Errorf("%w: annotations cannot be larger than %d bytes", ErrInvalid, MaxAnnotationsSize)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package labels
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateKey(t *testing.T) {
+	cases := []struct {
+		key       string
+		expectErr bool
+	}{
+		{"env", false},
+		{"app.kubernetes.io/role", false},
+		{"a_b-c.d", false},
+		{"", true},
+		{"-env", true},
+		{"env-", true},
+		{"env prod", true},
+		{"/env", true},
+		{"Example.com/env", true},
+		{"example.com/", true},
+		{strings.Repeat("a", 63), false},
+		{strings.Repeat("a", 64), true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.key, func(t *testing.T) {
+			err := ValidateKey(tc.key)
+			if tc.expectErr {
+				require.ErrorIs(t, err, ErrInvalid)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Validate(map[string]string{"env": "prod", "empty": ""}))
+	require.ErrorIs(t, Validate(map[string]string{"env": "prod east"}), ErrInvalid)
+	require.ErrorIs(t, Validate(map[string]string{"env": strings.Repeat("a", 64)}), ErrInvalid)
+
+	require.NoError(t, ValidateAnnotations(map[string]string{"example.com/notes": "free form, with spaces"}))
+	require.ErrorIs(t, ValidateAnnotations(map[string]string{"bad key": "v"}), ErrInvalid)
+	require.ErrorIs(t, ValidateAnnotations(map[string]string{"notes": strings.Repeat("a", MaxAnnotationsSize)}), ErrInvalid)
+}
+
+func TestSelector(t *testing.T) {
+	device := map[string]string{"env": "prod", "role": "web", "region": "us-east"}
+
+	cases := []struct {
+		selector    string
+		expectMatch bool
+		expectStr   string
+	}{
+		{"", true, ""},
+		{"env=prod", true, "env=prod"},
+		{"env==prod", true, "env=prod"},
+		{"env=dev", false, "env=dev"},
+		{"env=prod,role!=db", true, "env=prod,role!=db"},
+		{"env=prod,role!=web", false, "env=prod,role!=web"},
+		{"missing!=x", true, "missing!=x"},
+		{"region in (us-west, us-east)", true, "region in (us-east,us-west)"},
+		{"region notin (us-east)", false, "region notin (us-east)"},
+		{"missing notin (a)", true, "missing notin (a)"},
+		{"role", true, "role"},
+		{"!role", false, "!role"},
+		{"!legacy, env = prod", true, "!legacy,env=prod"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.selector, func(t *testing.T) {
+			s, err := Parse(tc.selector)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectMatch, s.Matches(device))
+			require.Equal(t, tc.expectStr, s.String())
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []string{
+		"env=prod,",
+		",env=prod",
+		"=prod",
+		"env=prod east",
+		"env in prod",
+		"env in (prod",
+		"env between (a,b)",
+		"!",
+		"bad key",
+	}
+
+	for _, tc := range cases {
+		t.Run(tc, func(t *testing.T) {
+			_, err := Parse(tc)
+			require.ErrorIs(t, err, ErrInvalid)
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package labels
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Operator is a selector requirement's operator.
+type Operator string
+
+// Selector operators.
+const (
+	Equals       Operator = "="
+	NotEquals    Operator = "!="
+	In           Operator = "in"
+	NotIn        Operator = "notin"
+	Exists       Operator = "exists"
+	DoesNotExist Operator = "!"
+)
+
+// Requirement is a single condition of a selector.
+type Requirement struct {
+	Key      string
+	Operator Operator
+
+	// Values has one value for Equals and NotEquals, one or more
+	// for In and NotIn, and none for Exists and DoesNotExist.
+	Values []string
+}
+
+// Matches returns true if labels satisfy the requirement.
+func (r Requirement) Matches(labels map[string]string) bool {
+	v, ok := labels[r.Key]
+	switch r.Operator {
+	case Exists:
+		return ok
+	case DoesNotExist:
+		return !ok
+	case Equals:
+		return ok && v == r.Values[0]
+	case NotEquals:
+		return !ok || v != r.Values[0]
+	case In:
+		return ok && contains(r.Values, v)
+	case NotIn:
+		return !ok || !contains(r.Values, v)
+	default:
+		return false
+	}
+}
+
+// String returns the requirement in selector syntax.
+func (r Requirement) String() string {
+	switch r.Operator {
+	case Exists:
+		return r.Key
+	case DoesNotExist:
+		return "!" + r.Key
+	case In, NotIn:
+		return fmt.Sprintf("%s %s (%s)", r.Key, r.Operator, strings.Join(r.Values, ","))
+	default:
+		return r.Key + string(r.Operator) + r.Values[0]
+	}
+}
+
+// Selector matches labels which satisfy every requirement. An empty
+// selector matches all labels.
+type Selector []Requirement
+
+// Matches returns true if labels satisfy every requirement.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Empty returns true if the selector matches all labels.
+func (s Selector) Empty() bool {
+	return len(s) == 0
+}
+
+// String returns the selector in selector syntax.
+func (s Selector) String() string {
+	parts := make([]string, 0, len(s))
+	for _, r := range s {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// Parse parses a comma separated list of requirements, such as
+// 'env=prod,role!=db,region in (us-east,us-west),!legacy'. Supported
+// requirements are 'key=value', 'key==value', 'key!=value', 'key in
+// (values)', 'key notin (values)', 'key' and '!key'. An empty string
+// returns an empty selector.
+func Parse(s string) (Selector, error) {
+	selector := Selector{}
+	for _, part := range splitRequirements(s) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			return nil, fmt.Errorf("%w: selector '%s' has an empty requirement", ErrInvalid, s)
+		}
+
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// splitRequirements splits s on commas which are not
+// within parentheses.
+func splitRequirements(s string) []string {
+	parts := []string{}
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseRequirement(s string) (Requirement, error) {
+	if strings.HasPrefix(s, "!") && !strings.Contains(s, "=") {
+		key := strings.TrimSpace(s[1:])
+		return Requirement{Key: key, Operator: DoesNotExist}, ValidateKey(key)
+	}
+
+	for _, op := range []string{"!=", "==", "="} {
+		if i := strings.Index(s, op); i >= 0 {
+			key := strings.TrimSpace(s[:i])
+			value := strings.TrimSpace(s[i+len(op):])
+			if err := ValidateKey(key); err != nil {
+				return Requirement{}, err
+			}
+			if err := ValidateValue(value); err != nil {
+				return Requirement{}, err
+			}
+			operator := Equals
+			if op == "!=" {
+				operator = NotEquals
+			}
+			return Requirement{Key: key, Operator: operator, Values: []string{value}}, nil
+		}
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) == 1 && !strings.ContainsAny(s, "()") {
+		return Requirement{Key: fields[0], Operator: Exists}, ValidateKey(fields[0])
+	}
+
+	if len(fields) < 3 || (fields[1] != string(In) && fields[1] != string(NotIn)) {
+		return Requirement{}, fmt.Errorf("%w: invalid requirement '%s'", ErrInvalid, s)
+	}
+
+	key := fields[0]
+	if err := ValidateKey(key); err != nil {
+		return Requirement{}, err
+	}
+
+	set := strings.TrimSpace(strings.Join(fields[2:], " "))
+	if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+		return Requirement{}, fmt.Errorf("%w: values of '%s' must be in parentheses", ErrInvalid, s)
+	}
+
+	values := []string{}
+	for _, v := range strings.Split(set[1:len(set)-1], ",") {
+		v = strings.TrimSpace(v)
+		if err := ValidateValue(v); err != nil {
+			return Requirement{}, err
+		}
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	return Requirement{Key: key, Operator: Operator(fields[1]), Values: values}, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
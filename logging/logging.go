@@ -7,24 +7,54 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// LogLevel is the minimum level of messages which are logged.
 type LogLevel string
 
 const (
-	InfoLevel  LogLevel = "info"
+	// InfoLevel logs informational messages and errors.
+	InfoLevel LogLevel = "info"
+
+	// ErrorLevel logs errors only.
 	ErrorLevel LogLevel = "error"
+
+	// DebugLevel logs all messages.
 	DebugLevel LogLevel = "debug"
 )
 
+// LogFormat is the encoding of log messages.
+type LogFormat string
+
+const (
+	// JSONFormat encodes each message as a JSON object.
+	JSONFormat LogFormat = "json"
+
+	// ConsoleFormat encodes messages as human readable text.
+	ConsoleFormat LogFormat = "console"
+)
+
 // New returns a configured Zap logger suitable for
 // container application which need to log structured
 // messages to sdout.
 func New(level LogLevel) (*zap.Logger, error) {
+	return NewWithFormat(level, JSONFormat)
+}
+
+// NewWithFormat returns a configured Zap logger which
+// encodes messages using the given format.
+func NewWithFormat(level LogLevel, format LogFormat) (*zap.Logger, error) {
+	switch format {
+	case JSONFormat, ConsoleFormat:
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+
 	logLevel, err := zap.ParseAtomicLevel(string(level))
 	if err != nil {
 		return nil, fmt.Errorf("invalid log level: %s: %v", level, err)
 	}
 
 	logConf := zap.NewProductionConfig()
+	logConf.Encoding = string(format)
 	logConf.OutputPaths = []string{"stdout"}
 	logConf.EncoderConfig.MessageKey = "message"
 	logConf.EncoderConfig.TimeKey = "time"
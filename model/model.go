@@ -1,26 +1,430 @@
 package model
 
+import "time"
+
 // Account represents a user account.
 type Account struct {
 	// The account id.
-	ID string
+	ID string `json:"id"`
 
 	// The account's authentication key.
-	Key string
+	Key string `json:"key,omitempty"`
 
 	// Active represents whether or not the account
 	// has an active subscription.
-	Active bool
+	Active bool `json:"active"`
+
+	// MaxDevices is the maximum number of devices the
+	// account may register. Zero means unlimited.
+	MaxDevices int `json:"max_devices,omitempty"`
+
+	// Plan is the name of the account's subscription plan.
+	Plan string `json:"plan,omitempty"`
+
+	// ExpiresAt is when the subscription expires. Subscriptions
+	// without an expiry do not expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// FingerprintPolicy decides how a device which re-registers
+	// with a different fingerprint is handled. The default is
+	// FingerprintAllow.
+	FingerprintPolicy FingerprintPolicy `json:"fingerprint_policy,omitempty"`
+
+	// AllowedCIDRs are the source IP ranges which may authenticate
+	// as the account. Any source IP is allowed when empty.
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+}
+
+// IPAllowlist is the admin representation of an account's allowed
+// source IP ranges.
+type IPAllowlist struct {
+	CIDRs []string `json:"cidrs"`
+}
+
+// FingerprintPolicy is how an account handles a device id which
+// re-registers with a different hardware fingerprint.
+type FingerprintPolicy string
+
+const (
+	// FingerprintAllow replaces the existing device and reports
+	// the conflict.
+	FingerprintAllow FingerprintPolicy = "allow"
+
+	// FingerprintReject rejects the registration.
+	FingerprintReject FingerprintPolicy = "reject"
+
+	// FingerprintFork registers the device under a new id derived
+	// from the requested id and the fingerprint.
+	FingerprintFork FingerprintPolicy = "fork"
+)
+
+// SubscriptionState is the state of an account's subscription.
+type SubscriptionState string
+
+const (
+	// SubscriptionActive subscriptions may use the api.
+	SubscriptionActive SubscriptionState = "active"
+
+	// SubscriptionInactive subscriptions were suspended or
+	// never activated.
+	SubscriptionInactive SubscriptionState = "inactive"
+
+	// SubscriptionExpired subscriptions are past their expiry.
+	SubscriptionExpired SubscriptionState = "expired"
+)
+
+// Subscription is the status of an account's subscription.
+type Subscription struct {
+	AccountID string            `json:"account_id"`
+	State     SubscriptionState `json:"state"`
+	Plan      string            `json:"plan,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+
+	// Reason explains why a subscription is not active.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Active returns true if the subscription is active.
+func (s Subscription) Active() bool {
+	return s.State == SubscriptionActive
 }
 
 // Device represents an enduser device.
 type Device struct {
 	// AccountID is the account the device is assosiated with
-	AccountID string
+	AccountID string `json:"account_id"`
 
 	// ID is the id of the device
-	ID string
+	ID string `json:"id"`
 
 	// The hostname of the device
-	Hostname string
+	Hostname string `json:"hostname"`
+
+	// Labels are identifying key value pairs which devices
+	// can be selected by, such as env=prod.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations are free-form key value pairs which are
+	// not used for selection.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Fingerprint identifies the device's hardware, so that
+	// machines registering with the same id can be detected.
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+}
+
+// Fingerprint identifies a device's hardware.
+type Fingerprint struct {
+	// MachineID is the operating system's machine id, such
+	// as /etc/machine-id.
+	MachineID string `json:"machine_id,omitempty"`
+
+	// MACHash is a hash of the device's MAC addresses.
+	MACHash string `json:"mac_hash,omitempty"`
+}
+
+// Empty returns true if f is nil or has no fields set.
+func (f *Fingerprint) Empty() bool {
+	return f == nil || (f.MachineID == "" && f.MACHash == "")
+}
+
+// Conflicts returns true if f and other are both set and
+// identify different hardware.
+func (f *Fingerprint) Conflicts(other *Fingerprint) bool {
+	if f.Empty() || other.Empty() {
+		return false
+	}
+	return *f != *other
+}
+
+// FingerprintConflict describes a device registration whose
+// fingerprint differs from the registered device with the same id.
+type FingerprintConflict struct {
+	// DeviceID is the requested device id.
+	DeviceID string `json:"device_id"`
+
+	// Policy is the account's policy which was applied.
+	Policy FingerprintPolicy `json:"policy"`
+
+	// Existing is the fingerprint of the registered device.
+	Existing Fingerprint `json:"existing"`
+
+	// ForkedID is the id the device was registered under
+	// when the policy is fork.
+	ForkedID string `json:"forked_id,omitempty"`
+}
+
+// DeviceRegistration is the result of registering a device. It
+// is the stored device, with the fingerprint conflict if any.
+type DeviceRegistration struct {
+	Device
+	Conflict *FingerprintConflict `json:"conflict,omitempty"`
+}
+
+// DevicePatch is a partial update of a device. Nil fields are left
+// unchanged. Label and annotation keys with a nil value are removed,
+// and all other keys are set.
+type DevicePatch struct {
+	Hostname    *string            `json:"hostname,omitempty"`
+	Labels      map[string]*string `json:"labels,omitempty"`
+	Annotations map[string]*string `json:"annotations,omitempty"`
+}
+
+// Validation is the result of a successful subscription
+// validation.
+type Validation struct {
+	// AccountID is the validated account.
+	AccountID string `json:"account_id"`
+
+	// Active represents whether or not the account
+	// has an active subscription.
+	Active bool `json:"active"`
+
+	// State, Plan and ExpiresAt describe the subscription.
+	State     SubscriptionState `json:"state"`
+	Plan      string            `json:"plan,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+
+	// MaxOfflineSeconds is how long clients may continue to trust
+	// this result when the api is unavailable. Zero means clients
+	// must not trust the result offline.
+	MaxOfflineSeconds int64 `json:"max_offline_seconds"`
+}
+
+// Problem is an RFC 7807 problem details response
+// returned by the api when a request fails.
+type Problem struct {
+	// Type is a URI reference identifying the problem type.
+	Type string `json:"type"`
+
+	// Title is a short summary of the problem type.
+	Title string `json:"title"`
+
+	// Status is the http status code.
+	Status int `json:"status"`
+
+	// Detail is an explanation specific to this occurrence
+	// of the problem.
+	Detail string `json:"detail,omitempty"`
+
+	// Instance is the request path which caused the problem.
+	Instance string `json:"instance,omitempty"`
+}
+
+// DeviceBatchResult is the outcome of a single device in
+// a batch registration.
+type DeviceBatchResult struct {
+	// ID is the device id.
+	ID string `json:"id"`
+
+	// Status is one of created, updated, failed or aborted.
+	// Aborted devices were valid, but were not registered
+	// because another device in an atomic batch failed.
+	Status string `json:"status"`
+
+	// Error describes why a device failed.
+	Error string `json:"error,omitempty"`
+
+	// Conflict is set when the device's fingerprint differs
+	// from the registered device with the same id.
+	Conflict *FingerprintConflict `json:"conflict,omitempty"`
+}
+
+// DeviceBatch is the result of a batch registration.
+type DeviceBatch struct {
+	// Mode is atomic or per-item.
+	Mode string `json:"mode"`
+
+	// Results are in the same order as the request's devices.
+	Results []DeviceBatchResult `json:"results"`
+}
+
+// CredentialKind is the kind of a credential.
+type CredentialKind string
+
+const (
+	// CredentialEnrollment credentials are limited-use tokens
+	// which devices exchange for a device credential.
+	CredentialEnrollment CredentialKind = "enrollment"
+
+	// CredentialDevice credentials authenticate a single device
+	// and may only access that device's resources.
+	CredentialDevice CredentialKind = "device"
+
+	// CredentialToken credentials are api tokens which may only
+	// make requests allowed by their scopes.
+	CredentialToken CredentialKind = "token"
+)
+
+// Scope is a permission granted to an api token.
+type Scope string
+
+const (
+	// ScopeSubscriptionRead allows validating the subscription and
+	// reading the account.
+	ScopeSubscriptionRead Scope = "subscription:read"
+
+	// ScopeDevicesRead allows listing, reading and streaming devices.
+	ScopeDevicesRead Scope = "devices:read"
+
+	// ScopeDevicesWrite allows registering and updating devices.
+	ScopeDevicesWrite Scope = "devices:write"
+
+	// ScopeAccountAdmin allows every request, including managing
+	// api tokens and webhooks.
+	ScopeAccountAdmin Scope = "account:admin"
+)
+
+// Scopes are the valid api token scopes.
+var Scopes = []Scope{ScopeSubscriptionRead, ScopeDevicesRead, ScopeDevicesWrite, ScopeAccountAdmin}
+
+// Credential is a secret, other than the account key, which
+// authenticates requests for an account. Only the hash of the
+// secret is stored.
+type Credential struct {
+	// ID identifies the credential within its account.
+	ID string `json:"id"`
+
+	// AccountID is the account the credential belongs to.
+	AccountID string `json:"account_id"`
+
+	// Kind is the kind of credential.
+	Kind CredentialKind `json:"kind"`
+
+	// DeviceID is the device a device credential is bound to.
+	DeviceID string `json:"device_id,omitempty"`
+
+	// Name describes an api token.
+	Name string `json:"name,omitempty"`
+
+	// Scopes are the permissions of an api token.
+	Scopes []Scope `json:"scopes,omitempty"`
+
+	// Hash is the hex encoded sha256 hash of the secret.
+	Hash string `json:"hash,omitempty"`
+
+	// MaxUses is the number of times an enrollment credential
+	// may be used. Uses is the number of times it was used.
+	MaxUses int `json:"max_uses,omitempty"`
+	Uses    int `json:"uses,omitempty"`
+
+	// ExpiresAt is when the credential expires. Credentials
+	// without an expiry do not expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HasScope returns true if the credential has scope, or the
+// account:admin scope which grants every scope.
+func (c Credential) HasScope(scope Scope) bool {
+	for _, s := range c.Scopes {
+		if s == scope || s == ScopeAccountAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// IssuedCredential is a newly created credential with its token,
+// which is only returned when the credential is created.
+type IssuedCredential struct {
+	Credential
+	Token string `json:"token"`
+}
+
+// Enrollment is the result of enrolling a device with an
+// enrollment token.
+type Enrollment struct {
+	// Device is the registered device.
+	Device DeviceRegistration `json:"device"`
+
+	// Credential is the device's credential. Its token is used as a
+	// bearer token in place of the account key.
+	Credential IssuedCredential `json:"credential"`
+}
+
+// DeviceCode is the response to an RFC 8628 device authorization
+// request.
+type DeviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceToken is the successful response to a device code token
+// request. The access token is a device credential.
+type DeviceToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	AccountID   string `json:"account_id"`
+	DeviceID    string `json:"device_id"`
+}
+
+// OAuthError is an RFC 6749 error response, returned by the oauth
+// endpoints instead of a Problem.
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// DeviceAuthorizationStatus is the status of a device authorization.
+type DeviceAuthorizationStatus string
+
+const (
+	// DeviceAuthorizationPending authorizations are waiting to be
+	// approved or denied.
+	DeviceAuthorizationPending DeviceAuthorizationStatus = "pending"
+
+	// DeviceAuthorizationApproved authorizations registered the device
+	// and are waiting for the device to request its token.
+	DeviceAuthorizationApproved DeviceAuthorizationStatus = "approved"
+
+	// DeviceAuthorizationDenied authorizations were denied.
+	DeviceAuthorizationDenied DeviceAuthorizationStatus = "denied"
+)
+
+// DeviceAuthorization is a device waiting to be approved by a user
+// with its user code.
+type DeviceAuthorization struct {
+	UserCode  string                    `json:"user_code"`
+	ClientID  string                    `json:"client_id"`
+	Device    Device                    `json:"device"`
+	Status    DeviceAuthorizationStatus `json:"status"`
+	ExpiresAt time.Time                 `json:"expires_at"`
+}
+
+// LockoutKind is what a lockout applies to.
+type LockoutKind string
+
+const (
+	// LockoutAccount lockouts reject requests for an account.
+	LockoutAccount LockoutKind = "account"
+
+	// LockoutIP lockouts reject requests from a source IP.
+	LockoutIP LockoutKind = "ip"
+)
+
+// Lockout tracks failed authentication attempts for an account or
+// source IP.
+type Lockout struct {
+	Kind LockoutKind `json:"kind"`
+
+	// Key is the account id or source IP.
+	Key string `json:"key"`
+
+	// Failures is the number of failed attempts in the current
+	// window.
+	Failures int `json:"failures"`
+
+	// Lockouts is the number of times the key was locked out.
+	// Each lockout is longer than the last.
+	Lockouts int `json:"lockouts"`
+
+	// LockedUntil is when the current lockout ends, and is not set
+	// when the key is not locked out.
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
 }
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/store"
+)
+
+const (
+	// contextKeyAdmin is set in the gin context when a request
+	// is authenticated with the admin token.
+	contextKeyAdmin = "admin"
+
+	// snapshotContentType is the media type of store snapshots.
+	snapshotContentType = "application/x-ndjson"
+)
+
+// authenticateAdmin is middleware which requires the admin token
+// as a bearer token.
+func (s *Server) authenticateAdmin(c *gin.Context) {
+	h := c.GetHeader("Authorization")
+	if !strings.HasPrefix(h, bearerPrefix) {
+		abortWithProblem(c, http.StatusUnauthorized, "missing admin token")
+		return
+	}
+
+	token := strings.TrimPrefix(h, bearerPrefix)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		s.logger.Debug("invalid admin token")
+		abortWithProblem(c, http.StatusUnauthorized, "invalid admin token")
+		return
+	}
+
+	c.Set(contextKeyAdmin, true)
+	c.Next()
+}
+
+// exportHandler writes a snapshot of the store.
+func (s *Server) exportHandler(c *gin.Context) {
+	c.Header("Content-Type", snapshotContentType)
+	c.Status(http.StatusOK)
+
+	if err := store.Export(s.store, c.Writer); err != nil {
+		if errors.Is(err, store.ErrSnapshotUnsupported) {
+			abortWithProblem(c, http.StatusNotImplemented, err.Error())
+			return
+		}
+		// The status code may already be written, so the
+		// error can only be logged.
+		s.logger.Sugar().Errorf("failed to export snapshot: %v", err)
+		_ = c.Error(err)
+	}
+}
+
+// importHandler applies the snapshot in the request body using the
+// import mode from the 'mode' query parameter, which defaults to merge.
+func (s *Server) importHandler(c *gin.Context) {
+	mode, err := store.ParseImportMode(c.DefaultQuery("mode", string(store.ImportMerge)))
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stats, err := store.Import(s.store, c.Request.Body, mode)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			abortWithProblem(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+		case errors.Is(err, store.ErrSnapshotUnsupported):
+			abortWithProblem(c, http.StatusNotImplemented, err.Error())
+		case errors.Is(err, store.ErrInvalidSnapshot):
+			s.logger.Sugar().Debugf("failed to import snapshot: %v", err)
+			abortWithProblem(c, http.StatusBadRequest, err.Error())
+		default:
+			s.logger.Sugar().Errorf("failed to import snapshot: %v", err)
+			abortWithProblem(c, http.StatusInternalServerError, "failed to import snapshot")
+		}
+		return
+	}
+
+	s.logger.Sugar().Infof("imported snapshot with %d accounts and %d devices using mode %s", stats.Accounts, stats.Devices, stats.Mode)
+	c.JSON(http.StatusOK, stats)
+}
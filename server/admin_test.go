@@ -0,0 +1,150 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+const testAdminToken = "admin-token-0123456789"
+
+func TestAdminDisabled(t *testing.T) {
+	s, err := New(testLogger(t), WithMemoryStore(true))
+	require.NoError(t, err)
+
+	rec := doRequest(s, http.MethodGet, "/admin/v1/snapshot", testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestWithAdminToken(t *testing.T) {
+	_, err := New(testLogger(t), WithMemoryStore(true), WithAdminToken("short"))
+	require.ErrorContains(t, err, "admin token must be at least 16 characters")
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	rec := doRequest(s, http.MethodGet, "/admin/v1/snapshot", "", "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	requireProblem(t, rec, http.StatusUnauthorized)
+
+	rec = doRequest(s, http.MethodGet, "/admin/v1/snapshot", "xyz", "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	requireProblem(t, rec, http.StatusUnauthorized)
+}
+
+func TestAdminExport(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	rec := doRequest(s, http.MethodGet, "/admin/v1/snapshot", testAdminToken, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, snapshotContentType, rec.Header().Get("Content-Type"))
+	require.True(t, strings.HasPrefix(rec.Body.String(), `{"kind":"header","version":1}`))
+	require.Contains(t, rec.Body.String(), `"id":"device-a"`)
+}
+
+func TestAdminImport(t *testing.T) {
+	st := store.NewTestingMemory()
+	s := newAdminServer(t, st)
+
+	snap := "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"account\",\"account\":{\"id\":\"new\",\"key\":\"key\",\"active\":true}}\n"
+
+	rec := doRequest(s, http.MethodPost, "/admin/v1/snapshot?mode=dry-run", testAdminToken, snap)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.JSONEq(t, `{"mode":"dry-run","accounts":1,"devices":0,"credentials":0}`, rec.Body.String())
+	_, err := st.Account("new")
+	require.ErrorIs(t, err, store.ErrNotFound)
+
+	rec = doRequest(s, http.MethodPost, "/admin/v1/snapshot", testAdminToken, snap)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.JSONEq(t, `{"mode":"merge","accounts":1,"devices":0,"credentials":0}`, rec.Body.String())
+	_, err = st.Account("new")
+	require.NoError(t, err)
+
+	rec = doRequest(s, http.MethodPost, "/admin/v1/snapshot?mode=upsert", testAdminToken, snap)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	requireProblem(t, rec, http.StatusBadRequest)
+
+	rec = doRequest(s, http.MethodPost, "/admin/v1/snapshot", testAdminToken, "{}")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	p := requireProblem(t, rec, http.StatusBadRequest)
+	require.Contains(t, p.Detail, "expected snapshot header")
+}
+
+func TestAdminImportBodyLimit(t *testing.T) {
+	snap := "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"account\",\"account\":{\"id\":\"new\",\"key\":\"key\",\"active\":true}}\n"
+
+	cases := []struct {
+		name        string
+		importBytes int64
+		chunked     bool
+		expectCode  int
+	}{
+		{"within-import-limit", int64(len(snap)), false, http.StatusOK},
+		{"exceeds-import-limit", int64(len(snap) - 1), false, http.StatusRequestEntityTooLarge},
+		{"chunked-within-import-limit", int64(len(snap)), true, http.StatusOK},
+		{"chunked-exceeds-import-limit", int64(len(snap) - 1), true, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := store.NewTestingMemory()
+			// The router wide limit does not apply to imports.
+			s, err := New(testLogger(t), WithStore(st), WithAdminToken(testAdminToken), WithMaxBodyBytes(8), WithMaxImportBytes(tc.importBytes))
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/v1/snapshot", strings.NewReader(snap))
+			req.Header.Set("Authorization", "Bearer "+testAdminToken)
+			if tc.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			s.Router.ServeHTTP(rec, req)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+
+			_, err = st.Account("new")
+			if tc.expectCode == http.StatusOK {
+				require.NoError(t, err)
+			} else {
+				requireProblem(t, rec, tc.expectCode)
+				require.ErrorIs(t, err, store.ErrNotFound)
+			}
+		})
+	}
+
+	// Other admin routes keep the router wide limit.
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithAdminToken(testAdminToken), WithMaxBodyBytes(8))
+	require.NoError(t, err)
+	rec := doRequest(s, http.MethodPost, "/admin/v1/accounts/abc/enrollment-tokens", testAdminToken, `{"ttl_seconds": 60}`)
+	requireProblem(t, rec, http.StatusRequestEntityTooLarge)
+
+	_, err = New(testLogger(t), WithStore(store.NewTestingMemory()), WithMaxImportBytes(0))
+	require.Error(t, err)
+}
+
+func TestAdminSnapshotUnsupported(t *testing.T) {
+	s := newAdminServer(t, &unsupportedStore{Store: store.NewTestingMemory()})
+
+	rec := doRequest(s, http.MethodGet, "/admin/v1/snapshot", testAdminToken, "")
+	require.Equal(t, http.StatusNotImplemented, rec.Code)
+	requireProblem(t, rec, http.StatusNotImplemented)
+
+	rec = doRequest(s, http.MethodPost, "/admin/v1/snapshot", testAdminToken, "{}")
+	require.Equal(t, http.StatusNotImplemented, rec.Code)
+}
+
+func newAdminServer(t *testing.T, st store.Store) *Server {
+	t.Helper()
+	s, err := New(testLogger(t), WithStore(st), WithAdminToken(testAdminToken))
+	require.NoError(t, err)
+	return s
+}
+
+// unsupportedStore hides optional store interfaces.
+type unsupportedStore struct {
+	store.Store
+}
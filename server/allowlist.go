@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/model"
+)
+
+// maxAllowedCIDRs is the most ranges an account's ip allowlist
+// may contain.
+const maxAllowedCIDRs = 100
+
+// WithTrustedProxies configures the proxies whose X-Forwarded-For and
+// X-Real-IP headers are used to find a request's source IP. Each
+// proxy is an IP address or CIDR. No proxies are trusted by default,
+// and the source IP is the address of the connection.
+func WithTrustedProxies(proxies []string) Option {
+	return func(s *Server) error {
+		if err := s.Router.SetTrustedProxies(proxies); err != nil {
+			return fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		return nil
+	}
+}
+
+// checkAllowlist aborts the request with 403 if the account has an ip
+// allowlist which does not contain the request's source IP. Returns
+// false if the request was aborted.
+func (s *Server) checkAllowlist(c *gin.Context, account model.Account) bool {
+	if len(account.AllowedCIDRs) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(c.ClientIP())
+	if ip != nil {
+		for _, cidr := range account.AllowedCIDRs {
+			// Invalid ranges can only be stored by importing a
+			// snapshot, and match nothing.
+			if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	s.logger.Sugar().Debugf("source ip %s is not allowed for account %s", c.ClientIP(), account.ID)
+	abortWithProblem(c, http.StatusForbidden, fmt.Sprintf("source ip %s is not in the account's ip allowlist", c.ClientIP()))
+	return false
+}
+
+// allowlistHandler returns the ip allowlist of the account in the path.
+func (s *Server) allowlistHandler(c *gin.Context) {
+	account, err := s.store.Account(c.Param("account"))
+	if err != nil {
+		s.storeError(c, err, "failed to lookup account")
+		return
+	}
+
+	cidrs := account.AllowedCIDRs
+	if cidrs == nil {
+		cidrs = []string{}
+	}
+	c.JSON(http.StatusOK, model.IPAllowlist{CIDRs: cidrs})
+}
+
+// putAllowlistHandler replaces the ip allowlist of the account in the
+// path. IP addresses are stored as single address ranges, and an empty
+// list allows any source IP.
+func (s *Server) putAllowlistHandler(c *gin.Context) {
+	req := model.IPAllowlist{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithProblem(c, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	cidrs, err := parseCIDRs(req.CIDRs)
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	account, err := s.store.Account(c.Param("account"))
+	if err != nil {
+		s.storeError(c, err, "failed to lookup account")
+		return
+	}
+
+	account.AllowedCIDRs = cidrs
+	if err := s.store.UpdateAccount(account); err != nil {
+		s.storeError(c, err, "failed to update account")
+		return
+	}
+
+	s.logger.Sugar().Infof("updated ip allowlist of account %s to %v", account.ID, cidrs)
+	if cidrs == nil {
+		cidrs = []string{}
+	}
+	c.JSON(http.StatusOK, model.IPAllowlist{CIDRs: cidrs})
+}
+
+// parseCIDRs returns the normalized ranges, or an error naming the
+// first invalid range. Returns nil for an empty list.
+func parseCIDRs(values []string) ([]string, error) {
+	if len(values) > maxAllowedCIDRs {
+		return nil, fmt.Errorf("an ip allowlist may contain at most %d ranges", maxAllowedCIDRs)
+	}
+
+	var cidrs []string
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid cidr '%s'", v)
+			}
+			if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr '%s'", v)
+		}
+		cidrs = append(cidrs, network.String())
+	}
+	return cidrs, nil
+}
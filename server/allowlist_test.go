@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/audit"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowlist(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	rec := doRequest(s, http.MethodGet, "/admin/v1/accounts/abc/ip-allowlist", testAdminToken, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.JSONEq(t, `{"cidrs":[]}`, rec.Body.String())
+
+	rec = doRequest(s, http.MethodPut, "/admin/v1/accounts/abc/ip-allowlist", testAdminToken, `{"cidrs":["10.1.2.3/8"," 192.0.2.1","2001:db8::1"]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	allowlist := model.IPAllowlist{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &allowlist))
+	require.Equal(t, []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128"}, allowlist.CIDRs)
+
+	account, err := s.store.Account("abc")
+	require.NoError(t, err)
+	require.Equal(t, allowlist.CIDRs, account.AllowedCIDRs)
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		key        string
+		expectCode int
+	}{
+		{"allowed-ip", "192.0.2.1:1234", "xyz", http.StatusOK},
+		{"allowed-range", "10.20.30.40:1234", "xyz", http.StatusOK},
+		{"allowed-ipv6", "[2001:db8::1]:1234", "xyz", http.StatusOK},
+		{"denied", "203.0.113.5:1234", "xyz", http.StatusForbidden},
+		{"denied-ipv6", "[2001:db8::2]:1234", "xyz", http.StatusForbidden},
+		{"denied-invalid-key", "203.0.113.5:1234", "wrong", http.StatusForbidden},
+		{"allowed-invalid-key", "10.20.30.40:1234", "wrong", http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := serveFrom(s, requestFrom(tc.remoteAddr, http.MethodGet, "/v1/accounts/abc", tc.key))
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+		})
+	}
+
+	// Other accounts are not restricted.
+	rec = serveFrom(s, requestFrom("203.0.113.5:1234", http.MethodGet, "/v1/accounts/go", "095"))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// An empty list removes the restriction.
+	rec = doRequest(s, http.MethodPut, "/admin/v1/accounts/abc/ip-allowlist", testAdminToken, `{"cidrs":[]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.JSONEq(t, `{"cidrs":[]}`, rec.Body.String())
+	rec = serveFrom(s, requestFrom("203.0.113.5:1234", http.MethodGet, "/v1/accounts/abc", "xyz"))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAllowlistCredentials(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+	token := createToken(t, s, "abc", "xyz", `{"name":"ci","scopes":["account:admin"]}`)
+	enrollment := createEnrollmentToken(t, s, "abc", `{}`)
+
+	rec := doRequest(s, http.MethodPut, "/admin/v1/accounts/abc/ip-allowlist", testAdminToken, `{"cidrs":["10.0.0.0/8"]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	cases := []struct {
+		name string
+		req  func(remoteAddr string) *http.Request
+	}{
+		{
+			"api-token",
+			func(remoteAddr string) *http.Request {
+				return requestFrom(remoteAddr, http.MethodGet, "/v1/accounts/abc", token.Token)
+			},
+		},
+		{
+			"signed",
+			func(remoteAddr string) *http.Request {
+				req := signedRequest(t, http.MethodGet, "/v1/accounts/abc", "", "abc", "xyz", time.Now())
+				req.RemoteAddr = remoteAddr
+				return req
+			},
+		},
+		{
+			"enrollment",
+			func(remoteAddr string) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/v1/accounts/abc/enroll", strings.NewReader(`{"id":"laptop"}`))
+				req.Header.Set("Authorization", "Bearer "+enrollment.Token)
+				req.RemoteAddr = remoteAddr
+				return req
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := serveFrom(s, tc.req("203.0.113.5:1234"))
+			requireProblem(t, rec, http.StatusForbidden)
+
+			rec = serveFrom(s, tc.req("10.0.0.1:1234"))
+			require.Less(t, rec.Code, http.StatusBadRequest, rec.Body.String())
+		})
+	}
+}
+
+func TestAllowlistRequests(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	tooMany := make([]string, maxAllowedCIDRs+1)
+	for i := range tooMany {
+		tooMany[i] = `"10.0.0.1"`
+	}
+
+	cases := []struct {
+		name       string
+		path       string
+		body       string
+		expectCode int
+	}{
+		{"invalid-body", "/admin/v1/accounts/abc/ip-allowlist", `{"cidrs":"10.0.0.0/8"}`, http.StatusBadRequest},
+		{"invalid-cidr", "/admin/v1/accounts/abc/ip-allowlist", `{"cidrs":["10.0.0.0/33"]}`, http.StatusBadRequest},
+		{"invalid-ip", "/admin/v1/accounts/abc/ip-allowlist", `{"cidrs":["example.com"]}`, http.StatusBadRequest},
+		{"too-many", "/admin/v1/accounts/abc/ip-allowlist", `{"cidrs":[` + strings.Join(tooMany, ",") + `]}`, http.StatusBadRequest},
+		{"unknown-account", "/admin/v1/accounts/missing/ip-allowlist", `{"cidrs":["10.0.0.0/8"]}`, http.StatusNotFound},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doRequest(s, http.MethodPut, tc.path, testAdminToken, tc.body)
+			requireProblem(t, rec, tc.expectCode)
+		})
+	}
+
+	account, err := s.store.Account("abc")
+	require.NoError(t, err)
+	require.Empty(t, account.AllowedCIDRs)
+
+	rec := doRequest(s, http.MethodGet, "/admin/v1/accounts/missing/ip-allowlist", testAdminToken, "")
+	requireProblem(t, rec, http.StatusNotFound)
+}
+
+func TestTrustedProxies(t *testing.T) {
+	cases := []struct {
+		name     string
+		proxies  []string
+		expectIP string
+	}{
+		{"untrusted-by-default", nil, "203.0.113.5"},
+		{"trusted-proxy", []string{"203.0.113.0/24"}, "10.0.0.1"},
+		{"other-proxy", []string{"198.51.100.1"}, "203.0.113.5"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sink := audit.NewMemorySink(0)
+			ops := []Option{WithStore(store.NewTestingMemory()), WithAdminToken(testAdminToken), WithAuditSink(sink)}
+			if tc.proxies != nil {
+				ops = append(ops, WithTrustedProxies(tc.proxies))
+			}
+			s, err := New(testLogger(t), ops...)
+			require.NoError(t, err)
+
+			rec := doRequest(s, http.MethodPut, "/admin/v1/accounts/abc/ip-allowlist", testAdminToken, `{"cidrs":["10.0.0.0/8"]}`)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+			req := requestFrom("203.0.113.5:1234", http.MethodGet, "/v1/accounts/abc", "xyz")
+			req.Header.Set("X-Forwarded-For", "10.0.0.1")
+			rec = serveFrom(s, req)
+			if tc.expectIP == "10.0.0.1" {
+				require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+			} else {
+				requireProblem(t, rec, http.StatusForbidden)
+			}
+
+			entries, err := sink.Query(audit.Filter{Action: "account.get"})
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			require.Equal(t, tc.expectIP, entries[0].SourceIP)
+		})
+	}
+
+	_, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithTrustedProxies([]string{"proxy.example.com"}))
+	require.Error(t, err)
+}
+
+func requestFrom(remoteAddr, method, path, key string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("Authorization", "Bearer "+key)
+	return req
+}
+
+func serveFrom(s *Server, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, req)
+	return rec
+}
@@ -2,23 +2,19 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/labels"
 	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
 )
 
-// TODO(jsirianni): Handle broken backends, return 500 level errors.
-
-var (
-	errAccountNotActive = errors.New("subscription is not active")
-)
-
-// AccountRequest represents the request payload
-// expected from client requests.
-type AccountRequest struct {
-	Key string `json:"key"`
-}
+// maxBatchDevices is the maximum number of devices in a
+// batch registration.
+const maxBatchDevices = 10000
 
 func healthHandler(c *gin.Context) {
 	c.Writer.WriteHeader(200)
@@ -27,78 +23,256 @@ func healthHandler(c *gin.Context) {
 // checkSubscriptionHandler returns status code 200 if the account id
 // and account key combination is a valid subscription.
 func (s *Server) checkSubscriptionHandler(c *gin.Context) {
-	account, ok := s.isActiveAccount(c)
-	if !ok {
+	sub := contextSubscription(c)
+
+	s.logger.Sugar().Debugf("account %s is active", sub.AccountID)
+
+	c.JSON(http.StatusOK, model.Validation{
+		AccountID:         sub.AccountID,
+		Active:            sub.Active(),
+		State:             sub.State,
+		Plan:              sub.Plan,
+		ExpiresAt:         sub.ExpiresAt,
+		MaxOfflineSeconds: int64(s.maxOffline / time.Second),
+	})
+}
+
+// registerDeviceHandler creates or replaces the device in the
+// request body. The response is the stored device, which includes
+// the fingerprint conflict when the device's id was registered with
+// a different fingerprint.
+func (s *Server) registerDeviceHandler(c *gin.Context) {
+	account := contextAccount(c)
+
+	device := model.Device{}
+	if err := c.ShouldBindJSON(&device); err != nil {
+		s.logger.Sugar().Debugf("failed to parse request body as json: %v", err)
+		abortWithProblem(c, http.StatusBadRequest, "request body is not a valid device")
 		return
 	}
 
-	s.logger.Sugar().Debugf("account %s is active", account.ID)
+	if device.ID == "" {
+		abortWithProblem(c, http.StatusBadRequest, "device id is required")
+		return
+	}
 
-	c.Writer.WriteHeader(200)
+	c.Set(contextKeyAuditTarget, "device:"+device.ID)
+
+	if device.AccountID == "" {
+		device.AccountID = account.ID
+	}
+
+	if device.AccountID != account.ID {
+		abortWithProblem(c, http.StatusBadRequest, "device account id does not match the account parameter")
+		return
+	}
+
+	if credential, ok := contextCredential(c); ok && credential.Kind == model.CredentialDevice && credential.DeviceID != device.ID {
+		abortWithProblem(c, http.StatusForbidden, "device credentials may only access their own device")
+		return
+	}
+
+	registration, err := s.store.RegisterDevice(account.ID, account.Key, device)
+	if err != nil {
+		s.storeError(c, err, "failed to register device")
+		return
+	}
+
+	if registration.Conflict != nil {
+		s.logger.Sugar().Infof("device %s in account %s registered with a different fingerprint, policy %s", device.ID, account.ID, registration.Conflict.Policy)
+	}
+
+	c.Set(contextKeyAuditTarget, "device:"+registration.ID)
+	c.JSON(http.StatusOK, registration)
 }
 
-func (s *Server) registerDeviceHandler(c *gin.Context) {
-	c.Writer.WriteHeader(200)
+// devicesActionHandler dispatches custom methods on an account's
+// devices, such as ':batch'. The action includes the leading colon.
+func (s *Server) devicesActionHandler(c *gin.Context) {
+	switch c.Param("action") {
+	case ":batch":
+		s.batchDevicesHandler(c)
+	default:
+		abortWithProblem(c, http.StatusNotFound, "unknown devices action")
+	}
+}
+
+// batchDevicesHandler registers the array of devices in the request
+// body. The 'mode' query parameter is atomic, the default, or per-item.
+// The response has status code 207 when any device fails.
+func (s *Server) batchDevicesHandler(c *gin.Context) {
+	account := contextAccount(c)
+
+	mode, err := store.ParseBatchMode(c.DefaultQuery("mode", string(store.BatchAtomic)))
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	devices := []model.Device{}
+	if err := c.ShouldBindJSON(&devices); err != nil {
+		s.logger.Sugar().Debugf("failed to parse request body as json: %v", err)
+		abortWithProblem(c, http.StatusBadRequest, "request body is not a valid array of devices")
+		return
+	}
+
+	if len(devices) == 0 {
+		abortWithProblem(c, http.StatusBadRequest, "at least one device is required")
+		return
+	}
+
+	if len(devices) > maxBatchDevices {
+		abortWithProblem(c, http.StatusBadRequest, fmt.Sprintf("a batch cannot have more than %d devices", maxBatchDevices))
+		return
+	}
+
+	// Devices for other accounts fail before reaching the store,
+	// which registers the remaining devices.
+	results := make([]model.DeviceBatchResult, len(devices))
+	valid := make([]model.Device, 0, len(devices))
+	index := make([]int, 0, len(devices))
+	for i, d := range devices {
+		results[i].ID = d.ID
+		if d.AccountID != "" && d.AccountID != account.ID {
+			results[i].Status = string(store.BatchFailed)
+			results[i].Error = "device account id does not match the account parameter"
+			continue
+		}
+		valid = append(valid, d)
+		index = append(index, i)
+	}
+
+	var stored []store.BatchResult
+	if mode == store.BatchAtomic && len(valid) < len(devices) {
+		stored = make([]store.BatchResult, len(valid))
+		for i := range stored {
+			stored[i].Status = store.BatchAborted
+		}
+	} else {
+		stored, err = s.store.RegisterDevices(account.ID, account.Key, valid, mode)
+		if err != nil {
+			s.storeError(c, err, "failed to register devices")
+			return
+		}
+	}
+
+	status := http.StatusOK
+	for i, r := range stored {
+		result := &results[index[i]]
+		result.Status = string(r.Status)
+		result.Conflict = r.Conflict
+		if r.Err != nil {
+			result.Error = r.Err.Error()
+		}
+	}
+	for _, r := range results {
+		if r.Status == string(store.BatchFailed) || r.Status == string(store.BatchAborted) {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
+
+	c.JSON(status, model.DeviceBatch{Mode: string(mode), Results: results})
 }
 
+// accountHandler returns the authenticated account. The account
+// key is never included in the response.
 func (s *Server) accountHandler(c *gin.Context) {
-	c.Writer.WriteHeader(200)
+	account := contextAccount(c)
+	account.Key = ""
+	c.JSON(http.StatusOK, account)
 }
 
+// devicesHandler returns the authenticated account's devices, filtered
+// by the label selector in the 'selector' query parameter.
 func (s *Server) devicesHandler(c *gin.Context) {
-	c.Writer.WriteHeader(200)
+	account := contextAccount(c)
+
+	selector, err := labels.Parse(c.Query("selector"))
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	devices, err := s.store.Devices(account.ID, selector)
+	if err != nil {
+		s.storeError(c, err, "failed to list devices")
+		return
+	}
+
+	c.JSON(http.StatusOK, devices)
 }
 
+// deviceHandler returns a single device for the authenticated account.
 func (s *Server) deviceHandler(c *gin.Context) {
-	c.Writer.WriteHeader(200)
+	account := contextAccount(c)
+
+	device, err := s.store.Device(account.ID, c.Param("device"))
+	if err != nil {
+		s.storeError(c, err, "failed to lookup device")
+		return
+	}
+
+	c.JSON(http.StatusOK, device)
 }
 
-// Returns the account and true if the account is valid and active.
-// Callers should return without writing status codes or response bodies
-// when false.
-func (s *Server) isActiveAccount(c *gin.Context) (*model.Account, bool) {
-	reqBody := AccountRequest{}
-	if err := c.BindJSON(&reqBody); err != nil {
+// patchDeviceHandler updates the hostname, labels and annotations
+// of an existing device. Labels and annotations set to null are
+// removed.
+func (s *Server) patchDeviceHandler(c *gin.Context) {
+	account := contextAccount(c)
+
+	patch := model.DevicePatch{}
+	if err := c.ShouldBindJSON(&patch); err != nil {
 		s.logger.Sugar().Debugf("failed to parse request body as json: %v", err)
-		c.Writer.WriteHeader(http.StatusBadRequest)
-		return nil, false
+		abortWithProblem(c, http.StatusBadRequest, "request body is not a valid device patch")
+		return
 	}
 
-	accountID, ok := c.Params.Get("account")
-	if !ok || accountID == "" {
-		s.logger.Debug("missing account parameter")
-		c.Writer.WriteHeader(http.StatusBadRequest)
-		return nil, false
+	device, err := s.store.PatchDevice(account.ID, c.Param("device"), patch)
+	if err != nil {
+		s.storeError(c, err, "failed to update device")
+		return
 	}
 
-	if reqBody.Key == "" {
-		s.logger.Debug("missing account key in request body")
-		c.Writer.WriteHeader(http.StatusBadRequest)
-		return nil, false
+	c.JSON(http.StatusOK, device)
+}
+
+// storeError writes a problem response for a store error. Missing
+// resources return 404, invalid devices return 400, exceeding the
+// device limit returns 403, rejected fingerprint conflicts return
+// 409 and all other errors are treated as backend failures.
+func (s *Server) storeError(c *gin.Context, err error, msg string) {
+	if errors.Is(err, store.ErrNotFound) {
+		s.logger.Sugar().Debugf("%s: %v", msg, err)
+		abortWithProblem(c, http.StatusNotFound, err.Error())
+		return
 	}
 
-	account, err := s.store.Account(accountID)
-	if err != nil {
-		s.logger.Sugar().Debugf("failed to lookup account %s: %v", accountID, err)
-		c.Writer.WriteHeader(http.StatusUnauthorized)
-		return nil, false
+	if errors.Is(err, store.ErrInvalidDevice) {
+		s.logger.Sugar().Debugf("%s: %v", msg, err)
+		abortWithProblem(c, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	if account.Key != reqBody.Key {
-		s.logger.Sugar().Debugf("invalid key for account %s", accountID)
-		c.Writer.WriteHeader(http.StatusUnauthorized)
-		return nil, false
+	if errors.Is(err, store.ErrDeviceLimit) {
+		s.logger.Sugar().Debugf("%s: %v", msg, err)
+		abortWithProblem(c, http.StatusForbidden, err.Error())
+		return
 	}
 
-	// TODO(jsirianni): IF the account and key exist but do not have
-	// an active subscription, return an error to the user explaining that
-	// no valid subscription was found.
-	if !account.Active {
-		s.logger.Sugar().Debugf("account %s is not active: %v", accountID, errAccountNotActive)
-		c.AbortWithError(http.StatusPaymentRequired, errAccountNotActive)
-		return nil, false
+	if errors.Is(err, store.ErrFingerprintConflict) || errors.Is(err, store.ErrAlreadyExists) {
+		s.logger.Sugar().Debugf("%s: %v", msg, err)
+		abortWithProblem(c, http.StatusConflict, err.Error())
+		return
 	}
 
-	return &account, true
+	if errors.Is(err, store.ErrTooLarge) {
+		s.logger.Sugar().Debugf("%s: %v", msg, err)
+		abortWithProblem(c, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
 
+	s.logger.Sugar().Errorf("%s: %v", msg, err)
+	abortWithProblem(c, http.StatusInternalServerError, msg)
 }
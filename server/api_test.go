@@ -0,0 +1,296 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPI(t *testing.T) {
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		key        string
+		body       string
+		expectCode int
+		expectBody string
+	}{
+		{
+			"health",
+			http.MethodGet,
+			"/health",
+			"",
+			"",
+			http.StatusOK,
+			"",
+		},
+		{
+			"validate-header-key",
+			http.MethodPost,
+			"/v1/accounts/abc/validate",
+			"xyz",
+			"",
+			http.StatusOK,
+			`{"account_id":"abc","active":true,"state":"active","max_offline_seconds":86400}`,
+		},
+		{
+			"validate-body-key",
+			http.MethodPost,
+			"/v1/accounts/abc/validate",
+			"",
+			`{"key":"xyz"}`,
+			http.StatusOK,
+			`{"account_id":"abc","active":true,"state":"active","max_offline_seconds":86400}`,
+		},
+		{
+			"validate-missing-key",
+			http.MethodPost,
+			"/v1/accounts/abc/validate",
+			"",
+			"",
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"validate-invalid-body",
+			http.MethodPost,
+			"/v1/accounts/abc/validate",
+			"",
+			"{",
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"validate-invalid-key",
+			http.MethodPost,
+			"/v1/accounts/abc/validate",
+			"bad",
+			"",
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"validate-invalid-account",
+			http.MethodPost,
+			"/v1/accounts/bad/validate",
+			"xyz",
+			"",
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"validate-inactive",
+			http.MethodPost,
+			"/v1/accounts/go/validate",
+			"095",
+			"",
+			http.StatusPaymentRequired,
+			"",
+		},
+		{
+			"account",
+			http.MethodGet,
+			"/v1/accounts/abc",
+			"xyz",
+			"",
+			http.StatusOK,
+			`{"id":"abc","active":true}`,
+		},
+		{
+			"account-inactive",
+			http.MethodGet,
+			"/v1/accounts/go",
+			"095",
+			"",
+			http.StatusOK,
+			`{"id":"go","active":false}`,
+		},
+		{
+			"devices",
+			http.MethodGet,
+			"/v1/accounts/abc/devices",
+			"xyz",
+			"",
+			http.StatusOK,
+			`[{"account_id":"abc","id":"device-a","hostname":"testname"},{"account_id":"abc","id":"device-b","hostname":"testname-b"}]`,
+		},
+		{
+			"devices-empty",
+			http.MethodGet,
+			"/v1/accounts/go/devices",
+			"095",
+			"",
+			http.StatusOK,
+			`[]`,
+		},
+		{
+			"device",
+			http.MethodGet,
+			"/v1/accounts/abc/devices/device-a",
+			"xyz",
+			"",
+			http.StatusOK,
+			`{"account_id":"abc","id":"device-a","hostname":"testname"}`,
+		},
+		{
+			"device-not-found",
+			http.MethodGet,
+			"/v1/accounts/abc/devices/missing",
+			"xyz",
+			"",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"register-device",
+			http.MethodPut,
+			"/v1/accounts/abc/device",
+			"xyz",
+			`{"id":"device-c","hostname":"new"}`,
+			http.StatusOK,
+			`{"account_id":"abc","id":"device-c","hostname":"new"}`,
+		},
+		{
+			"register-device-missing-id",
+			http.MethodPut,
+			"/v1/accounts/abc/device",
+			"xyz",
+			`{"hostname":"new"}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"register-device-account-mismatch",
+			http.MethodPut,
+			"/v1/accounts/abc/device",
+			"xyz",
+			`{"id":"device-c","account_id":"go"}`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"register-device-inactive",
+			http.MethodPut,
+			"/v1/accounts/go/device",
+			"095",
+			`{"id":"device-c"}`,
+			http.StatusPaymentRequired,
+			"",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := New(testLogger(t), WithMemoryStore(true))
+			require.NoError(t, err)
+
+			rec := doRequest(s, tc.method, tc.path, tc.key, tc.body)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+
+			if tc.expectCode >= 400 {
+				requireProblem(t, rec, tc.expectCode)
+				return
+			}
+
+			if tc.expectBody != "" {
+				require.JSONEq(t, tc.expectBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func doRequest(s *Server, method, path, key, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, req)
+	return rec
+}
+
+func requireProblem(t *testing.T, rec *httptest.ResponseRecorder, status int) model.Problem {
+	t.Helper()
+	require.Equal(t, problemContentType, rec.Header().Get("Content-Type"))
+
+	p := model.Problem{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	require.Equal(t, status, p.Status)
+	require.Equal(t, http.StatusText(status), p.Title)
+	return p
+}
+
+func TestValidateSubscriptionState(t *testing.T) {
+	st := store.NewTestingMemory()
+	past := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	require.NoError(t, st.CreateAccount(model.Account{ID: "expired", Key: "key", Active: true, Plan: "pro", ExpiresAt: &past}))
+	require.NoError(t, st.CreateAccount(model.Account{ID: "pro", Key: "key", Active: true, Plan: "pro", ExpiresAt: &future}))
+
+	s, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/pro/validate", "key", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	v := model.Validation{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &v))
+	require.Equal(t, model.SubscriptionActive, v.State)
+	require.Equal(t, "pro", v.Plan)
+	require.Equal(t, future, v.ExpiresAt.UTC())
+
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/expired/validate", "key", "")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	p := requireProblem(t, rec, http.StatusPaymentRequired)
+	require.Equal(t, "subscription expired at "+past.Format(time.RFC3339), p.Detail)
+
+	rec = doRequest(s, http.MethodPut, "/v1/accounts/expired/device", "key", `{"id":"device"}`)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/go/validate", "095", "")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	p = requireProblem(t, rec, http.StatusPaymentRequired)
+	require.Equal(t, "subscription is not active", p.Detail)
+}
+
+func TestRegisterDeviceFingerprint(t *testing.T) {
+	st := store.NewTestingMemory()
+	require.NoError(t, st.CreateAccount(model.Account{ID: "fork", Key: "key", Active: true, FingerprintPolicy: model.FingerprintFork}))
+	require.NoError(t, st.CreateAccount(model.Account{ID: "reject", Key: "key", Active: true, FingerprintPolicy: model.FingerprintReject}))
+	s, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+
+	for _, account := range []string{"fork", "reject"} {
+		rec := doRequest(s, http.MethodPut, "/v1/accounts/"+account+"/device", "key", `{"id":"vm","fingerprint":{"machine_id":"a","mac_hash":"1"}}`)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		require.NotContains(t, rec.Body.String(), "conflict")
+	}
+
+	rec := doRequest(s, http.MethodPut, "/v1/accounts/fork/device", "key", `{"id":"vm","fingerprint":{"machine_id":"a","mac_hash":"2"}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	registration := model.DeviceRegistration{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &registration))
+	require.NotNil(t, registration.Conflict)
+	require.Equal(t, model.FingerprintFork, registration.Conflict.Policy)
+	require.Equal(t, "vm", registration.Conflict.DeviceID)
+	require.Equal(t, registration.ID, registration.Conflict.ForkedID)
+	require.NotEqual(t, "vm", registration.ID)
+
+	_, err = st.Device("fork", registration.ID)
+	require.NoError(t, err)
+
+	rec = doRequest(s, http.MethodPut, "/v1/accounts/reject/device", "key", `{"id":"vm","fingerprint":{"machine_id":"a","mac_hash":"2"}}`)
+	requireProblem(t, rec, http.StatusConflict)
+}
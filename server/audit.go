@@ -0,0 +1,236 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/audit"
+	"github.com/jsirianni/server/model"
+)
+
+const (
+	// headerRequestID is the request id header. A valid id passed
+	// by the client is used, otherwise one is generated.
+	headerRequestID = "X-Request-ID"
+
+	// contextKeyRequestID is the gin context key for the
+	// request id.
+	contextKeyRequestID = "request_id"
+
+	// contextKeyAuditTarget is the gin context key for a target
+	// which is not a route parameter, such as a device id in the
+	// request body.
+	contextKeyAuditTarget = "audit_target"
+
+	// maxRequestIDLength is the maximum length of a client
+	// provided request id.
+	maxRequestIDLength = 128
+
+	// DefaultAuditLimit is the default number of entries returned
+	// by the audit endpoint.
+	DefaultAuditLimit = 100
+)
+
+// auditActions names the action of each audited route.
+var auditActions = map[string]string{
+	"POST /v1/accounts/:account/validate":                                      "subscription.validate",
+	"GET /v1/accounts/:account":                                                "account.get",
+	"GET /v1/accounts/:account/devices":                                        "device.list",
+	"PATCH /v1/accounts/:account/devices/:device":                              "device.update",
+	"GET /v1/accounts/:account/devices/:device":                                "device.get",
+	"POST /v1/accounts/:account/devices:action":                                "device.batch",
+	"PUT /v1/accounts/:account/device":                                         "device.register",
+	"POST /v1/accounts/:account/enroll":                                        "device.enroll",
+	"GET /v1/accounts/:account/device-authorizations/:user_code":               "device_authorization.get",
+	"POST /v1/accounts/:account/device-authorizations/:user_code/approve":      "device_authorization.approve",
+	"POST /v1/accounts/:account/device-authorizations/:user_code/deny":         "device_authorization.deny",
+	"GET /v1/accounts/:account/events":                                         "event.stream",
+	"POST /v1/accounts/:account/tokens":                                        "token.create",
+	"GET /v1/accounts/:account/tokens":                                         "token.list",
+	"DELETE /v1/accounts/:account/tokens/:token":                               "token.delete",
+	"POST /v1/accounts/:account/webhooks":                                      "webhook.create",
+	"GET /v1/accounts/:account/webhooks":                                       "webhook.list",
+	"DELETE /v1/accounts/:account/webhooks/:webhook":                           "webhook.delete",
+	"GET /v1/accounts/:account/webhooks/:webhook/deliveries":                   "webhook.deliveries",
+	"POST /v1/accounts/:account/webhooks/:webhook/deliveries/:delivery/replay": "webhook.replay",
+	"GET /admin/v1/snapshot":                                                   "snapshot.export",
+	"POST /admin/v1/snapshot":                                                  "snapshot.import",
+	"GET /admin/v1/lockouts":                                                   "lockout.list",
+	"DELETE /admin/v1/lockouts/accounts/:account":                              "lockout.clear",
+	"DELETE /admin/v1/lockouts/ips/:ip":                                        "lockout.clear",
+	"GET /admin/v1/audit":                                                      "audit.query",
+	"POST /admin/v1/accounts/:account/enrollment-tokens":                       "enrollment_token.create",
+	"GET /admin/v1/accounts/:account/credentials":                              "credential.list",
+	"DELETE /admin/v1/accounts/:account/credentials/:credential":               "credential.delete",
+	"GET /admin/v1/accounts/:account/ip-allowlist":                             "ip_allowlist.get",
+	"PUT /admin/v1/accounts/:account/ip-allowlist":                             "ip_allowlist.update",
+}
+
+// WithAuditSink records authenticated and administrative requests
+// to sink and enables the admin audit endpoint.
+func WithAuditSink(sink audit.Sink) Option {
+	return func(s *Server) error {
+		if sink == nil {
+			return errors.New("audit sink cannot be nil")
+		}
+		s.auditSink = sink
+		return nil
+	}
+}
+
+// requestID is middleware which sets the request id in the gin
+// context and response headers.
+func requestID(c *gin.Context) {
+	id := c.GetHeader(headerRequestID)
+	if !validRequestID(id) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			abortWithProblem(c, http.StatusInternalServerError, "failed to generate request id")
+			return
+		}
+		id = hex.EncodeToString(b)
+	}
+
+	c.Set(contextKeyRequestID, id)
+	c.Header(headerRequestID, id)
+	c.Next()
+}
+
+// validRequestID returns true if id is a non empty string of
+// printable ascii characters, no longer than maxRequestIDLength.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// auditRequest is middleware which records the request to the
+// audit sink once it completes. It runs before authentication
+// so that rejected requests are recorded.
+func (s *Server) auditRequest(c *gin.Context) {
+	start := time.Now().UTC()
+	c.Next()
+
+	action, ok := auditActions[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		action = strings.ToLower(c.Request.Method) + " " + c.FullPath()
+	}
+
+	result := audit.ResultSuccess
+	if c.Writer.Status() >= http.StatusBadRequest {
+		result = audit.ResultFailure
+	}
+
+	entry := audit.Entry{
+		Time:      start,
+		Actor:     auditActor(c),
+		Action:    action,
+		Target:    auditTarget(c),
+		SourceIP:  c.ClientIP(),
+		RequestID: c.GetString(contextKeyRequestID),
+		Result:    result,
+		Status:    c.Writer.Status(),
+	}
+
+	if err := s.auditSink.Write(entry); err != nil {
+		s.logger.Sugar().Errorf("failed to write audit entry for request %s: %v", entry.RequestID, err)
+	}
+}
+
+// auditActor returns the principal which authenticated the request.
+func auditActor(c *gin.Context) audit.Actor {
+	if c.GetBool(contextKeyAdmin) {
+		return audit.Actor{Type: audit.ActorAdmin}
+	}
+	if credential, ok := contextCredential(c); ok {
+		switch credential.Kind {
+		case model.CredentialDevice:
+			return audit.Actor{Type: audit.ActorDevice, ID: credential.AccountID + "/" + credential.DeviceID}
+		case model.CredentialEnrollment:
+			return audit.Actor{Type: audit.ActorEnrollment, ID: credential.AccountID + "/" + credential.ID}
+		case model.CredentialToken:
+			return audit.Actor{Type: audit.ActorToken, ID: credential.AccountID + "/" + credential.ID}
+		}
+	}
+	if v, ok := c.Get(contextKeyAccount); ok && v != nil {
+		return audit.Actor{Type: audit.ActorAccount, ID: contextAccount(c).ID}
+	}
+	return audit.Actor{Type: audit.ActorAnonymous}
+}
+
+// auditTarget returns the resource the request acted on, built from
+// the route parameters, such as 'account:abc/device:device-a'.
+func auditTarget(c *gin.Context) string {
+	parts := make([]string, 0, len(c.Params)+1)
+	for _, p := range c.Params {
+		if p.Key == "action" {
+			continue
+		}
+		parts = append(parts, p.Key+":"+p.Value)
+	}
+	if target := c.GetString(contextKeyAuditTarget); target != "" {
+		parts = append(parts, target)
+	}
+	return strings.Join(parts, "/")
+}
+
+// auditHandler returns audit entries, newest first. Entries are
+// filtered with the 'since' and 'until' RFC 3339 query parameters,
+// the 'actor' and 'action' parameters, and limited with 'limit'.
+func (s *Server) auditHandler(c *gin.Context) {
+	filter := audit.Filter{
+		ActorID: c.Query("actor"),
+		Action:  c.Query("action"),
+		Limit:   DefaultAuditLimit,
+	}
+
+	times := []struct {
+		param string
+		t     *time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	}
+	for _, qt := range times {
+		v := c.Query(qt.param)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, qt.param+" must be an RFC 3339 timestamp")
+			return
+		}
+		*qt.t = parsed
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			abortWithProblem(c, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	entries, err := s.auditSink.Query(filter)
+	if err != nil {
+		s.logger.Sugar().Errorf("failed to query audit log: %v", err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to query audit log")
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
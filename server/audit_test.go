@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/audit"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	sink := audit.NewMemorySink(0)
+	s, err := New(testLogger(t), WithMemoryStore(true), WithAdminToken(testAdminToken), WithAuditSink(sink))
+	require.NoError(t, err)
+
+	cases := []struct {
+		name         string
+		method       string
+		path         string
+		key          string
+		body         string
+		expectActor  audit.Actor
+		expectAction string
+		expectTarget string
+		expectResult audit.Result
+		expectStatus int
+	}{
+		{
+			"validate",
+			http.MethodPost,
+			"/v1/accounts/abc/validate",
+			"xyz",
+			"",
+			audit.Actor{Type: audit.ActorAccount, ID: "abc"},
+			"subscription.validate",
+			"account:abc",
+			audit.ResultSuccess,
+			http.StatusOK,
+		},
+		{
+			"invalid-key",
+			http.MethodPost,
+			"/v1/accounts/abc/validate",
+			"bad",
+			"",
+			audit.Actor{Type: audit.ActorAnonymous},
+			"subscription.validate",
+			"account:abc",
+			audit.ResultFailure,
+			http.StatusUnauthorized,
+		},
+		{
+			"register",
+			http.MethodPut,
+			"/v1/accounts/abc/device",
+			"xyz",
+			`{"id":"device-c"}`,
+			audit.Actor{Type: audit.ActorAccount, ID: "abc"},
+			"device.register",
+			"account:abc/device:device-c",
+			audit.ResultSuccess,
+			http.StatusOK,
+		},
+		{
+			"device-not-found",
+			http.MethodGet,
+			"/v1/accounts/abc/devices/missing",
+			"xyz",
+			"",
+			audit.Actor{Type: audit.ActorAccount, ID: "abc"},
+			"device.get",
+			"account:abc/device:missing",
+			audit.ResultFailure,
+			http.StatusNotFound,
+		},
+		{
+			"admin-export",
+			http.MethodGet,
+			"/admin/v1/snapshot",
+			testAdminToken,
+			"",
+			audit.Actor{Type: audit.ActorAdmin},
+			"snapshot.export",
+			"",
+			audit.ResultSuccess,
+			http.StatusOK,
+		},
+		{
+			"admin-invalid-token",
+			http.MethodGet,
+			"/admin/v1/snapshot",
+			"bad",
+			"",
+			audit.Actor{Type: audit.ActorAnonymous},
+			"snapshot.export",
+			"",
+			audit.ResultFailure,
+			http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doRequest(s, tc.method, tc.path, tc.key, tc.body)
+			require.Equal(t, tc.expectStatus, rec.Code, rec.Body.String())
+
+			entries, err := sink.Query(audit.Filter{Limit: 1})
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+
+			e := entries[0]
+			require.Equal(t, tc.expectActor, e.Actor)
+			require.Equal(t, tc.expectAction, e.Action)
+			require.Equal(t, tc.expectTarget, e.Target)
+			require.Equal(t, tc.expectResult, e.Result)
+			require.Equal(t, tc.expectStatus, e.Status)
+			require.Equal(t, "192.0.2.1", e.SourceIP)
+			require.Equal(t, rec.Header().Get(headerRequestID), e.RequestID)
+			require.Len(t, e.RequestID, 32)
+			require.WithinDuration(t, time.Now(), e.Time, time.Minute)
+		})
+	}
+
+	rec := doRequest(s, http.MethodGet, "/health", "", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	entries, err := sink.Query(audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, len(cases), "expected health checks to not be audited")
+}
+
+func TestAuditRequestID(t *testing.T) {
+	sink := audit.NewMemorySink(0)
+	s, err := New(testLogger(t), WithMemoryStore(true), WithAuditSink(sink))
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		id       string
+		expectID bool
+	}{
+		{"client", "req-123", true},
+		{"empty", "", false},
+		{"invalid", "req 123", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/accounts/abc", nil)
+			req.Header.Set("Authorization", "Bearer xyz")
+			req.Header.Set(headerRequestID, tc.id)
+			rec := httptest.NewRecorder()
+			s.Router.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			id := rec.Header().Get(headerRequestID)
+			if tc.expectID {
+				require.Equal(t, tc.id, id)
+			} else {
+				require.Len(t, id, 32)
+			}
+
+			entries, err := sink.Query(audit.Filter{Limit: 1})
+			require.NoError(t, err)
+			require.Equal(t, id, entries[0].RequestID)
+		})
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	sink := audit.NewMemorySink(0)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, action := range []string{"subscription.validate", "device.register", "device.get"} {
+		require.NoError(t, sink.Write(audit.Entry{
+			Time:      start.Add(time.Duration(i) * time.Minute),
+			Actor:     audit.Actor{Type: audit.ActorAccount, ID: "abc"},
+			Action:    action,
+			RequestID: action,
+		}))
+	}
+
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithAdminToken(testAdminToken), WithAuditSink(sink))
+	require.NoError(t, err)
+
+	cases := []struct {
+		name       string
+		query      string
+		expectCode int
+		expectIDs  []string
+	}{
+		{"range", "?since=2024-01-01T00:01:00Z&until=2024-01-01T00:02:00Z", http.StatusOK, []string{"device.register"}},
+		{"action", "?action=device.get", http.StatusOK, []string{"device.get"}},
+		{"limit", "?until=2024-01-02T00:00:00Z&limit=2", http.StatusOK, []string{"device.get", "device.register"}},
+		{"invalid-since", "?since=yesterday", http.StatusBadRequest, nil},
+		{"invalid-until", "?until=1704067200", http.StatusBadRequest, nil},
+		{"invalid-limit", "?limit=0", http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doRequest(s, http.MethodGet, "/admin/v1/audit"+tc.query, testAdminToken, "")
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+			if tc.expectCode != http.StatusOK {
+				requireProblem(t, rec, tc.expectCode)
+				return
+			}
+
+			entries := []audit.Entry{}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+			ids := []string{}
+			for _, e := range entries {
+				ids = append(ids, e.RequestID)
+			}
+			require.Equal(t, tc.expectIDs, ids)
+		})
+	}
+
+	// Disabled without an audit sink.
+	s, err = New(testLogger(t), WithMemoryStore(true), WithAdminToken(testAdminToken))
+	require.NoError(t, err)
+	rec := doRequest(s, http.MethodGet, "/admin/v1/audit", testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	_, err = New(testLogger(t), WithMemoryStore(true), WithAuditSink(nil))
+	require.ErrorContains(t, err, "audit sink cannot be nil")
+}
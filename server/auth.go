@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/signing"
+	"github.com/jsirianni/server/store"
+)
+
+const (
+	// contextKeyAccount is the gin context key for the
+	// authenticated account.
+	contextKeyAccount = "account"
+
+	// contextKeySubscription is the gin context key for the
+	// authenticated account's subscription status.
+	contextKeySubscription = "subscription"
+
+	// bearerPrefix is the Authorization header scheme used
+	// to pass the account key.
+	bearerPrefix = "Bearer "
+)
+
+// AccountRequest represents the request payload
+// expected from client requests which do not pass the
+// account key with the Authorization header.
+type AccountRequest struct {
+	Key string `json:"key"`
+}
+
+// authenticate is middleware which requires a valid account id and
+// account key combination. The key is read from the Authorization
+// header as a bearer token, falling back to the 'key' field of a
+// JSON request body. A device credential or api token may be used in
+// place of the key, or the request may be signed with the key. The
+// account is stored in the gin context.
+func (s *Server) authenticate(c *gin.Context) {
+	accountID := c.Param("account")
+	if accountID == "" {
+		s.logger.Debug("missing account parameter")
+		abortWithProblem(c, http.StatusBadRequest, "missing account parameter")
+		return
+	}
+
+	if !s.checkLockout(c) {
+		return
+	}
+
+	if signing.IsSigned(c.Request) {
+		s.authenticateSigned(c, accountID)
+		return
+	}
+
+	key, err := requestKey(c)
+	if err != nil {
+		s.logger.Sugar().Debugf("failed to parse request body as json: %v", err)
+		abortWithProblem(c, http.StatusBadRequest, "request body is not valid json")
+		return
+	}
+
+	if key == "" {
+		s.logger.Debug("missing account key")
+		abortWithProblem(c, http.StatusUnauthorized, "missing account key")
+		return
+	}
+
+	account, err := s.store.Account(accountID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			s.logger.Sugar().Debugf("failed to lookup account %s: %v", accountID, err)
+			s.rejectCredentials(c, "", "invalid account id or account key")
+			return
+		}
+		s.logger.Sugar().Errorf("failed to lookup account %s: %v", accountID, err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to lookup account")
+		return
+	}
+
+	// The allowlist is checked before the key so that keys can not
+	// be guessed from outside of it.
+	if !s.checkAllowlist(c, account) {
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(account.Key), []byte(key)) != 1 {
+		s.authenticateCredential(c, account, key)
+		return
+	}
+
+	s.lockouts.succeed(account.ID)
+	c.Set(contextKeyAccount, account)
+	c.Next()
+}
+
+// requireActive is middleware which requires the authenticated
+// account to have an active subscription, as reported by the store.
+// The subscription is stored in the gin context.
+func (s *Server) requireActive(c *gin.Context) {
+	account := contextAccount(c)
+
+	sub, err := s.store.CheckSubscription(account.ID, account.Key)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidCredentials) {
+			// The account changed since it was authenticated.
+			abortWithProblem(c, http.StatusUnauthorized, "invalid account id or account key")
+			return
+		}
+		s.logger.Sugar().Errorf("failed to check subscription for account %s: %v", account.ID, err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to check subscription")
+		return
+	}
+
+	if !sub.Active() {
+		s.logger.Sugar().Debugf("account %s subscription is %s: %s", account.ID, sub.State, sub.Reason)
+		abortWithProblem(c, http.StatusPaymentRequired, sub.Reason)
+		return
+	}
+
+	c.Set(contextKeySubscription, sub)
+	c.Next()
+}
+
+// contextSubscription returns the subscription set by requireActive.
+func contextSubscription(c *gin.Context) model.Subscription {
+	sub, _ := c.MustGet(contextKeySubscription).(model.Subscription)
+	return sub
+}
+
+// contextAccount returns the account set by authenticate.
+func contextAccount(c *gin.Context) model.Account {
+	account, _ := c.MustGet(contextKeyAccount).(model.Account)
+	return account
+}
+
+// requestKey returns the account key from the Authorization header
+// or the JSON request body. The request body is left unread.
+func requestKey(c *gin.Context) (string, error) {
+	if h := c.GetHeader("Authorization"); strings.HasPrefix(h, bearerPrefix) {
+		return strings.TrimPrefix(h, bearerPrefix), nil
+	}
+
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return "", nil
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return "", nil
+	}
+
+	reqBody := AccountRequest{}
+	if err := json.Unmarshal(body, &reqBody); err != nil {
+		return "", err
+	}
+	return reqBody.Key, nil
+}
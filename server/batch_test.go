@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchDevices(t *testing.T) {
+	cases := []struct {
+		name         string
+		path         string
+		body         string
+		expectCode   int
+		expectStatus []string
+	}{
+		{
+			"atomic",
+			"/v1/accounts/abc/devices:batch",
+			`[{"id":"device-a","hostname":"a"},{"id":"device-c","account_id":"abc"}]`,
+			http.StatusOK,
+			[]string{"updated", "created"},
+		},
+		{
+			"atomic-limit",
+			"/v1/accounts/abc/devices:batch",
+			`[{"id":"device-c"},{"id":"device-d"}]`,
+			http.StatusMultiStatus,
+			[]string{"aborted", "failed"},
+		},
+		{
+			"atomic-account-mismatch",
+			"/v1/accounts/abc/devices:batch?mode=atomic",
+			`[{"id":"device-c"},{"id":"device-d","account_id":"go"}]`,
+			http.StatusMultiStatus,
+			[]string{"aborted", "failed"},
+		},
+		{
+			"per-item",
+			"/v1/accounts/abc/devices:batch?mode=per-item",
+			`[{"id":"device-c"},{"id":"device-d"},{"id":"device-e","account_id":"go"}]`,
+			http.StatusMultiStatus,
+			[]string{"created", "failed", "failed"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := store.NewTestingMemory()
+			require.NoError(t, st.UpdateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, MaxDevices: 3}))
+			s, err := New(testLogger(t), WithStore(st))
+			require.NoError(t, err)
+
+			rec := doRequest(s, http.MethodPost, tc.path, "xyz", tc.body)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+
+			batch := model.DeviceBatch{}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &batch))
+			status := []string{}
+			for _, r := range batch.Results {
+				status = append(status, r.Status)
+				if r.Status == "failed" {
+					require.NotEmpty(t, r.Error)
+				}
+			}
+			require.Equal(t, tc.expectStatus, status)
+		})
+	}
+}
+
+func TestBatchDevicesErrors(t *testing.T) {
+	s, err := New(testLogger(t), WithMemoryStore(true))
+	require.NoError(t, err)
+
+	cases := []struct {
+		name       string
+		path       string
+		key        string
+		body       string
+		expectCode int
+	}{
+		{"invalid-mode", "/v1/accounts/abc/devices:batch?mode=best-effort", "xyz", `[{"id":"a"}]`, http.StatusBadRequest},
+		{"invalid-body", "/v1/accounts/abc/devices:batch", "xyz", `{"id":"a"}`, http.StatusBadRequest},
+		{"empty", "/v1/accounts/abc/devices:batch", "xyz", `[]`, http.StatusBadRequest},
+		{"unknown-action", "/v1/accounts/abc/devices:purge", "xyz", `[{"id":"a"}]`, http.StatusNotFound},
+		{"inactive", "/v1/accounts/go/devices:batch", "095", `[{"id":"a"}]`, http.StatusPaymentRequired},
+		{"unauthorized", "/v1/accounts/abc/devices:batch", "bad", `[{"id":"a"}]`, http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doRequest(s, http.MethodPost, tc.path, tc.key, tc.body)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+			requireProblem(t, rec, tc.expectCode)
+		})
+	}
+}
+
+func TestRegisterDeviceLimit(t *testing.T) {
+	st := store.NewTestingMemory()
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, MaxDevices: 2}))
+	s, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+
+	rec := doRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", `{"id":"device-c"}`)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	requireProblem(t, rec, http.StatusForbidden)
+}
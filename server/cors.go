@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/signing"
+)
+
+// corsPathPrefix is the prefix of the routes which browsers may call
+// from other origins.
+const corsPathPrefix = "/v1/"
+
+// corsExposedHeaders are the response headers which browsers may read
+// from cross origin responses.
+var corsExposedHeaders = []string{headerRequestID, headerIdempotentReplayed, "Retry-After"}
+
+// CORSPolicy configures cross origin requests to the /v1 api from
+// browsers. An origin of '*' allows any origin, but can not be used
+// with AllowCredentials.
+type CORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache a preflight response.
+	// Browsers use their own default when zero.
+	MaxAge time.Duration
+}
+
+// DefaultCORSPolicy returns a policy allowing the api's methods and
+// request headers, with no allowed origins.
+func DefaultCORSPolicy() CORSPolicy {
+	return CORSPolicy{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		AllowedHeaders: []string{
+			"Authorization",
+			"Content-Type",
+			headerIdempotencyKey,
+			headerRequestID,
+			"Last-Event-ID",
+			signing.HeaderDate,
+			signing.HeaderNonce,
+		},
+		MaxAge: time.Minute * 10,
+	}
+}
+
+// Validate returns an error if the policy is invalid.
+func (p CORSPolicy) Validate() error {
+	if len(p.AllowedOrigins) == 0 {
+		return errors.New("cors requires at least one allowed origin")
+	}
+
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			if p.AllowCredentials {
+				return errors.New("cors cannot allow credentials from any origin")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("invalid cors origin '%s': must be a scheme and host, such as https://example.com", origin)
+		}
+	}
+
+	if len(p.AllowedMethods) == 0 {
+		return errors.New("cors requires at least one allowed method")
+	}
+
+	if p.MaxAge < 0 {
+		return fmt.Errorf("cors max age cannot be negative: %s", p.MaxAge)
+	}
+	return nil
+}
+
+// WithCORS allows browsers to call the /v1 api from the policy's
+// origins, and answers their preflight requests.
+func WithCORS(policy CORSPolicy) Option {
+	return func(s *Server) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		s.corsPolicy = &policy
+		return nil
+	}
+}
+
+// allowsOrigin returns true if the origin is allowed.
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	for _, o := range p.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedHeader returns the first header in the comma separated list
+// which is not allowed, or false if all are allowed.
+func (p *CORSPolicy) deniedHeader(headers string) (string, bool) {
+	for _, h := range strings.Split(headers, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if !containsFold(p.AllowedHeaders, h) {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+// cors is middleware which sets the CORS headers of /v1 requests from
+// allowed origins, and answers preflight requests. Requests without an
+// Origin header, or from other origins, get no CORS headers, so
+// browsers block their responses.
+func (s *Server) cors(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if origin == "" || !strings.HasPrefix(c.Request.URL.Path, corsPathPrefix) {
+		c.Next()
+		return
+	}
+
+	p := s.corsPolicy
+	preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+	c.Writer.Header().Add("Vary", "Origin")
+	if preflight {
+		c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+		c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	if !p.allowsOrigin(origin) {
+		s.logger.Sugar().Debugf("cors origin %s is not allowed", origin)
+		if preflight {
+			abortWithProblem(c, http.StatusForbidden, fmt.Sprintf("origin %s is not allowed", origin))
+			return
+		}
+		c.Next()
+		return
+	}
+
+	if containsFold(p.AllowedOrigins, "*") {
+		c.Header("Access-Control-Allow-Origin", "*")
+	} else {
+		c.Header("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		c.Header("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		c.Header("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		c.Next()
+		return
+	}
+
+	method := c.GetHeader("Access-Control-Request-Method")
+	if !containsFold(p.AllowedMethods, method) {
+		abortWithProblem(c, http.StatusForbidden, fmt.Sprintf("method %s is not allowed", method))
+		return
+	}
+	if h, denied := p.deniedHeader(c.GetHeader("Access-Control-Request-Headers")); denied {
+		abortWithProblem(c, http.StatusForbidden, fmt.Sprintf("header %s is not allowed", h))
+		return
+	}
+
+	c.Header("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+	if len(p.AllowedHeaders) > 0 {
+		c.Header("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+	}
+	if p.MaxAge > 0 {
+		c.Header("Access-Control-Max-Age", strconv.FormatInt(int64(p.MaxAge/time.Second), 10))
+	}
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
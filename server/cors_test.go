@@ -0,0 +1,168 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+const testOrigin = "https://console.example.com"
+
+func TestCORSPreflight(t *testing.T) {
+	s := newCORSServer(t, testOrigin)
+
+	cases := []struct {
+		name       string
+		path       string
+		origin     string
+		method     string
+		headers    string
+		expectCode int
+	}{
+		{"account", "/v1/accounts/abc", testOrigin, http.MethodGet, "authorization", http.StatusNoContent},
+		{"patch-device", "/v1/accounts/abc/devices/device-a", testOrigin, http.MethodPatch, "Authorization, Content-Type, Idempotency-Key", http.StatusNoContent},
+		{"delete-token", "/v1/accounts/abc/tokens/t1", testOrigin, http.MethodDelete, "", http.StatusNoContent},
+		{"signed", "/v1/accounts/abc/device", testOrigin, http.MethodPut, "authorization,x-signature-date,x-signature-nonce", http.StatusNoContent},
+		{"oauth", "/v1/oauth/device/code", testOrigin, http.MethodPost, "content-type", http.StatusNoContent},
+		{"origin-case", "/v1/accounts/abc", "https://Console.Example.com", http.MethodGet, "", http.StatusNoContent},
+		{"denied-origin", "/v1/accounts/abc", "https://evil.example.com", http.MethodGet, "authorization", http.StatusForbidden},
+		{"denied-origin-subdomain", "/v1/accounts/abc", "https://console.example.com.evil.com", http.MethodGet, "", http.StatusForbidden},
+		{"denied-method", "/v1/accounts/abc", testOrigin, "TRACE", "", http.StatusForbidden},
+		{"denied-header", "/v1/accounts/abc", testOrigin, http.MethodGet, "authorization, x-custom", http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, tc.path, nil)
+			req.Header.Set("Origin", tc.origin)
+			req.Header.Set("Access-Control-Request-Method", tc.method)
+			if tc.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tc.headers)
+			}
+			rec := serveFrom(s, req)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+			require.Contains(t, rec.Header().Values("Vary"), "Origin")
+
+			if tc.expectCode != http.StatusNoContent {
+				requireProblem(t, rec, tc.expectCode)
+				return
+			}
+			require.Equal(t, tc.origin, rec.Header().Get("Access-Control-Allow-Origin"))
+			require.Equal(t, "GET, POST, PUT, PATCH, DELETE", rec.Header().Get("Access-Control-Allow-Methods"))
+			require.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+			require.Equal(t, "600", rec.Header().Get("Access-Control-Max-Age"))
+			require.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+			require.Empty(t, rec.Body.String())
+		})
+	}
+
+	// The denied origin is not echoed.
+	req := httptest.NewRequest(http.MethodOptions, "/v1/accounts/abc", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rec := serveFrom(s, req)
+	require.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSRequests(t *testing.T) {
+	s := newCORSServer(t, testOrigin)
+
+	cases := []struct {
+		name         string
+		path         string
+		origin       string
+		key          string
+		expectCode   int
+		expectOrigin string
+	}{
+		{"allowed", "/v1/accounts/abc", testOrigin, "xyz", http.StatusOK, testOrigin},
+		{"allowed-problem", "/v1/accounts/abc", testOrigin, "wrong", http.StatusUnauthorized, testOrigin},
+		{"denied", "/v1/accounts/abc", "https://evil.example.com", "xyz", http.StatusOK, ""},
+		{"no-origin", "/v1/accounts/abc", "", "xyz", http.StatusOK, ""},
+		{"admin", "/admin/v1/accounts/abc/credentials", testOrigin, testAdminToken, http.StatusOK, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := requestFrom("192.0.2.1:1234", http.MethodGet, tc.path, tc.key)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			rec := serveFrom(s, req)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+			require.Equal(t, tc.expectOrigin, rec.Header().Get("Access-Control-Allow-Origin"))
+			if tc.expectOrigin != "" {
+				require.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+				require.Contains(t, rec.Header().Get("Access-Control-Expose-Headers"), headerRequestID)
+			}
+		})
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	policy := DefaultCORSPolicy()
+	policy.AllowedOrigins = []string{"*"}
+	policy.MaxAge = 0
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithCORS(policy))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodOptions, "/v1/accounts/abc", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rec := serveFrom(s, req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+	require.Empty(t, rec.Header().Get("Access-Control-Max-Age"))
+}
+
+func TestCORSDisabled(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	req := httptest.NewRequest(http.MethodOptions, "/v1/accounts/abc", nil)
+	req.Header.Set("Origin", testOrigin)
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rec := serveFrom(s, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestWithCORS(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(*CORSPolicy)
+	}{
+		{"no-origins", func(p *CORSPolicy) { p.AllowedOrigins = nil }},
+		{"origin-path", func(p *CORSPolicy) { p.AllowedOrigins = []string{"https://example.com/console"} }},
+		{"origin-scheme", func(p *CORSPolicy) { p.AllowedOrigins = []string{"example.com"} }},
+		{"any-origin-credentials", func(p *CORSPolicy) { p.AllowedOrigins = []string{"*"}; p.AllowCredentials = true }},
+		{"no-methods", func(p *CORSPolicy) { p.AllowedMethods = nil }},
+		{"negative-max-age", func(p *CORSPolicy) { p.MaxAge = -time.Second }},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultCORSPolicy()
+			policy.AllowedOrigins = []string{testOrigin}
+			tc.modify(&policy)
+			_, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithCORS(policy))
+			require.Error(t, err)
+		})
+	}
+}
+
+// newCORSServer returns a server which allows credentialed cross
+// origin requests from origins.
+func newCORSServer(t *testing.T, origins ...string) *Server {
+	t.Helper()
+	policy := DefaultCORSPolicy()
+	policy.AllowedOrigins = origins
+	policy.AllowCredentials = true
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithAdminToken(testAdminToken), WithDeviceAuthorization(testVerificationURI), WithCORS(policy))
+	require.NoError(t, err)
+	return s
+}
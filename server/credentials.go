@@ -0,0 +1,338 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+)
+
+const (
+	// DefaultEnrollmentTokenTTL is how long enrollment tokens are
+	// valid when the request does not set a ttl.
+	DefaultEnrollmentTokenTTL = time.Hour
+
+	// MaxEnrollmentTokenTTL is the longest an enrollment token
+	// may be valid.
+	MaxEnrollmentTokenTTL = time.Hour * 24 * 7
+
+	// contextKeyCredential is the gin context key for the
+	// credential a request authenticated with.
+	contextKeyCredential = "credential"
+)
+
+// deviceRoutes are the routes which device credentials may use.
+// Routes with a device parameter are limited to the credential's
+// device.
+var deviceRoutes = map[string]bool{
+	"POST /v1/accounts/:account/validate":         true,
+	"GET /v1/accounts/:account/devices/:device":   true,
+	"PATCH /v1/accounts/:account/devices/:device": true,
+	"PUT /v1/accounts/:account/device":            true,
+}
+
+// EnrollmentTokenRequest is the request body for creating an
+// enrollment token. The token is valid for TTLSeconds, which defaults
+// to DefaultEnrollmentTokenTTL, and may be used MaxUses times, which
+// defaults to one.
+type EnrollmentTokenRequest struct {
+	TTLSeconds int64 `json:"ttl_seconds"`
+	MaxUses    int   `json:"max_uses"`
+}
+
+// authenticateCredential authenticates a request with a device
+// credential or api token for the given account. Device credentials
+// may only be used for deviceRoutes and their own device, and api
+// tokens for routes allowed by their scopes.
+func (s *Server) authenticateCredential(c *gin.Context, account model.Account, token string) {
+	credential, err := s.verifyCredential(account.ID, token)
+	if err != nil {
+		s.logger.Sugar().Errorf("failed to lookup credential for account %s: %v", account.ID, err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to lookup account")
+		return
+	}
+
+	if credential == nil || credential.Kind == model.CredentialEnrollment {
+		s.logger.Sugar().Debugf("invalid key for account %s", account.ID)
+		s.rejectCredentials(c, account.ID, "invalid account id or account key")
+		return
+	}
+	s.lockouts.succeed(account.ID)
+
+	// The credential is set before checking the route so that
+	// rejected requests are audited as the credential.
+	c.Set(contextKeyAccount, account)
+	c.Set(contextKeyCredential, *credential)
+
+	if credential.Kind == model.CredentialToken {
+		scope := routeScope(c)
+		if !credential.HasScope(scope) {
+			abortWithProblem(c, http.StatusForbidden, fmt.Sprintf("api token is missing the %s scope", scope))
+			return
+		}
+		c.Next()
+		return
+	}
+
+	device := c.Param("device")
+	if !deviceRoutes[c.Request.Method+" "+c.FullPath()] || (device != "" && device != credential.DeviceID) {
+		abortWithProblem(c, http.StatusForbidden, "device credentials may only access their own device")
+		return
+	}
+
+	c.Next()
+}
+
+// authenticateEnrollment is middleware which requires an enrollment
+// token as a bearer token. The token's account is stored in the gin
+// context, and the token is used by enrollHandler.
+func (s *Server) authenticateEnrollment(c *gin.Context) {
+	h := c.GetHeader("Authorization")
+	if !strings.HasPrefix(h, bearerPrefix) {
+		abortWithProblem(c, http.StatusUnauthorized, "missing enrollment token")
+		return
+	}
+
+	if !s.checkLockout(c) {
+		return
+	}
+
+	account, err := s.store.Account(c.Param("account"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			s.rejectCredentials(c, "", "invalid enrollment token")
+			return
+		}
+		s.logger.Sugar().Errorf("failed to lookup account %s: %v", c.Param("account"), err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to lookup account")
+		return
+	}
+
+	if !s.checkAllowlist(c, account) {
+		return
+	}
+
+	credential, err := s.verifyCredential(account.ID, strings.TrimPrefix(h, bearerPrefix))
+	if err != nil {
+		s.logger.Sugar().Errorf("failed to lookup enrollment token for account %s: %v", account.ID, err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to lookup enrollment token")
+		return
+	}
+
+	if credential == nil || credential.Kind != model.CredentialEnrollment {
+		s.logger.Sugar().Debugf("invalid enrollment token for account %s", account.ID)
+		s.rejectCredentials(c, account.ID, "invalid enrollment token")
+		return
+	}
+	s.lockouts.succeed(account.ID)
+
+	c.Set(contextKeyAccount, account)
+	c.Set(contextKeyCredential, *credential)
+	c.Next()
+}
+
+// enrollHandler registers the device in the request body using the
+// request's enrollment token, and returns the device with a new
+// credential which authenticates as the device.
+func (s *Server) enrollHandler(c *gin.Context) {
+	account := contextAccount(c)
+	enrollment, _ := contextCredential(c)
+
+	device := model.Device{}
+	if err := c.ShouldBindJSON(&device); err != nil {
+		s.logger.Sugar().Debugf("failed to parse request body as json: %v", err)
+		abortWithProblem(c, http.StatusBadRequest, "request body is not a valid device")
+		return
+	}
+
+	if device.ID == "" {
+		abortWithProblem(c, http.StatusBadRequest, "device id is required")
+		return
+	}
+
+	c.Set(contextKeyAuditTarget, "device:"+device.ID)
+
+	if device.AccountID != "" && device.AccountID != account.ID {
+		abortWithProblem(c, http.StatusBadRequest, "device account id does not match the account parameter")
+		return
+	}
+
+	credential, token, err := newCredential(account.ID, model.CredentialDevice, time.Now())
+	if err != nil {
+		s.logger.Sugar().Errorf("failed to create device credential: %v", err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to create device credential")
+		return
+	}
+
+	registration, err := s.store.Enroll(account.ID, enrollment.ID, device, credential)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidCredentials) {
+			s.logger.Sugar().Debugf("failed to enroll device: %v", err)
+			abortWithProblem(c, http.StatusUnauthorized, "invalid enrollment token")
+			return
+		}
+		s.storeError(c, err, "failed to enroll device")
+		return
+	}
+
+	credential.DeviceID = registration.ID
+	credential.Hash = ""
+
+	c.Set(contextKeyAuditTarget, "device:"+registration.ID)
+	c.JSON(http.StatusOK, model.Enrollment{
+		Device:     registration,
+		Credential: model.IssuedCredential{Credential: credential, Token: token},
+	})
+}
+
+// createEnrollmentTokenHandler creates an enrollment token for the
+// account. The token is only returned in this response.
+func (s *Server) createEnrollmentTokenHandler(c *gin.Context) {
+	req := EnrollmentTokenRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithProblem(c, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	ttl := DefaultEnrollmentTokenTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > MaxEnrollmentTokenTTL {
+		abortWithProblem(c, http.StatusBadRequest, fmt.Sprintf("ttl_seconds must be between 1 and %d", int64(MaxEnrollmentTokenTTL/time.Second)))
+		return
+	}
+
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.MaxUses < 0 {
+		abortWithProblem(c, http.StatusBadRequest, "max_uses cannot be negative")
+		return
+	}
+
+	now := time.Now()
+	credential, token, err := newCredential(c.Param("account"), model.CredentialEnrollment, now)
+	if err != nil {
+		s.logger.Sugar().Errorf("failed to create enrollment token: %v", err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to create enrollment token")
+		return
+	}
+	expiresAt := now.Add(ttl).UTC()
+	credential.ExpiresAt = &expiresAt
+	credential.MaxUses = req.MaxUses
+
+	if err := s.store.CreateCredential(credential); err != nil {
+		s.storeError(c, err, "failed to create enrollment token")
+		return
+	}
+
+	c.Set(contextKeyAuditTarget, "credential:"+credential.ID)
+	credential.Hash = ""
+	c.JSON(http.StatusCreated, model.IssuedCredential{Credential: credential, Token: token})
+}
+
+// credentialsHandler lists the account's enrollment tokens, device
+// credentials and api tokens, without their hashes.
+func (s *Server) credentialsHandler(c *gin.Context) {
+	credentials, err := s.store.Credentials(c.Param("account"))
+	if err != nil {
+		s.storeError(c, err, "failed to list credentials")
+		return
+	}
+
+	for i := range credentials {
+		credentials[i].Hash = ""
+	}
+	c.JSON(http.StatusOK, credentials)
+}
+
+// deleteCredentialHandler revokes an enrollment token, device
+// credential or api token.
+func (s *Server) deleteCredentialHandler(c *gin.Context) {
+	if err := s.store.DeleteCredential(c.Param("account"), c.Param("credential")); err != nil {
+		s.storeError(c, err, "failed to delete credential")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// verifyCredential returns the account's credential for token, or nil
+// if the token is invalid or the credential has expired.
+func (s *Server) verifyCredential(accountID, token string) (*model.Credential, error) {
+	id, secret, ok := parseToken(token)
+	if !ok {
+		return nil, nil
+	}
+
+	credential, err := s.store.Credential(accountID, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(credential.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, nil
+	}
+	if credential.ExpiresAt != nil && !time.Now().Before(*credential.ExpiresAt) {
+		return nil, nil
+	}
+	return &credential, nil
+}
+
+// contextCredential returns the credential a request authenticated
+// with. Returns false for requests authenticated with the account key.
+func contextCredential(c *gin.Context) (model.Credential, bool) {
+	v, ok := c.Get(contextKeyCredential)
+	if !ok {
+		return model.Credential{}, false
+	}
+	credential, ok := v.(model.Credential)
+	return credential, ok
+}
+
+// newCredential returns a credential with a random id and secret,
+// along with its token, '<id>.<secret>'. Only the secret's hash is
+// kept in the credential.
+func newCredential(accountID string, kind model.CredentialKind, now time.Time) (model.Credential, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return model.Credential{}, "", fmt.Errorf("failed to generate credential id: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return model.Credential{}, "", fmt.Errorf("failed to generate credential secret: %w", err)
+	}
+
+	credential := model.Credential{
+		ID:        hex.EncodeToString(id),
+		AccountID: accountID,
+		Kind:      kind,
+		Hash:      hashSecret(hex.EncodeToString(secret)),
+		CreatedAt: now.UTC(),
+	}
+	return credential, credential.ID + "." + hex.EncodeToString(secret), nil
+}
+
+// parseToken splits a credential token into its id and secret.
+func parseToken(token string) (id, secret string, ok bool) {
+	id, secret, ok = strings.Cut(token, ".")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+// hashSecret returns the hex encoded sha256 hash of secret.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
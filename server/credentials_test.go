@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jsirianni/server/audit"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrollment(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	token := createEnrollmentToken(t, s, "abc", `{"ttl_seconds":600,"max_uses":1}`)
+	require.Equal(t, model.CredentialEnrollment, token.Kind)
+	require.Equal(t, 1, token.MaxUses)
+	require.Empty(t, token.Hash)
+
+	// Enrollment tokens do not authenticate other requests.
+	rec := doRequest(s, http.MethodGet, "/v1/accounts/abc/devices/device-a", token.Token, "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/enroll", token.Token, `{"id":"laptop","hostname":"laptop-1"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	enrollment := model.Enrollment{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &enrollment))
+	require.Equal(t, model.Device{AccountID: "abc", ID: "laptop", Hostname: "laptop-1"}, enrollment.Device.Device)
+	require.Equal(t, model.CredentialDevice, enrollment.Credential.Kind)
+	require.Equal(t, "laptop", enrollment.Credential.DeviceID)
+	require.Empty(t, enrollment.Credential.Hash)
+	require.NotEmpty(t, enrollment.Credential.Token)
+
+	// The token has no uses left.
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/enroll", token.Token, `{"id":"other"}`)
+	requireProblem(t, rec, http.StatusUnauthorized)
+
+	deviceKey := enrollment.Credential.Token
+	cases := []struct {
+		method     string
+		path       string
+		body       string
+		expectCode int
+	}{
+		{http.MethodPost, "/v1/accounts/abc/validate", "", http.StatusOK},
+		{http.MethodGet, "/v1/accounts/abc/devices/laptop", "", http.StatusOK},
+		{http.MethodPatch, "/v1/accounts/abc/devices/laptop", `{"hostname":"laptop-2"}`, http.StatusOK},
+		{http.MethodPut, "/v1/accounts/abc/device", `{"id":"laptop","hostname":"laptop-3"}`, http.StatusOK},
+		{http.MethodGet, "/v1/accounts/abc/devices/device-a", "", http.StatusForbidden},
+		{http.MethodPatch, "/v1/accounts/abc/devices/device-a", `{"hostname":"x"}`, http.StatusForbidden},
+		{http.MethodPut, "/v1/accounts/abc/device", `{"id":"device-a"}`, http.StatusForbidden},
+		{http.MethodGet, "/v1/accounts/abc/devices", "", http.StatusForbidden},
+		{http.MethodGet, "/v1/accounts/abc", "", http.StatusForbidden},
+		{http.MethodPost, "/v1/accounts/abc/devices:batch", `[{"id":"laptop"}]`, http.StatusForbidden},
+		{http.MethodGet, "/v1/accounts/go/devices/laptop", "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			rec := doRequest(s, tc.method, tc.path, deviceKey, tc.body)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+			if tc.expectCode == http.StatusForbidden {
+				p := requireProblem(t, rec, http.StatusForbidden)
+				require.Equal(t, "device credentials may only access their own device", p.Detail)
+			}
+		})
+	}
+
+	// Revoking the credential takes effect immediately.
+	rec = doRequest(s, http.MethodDelete, "/admin/v1/accounts/abc/credentials/"+enrollment.Credential.ID, testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc/devices/laptop", deviceKey, "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = doRequest(s, http.MethodDelete, "/admin/v1/accounts/abc/credentials/"+enrollment.Credential.ID, testAdminToken, "")
+	requireProblem(t, rec, http.StatusNotFound)
+}
+
+func TestEnrollmentTokenRequest(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	cases := []struct {
+		name       string
+		account    string
+		body       string
+		expectCode int
+	}{
+		{"defaults", "abc", `{}`, http.StatusCreated},
+		{"ttl", "abc", `{"ttl_seconds":60,"max_uses":10}`, http.StatusCreated},
+		{"ttl-too-long", "abc", `{"ttl_seconds":604801}`, http.StatusBadRequest},
+		{"negative-ttl", "abc", `{"ttl_seconds":-1}`, http.StatusBadRequest},
+		{"negative-uses", "abc", `{"max_uses":-1}`, http.StatusBadRequest},
+		{"invalid-body", "abc", `[]`, http.StatusBadRequest},
+		{"unknown-account", "missing", `{}`, http.StatusNotFound},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doRequest(s, http.MethodPost, "/admin/v1/accounts/"+tc.account+"/enrollment-tokens", testAdminToken, tc.body)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+		})
+	}
+
+	rec := doRequest(s, http.MethodGet, "/admin/v1/accounts/abc/credentials", testAdminToken, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	credentials := []model.Credential{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &credentials))
+	require.Len(t, credentials, 2)
+	for _, c := range credentials {
+		require.Empty(t, c.Hash)
+	}
+
+	rec = doRequest(s, http.MethodPost, "/admin/v1/accounts/abc/enrollment-tokens", "wrong", `{}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestEnrollInactiveAccount(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	token := createEnrollmentToken(t, s, "go", `{}`)
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/go/enroll", token.Token, `{"id":"laptop"}`)
+	requireProblem(t, rec, http.StatusPaymentRequired)
+
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/enroll", token.Token, `{"id":"laptop"}`)
+	requireProblem(t, rec, http.StatusUnauthorized)
+}
+
+func TestEnrollExistingDevice(t *testing.T) {
+	st := store.NewTestingMemory()
+	s := newAdminServer(t, st)
+	token := createEnrollmentToken(t, s, "abc", `{"max_uses":2}`)
+
+	existing, err := st.Device("abc", "device-a")
+	require.NoError(t, err)
+
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/enroll", token.Token, `{"id":"device-a","hostname":"other"}`)
+	requireProblem(t, rec, http.StatusConflict)
+
+	device, err := st.Device("abc", "device-a")
+	require.NoError(t, err)
+	require.Equal(t, existing, device, "expected the existing device to be unchanged")
+}
+
+func TestEnrollmentAudit(t *testing.T) {
+	sink := audit.NewMemorySink(0)
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithAdminToken(testAdminToken), WithAuditSink(sink))
+	require.NoError(t, err)
+
+	token := createEnrollmentToken(t, s, "abc", `{}`)
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/enroll", token.Token, `{"id":"laptop"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	enrollment := model.Enrollment{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &enrollment))
+
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc/devices/device-a", enrollment.Credential.Token, "")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	entries, err := sink.Query(audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, audit.Actor{Type: audit.ActorDevice, ID: "abc/laptop"}, entries[0].Actor)
+	require.Equal(t, audit.ResultFailure, entries[0].Result)
+	require.Equal(t, "device.enroll", entries[1].Action)
+	require.Equal(t, audit.Actor{Type: audit.ActorEnrollment, ID: "abc/" + token.ID}, entries[1].Actor)
+	require.Equal(t, "account:abc/device:laptop", entries[1].Target)
+	require.Equal(t, "enrollment_token.create", entries[2].Action)
+}
+
+// createEnrollmentToken creates an enrollment token with the admin api.
+func createEnrollmentToken(t *testing.T, s *Server, accountID, body string) model.IssuedCredential {
+	t.Helper()
+	rec := doRequest(s, http.MethodPost, "/admin/v1/accounts/"+accountID+"/enrollment-tokens", testAdminToken, body)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	token := model.IssuedCredential{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &token))
+	return token
+}
@@ -0,0 +1,486 @@
+package server
+
+import (
+	"container/list"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+)
+
+const (
+	// DefaultDeviceCodeLifetime is how long a device code may be
+	// approved and polled for.
+	DefaultDeviceCodeLifetime = time.Minute * 10
+
+	// DefaultDeviceCodeInterval is the minimum time between token
+	// requests for a device code.
+	DefaultDeviceCodeInterval = time.Second * 5
+
+	// deviceCodeGrantType is the RFC 8628 token request grant type.
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// userCodeAlphabet excludes vowels, so that user codes do not
+	// spell words, and characters which are easily confused.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+
+	// maxDeviceAuthorizations is the maximum number of unexpired
+	// device authorizations.
+	maxDeviceAuthorizations = 10000
+
+	// maxDeviceAuthorizationsPerIP is the maximum number of
+	// unexpired device authorizations requested by a source IP,
+	// or IPv6 /64.
+	maxDeviceAuthorizationsPerIP = 20
+
+	// slowDownIncrease is added to a device code's interval each
+	// time the device polls too quickly.
+	slowDownIncrease = time.Second * 5
+)
+
+// RFC 6749 and RFC 8628 token endpoint error codes.
+const (
+	oauthInvalidRequest         = "invalid_request"
+	oauthInvalidGrant           = "invalid_grant"
+	oauthUnsupportedGrantType   = "unsupported_grant_type"
+	oauthAuthorizationPending   = "authorization_pending"
+	oauthSlowDown               = "slow_down"
+	oauthAccessDenied           = "access_denied"
+	oauthExpiredToken           = "expired_token"
+	oauthServerError            = "server_error"
+	oauthTemporarilyUnavailable = "temporarily_unavailable"
+)
+
+// WithDeviceAuthorization enables the RFC 8628 device authorization
+// grant. Users approve devices at verificationURI, which is expected
+// to call the device authorization endpoints with the account's key.
+func WithDeviceAuthorization(verificationURI string) Option {
+	return func(s *Server) error {
+		u, err := url.Parse(verificationURI)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid verification uri '%s': must be an absolute http or https url", verificationURI)
+		}
+		s.deviceAuth = newDeviceAuthorizations(verificationURI)
+		return nil
+	}
+}
+
+// deviceAuthorization is a device code and its user code.
+type deviceAuthorization struct {
+	model.DeviceAuthorization
+
+	// deviceCode is the hash of the device code
+	deviceCode string
+
+	interval time.Duration
+	lastPoll time.Time
+
+	// accountID is the account which approved the device
+	accountID string
+
+	// approving is set while the device is being registered
+	approving bool
+
+	// sourceIP is the lockout key of the requesting IP
+	sourceIP string
+
+	// element is the authorization's position in the expiry list
+	element *list.Element
+}
+
+// deviceAuthorizations stores device authorizations by the hash of
+// their device code and by their user code.
+type deviceAuthorizations struct {
+	verificationURI string
+	lifetime        time.Duration
+	interval        time.Duration
+	now             func() time.Time
+
+	mu           sync.Mutex
+	byDeviceCode map[string]*deviceAuthorization
+	byUserCode   map[string]*deviceAuthorization
+
+	// byIP is the number of authorizations of each source IP
+	byIP map[string]int
+
+	// expiry orders authorizations by when they were issued,
+	// which is the order they expire as they share a lifetime
+	expiry *list.List
+}
+
+func newDeviceAuthorizations(verificationURI string) *deviceAuthorizations {
+	return &deviceAuthorizations{
+		verificationURI: verificationURI,
+		lifetime:        DefaultDeviceCodeLifetime,
+		interval:        DefaultDeviceCodeInterval,
+		now:             time.Now,
+		byDeviceCode:    make(map[string]*deviceAuthorization),
+		byUserCode:      make(map[string]*deviceAuthorization),
+		byIP:            make(map[string]int),
+		expiry:          list.New(),
+	}
+}
+
+// prune removes expired authorizations. Callers must hold the lock.
+func (d *deviceAuthorizations) prune(now time.Time) {
+	for el := d.expiry.Front(); el != nil; el = d.expiry.Front() {
+		a := el.Value.(*deviceAuthorization)
+		if now.Before(a.ExpiresAt) {
+			return
+		}
+		d.remove(a)
+	}
+}
+
+// add stores an authorization. Callers must hold the lock.
+func (d *deviceAuthorizations) add(a *deviceAuthorization) {
+	d.byDeviceCode[a.deviceCode] = a
+	d.byUserCode[normalizeUserCode(a.UserCode)] = a
+	d.byIP[a.sourceIP]++
+	a.element = d.expiry.PushBack(a)
+}
+
+// remove deletes an authorization. Callers must hold the lock.
+func (d *deviceAuthorizations) remove(a *deviceAuthorization) {
+	if _, ok := d.byDeviceCode[a.deviceCode]; !ok {
+		return
+	}
+	delete(d.byDeviceCode, a.deviceCode)
+	delete(d.byUserCode, normalizeUserCode(a.UserCode))
+	d.expiry.Remove(a.element)
+	if d.byIP[a.sourceIP]--; d.byIP[a.sourceIP] <= 0 {
+		delete(d.byIP, a.sourceIP)
+	}
+}
+
+// lookup returns the unexpired authorization for a user code. Callers
+// must hold the lock.
+func (d *deviceAuthorizations) lookup(userCode string) (*deviceAuthorization, bool) {
+	a, ok := d.byUserCode[normalizeUserCode(userCode)]
+	if !ok || !d.now().Before(a.ExpiresAt) {
+		return nil, false
+	}
+	return a, true
+}
+
+// deviceCodeHandler issues a device code and user code for the device
+// described by the form parameters 'device_id' and 'hostname'. Each
+// source IP may have maxDeviceAuthorizationsPerIP unexpired
+// authorizations, so that one client can not exhaust the pool.
+func (s *Server) deviceCodeHandler(c *gin.Context) {
+	clientID := c.PostForm("client_id")
+	deviceID := c.PostForm("device_id")
+	if clientID == "" || deviceID == "" {
+		oauthError(c, http.StatusBadRequest, oauthInvalidRequest, "client_id and device_id are required")
+		return
+	}
+
+	deviceCode, err := randomHex(32)
+	if err != nil {
+		s.logger.Sugar().Errorf("failed to generate device code: %v", err)
+		oauthError(c, http.StatusInternalServerError, oauthServerError, "")
+		return
+	}
+
+	d := s.deviceAuth
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	d.prune(now)
+	sourceIP := lockoutIP(c.ClientIP())
+	if d.byIP[sourceIP] >= maxDeviceAuthorizationsPerIP {
+		oauthError(c, http.StatusTooManyRequests, oauthTemporarilyUnavailable, "too many pending device authorizations from this address")
+		return
+	}
+	if len(d.byDeviceCode) >= maxDeviceAuthorizations {
+		oauthError(c, http.StatusServiceUnavailable, oauthTemporarilyUnavailable, "too many pending device authorizations")
+		return
+	}
+
+	userCode, err := d.newUserCode()
+	if err != nil {
+		s.logger.Sugar().Errorf("failed to generate user code: %v", err)
+		oauthError(c, http.StatusInternalServerError, oauthServerError, "")
+		return
+	}
+
+	a := &deviceAuthorization{
+		DeviceAuthorization: model.DeviceAuthorization{
+			UserCode:  userCode,
+			ClientID:  clientID,
+			Device:    model.Device{ID: deviceID, Hostname: c.PostForm("hostname")},
+			Status:    model.DeviceAuthorizationPending,
+			ExpiresAt: now.Add(d.lifetime).UTC(),
+		},
+		deviceCode: hashSecret(deviceCode),
+		interval:   d.interval,
+		sourceIP:   sourceIP,
+	}
+	d.add(a)
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, model.DeviceCode{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         d.verificationURI,
+		VerificationURIComplete: d.verificationURI + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               int64(d.lifetime / time.Second),
+		Interval:                int64(d.interval / time.Second),
+	})
+}
+
+// tokenHandler exchanges an approved device code for a device
+// credential. Devices poll it until the user approves or denies the
+// device, or the device code expires.
+func (s *Server) tokenHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	if c.PostForm("grant_type") != deviceCodeGrantType {
+		oauthError(c, http.StatusBadRequest, oauthUnsupportedGrantType, "")
+		return
+	}
+
+	deviceCode := c.PostForm("device_code")
+	if deviceCode == "" {
+		oauthError(c, http.StatusBadRequest, oauthInvalidRequest, "device_code is required")
+		return
+	}
+
+	d := s.deviceAuth
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a, ok := d.byDeviceCode[hashSecret(deviceCode)]
+	if !ok || a.ClientID != c.PostForm("client_id") {
+		oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "")
+		return
+	}
+
+	now := d.now()
+	if !now.Before(a.ExpiresAt) {
+		d.remove(a)
+		oauthError(c, http.StatusBadRequest, oauthExpiredToken, "")
+		return
+	}
+
+	switch a.Status {
+	case model.DeviceAuthorizationDenied:
+		d.remove(a)
+		oauthError(c, http.StatusBadRequest, oauthAccessDenied, "")
+		return
+	case model.DeviceAuthorizationPending:
+		if !a.lastPoll.IsZero() && now.Sub(a.lastPoll) < a.interval {
+			a.interval += slowDownIncrease
+			a.lastPoll = now
+			oauthError(c, http.StatusBadRequest, oauthSlowDown, "")
+			return
+		}
+		a.lastPoll = now
+		oauthError(c, http.StatusBadRequest, oauthAuthorizationPending, "")
+		return
+	}
+
+	credential, token, err := newCredential(a.accountID, model.CredentialDevice, now)
+	if err != nil {
+		s.logger.Sugar().Errorf("failed to create device credential: %v", err)
+		oauthError(c, http.StatusInternalServerError, oauthServerError, "")
+		return
+	}
+	credential.DeviceID = a.Device.ID
+
+	if err := s.store.CreateCredential(credential); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			// The device was deleted after it was approved.
+			d.remove(a)
+			oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "")
+			return
+		}
+		s.logger.Sugar().Errorf("failed to create device credential: %v", err)
+		oauthError(c, http.StatusInternalServerError, oauthServerError, "")
+		return
+	}
+	d.remove(a)
+
+	c.JSON(http.StatusOK, model.DeviceToken{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		AccountID:   a.accountID,
+		DeviceID:    a.Device.ID,
+	})
+}
+
+// deviceAuthorizationHandler returns the device waiting for approval
+// with the user code in the path, so that the user can confirm it.
+func (s *Server) deviceAuthorizationHandler(c *gin.Context) {
+	d := s.deviceAuth
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a, ok := d.lookup(c.Param("user_code"))
+	if !ok {
+		abortWithProblem(c, http.StatusNotFound, "device authorization does not exist or has expired")
+		return
+	}
+	c.JSON(http.StatusOK, a.DeviceAuthorization)
+}
+
+// approveDeviceHandler registers the device waiting for approval with
+// the user code in the path to the authenticated account. The device
+// receives its credential from the token endpoint.
+func (s *Server) approveDeviceHandler(c *gin.Context) {
+	account := contextAccount(c)
+
+	a, ok := s.startApproval(c)
+	if !ok {
+		return
+	}
+
+	// The device is not changed by other requests while it is
+	// being approved.
+	registration, ok := s.registerApprovedDevice(c, account, a.Device)
+
+	d := s.deviceAuth
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a.approving = false
+	if !ok {
+		return
+	}
+
+	a.Status = model.DeviceAuthorizationApproved
+	a.accountID = account.ID
+	a.Device = registration.Device
+
+	c.Set(contextKeyAuditTarget, "device:"+registration.ID)
+	c.JSON(http.StatusOK, registration)
+}
+
+// startApproval marks the authorization with the user code in the
+// path as being approved, so that the device can be registered
+// without holding the lock. Returns false if the request was aborted.
+func (s *Server) startApproval(c *gin.Context) (*deviceAuthorization, bool) {
+	d := s.deviceAuth
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a, ok := s.pendingAuthorization(c)
+	if !ok {
+		return nil, false
+	}
+	a.approving = true
+	return a, true
+}
+
+// registerApprovedDevice registers an approved device to the account.
+// Returns false if the request was aborted.
+func (s *Server) registerApprovedDevice(c *gin.Context, account model.Account, device model.Device) (model.DeviceRegistration, bool) {
+	// Approving an existing device id would give the new device
+	// the existing device's identity.
+	_, err := s.store.Device(account.ID, device.ID)
+	switch {
+	case err == nil:
+		abortWithProblem(c, http.StatusConflict, fmt.Sprintf("device with id %s already exists", device.ID))
+		return model.DeviceRegistration{}, false
+	case !errors.Is(err, store.ErrNotFound):
+		s.storeError(c, err, "failed to lookup device")
+		return model.DeviceRegistration{}, false
+	}
+
+	registration, err := s.store.RegisterDevice(account.ID, account.Key, device)
+	if err != nil {
+		s.storeError(c, err, "failed to register device")
+		return model.DeviceRegistration{}, false
+	}
+	return registration, true
+}
+
+// pendingAuthorization returns the authorization with the user code
+// in the path if it is pending and not being approved. Returns false
+// if the request was aborted. Callers must hold the lock.
+func (s *Server) pendingAuthorization(c *gin.Context) (*deviceAuthorization, bool) {
+	a, ok := s.deviceAuth.lookup(c.Param("user_code"))
+	if !ok {
+		abortWithProblem(c, http.StatusNotFound, "device authorization does not exist or has expired")
+		return nil, false
+	}
+
+	c.Set(contextKeyAuditTarget, "device:"+a.Device.ID)
+
+	switch {
+	case a.approving:
+		abortWithProblem(c, http.StatusConflict, "device authorization is being approved")
+		return nil, false
+	case a.Status != model.DeviceAuthorizationPending:
+		abortWithProblem(c, http.StatusConflict, fmt.Sprintf("device authorization is %s", a.Status))
+		return nil, false
+	}
+	return a, true
+}
+
+// denyDeviceHandler denies the device waiting for approval with the
+// user code in the path.
+func (s *Server) denyDeviceHandler(c *gin.Context) {
+	d := s.deviceAuth
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a, ok := s.pendingAuthorization(c)
+	if !ok {
+		return
+	}
+
+	a.Status = model.DeviceAuthorizationDenied
+	c.Status(http.StatusNoContent)
+}
+
+// newUserCode returns a random user code, 'XXXX-XXXX', which is not
+// in use. Callers must hold the lock.
+func (d *deviceAuthorizations) newUserCode() (string, error) {
+	alphabetSize := big.NewInt(int64(len(userCodeAlphabet)))
+	for {
+		b := make([]byte, userCodeLength)
+		for i := range b {
+			n, err := rand.Int(rand.Reader, alphabetSize)
+			if err != nil {
+				return "", fmt.Errorf("failed to generate user code: %w", err)
+			}
+			b[i] = userCodeAlphabet[n.Int64()]
+		}
+
+		code := string(b[:userCodeLength/2]) + "-" + string(b[userCodeLength/2:])
+		if _, ok := d.byUserCode[normalizeUserCode(code)]; !ok {
+			return code, nil
+		}
+	}
+}
+
+// normalizeUserCode returns a user code in upper case without
+// separators, so that users may enter it in either case.
+func normalizeUserCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// oauthError writes an RFC 6749 error response.
+func oauthError(c *gin.Context, status int, code, description string) {
+	c.AbortWithStatusJSON(status, model.OAuthError{Error: code, ErrorDescription: description})
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %w", err)
+	}
+	return fmt.Sprintf("%x", b), nil
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+const testVerificationURI = "https://example.com/device"
+
+func TestDeviceAuthorization(t *testing.T) {
+	s, now := newDeviceAuthServer(t)
+
+	code := requestDeviceCode(t, s, "cli", "laptop")
+	require.Equal(t, testVerificationURI, code.VerificationURI)
+	require.Equal(t, testVerificationURI+"?user_code="+code.UserCode, code.VerificationURIComplete)
+	require.Equal(t, int64(600), code.ExpiresIn)
+	require.Equal(t, int64(5), code.Interval)
+	require.Regexp(t, `^[B-Z]{4}-[B-Z]{4}$`, code.UserCode)
+
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthAuthorizationPending)
+
+	// Polling faster than the interval increases it.
+	*now = now.Add(time.Second)
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthSlowDown)
+	*now = now.Add(time.Second * 6)
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthSlowDown)
+	*now = now.Add(time.Second * 15)
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthAuthorizationPending)
+
+	// User codes are accepted in lower case and without the separator.
+	userCode := strings.ToLower(strings.ReplaceAll(code.UserCode, "-", ""))
+	rec := doRequest(s, http.MethodGet, "/v1/accounts/abc/device-authorizations/"+userCode, "xyz", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	authorization := model.DeviceAuthorization{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &authorization))
+	require.Equal(t, model.DeviceAuthorizationPending, authorization.Status)
+	require.Equal(t, model.Device{ID: "laptop", Hostname: "laptop-1"}, authorization.Device)
+
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/device-authorizations/"+code.UserCode+"/approve", "xyz", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	registration := model.DeviceRegistration{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &registration))
+	require.Equal(t, model.Device{AccountID: "abc", ID: "laptop", Hostname: "laptop-1"}, registration.Device)
+
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/device-authorizations/"+code.UserCode+"/deny", "xyz", "")
+	requireProblem(t, rec, http.StatusConflict)
+
+	// The token must be requested by the same client.
+	*now = now.Add(time.Minute)
+	requireOAuthError(t, pollToken(s, "other", code.DeviceCode), oauthInvalidGrant)
+
+	rec = pollToken(s, "cli", code.DeviceCode)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	token := model.DeviceToken{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &token))
+	require.Equal(t, "Bearer", token.TokenType)
+	require.Equal(t, "abc", token.AccountID)
+	require.Equal(t, "laptop", token.DeviceID)
+
+	// The access token is a device credential.
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc/devices/laptop", token.AccessToken, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc/devices/device-a", token.AccessToken, "")
+	requireProblem(t, rec, http.StatusForbidden)
+
+	// Device codes are exchanged once.
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthInvalidGrant)
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc/device-authorizations/"+code.UserCode, "xyz", "")
+	requireProblem(t, rec, http.StatusNotFound)
+}
+
+func TestDeviceAuthorizationDenied(t *testing.T) {
+	s, _ := newDeviceAuthServer(t)
+
+	code := requestDeviceCode(t, s, "cli", "laptop")
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/device-authorizations/"+code.UserCode+"/deny", "xyz", "")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/device-authorizations/"+code.UserCode+"/approve", "xyz", "")
+	requireProblem(t, rec, http.StatusConflict)
+
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthAccessDenied)
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthInvalidGrant)
+
+	_, err := s.store.Device("abc", "laptop")
+	require.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestDeviceAuthorizationExpired(t *testing.T) {
+	s, now := newDeviceAuthServer(t)
+
+	code := requestDeviceCode(t, s, "cli", "laptop")
+	*now = now.Add(DefaultDeviceCodeLifetime)
+
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/device-authorizations/"+code.UserCode+"/approve", "xyz", "")
+	requireProblem(t, rec, http.StatusNotFound)
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthExpiredToken)
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthInvalidGrant)
+}
+
+func TestDeviceAuthorizationApproving(t *testing.T) {
+	s, _ := newDeviceAuthServer(t)
+
+	code := requestDeviceCode(t, s, "cli", "laptop")
+	a, ok := s.deviceAuth.lookup(code.UserCode)
+	require.True(t, ok)
+	a.approving = true
+
+	// The authorization can be viewed and polled, but not approved
+	// or denied, while another request registers the device.
+	rec := doRequest(s, http.MethodGet, "/v1/accounts/abc/device-authorizations/"+code.UserCode, "xyz", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthAuthorizationPending)
+	for _, action := range []string{"approve", "deny"} {
+		rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/device-authorizations/"+code.UserCode+"/"+action, "xyz", "")
+		requireProblem(t, rec, http.StatusConflict)
+	}
+
+	a.approving = false
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/device-authorizations/"+code.UserCode+"/approve", "xyz", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// A failed approval leaves the authorization pending.
+	code = requestDeviceCode(t, s, "cli", "device-a")
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/device-authorizations/"+code.UserCode+"/approve", "xyz", "")
+	requireProblem(t, rec, http.StatusConflict)
+	rec = doRequest(s, http.MethodPost, "/v1/accounts/abc/device-authorizations/"+code.UserCode+"/deny", "xyz", "")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+}
+
+func TestDeviceAuthorizationLimit(t *testing.T) {
+	s, now := newDeviceAuthServer(t)
+
+	for i := 0; i < maxDeviceAuthorizationsPerIP; i++ {
+		requestDeviceCode(t, s, "cli", "laptop")
+	}
+	rec := postForm(s, "/v1/oauth/device/code", url.Values{"client_id": {"cli"}, "device_id": {"laptop"}})
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	requireOAuthError(t, rec, oauthTemporarilyUnavailable)
+
+	// Other source IPs are not limited.
+	req := httptest.NewRequest(http.MethodPost, "/v1/oauth/device/code", strings.NewReader("client_id=cli&device_id=laptop"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "198.51.100.1:1234"
+	rec = serveFrom(s, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// Expired authorizations no longer count.
+	*now = now.Add(DefaultDeviceCodeLifetime)
+	requestDeviceCode(t, s, "cli", "laptop")
+	require.Len(t, s.deviceAuth.byDeviceCode, 1)
+	require.Equal(t, 1, s.deviceAuth.expiry.Len())
+	require.Equal(t, map[string]int{"192.0.2.1": 1}, s.deviceAuth.byIP)
+}
+
+func TestDeviceAuthorizationApprove(t *testing.T) {
+	cases := []struct {
+		name       string
+		account    string
+		key        string
+		device     string
+		expectCode int
+	}{
+		{"inactive", "go", "095", "laptop", http.StatusPaymentRequired},
+		{"invalid-key", "abc", "wrong", "laptop", http.StatusUnauthorized},
+		{"unknown-user-code", "abc", "xyz", "laptop", http.StatusNotFound},
+		{"existing-device", "abc", "xyz", "device-a", http.StatusConflict},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newDeviceAuthServer(t)
+			code := requestDeviceCode(t, s, "cli", tc.device)
+			userCode := code.UserCode
+			if tc.expectCode == http.StatusNotFound {
+				userCode = "BBBB-BBBB"
+			}
+
+			rec := doRequest(s, http.MethodPost, "/v1/accounts/"+tc.account+"/device-authorizations/"+userCode+"/approve", tc.key, "")
+			requireProblem(t, rec, tc.expectCode)
+			requireOAuthError(t, pollToken(s, "cli", code.DeviceCode), oauthAuthorizationPending)
+		})
+	}
+}
+
+func TestDeviceAuthorizationRequests(t *testing.T) {
+	s, _ := newDeviceAuthServer(t)
+
+	cases := []struct {
+		name       string
+		path       string
+		form       url.Values
+		expectCode int
+		expectErr  string
+	}{
+		{"missing-client-id", "/v1/oauth/device/code", url.Values{"device_id": {"laptop"}}, http.StatusBadRequest, oauthInvalidRequest},
+		{"missing-device-id", "/v1/oauth/device/code", url.Values{"client_id": {"cli"}}, http.StatusBadRequest, oauthInvalidRequest},
+		{"unsupported-grant", "/v1/oauth/token", url.Values{"grant_type": {"password"}}, http.StatusBadRequest, oauthUnsupportedGrantType},
+		{"missing-device-code", "/v1/oauth/token", url.Values{"grant_type": {deviceCodeGrantType}}, http.StatusBadRequest, oauthInvalidRequest},
+		{"unknown-device-code", "/v1/oauth/token", url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {"x"}}, http.StatusBadRequest, oauthInvalidGrant},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := postForm(s, tc.path, tc.form)
+			require.Equal(t, tc.expectCode, rec.Code)
+			requireOAuthError(t, rec, tc.expectErr)
+		})
+	}
+}
+
+func TestDeviceAuthorizationDisabled(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+	rec := postForm(s, "/v1/oauth/device/code", url.Values{"client_id": {"cli"}, "device_id": {"laptop"}})
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	_, err := New(testLogger(t), WithDeviceAuthorization("/device"))
+	require.Error(t, err)
+}
+
+// newDeviceAuthServer returns a server with the device authorization
+// grant enabled, and a pointer to the time used by the grant.
+func newDeviceAuthServer(t *testing.T) (*Server, *time.Time) {
+	t.Helper()
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithDeviceAuthorization(testVerificationURI))
+	require.NoError(t, err)
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.deviceAuth.now = func() time.Time { return now }
+	return s, &now
+}
+
+func requestDeviceCode(t *testing.T, s *Server, clientID, deviceID string) model.DeviceCode {
+	t.Helper()
+	rec := postForm(s, "/v1/oauth/device/code", url.Values{"client_id": {clientID}, "device_id": {deviceID}, "hostname": {deviceID + "-1"}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	code := model.DeviceCode{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &code))
+	return code
+}
+
+func pollToken(s *Server, clientID, deviceCode string) *httptest.ResponseRecorder {
+	return postForm(s, "/v1/oauth/token", url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"client_id":   {clientID},
+		"device_code": {deviceCode},
+	})
+}
+
+func postForm(s *Server, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, req)
+	return rec
+}
+
+func requireOAuthError(t *testing.T, rec *httptest.ResponseRecorder, code string) {
+	t.Helper()
+	e := model.OAuthError{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &e), rec.Body.String())
+	require.Equal(t, code, e.Error)
+}
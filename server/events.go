@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultEventHeartbeat is the default interval between
+	// heartbeats on an event stream. It is shorter than the
+	// stream lifetime of the default write timeout.
+	DefaultEventHeartbeat = time.Second * 10
+
+	// eventRetry is the reconnection delay, in milliseconds,
+	// sent to event stream clients.
+	eventRetry = 1000
+)
+
+// Event stream event types.
+const (
+	eventDeviceRegistered    = "device.registered"
+	eventDeviceUpdated       = "device.updated"
+	eventDeviceDeleted       = "device.deleted"
+	eventSubscriptionChanged = "subscription.changed"
+
+	// eventResync tells clients that events were missed and
+	// the account's devices must be reloaded.
+	eventResync = "resync"
+)
+
+// subscriptionEvent is the data of a subscription.changed event.
+type subscriptionEvent struct {
+	AccountID string                  `json:"account_id"`
+	Active    bool                    `json:"active"`
+	State     model.SubscriptionState `json:"state"`
+	Plan      string                  `json:"plan,omitempty"`
+	ExpiresAt *time.Time              `json:"expires_at,omitempty"`
+}
+
+func newSubscriptionEvent(account model.Account, now time.Time) subscriptionEvent {
+	sub := store.SubscriptionStatus(account, now)
+	return subscriptionEvent{
+		AccountID: account.ID,
+		Active:    sub.Active(),
+		State:     sub.State,
+		Plan:      sub.Plan,
+		ExpiresAt: sub.ExpiresAt,
+	}
+}
+
+// equal returns true if e and other describe the same subscription.
+func (e subscriptionEvent) equal(other subscriptionEvent) bool {
+	if e.State != other.State || e.Plan != other.Plan {
+		return false
+	}
+	if e.ExpiresAt == nil || other.ExpiresAt == nil {
+		return e.ExpiresAt == nil && other.ExpiresAt == nil
+	}
+	return e.ExpiresAt.Equal(*other.ExpiresAt)
+}
+
+// connContextKey is the request context key of the connection
+// which received the request.
+type connContextKey struct{}
+
+// withConn is the http.Server's ConnContext function.
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// resyncEvent is the data of a resync event.
+type resyncEvent struct {
+	AccountID string `json:"account_id"`
+}
+
+// eventsHandler streams the account's device and subscription
+// changes as server-sent events. Event ids are store revisions, so
+// clients resume with the Last-Event-ID header. The write timeout
+// applies to each write of an HTTP/1 stream, which extends its
+// connection's write deadline. Other streams are closed before the
+// write timeout. Streams are closed when the server stops.
+func (s *Server) eventsHandler(c *gin.Context) {
+	account := contextAccount(c)
+
+	var from uint64
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		revision, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, "invalid Last-Event-ID header")
+			return
+		}
+		from = revision
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	events, err := s.store.Watch(ctx, from)
+	if err != nil {
+		s.storeError(c, err, "failed to watch account")
+		return
+	}
+
+	current, err := s.store.Account(account.ID)
+	if err != nil {
+		s.storeError(c, err, "failed to retrieve account")
+		return
+	}
+
+	// The subscription the client last saw is unknown when
+	// resuming, so the first account update is always sent.
+	converter := &accountEvents{accountID: account.ID, account: &current}
+	if from == 0 {
+		sub := newSubscriptionEvent(current, time.Now())
+		converter.sub = &sub
+	}
+
+	conn, _ := c.Request.Context().Value(connContextKey{}).(net.Conn)
+	if c.Request.ProtoMajor != 1 {
+		conn = nil
+	}
+	writeTimeout := s.server.WriteTimeout
+	extend := func() {
+		if conn != nil && writeTimeout > 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	extend()
+	if _, err := fmt.Fprintf(c.Writer, "retry: %d\n\n", eventRetry); err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(s.eventHeartbeat)
+	defer heartbeat.Stop()
+
+	var deadline <-chan time.Time
+	if d := streamDuration(writeTimeout); d > 0 && conn == nil {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	// expiry fires when the subscription's expiry passes, which
+	// changes it without a store event.
+	var (
+		expiry  *time.Timer
+		expired <-chan time.Time
+	)
+	arm := func() {
+		if expiry != nil {
+			expiry.Stop()
+			expired = nil
+		}
+		if at, ok := converter.expiry(); ok {
+			if d := time.Until(at); d > 0 {
+				expiry = time.NewTimer(d)
+				expired = expiry.C
+			}
+		}
+	}
+	arm()
+	defer func() {
+		if expiry != nil {
+			expiry.Stop()
+		}
+	}()
+
+	for {
+		var (
+			event sse.Event
+			send  bool
+		)
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			event, send = converter.convert(e)
+			if e.Type == store.EventAccountUpdated && e.AccountID == account.ID {
+				arm()
+			}
+		case <-expired:
+			expiry, expired = nil, nil
+			event, send = converter.expire()
+		case <-heartbeat.C:
+			extend()
+			if _, err := io.WriteString(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-deadline:
+			return
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		if send {
+			extend()
+			if err := sse.Encode(c.Writer, event); err != nil {
+				s.logger.Debug("failed to write event", zap.Error(err))
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// accountEvents converts store events into events for
+// a single account.
+type accountEvents struct {
+	accountID string
+
+	// account is the latest known account
+	account *model.Account
+
+	// sub is the subscription last sent to the client, or nil
+	// when it is unknown.
+	sub *subscriptionEvent
+}
+
+// convert returns the event for e. Returns false when e
+// does not concern the account's clients.
+func (a *accountEvents) convert(e store.Event) (sse.Event, bool) {
+	event := sse.Event{Id: strconv.FormatUint(e.Revision, 10)}
+
+	if e.Type == store.EventResync {
+		a.sub = nil
+		event.Event = eventResync
+		event.Data = resyncEvent{AccountID: a.accountID}
+		return event, true
+	}
+
+	if e.AccountID != a.accountID {
+		return event, false
+	}
+
+	switch e.Type {
+	case store.EventDeviceRegistered:
+		event.Event = eventDeviceRegistered
+		event.Data = e.Device
+	case store.EventDeviceUpdated:
+		event.Event = eventDeviceUpdated
+		event.Data = e.Device
+	case store.EventDeviceDeleted:
+		event.Event = eventDeviceDeleted
+		event.Data = e.Device
+	case store.EventAccountUpdated:
+		account := *e.Account
+		a.account = &account
+		return a.subscriptionChanged(event, time.Now())
+	default:
+		return event, false
+	}
+
+	return event, true
+}
+
+// subscriptionChanged returns a subscription.changed event if the
+// latest account's subscription at now differs from the last one sent.
+func (a *accountEvents) subscriptionChanged(event sse.Event, now time.Time) (sse.Event, bool) {
+	sub := newSubscriptionEvent(*a.account, now)
+	if a.sub != nil && a.sub.equal(sub) {
+		return event, false
+	}
+	a.sub = &sub
+	event.Event = eventSubscriptionChanged
+	event.Data = sub
+	return event, true
+}
+
+// expiry returns when the latest account's active subscription
+// expires, or false if it does not.
+func (a *accountEvents) expiry() (time.Time, bool) {
+	if a.account == nil || !a.account.Active || a.account.ExpiresAt == nil {
+		return time.Time{}, false
+	}
+	return *a.account.ExpiresAt, true
+}
+
+// expire returns the subscription.changed event for the
+// subscription's expiry. The event has no id, because no store
+// revision changed, so clients keep resuming from their last id.
+func (a *accountEvents) expire() (sse.Event, bool) {
+	if a.account == nil {
+		return sse.Event{}, false
+	}
+	return a.subscriptionChanged(sse.Event{}, time.Now())
+}
+
+// streamDuration returns how long an event stream may stay open
+// before the write timeout ends it, leaving time for the final
+// write. Zero means no limit.
+func streamDuration(writeTimeout time.Duration) time.Duration {
+	if writeTimeout <= 0 {
+		return 0
+	}
+	return writeTimeout * 9 / 10
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	st := store.NewTestingMemory()
+	s, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+
+	events := openEvents(t, s, "abc", "xyz", "")
+
+	_, err = st.RegisterDevice("abc", "xyz", model.Device{ID: "device-c", Hostname: "c"})
+	require.NoError(t, err)
+	_, err = st.RegisterDevice("abc", "xyz", model.Device{ID: "device-c", Hostname: "renamed"})
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteDevice("abc", "device-c"))
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "go", Key: "095", Active: true}))
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "abc", Key: "rotated", Active: true}))
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "abc", Key: "rotated", Active: false}))
+	_, err = st.Import(strings.NewReader("{\"kind\":\"header\",\"version\":1}\n"), store.ImportMerge)
+	require.NoError(t, err)
+
+	expect := []sseEvent{
+		{"1", "device.registered", `{"account_id":"abc","id":"device-c","hostname":"c"}`},
+		{"2", "device.updated", `{"account_id":"abc","id":"device-c","hostname":"renamed"}`},
+		{"3", "device.deleted", `{"account_id":"abc","id":"device-c","hostname":""}`},
+		{"6", "subscription.changed", `{"account_id":"abc","active":false,"state":"inactive"}`},
+		{"7", "resync", `{"account_id":"abc"}`},
+	}
+	for _, e := range expect {
+		require.Equal(t, e, events.next(t))
+	}
+
+	// Resume after the device was registered. The subscription
+	// state is unknown, so the first account update is sent.
+	events = openEvents(t, s, "abc", "rotated", "1")
+	expect = []sseEvent{
+		{"2", "device.updated", `{"account_id":"abc","id":"device-c","hostname":"renamed"}`},
+		{"3", "device.deleted", `{"account_id":"abc","id":"device-c","hostname":""}`},
+		{"5", "subscription.changed", `{"account_id":"abc","active":true,"state":"active"}`},
+		{"6", "subscription.changed", `{"account_id":"abc","active":false,"state":"inactive"}`},
+		{"7", "resync", `{"account_id":"abc"}`},
+	}
+	for _, e := range expect {
+		require.Equal(t, e, events.next(t))
+	}
+}
+
+func TestEventsSubscriptionChanged(t *testing.T) {
+	st := store.NewTestingMemory()
+	s, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+
+	expires := time.Now().Add(time.Millisecond * 200).UTC().Truncate(time.Millisecond)
+	expiresJSON := expires.Format(time.RFC3339Nano)
+	events := openEvents(t, s, "abc", "xyz", "")
+
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, Plan: "pro"}))
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, Plan: "pro", ExpiresAt: &expires}))
+
+	expect := []sseEvent{
+		{"1", "subscription.changed", `{"account_id":"abc","active":true,"state":"active","plan":"pro"}`},
+		{"2", "subscription.changed", `{"account_id":"abc","active":true,"state":"active","plan":"pro","expires_at":"` + expiresJSON + `"}`},
+		{"", "subscription.changed", `{"account_id":"abc","active":false,"state":"expired","plan":"pro","expires_at":"` + expiresJSON + `"}`},
+	}
+	for _, e := range expect {
+		require.Equal(t, e, events.next(t))
+	}
+}
+
+func TestEventsErrors(t *testing.T) {
+	s, err := New(testLogger(t), WithMemoryStore(true))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/accounts/abc/events", nil)
+	req.Header.Set("Authorization", "Bearer xyz")
+	req.Header.Set("Last-Event-ID", "latest")
+	rec := httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	requireProblem(t, rec, http.StatusBadRequest)
+
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc/events", "invalid", "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestEventsHeartbeat(t *testing.T) {
+	s, err := New(testLogger(t), WithMemoryStore(true), WithEventHeartbeat(time.Millisecond*10))
+	require.NoError(t, err)
+
+	events := openEvents(t, s, "abc", "xyz", "")
+	line, err := events.r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, ": heartbeat\n", line)
+}
+
+func TestEventsStop(t *testing.T) {
+	s, err := New(testLogger(t), WithMemoryStore(true))
+	require.NoError(t, err)
+
+	events := openEvents(t, s, "abc", "xyz", "")
+	require.NoError(t, s.Stop(time.Second))
+	require.NoError(t, s.Stop(time.Second), "expected stop to be repeatable")
+
+	_, err = io.ReadAll(events.r)
+	require.NoError(t, err, "expected the stream to end")
+}
+
+func TestEventsWriteTimeout(t *testing.T) {
+	s, err := New(testLogger(t), WithMemoryStore(true), WithWriteTimeout(time.Millisecond*100), WithEventHeartbeat(time.Millisecond*20))
+	require.NoError(t, err)
+
+	// HTTP/1 streams extend the write deadline with each write.
+	start := time.Now()
+	events := openEvents(t, s, "abc", "xyz", "")
+	for time.Since(start) < time.Millisecond*300 {
+		line, err := events.r.ReadString('\n')
+		require.NoError(t, err, "expected the stream to outlive the write timeout")
+		require.True(t, line == ": heartbeat\n" || line == "\n", "unexpected line %q", line)
+	}
+
+	// Streams which cannot extend the write deadline end
+	// before the write timeout.
+	ts := httptest.NewServer(s.Router)
+	t.Cleanup(ts.Close)
+	start = time.Now()
+	events = openEventsFrom(t, ts, "abc", "xyz", "")
+	_, err = io.ReadAll(events.r)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), time.Millisecond*300, "expected the stream to end")
+}
+
+func TestStreamDuration(t *testing.T) {
+	require.Equal(t, time.Duration(0), streamDuration(0))
+	require.Equal(t, time.Second*9, streamDuration(time.Second*10))
+}
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+type eventStream struct {
+	r *bufio.Reader
+}
+
+// openEvents opens an event stream from an HTTP/1 server configured
+// like s, and reads the retry preamble, after which the stream is
+// watching the store.
+func openEvents(t *testing.T, s *Server, accountID, key, lastEventID string) *eventStream {
+	t.Helper()
+
+	ts := httptest.NewUnstartedServer(s.Router)
+	ts.Config.ConnContext = s.server.ConnContext
+	ts.Config.WriteTimeout = s.server.WriteTimeout
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return openEventsFrom(t, ts, accountID, key, lastEventID)
+}
+
+// openEventsFrom opens an event stream from ts.
+func openEventsFrom(t *testing.T, ts *httptest.Server, accountID, key, lastEventID string) *eventStream {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/accounts/"+accountID+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+key)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := &eventStream{r: bufio.NewReader(resp.Body)}
+	line, err := events.r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "retry: 1000\n", line)
+	_, err = events.r.ReadString('\n')
+	require.NoError(t, err)
+	return events
+}
+
+// next returns the next event, skipping comments.
+func (e *eventStream) next(t *testing.T) sseEvent {
+	t.Helper()
+
+	event := sseEvent{}
+	for {
+		line, err := e.r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "":
+			if event.event != "" {
+				return event
+			}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "id:"):
+			event.id = strings.TrimPrefix(line, "id:")
+		case strings.HasPrefix(line, "event:"):
+			event.event = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:"):
+			event.data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+}
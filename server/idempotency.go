@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// headerIdempotencyKey is the request header which makes a
+	// mutating request safe to retry.
+	headerIdempotencyKey = "Idempotency-Key"
+
+	// headerIdempotentReplayed is set on responses which were
+	// replayed for a duplicate request.
+	headerIdempotentReplayed = "Idempotent-Replayed"
+
+	// maxIdempotencyKeyLength is the maximum length of an
+	// idempotency key.
+	maxIdempotencyKeyLength = 255
+
+	// DefaultIdempotencyWindow is the default duration responses
+	// are kept for replay.
+	DefaultIdempotencyWindow = time.Hour * 24
+
+	// maxIdempotencyEntries and maxIdempotencyBytes limit the
+	// number of kept responses and the total size of their bodies.
+	// The oldest responses are evicted first. Requests in progress
+	// are not evicted.
+	maxIdempotencyEntries = 100000
+	maxIdempotencyBytes   = 64 << 20
+)
+
+// WithIdempotencyWindow configures how long the response to a
+// request with an idempotency key is kept for replay.
+func WithIdempotencyWindow(window time.Duration) Option {
+	return func(s *Server) error {
+		if window <= 0 {
+			return fmt.Errorf("idempotency window must be greater than zero: %s", window)
+		}
+		s.idempotency.window = window
+		return nil
+	}
+}
+
+// idempotencyEntry is the first response to an idempotency key.
+type idempotencyEntry struct {
+	key string
+
+	// fingerprint identifies the request which used the key
+	fingerprint [sha256.Size]byte
+
+	// done is false while the first request is in progress
+	done bool
+
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyCache stores responses by account and idempotency key.
+type idempotencyCache struct {
+	window     time.Duration
+	now        func() time.Time
+	maxEntries int
+	maxBytes   int
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+
+	// order is the entries by expiry, oldest first. Released
+	// entries remain until they reach the front.
+	order []*idempotencyEntry
+
+	// size is the total size of the stored bodies
+	size int
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		window:     DefaultIdempotencyWindow,
+		now:        time.Now,
+		maxEntries: maxIdempotencyEntries,
+		maxBytes:   maxIdempotencyBytes,
+		entries:    make(map[string]*idempotencyEntry),
+	}
+}
+
+// begin returns the entry for key. If the key is not in use, an
+// in progress entry is stored and begin returns nil. Returns false if
+// the cache is full of requests in progress.
+func (i *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte) (*idempotencyEntry, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := i.now()
+	i.prune(now)
+
+	if e, ok := i.entries[key]; ok {
+		copied := *e
+		return &copied, true
+	}
+
+	for len(i.entries) >= i.maxEntries {
+		if !i.evictDone() {
+			return nil, false
+		}
+	}
+
+	e := &idempotencyEntry{key: key, fingerprint: fingerprint, expires: now.Add(i.window)}
+	i.entries[key] = e
+	i.order = append(i.order, e)
+	return nil, true
+}
+
+// finish stores the response to an in progress key.
+func (i *idempotencyCache) finish(key string, status int, contentType string, body []byte) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if e, ok := i.entries[key]; ok {
+		e.done = true
+		e.status = status
+		e.contentType = contentType
+		e.body = body
+		i.size += len(body)
+	}
+
+	for i.size > i.maxBytes {
+		if !i.evictDone() {
+			break
+		}
+	}
+}
+
+// release removes an in progress key so that the request
+// can be retried.
+func (i *idempotencyCache) release(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if e, ok := i.entries[key]; ok {
+		i.size -= len(e.body)
+		delete(i.entries, key)
+	}
+}
+
+// prune removes expired entries. Callers must hold the lock.
+func (i *idempotencyCache) prune(now time.Time) {
+	for len(i.order) > 0 && !i.order[0].expires.After(now) {
+		i.evict()
+	}
+}
+
+// evictDone removes the oldest entry which is not in progress.
+// Returns false if every entry is in progress. Callers must hold the
+// lock.
+func (i *idempotencyCache) evictDone() bool {
+	for len(i.order) > 0 && i.entries[i.order[0].key] != i.order[0] {
+		i.evict()
+	}
+
+	// Entries in progress are few, as each is a request being
+	// handled, so they are skipped rather than indexed.
+	for _, e := range i.order {
+		if i.entries[e.key] == e && e.done {
+			i.size -= len(e.body)
+			delete(i.entries, e.key)
+			return true
+		}
+	}
+	return false
+}
+
+// evict removes the oldest entry. Callers must hold the lock.
+func (i *idempotencyCache) evict() {
+	e := i.order[0]
+	i.order[0] = nil
+	i.order = i.order[1:]
+
+	if i.entries[e.key] == e {
+		i.size -= len(e.body)
+		delete(i.entries, e.key)
+	}
+}
+
+// recordingWriter captures the response body as it is written.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent is middleware which replays the first response to
+// requests with the same account and idempotency key. Admin requests
+// share a single scope. Reusing a key with a different request is
+// rejected with status code 422. Requests without a key, server
+// errors, authorization and rate limit errors, and requests which
+// panic are not stored, so that they can be retried.
+func (s *Server) idempotent(c *gin.Context) {
+	key := c.GetHeader(headerIdempotencyKey)
+	if key == "" {
+		c.Next()
+		return
+	}
+
+	if len(key) > maxIdempotencyKeyLength {
+		abortWithProblem(c, http.StatusBadRequest, fmt.Sprintf("idempotency key cannot be longer than %d characters", maxIdempotencyKeyLength))
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", c.Request.Method, c.Request.URL.Path)
+	h.Write(body)
+	fingerprint := [sha256.Size]byte{}
+	copy(fingerprint[:], h.Sum(nil))
+
+	scope := "admin"
+	if _, ok := c.Get(contextKeyAccount); ok {
+		scope = "account:" + contextAccount(c).ID
+	}
+	cacheKey := scope + "\x00" + key
+	e, ok := s.idempotency.begin(cacheKey, fingerprint)
+	if !ok {
+		abortWithProblem(c, http.StatusServiceUnavailable, "too many requests with idempotency keys are in progress")
+		return
+	}
+	if e != nil {
+		switch {
+		case e.fingerprint != fingerprint:
+			abortWithProblem(c, http.StatusUnprocessableEntity, "idempotency key was used with a different request")
+		case !e.done:
+			abortWithProblem(c, http.StatusConflict, "a request with this idempotency key is in progress")
+		default:
+			c.Abort()
+			c.Header(headerIdempotentReplayed, "true")
+			c.Data(e.status, e.contentType, e.body)
+		}
+		return
+	}
+
+	// completed is false when a handler panics. The status is not
+	// checked with Written, as a status set with c.Status is not
+	// written until all handlers return.
+	completed := false
+	w := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	defer func() {
+		c.Writer = w.ResponseWriter
+		status := w.Status()
+		if !completed || !storable(status) {
+			s.idempotency.release(cacheKey)
+			return
+		}
+		s.idempotency.finish(cacheKey, status, w.Header().Get("Content-Type"), w.body.Bytes())
+	}()
+
+	c.Next()
+	completed = true
+}
+
+// storable returns true if a response with the status is replayed.
+// Authorization, subscription and rate limit errors depend on state
+// which may change before the request is retried.
+func storable(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusPaymentRequired, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return status < http.StatusInternalServerError
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+// doIdempotentRequest is doRequest with an idempotency key.
+func doIdempotentRequest(s *Server, method, path, key, idempotencyKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set(headerIdempotencyKey, idempotencyKey)
+	rec := httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotency(t *testing.T) {
+	st := &countingStore{Store: store.NewTestingMemory()}
+	require.NoError(t, st.CreateAccount(model.Account{ID: "def", Key: "uvw", Active: true}))
+	s, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+
+	first := doIdempotentRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", "key-1", `{"id":"device-c"}`)
+	require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+	require.Empty(t, first.Header().Get(headerIdempotentReplayed))
+
+	replayed := doIdempotentRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", "key-1", `{"id":"device-c"}`)
+	require.Equal(t, http.StatusOK, replayed.Code)
+	require.Equal(t, "true", replayed.Header().Get(headerIdempotentReplayed))
+	require.Equal(t, first.Body.String(), replayed.Body.String())
+	require.Equal(t, first.Header().Get("Content-Type"), replayed.Header().Get("Content-Type"))
+	require.Equal(t, 1, st.registered, "expected the duplicate to be replayed")
+
+	rec := doIdempotentRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", "key-1", `{"id":"device-d"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	requireProblem(t, rec, http.StatusUnprocessableEntity)
+
+	// Keys are scoped to the account.
+	rec = doIdempotentRequest(s, http.MethodPut, "/v1/accounts/def/device", "uvw", "key-1", `{"id":"device-c"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Empty(t, rec.Header().Get(headerIdempotentReplayed))
+	require.Equal(t, 2, st.registered)
+
+	// Requests without a key are not replayed.
+	rec = doRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", `{"id":"device-c"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, 3, st.registered)
+
+	rec = doIdempotentRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", strings.Repeat("k", 256), `{"id":"device-c"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	requireProblem(t, rec, http.StatusBadRequest)
+}
+
+func TestIdempotencyErrors(t *testing.T) {
+	st := &countingStore{Store: store.NewTestingMemory(), fail: true}
+	s, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+
+	// Client errors are replayed.
+	rec := doIdempotentRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", "key-1", `{}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doIdempotentRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", "key-1", `{}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, "true", rec.Header().Get(headerIdempotentReplayed))
+	requireProblem(t, rec, http.StatusBadRequest)
+
+	// Server errors are retried.
+	rec = doIdempotentRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", "key-2", `{"id":"device-c"}`)
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	st.fail = false
+	rec = doIdempotentRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", "key-2", `{"id":"device-c"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get(headerIdempotentReplayed))
+	require.Equal(t, 1, st.registered)
+
+	// Subscription errors are retried once the subscription is
+	// renewed.
+	rec = doIdempotentRequest(s, http.MethodPut, "/v1/accounts/go/device", "095", "key-3", `{"id":"device-c"}`)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "go", Key: "095", Active: true}))
+	rec = doIdempotentRequest(s, http.MethodPut, "/v1/accounts/go/device", "095", "key-3", `{"id":"device-c"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Empty(t, rec.Header().Get(headerIdempotentReplayed))
+}
+
+func TestIdempotencyPanic(t *testing.T) {
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()))
+	require.NoError(t, err)
+
+	calls := 0
+	s.Router.POST("/panic", s.idempotent, func(c *gin.Context) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	rec := doIdempotentRequest(s, http.MethodPost, "/panic", "", "key-1", "")
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// The key is released rather than storing an empty response.
+	rec = doIdempotentRequest(s, http.MethodPost, "/panic", "", "key-1", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Empty(t, rec.Header().Get(headerIdempotentReplayed))
+
+	rec = doIdempotentRequest(s, http.MethodPost, "/panic", "", "key-1", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, "true", rec.Header().Get(headerIdempotentReplayed))
+	require.Equal(t, 2, calls)
+}
+
+func TestIdempotencyRoutes(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	// Admin requests are replayed.
+	first := doIdempotentRequest(s, http.MethodPost, "/admin/v1/accounts/abc/enrollment-tokens", testAdminToken, "key-1", `{"max_uses":1}`)
+	require.Equal(t, http.StatusCreated, first.Code, first.Body.String())
+	rec := doIdempotentRequest(s, http.MethodPost, "/admin/v1/accounts/abc/enrollment-tokens", testAdminToken, "key-1", `{"max_uses":1}`)
+	require.Equal(t, "true", rec.Header().Get(headerIdempotentReplayed))
+	require.Equal(t, first.Body.String(), rec.Body.String())
+
+	token := model.IssuedCredential{}
+	require.NoError(t, json.Unmarshal(first.Body.Bytes(), &token))
+
+	// A retried enrollment is replayed rather than using the
+	// token again.
+	first = doIdempotentRequest(s, http.MethodPost, "/v1/accounts/abc/enroll", token.Token, "key-1", `{"id":"laptop"}`)
+	require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+	rec = doIdempotentRequest(s, http.MethodPost, "/v1/accounts/abc/enroll", token.Token, "key-1", `{"id":"laptop"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "true", rec.Header().Get(headerIdempotentReplayed))
+	require.Equal(t, first.Body.String(), rec.Body.String())
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newIdempotencyCache()
+	cache.window = time.Minute
+	cache.now = func() time.Time { return now }
+
+	fingerprint := [32]byte{1}
+	requireBegin(t, cache, "a", false)
+
+	e := requireBegin(t, cache, "a", true)
+	require.False(t, e.done, "expected the first request to be in progress")
+
+	cache.finish("a", http.StatusCreated, "application/json", []byte("{}"))
+	e = requireBegin(t, cache, "a", true)
+	require.True(t, e.done)
+	require.Equal(t, http.StatusCreated, e.status)
+
+	now = now.Add(time.Second * 30)
+	requireBegin(t, cache, "b", false)
+
+	now = now.Add(time.Second * 31)
+	requireBegin(t, cache, "a", false)
+	requireBegin(t, cache, "b", true)
+	require.Len(t, cache.entries, 2)
+
+	cache.release("b")
+	requireBegin(t, cache, "b", false)
+
+	// Requests in progress are not evicted when the cache is full.
+	cache.maxEntries = 2
+	cache.maxBytes = 4
+	_, ok := cache.begin("c", fingerprint)
+	require.False(t, ok)
+
+	// The oldest completed entries are evicted.
+	cache.finish("a", http.StatusOK, "text/plain", []byte("abc"))
+	requireBegin(t, cache, "c", false)
+	require.Len(t, cache.entries, 2)
+	require.NotContains(t, cache.entries, "a")
+
+	cache.finish("b", http.StatusOK, "text/plain", []byte("abc"))
+	cache.finish("c", http.StatusOK, "text/plain", []byte("abc"))
+	require.Len(t, cache.entries, 1, "expected the bodies to exceed the size limit")
+	require.Equal(t, 3, cache.size)
+	require.True(t, requireBegin(t, cache, "c", true).done)
+	cache.release("c")
+	require.Equal(t, 0, cache.size)
+
+	_, err := New(testLogger(t), WithMemoryStore(true), WithIdempotencyWindow(0))
+	require.ErrorContains(t, err, "idempotency window must be greater than zero")
+}
+
+// requireBegin begins key and requires whether it was already in use.
+func requireBegin(t *testing.T, cache *idempotencyCache, key string, used bool) *idempotencyEntry {
+	t.Helper()
+	e, ok := cache.begin(key, [32]byte{1})
+	require.True(t, ok)
+	require.Equal(t, used, e != nil)
+	return e
+}
+
+// countingStore counts device registrations and optionally
+// fails them.
+type countingStore struct {
+	store.Store
+	registered int
+	fail       bool
+}
+
+func (s *countingStore) RegisterDevice(accountID, accountKey string, device model.Device) (model.DeviceRegistration, error) {
+	if s.fail {
+		return model.DeviceRegistration{}, errors.New("store is unavailable")
+	}
+	s.registered++
+	return s.Store.RegisterDevice(accountID, accountKey, device)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDevicesSelector(t *testing.T) {
+	st := store.NewTestingMemory()
+	_, err := st.RegisterDevice("abc", "xyz", model.Device{ID: "web", Labels: map[string]string{"env": "prod", "role": "web"}})
+	require.NoError(t, err)
+	_, err = st.RegisterDevice("abc", "xyz", model.Device{ID: "db", Labels: map[string]string{"env": "prod", "role": "db"}})
+	require.NoError(t, err)
+	s, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+
+	cases := []struct {
+		selector   string
+		expectCode int
+		expectIDs  []string
+	}{
+		{"", http.StatusOK, []string{"db", "device-a", "device-b", "web"}},
+		{"env=prod", http.StatusOK, []string{"db", "web"}},
+		{"env=prod,role!=db", http.StatusOK, []string{"web"}},
+		{"role in (db,cache)", http.StatusOK, []string{"db"}},
+		{"env=staging", http.StatusOK, []string{}},
+		{"env in (prod", http.StatusBadRequest, nil},
+		{"bad key=x", http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.selector, func(t *testing.T) {
+			rec := doRequest(s, http.MethodGet, "/v1/accounts/abc/devices?selector="+url.QueryEscape(tc.selector), "xyz", "")
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+			if tc.expectCode != http.StatusOK {
+				requireProblem(t, rec, tc.expectCode)
+				return
+			}
+
+			devices := []model.Device{}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &devices))
+			ids := []string{}
+			for _, d := range devices {
+				ids = append(ids, d.ID)
+			}
+			require.Equal(t, tc.expectIDs, ids)
+		})
+	}
+}
+
+func TestPatchDevice(t *testing.T) {
+	st := store.NewTestingMemory()
+	_, err := st.RegisterDevice("abc", "xyz", model.Device{
+		ID:          "web",
+		Hostname:    "web-1",
+		Labels:      map[string]string{"env": "dev", "role": "web"},
+		Annotations: map[string]string{"owner": "ops"},
+	})
+	require.NoError(t, err)
+	s, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+
+	rec := doRequest(s, http.MethodPatch, "/v1/accounts/abc/devices/web", "xyz",
+		`{"hostname":"web-2","labels":{"env":"prod","role":null},"annotations":{"example.com/ticket":"OPS-1"}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	device := model.Device{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &device))
+	require.Equal(t, model.Device{
+		AccountID:   "abc",
+		ID:          "web",
+		Hostname:    "web-2",
+		Labels:      map[string]string{"env": "prod"},
+		Annotations: map[string]string{"owner": "ops", "example.com/ticket": "OPS-1"},
+	}, device)
+
+	stored, err := st.Device("abc", "web")
+	require.NoError(t, err)
+	require.Equal(t, device, stored)
+
+	rec = doRequest(s, http.MethodPatch, "/v1/accounts/abc/devices/web", "xyz", `{"labels":{"env":"bad value"}}`)
+	requireProblem(t, rec, http.StatusBadRequest)
+
+	rec = doRequest(s, http.MethodPatch, "/v1/accounts/abc/devices/web", "xyz", `{"labels":["env"]}`)
+	requireProblem(t, rec, http.StatusBadRequest)
+
+	rec = doRequest(s, http.MethodPatch, "/v1/accounts/abc/devices/missing", "xyz", `{"hostname":"x"}`)
+	requireProblem(t, rec, http.StatusNotFound)
+
+	rec = doRequest(s, http.MethodPatch, "/v1/accounts/abc/devices/web", "wrong", `{"hostname":"x"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestRegisterDeviceInvalidLabels(t *testing.T) {
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()))
+	require.NoError(t, err)
+
+	rec := doRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", `{"id":"web","labels":{"-env":"prod"}}`)
+	requireProblem(t, rec, http.StatusBadRequest)
+
+	rec = doRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", `{"id":"web","labels":{"env":"prod"}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
@@ -0,0 +1,480 @@
+package server
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/audit"
+	"github.com/jsirianni/server/model"
+)
+
+// LockoutPolicy configures brute force protection. Failed
+// authentication attempts are counted per account and per source IP,
+// or IPv6 /64. Each failure is answered after a delay which doubles
+// with each failure, and Threshold failures within Window lock the
+// account or IP out. Each lockout is twice as long as the last, up to
+// MaxDuration. A locked out IP is rejected before its credentials are
+// checked. A locked out account still accepts valid credentials, so
+// that failures from other IPs can not lock its users out.
+type LockoutPolicy struct {
+	Threshold   int
+	Window      time.Duration
+	Duration    time.Duration
+	MaxDuration time.Duration
+	Delay       time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultLockoutPolicy returns the default lockout policy.
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		Threshold:   10,
+		Window:      time.Minute * 15,
+		Duration:    time.Minute * 15,
+		MaxDuration: time.Hour * 24,
+		Delay:       time.Millisecond * 250,
+		MaxDelay:    time.Second * 5,
+	}
+}
+
+// Validate returns an error if the policy is invalid.
+func (p LockoutPolicy) Validate() error {
+	if p.Threshold <= 0 {
+		return fmt.Errorf("lockout threshold must be greater than zero: %d", p.Threshold)
+	}
+	if p.Window <= 0 || p.Duration <= 0 {
+		return fmt.Errorf("lockout window and duration must be greater than zero: window %s, duration %s", p.Window, p.Duration)
+	}
+	if p.MaxDuration < p.Duration {
+		return fmt.Errorf("lockout max duration %s cannot be less than duration %s", p.MaxDuration, p.Duration)
+	}
+	if p.Delay < 0 || p.MaxDelay < p.Delay {
+		return fmt.Errorf("lockout delay %s cannot be negative or greater than max delay %s", p.Delay, p.MaxDelay)
+	}
+	return nil
+}
+
+// WithLockout enables brute force protection of account keys and
+// credentials with the given policy, and the admin lockout endpoints.
+func WithLockout(policy LockoutPolicy) Option {
+	return func(s *Server) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		s.lockouts = newLockouts(policy)
+		return nil
+	}
+}
+
+// maxLockoutEntries is the maximum number of tracked accounts and
+// source IPs.
+const maxLockoutEntries = 100000
+
+// lockoutEntry is the failures of an account or source IP.
+type lockoutEntry struct {
+	key         lockoutKey
+	failures    int
+	firstFailed time.Time
+	lockouts    int
+	lockedUntil time.Time
+
+	// expires is when the entry's failures have expired and its
+	// last lockout no longer escalates the next
+	expires time.Time
+
+	// index is the entry's position in the expiry heap
+	index int
+}
+
+// lockouts tracks failed authentication attempts. The methods of a
+// nil lockouts do nothing, so that callers need not check whether
+// brute force protection is enabled.
+type lockouts struct {
+	policy LockoutPolicy
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[lockoutKey]*lockoutEntry
+
+	// expiry orders entries by when they expire
+	expiry lockoutHeap
+}
+
+type lockoutKey struct {
+	kind model.LockoutKind
+	key  string
+}
+
+func newLockouts(policy LockoutPolicy) *lockouts {
+	return &lockouts{
+		policy:  policy,
+		now:     time.Now,
+		entries: make(map[lockoutKey]*lockoutEntry),
+	}
+}
+
+// lockedUntil returns the end of the account or source IP's lockout,
+// or false if it is not locked out.
+func (l *lockouts) lockedUntil(kind model.LockoutKind, key string) (time.Time, bool) {
+	if l == nil || key == "" {
+		return time.Time{}, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := lockoutKey{kind, key}
+	if kind == model.LockoutIP {
+		k.key = lockoutIP(key)
+	}
+	e, ok := l.entries[k]
+	if !ok || !e.lockedUntil.After(l.now()) {
+		return time.Time{}, false
+	}
+	return e.lockedUntil, true
+}
+
+// fail records a failed attempt for the account and source IP. It
+// returns the delay before the failure should be answered, and the
+// keys which were locked out by this failure.
+func (l *lockouts) fail(accountID, ip string) (time.Duration, []model.Lockout) {
+	if l == nil {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	failures := 0
+	locked := []model.Lockout{}
+	for _, k := range lockoutKeys(accountID, ip) {
+		e, ok := l.entries[k]
+		if !ok {
+			if !l.reserve(now) {
+				continue
+			}
+			e = &lockoutEntry{key: k}
+			l.add(e)
+		}
+
+		if e.failures == 0 || now.Sub(e.firstFailed) > l.policy.Window {
+			e.failures = 0
+			e.firstFailed = now
+		}
+		e.failures++
+		if e.failures > failures {
+			failures = e.failures
+		}
+
+		if e.failures >= l.policy.Threshold {
+			e.lockouts++
+			e.lockedUntil = now.Add(l.duration(e.lockouts))
+			e.failures = 0
+			locked = append(locked, e.lockout(k))
+		}
+		l.update(e)
+	}
+
+	return l.delay(failures), locked
+}
+
+// succeed clears the account's failures after a successful attempt.
+// The source IP's failures are kept, so that an attacker with one
+// valid key can not reset their count.
+func (l *lockouts) succeed(accountID string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[lockoutKey{model.LockoutAccount, accountID}]; ok {
+		e.failures = 0
+	}
+}
+
+// reserve makes room for a new entry, removing the entry closest to
+// expiring if there are too many and it is not locked out. Locked out
+// entries expire last unless the policy's window is longer than its
+// max duration. Returns false if no entry was removed. Callers must
+// hold the lock.
+func (l *lockouts) reserve(now time.Time) bool {
+	if len(l.entries) < maxLockoutEntries {
+		return true
+	}
+	if l.expiry[0].lockedUntil.After(now) {
+		return false
+	}
+	l.remove(l.expiry[0])
+	return true
+}
+
+// add tracks a new entry. Callers must hold the lock.
+func (l *lockouts) add(e *lockoutEntry) {
+	l.entries[e.key] = e
+	e.expires = l.expires(e)
+	heap.Push(&l.expiry, e)
+}
+
+// update reorders an entry after its failures or lockout changed.
+// Callers must hold the lock.
+func (l *lockouts) update(e *lockoutEntry) {
+	e.expires = l.expires(e)
+	heap.Fix(&l.expiry, e.index)
+}
+
+// remove stops tracking an entry. Callers must hold the lock.
+func (l *lockouts) remove(e *lockoutEntry) {
+	delete(l.entries, e.key)
+	heap.Remove(&l.expiry, e.index)
+}
+
+// expires returns when an entry's failures have expired and its last
+// lockout ended long enough ago that it no longer escalates the next.
+func (l *lockouts) expires(e *lockoutEntry) time.Time {
+	expires := e.firstFailed.Add(l.policy.Window)
+	if escalates := e.lockedUntil.Add(l.policy.MaxDuration); escalates.After(expires) {
+		return escalates
+	}
+	return expires
+}
+
+// clear removes an account or source IP's failures and lockout.
+// Returns false if there were none.
+func (l *lockouts) clear(kind model.LockoutKind, key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := lockoutKey{kind, key}
+	if kind == model.LockoutIP {
+		k.key = lockoutIP(key)
+	}
+	e, ok := l.entries[k]
+	if ok {
+		l.remove(e)
+	}
+	return ok
+}
+
+// list returns the tracked accounts and source IPs, ordered by kind
+// and key.
+func (l *lockouts) list() []model.Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	list := make([]model.Lockout, 0, len(l.entries))
+	for k, e := range l.entries {
+		lockout := e.lockout(k)
+		if !e.lockedUntil.After(now) {
+			lockout.LockedUntil = nil
+		}
+		list = append(list, lockout)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// prune removes expired entries. Callers must hold the lock.
+func (l *lockouts) prune(now time.Time) {
+	for len(l.expiry) > 0 && now.After(l.expiry[0].expires) {
+		l.remove(l.expiry[0])
+	}
+}
+
+// duration returns the length of the nth lockout.
+func (l *lockouts) duration(n int) time.Duration {
+	return backoff(l.policy.Duration, l.policy.MaxDuration, n)
+}
+
+// delay returns the delay before answering the nth failure.
+func (l *lockouts) delay(n int) time.Duration {
+	if l.policy.Delay == 0 {
+		return 0
+	}
+	return backoff(l.policy.Delay, l.policy.MaxDelay, n)
+}
+
+// backoff returns base doubled n-1 times, up to limit.
+func backoff(base, limit time.Duration, n int) time.Duration {
+	d := float64(base) * math.Pow(2, float64(n-1))
+	if d > float64(limit) {
+		return limit
+	}
+	return time.Duration(d)
+}
+
+func (e *lockoutEntry) lockout(k lockoutKey) model.Lockout {
+	lockout := model.Lockout{Kind: k.kind, Key: k.key, Failures: e.failures, Lockouts: e.lockouts}
+	if !e.lockedUntil.IsZero() {
+		until := e.lockedUntil.UTC()
+		lockout.LockedUntil = &until
+	}
+	return lockout
+}
+
+// lockoutHeap is a min-heap of entries ordered by expiry.
+type lockoutHeap []*lockoutEntry
+
+func (h lockoutHeap) Len() int           { return len(h) }
+func (h lockoutHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h lockoutHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lockoutHeap) Push(x interface{}) {
+	e := x.(*lockoutEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lockoutHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+func lockoutKeys(accountID, ip string) []lockoutKey {
+	keys := make([]lockoutKey, 0, 2)
+	if accountID != "" {
+		keys = append(keys, lockoutKey{model.LockoutAccount, accountID})
+	}
+	if ip != "" {
+		keys = append(keys, lockoutKey{model.LockoutIP, lockoutIP(ip)})
+	}
+	return keys
+}
+
+// lockoutIP returns the key of a source IP. IPv6 addresses are
+// grouped by their /64, as a single host is usually assigned one.
+func lockoutIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return ip
+	}
+	return netip.PrefixFrom(addr, 64).Masked().String()
+}
+
+// checkLockout aborts the request with 429 if the request's source IP
+// is locked out. Returns false if the request was aborted.
+func (s *Server) checkLockout(c *gin.Context) bool {
+	until, locked := s.lockouts.lockedUntil(model.LockoutIP, c.ClientIP())
+	if !locked {
+		return true
+	}
+	s.abortLockedOut(c, until)
+	return false
+}
+
+// abortLockedOut aborts the request with 429 and the time remaining
+// until the lockout ends.
+func (s *Server) abortLockedOut(c *gin.Context, until time.Time) {
+	retryAfter := int64(math.Ceil(until.Sub(s.lockouts.now()).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+	abortWithProblem(c, http.StatusTooManyRequests, "too many failed authentication attempts, try again later")
+}
+
+// rejectCredentials records a failed authentication attempt and
+// aborts the request after the lockout policy's delay, with 429 if
+// the account is locked out or 401 otherwise.
+func (s *Server) rejectCredentials(c *gin.Context, accountID, detail string) {
+	until, accountLocked := s.lockouts.lockedUntil(model.LockoutAccount, accountID)
+	delay, locked := s.lockouts.fail(accountID, c.ClientIP())
+
+	for _, lockout := range locked {
+		s.logger.Sugar().Warnf("locked out %s %s until %s after %d failed authentication attempts",
+			lockout.Kind, lockout.Key, lockout.LockedUntil.Format(time.RFC3339), s.lockouts.policy.Threshold)
+		s.auditLockout(c, lockout)
+	}
+
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-c.Request.Context().Done():
+		case <-s.done:
+		}
+	}
+
+	if accountLocked {
+		s.abortLockedOut(c, until)
+		return
+	}
+	abortWithProblem(c, http.StatusUnauthorized, detail)
+}
+
+// auditLockout records the start of a lockout to the audit sink.
+func (s *Server) auditLockout(c *gin.Context, lockout model.Lockout) {
+	if s.auditSink == nil {
+		return
+	}
+
+	entry := audit.Entry{
+		Time:      s.lockouts.now().UTC(),
+		Actor:     audit.Actor{Type: audit.ActorAnonymous},
+		Action:    "lockout.start",
+		Target:    string(lockout.Kind) + ":" + lockout.Key,
+		SourceIP:  c.ClientIP(),
+		RequestID: c.GetString(contextKeyRequestID),
+		Result:    audit.ResultFailure,
+		Status:    http.StatusUnauthorized,
+	}
+	if err := s.auditSink.Write(entry); err != nil {
+		s.logger.Sugar().Errorf("failed to write audit entry for request %s: %v", entry.RequestID, err)
+	}
+}
+
+// lockoutsHandler lists the accounts and source IPs with recent
+// failed authentication attempts or lockouts.
+func (s *Server) lockoutsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, s.lockouts.list())
+}
+
+// clearAccountLockoutHandler clears the failures and lockout of the
+// account in the path.
+func (s *Server) clearAccountLockoutHandler(c *gin.Context) {
+	s.clearLockout(c, model.LockoutAccount, c.Param("account"))
+}
+
+// clearIPLockoutHandler clears the failures and lockout of the source
+// IP in the path.
+func (s *Server) clearIPLockoutHandler(c *gin.Context) {
+	s.clearLockout(c, model.LockoutIP, c.Param("ip"))
+}
+
+func (s *Server) clearLockout(c *gin.Context, kind model.LockoutKind, key string) {
+	if !s.lockouts.clear(kind, key) {
+		abortWithProblem(c, http.StatusNotFound, fmt.Sprintf("%s %s has no failed authentication attempts", kind, key))
+		return
+	}
+	s.logger.Sugar().Infof("cleared lockout of %s %s", kind, key)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/audit"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockout(t *testing.T) {
+	s, now := newLockoutServer(t)
+
+	for i := 0; i < 3; i++ {
+		rec := doRequest(s, http.MethodGet, "/v1/accounts/abc", "wrong", "")
+		requireProblem(t, rec, http.StatusUnauthorized)
+	}
+
+	// The account and source IP are locked out, even with a valid key.
+	rec := doRequest(s, http.MethodGet, "/v1/accounts/abc", "xyz", "")
+	requireProblem(t, rec, http.StatusTooManyRequests)
+	require.Equal(t, "900", rec.Header().Get("Retry-After"))
+
+	rec = doRequest(s, http.MethodGet, "/admin/v1/lockouts", testAdminToken, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	lockouts := []model.Lockout{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &lockouts))
+	until := now.Add(time.Minute * 15)
+	require.Equal(t, []model.Lockout{
+		{Kind: model.LockoutAccount, Key: "abc", Lockouts: 1, LockedUntil: &until},
+		{Kind: model.LockoutIP, Key: "192.0.2.1", Lockouts: 1, LockedUntil: &until},
+	}, lockouts)
+
+	rec = doRequest(s, http.MethodDelete, "/admin/v1/lockouts/accounts/abc", testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc", "xyz", "")
+	requireProblem(t, rec, http.StatusTooManyRequests)
+
+	rec = doRequest(s, http.MethodDelete, "/admin/v1/lockouts/ips/192.0.2.1", testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc", "xyz", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doRequest(s, http.MethodDelete, "/admin/v1/lockouts/ips/192.0.2.1", testAdminToken, "")
+	requireProblem(t, rec, http.StatusNotFound)
+}
+
+func TestLockoutEscalates(t *testing.T) {
+	s, now := newLockoutServer(t)
+
+	for _, expect := range []time.Duration{time.Minute * 15, time.Minute * 30, time.Hour, time.Hour} {
+		for i := 0; i < 3; i++ {
+			rec := doRequest(s, http.MethodGet, "/v1/accounts/abc", "wrong", "")
+			requireProblem(t, rec, http.StatusUnauthorized)
+		}
+
+		until, locked := s.lockouts.lockedUntil(model.LockoutAccount, "abc")
+		require.True(t, locked)
+		require.Equal(t, now.Add(expect), until)
+
+		*now = until
+		rec := doRequest(s, http.MethodGet, "/v1/accounts/abc", "xyz", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// Lockouts are forgotten once they no longer escalate.
+	*now = now.Add(time.Hour * 2)
+	require.Empty(t, s.lockouts.list())
+}
+
+func TestLockoutCounts(t *testing.T) {
+	cases := []struct {
+		name          string
+		requests      []lockoutRequest
+		expectAccount bool
+		expectIP      bool
+	}{
+		{
+			"account-across-ips",
+			[]lockoutRequest{{"10.0.0.1", "abc", "wrong"}, {"10.0.0.2", "abc", "wrong"}, {"10.0.0.3", "abc", "wrong"}},
+			true,
+			false,
+		},
+		{
+			"ip-across-accounts",
+			[]lockoutRequest{{"10.0.0.1", "abc", "wrong"}, {"10.0.0.1", "go", "wrong"}, {"10.0.0.1", "missing", "wrong"}},
+			false,
+			true,
+		},
+		{
+			"success-resets-account",
+			[]lockoutRequest{{"10.0.0.1", "abc", "wrong"}, {"10.0.0.2", "abc", "wrong"}, {"10.0.0.3", "abc", "xyz"}, {"10.0.0.4", "abc", "wrong"}},
+			false,
+			false,
+		},
+		{
+			"success-does-not-reset-ip",
+			[]lockoutRequest{{"10.0.0.1", "abc", "wrong"}, {"10.0.0.1", "go", "wrong"}, {"10.0.0.1", "abc", "xyz"}, {"10.0.0.1", "go", "wrong"}},
+			false,
+			true,
+		},
+		{
+			"window",
+			[]lockoutRequest{{"10.0.0.1", "abc", "wrong"}, {"10.0.0.1", "abc", "wrong"}, {"", "", ""}, {"10.0.0.1", "abc", "wrong"}},
+			false,
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, now := newLockoutServer(t)
+			for _, r := range tc.requests {
+				if r.ip == "" {
+					*now = now.Add(time.Minute * 16)
+					continue
+				}
+				serveFrom(s, requestFrom(r.ip+":1234", http.MethodGet, "/v1/accounts/"+r.account, r.key))
+			}
+
+			_, locked := s.lockouts.lockedUntil(model.LockoutAccount, "abc")
+			require.Equal(t, tc.expectAccount, locked, "account")
+			_, locked = s.lockouts.lockedUntil(model.LockoutIP, "10.0.0.1")
+			require.Equal(t, tc.expectIP, locked, "ip")
+			_, locked = s.lockouts.lockedUntil(model.LockoutAccount, "missing")
+			require.False(t, locked, "unknown accounts are not tracked")
+		})
+	}
+}
+
+func TestLockoutAccount(t *testing.T) {
+	s, _ := newLockoutServer(t)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		rec := serveFrom(s, requestFrom(ip+":1234", http.MethodGet, "/v1/accounts/abc", "wrong"))
+		requireProblem(t, rec, http.StatusUnauthorized)
+	}
+
+	// A locked out account accepts its valid key from other IPs, and
+	// rejects invalid keys with the lockout.
+	rec := serveFrom(s, requestFrom("10.0.0.4:1234", http.MethodGet, "/v1/accounts/abc", "xyz"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = serveFrom(s, requestFrom("10.0.0.4:1234", http.MethodGet, "/v1/accounts/abc", "wrong"))
+	requireProblem(t, rec, http.StatusTooManyRequests)
+	require.Equal(t, "900", rec.Header().Get("Retry-After"))
+}
+
+func TestLockoutIPv6(t *testing.T) {
+	s, _ := newLockoutServer(t)
+
+	// Addresses in the same /64 share a lockout.
+	for _, ip := range []string{"[2001:db8::1]", "[2001:db8::2]", "[2001:db8::3]"} {
+		rec := serveFrom(s, requestFrom(ip+":1234", http.MethodGet, "/v1/accounts/missing", "wrong"))
+		requireProblem(t, rec, http.StatusUnauthorized)
+	}
+
+	rec := serveFrom(s, requestFrom("[2001:db8::ffff]:1234", http.MethodGet, "/v1/accounts/abc", "xyz"))
+	requireProblem(t, rec, http.StatusTooManyRequests)
+	rec = serveFrom(s, requestFrom("[2001:db8:0:1::1]:1234", http.MethodGet, "/v1/accounts/abc", "xyz"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	lockouts := s.lockouts.list()
+	require.Len(t, lockouts, 1)
+	require.Equal(t, "2001:db8::/64", lockouts[0].Key)
+
+	rec = doRequest(s, http.MethodDelete, "/admin/v1/lockouts/ips/2001:db8::5", testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Empty(t, s.lockouts.list())
+}
+
+func TestLockoutEntries(t *testing.T) {
+	l := newLockouts(DefaultLockoutPolicy())
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < maxLockoutEntries; i++ {
+		// Later entries are locked out for longer.
+		until := now.Add(time.Minute + time.Duration(i)*time.Millisecond)
+		l.add(&lockoutEntry{key: lockoutKey{model.LockoutIP, strconv.Itoa(i)}, failures: 1, firstFailed: now, lockedUntil: until})
+	}
+
+	// New IPs are not tracked while every entry is locked out.
+	l.fail("", "10.0.0.1")
+	require.Len(t, l.entries, maxLockoutEntries)
+	_, locked := l.lockedUntil(model.LockoutIP, "0")
+	require.True(t, locked)
+
+	// The entry closest to expiring is removed to make room once
+	// its lockout has ended.
+	now = now.Add(time.Minute)
+	l.fail("", "10.0.0.1")
+	require.Len(t, l.entries, maxLockoutEntries)
+	require.Equal(t, 1, l.entries[lockoutKey{model.LockoutIP, "10.0.0.1"}].failures)
+	require.NotContains(t, l.entries, lockoutKey{model.LockoutIP, "0"})
+	require.Contains(t, l.entries, lockoutKey{model.LockoutIP, "1"})
+
+	// Expired entries are removed as the clock passes them.
+	now = now.Add(time.Hour*24 + time.Millisecond*2)
+	require.Len(t, l.list(), maxLockoutEntries-2)
+	require.Len(t, l.expiry, maxLockoutEntries-2)
+}
+
+func TestLockoutCredentials(t *testing.T) {
+	s, _ := newLockoutServer(t)
+
+	token := createEnrollmentToken(t, s, "abc", `{}`)
+	for i := 0; i < 3; i++ {
+		rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/enroll", token.ID+".wrong", `{"id":"laptop"}`)
+		requireProblem(t, rec, http.StatusUnauthorized)
+	}
+
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/enroll", token.Token, `{"id":"laptop"}`)
+	requireProblem(t, rec, http.StatusTooManyRequests)
+
+	// Signed requests with the wrong key count as failures too.
+	s, _ = newLockoutServer(t)
+	for i := 0; i < 3; i++ {
+		rec = serveFrom(s, signedRequest(t, http.MethodGet, "/v1/accounts/abc", "", "abc", "wrong", time.Now()))
+		requireProblem(t, rec, http.StatusUnauthorized)
+	}
+	rec = serveFrom(s, signedRequest(t, http.MethodGet, "/v1/accounts/abc", "", "abc", "xyz", time.Now()))
+	requireProblem(t, rec, http.StatusTooManyRequests)
+}
+
+func TestLockoutAudit(t *testing.T) {
+	sink := audit.NewMemorySink(0)
+	policy := DefaultLockoutPolicy()
+	policy.Threshold = 1
+	policy.Delay = 0
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithAdminToken(testAdminToken), WithAuditSink(sink), WithLockout(policy))
+	require.NoError(t, err)
+
+	rec := doRequest(s, http.MethodGet, "/v1/accounts/abc", "wrong", "")
+	requireProblem(t, rec, http.StatusUnauthorized)
+	rec = doRequest(s, http.MethodDelete, "/admin/v1/lockouts/accounts/abc", testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	entries, err := sink.Query(audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	require.Equal(t, "lockout.clear", entries[0].Action)
+	require.Equal(t, "account:abc", entries[0].Target)
+	require.Equal(t, "account.get", entries[1].Action)
+	require.Equal(t, "lockout.start", entries[2].Action)
+	require.Equal(t, "lockout.start", entries[3].Action)
+	require.ElementsMatch(t, []string{"account:abc", "ip:192.0.2.1"}, []string{entries[2].Target, entries[3].Target})
+	require.Equal(t, entries[1].RequestID, entries[2].RequestID)
+}
+
+func TestLockoutDelay(t *testing.T) {
+	l := newLockouts(DefaultLockoutPolicy())
+
+	cases := []struct {
+		failures    int
+		expectDelay time.Duration
+	}{
+		{1, time.Millisecond * 250},
+		{2, time.Millisecond * 500},
+		{3, time.Second},
+		{5, time.Second * 4},
+		{6, time.Second * 5},
+		{100, time.Second * 5},
+	}
+
+	for _, tc := range cases {
+		require.Equal(t, tc.expectDelay, l.delay(tc.failures), "failures %d", tc.failures)
+	}
+
+	start := time.Now()
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithLockout(DefaultLockoutPolicy()))
+	require.NoError(t, err)
+	rec := doRequest(s, http.MethodGet, "/v1/accounts/abc", "wrong", "")
+	requireProblem(t, rec, http.StatusUnauthorized)
+	require.GreaterOrEqual(t, time.Since(start), time.Millisecond*250)
+}
+
+func TestLockoutDisabled(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+	for i := 0; i < 20; i++ {
+		rec := doRequest(s, http.MethodGet, "/v1/accounts/abc", "wrong", "")
+		requireProblem(t, rec, http.StatusUnauthorized)
+	}
+	rec := doRequest(s, http.MethodGet, "/v1/accounts/abc", "xyz", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doRequest(s, http.MethodGet, "/admin/v1/lockouts", testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestWithLockout(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(*LockoutPolicy)
+	}{
+		{"threshold", func(p *LockoutPolicy) { p.Threshold = 0 }},
+		{"window", func(p *LockoutPolicy) { p.Window = 0 }},
+		{"max-duration", func(p *LockoutPolicy) { p.MaxDuration = time.Minute }},
+		{"negative-delay", func(p *LockoutPolicy) { p.Delay = -1 }},
+		{"max-delay", func(p *LockoutPolicy) { p.MaxDelay = time.Millisecond }},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultLockoutPolicy()
+			tc.modify(&policy)
+			_, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithLockout(policy))
+			require.Error(t, err)
+		})
+	}
+}
+
+type lockoutRequest struct {
+	ip      string
+	account string
+	key     string
+}
+
+// newLockoutServer returns a server which locks out after three
+// failures without delays, and a pointer to the lockout time.
+func newLockoutServer(t *testing.T) (*Server, *time.Time) {
+	t.Helper()
+	policy := DefaultLockoutPolicy()
+	policy.Threshold = 3
+	policy.MaxDuration = time.Hour
+	policy.Delay = 0
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithAdminToken(testAdminToken), WithLockout(policy))
+	require.NoError(t, err)
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.lockouts.now = func() time.Time { return now }
+	return s, &now
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bodyLimitExempt are the routes which set their own request body
+// limit with streamBodyBytes.
+var bodyLimitExempt = map[string]bool{
+	"POST /admin/v1/snapshot": true,
+}
+
+// maxBodyBytes returns middleware which rejects requests with a
+// body larger than limit with status code 413. Requests which do not
+// declare a content length are buffered up to the limit in order to
+// enforce it before the request reaches a handler.
+func maxBodyBytes(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Body == http.NoBody || bodyLimitExempt[c.Request.Method+" "+c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		if c.Request.ContentLength > limit {
+			abortWithProblem(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+
+		if int64(len(body)) > limit {
+			abortWithProblem(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
+
+// streamBodyBytes returns middleware which limits the request body
+// to limit without buffering it, for routes which stream large
+// bodies. Reads beyond the limit return an *http.MaxBytesError, which
+// the handler must answer with status code 413.
+func streamBodyBytes(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			abortWithProblem(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+			return
+		}
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		}
+		c.Next()
+	}
+}
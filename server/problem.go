@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/model"
+)
+
+const (
+	// problemContentType is the media type of problem
+	// details responses.
+	problemContentType = "application/problem+json"
+
+	// problemTypeDefault is used when the status code is
+	// sufficient to describe the problem.
+	problemTypeDefault = "about:blank"
+)
+
+// abortWithProblem aborts the request and writes a problem
+// details response with the given status code and detail.
+func abortWithProblem(c *gin.Context, status int, detail string) {
+	p := model.Problem{
+		Type:     problemTypeDefault,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: c.Request.URL.Path,
+	}
+	c.Abort()
+	c.Header("Content-Type", problemContentType)
+	c.JSON(status, p)
+}
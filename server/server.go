@@ -8,17 +8,43 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/audit"
 	"github.com/jsirianni/server/store"
+	"github.com/jsirianni/server/webhook"
 	"go.uber.org/zap"
 )
 
 const (
 	// DefaultTimeout is the default read and write timeout.
 	DefaultTimeout = time.Second * 15
+
+	// DefaultIdleTimeout is the default keep-alive idle timeout.
+	DefaultIdleTimeout = time.Second * 60
+
+	// DefaultMaxHeaderBytes is the default maximum size of
+	// request headers.
+	DefaultMaxHeaderBytes = http.DefaultMaxHeaderBytes
+
+	// DefaultMaxBodyBytes is the default maximum size of
+	// a request body.
+	DefaultMaxBodyBytes = 1 << 20
+
+	// DefaultMaxImportBytes is the default maximum size of a
+	// snapshot imported with the admin api.
+	DefaultMaxImportBytes = 1 << 30
+
+	// minAdminTokenLength is the minimum length of the
+	// admin token.
+	minAdminTokenLength = 16
+
+	// DefaultMaxOffline is the default duration clients may trust
+	// a successful validation while the server is unavailable.
+	DefaultMaxOffline = time.Hour * 24
 )
 
 // Option is a function that configures a Server option.
@@ -45,6 +71,169 @@ func WithBindAddress(address string, port uint) Option {
 	}
 }
 
+// WithReadTimeout configures the maximum duration for reading
+// the entire request, including the body. A zero value disables
+// the timeout.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return fmt.Errorf("read timeout cannot be negative: %s", timeout)
+		}
+		s.server.ReadTimeout = timeout
+		return nil
+	}
+}
+
+// WithReadHeaderTimeout configures the maximum duration for reading
+// request headers. A zero value disables the timeout.
+func WithReadHeaderTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return fmt.Errorf("read header timeout cannot be negative: %s", timeout)
+		}
+		s.server.ReadHeaderTimeout = timeout
+		return nil
+	}
+}
+
+// WithWriteTimeout configures the maximum duration before timing
+// out writes of the response. A zero value disables the timeout.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return fmt.Errorf("write timeout cannot be negative: %s", timeout)
+		}
+		s.server.WriteTimeout = timeout
+		return nil
+	}
+}
+
+// WithIdleTimeout configures the maximum amount of time to wait for
+// the next request when keep-alives are enabled. A zero value disables
+// the timeout.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return fmt.Errorf("idle timeout cannot be negative: %s", timeout)
+		}
+		s.server.IdleTimeout = timeout
+		return nil
+	}
+}
+
+// WithMaxHeaderBytes configures the maximum number of bytes the
+// server will read parsing request headers.
+func WithMaxHeaderBytes(size int) Option {
+	return func(s *Server) error {
+		if size <= 0 {
+			return fmt.Errorf("max header bytes must be greater than zero: %d", size)
+		}
+		s.server.MaxHeaderBytes = size
+		return nil
+	}
+}
+
+// WithMaxBodyBytes configures the maximum size of a request body.
+// Requests with larger bodies are rejected with status code 413.
+func WithMaxBodyBytes(size int64) Option {
+	return func(s *Server) error {
+		if size <= 0 {
+			return fmt.Errorf("max body bytes must be greater than zero: %d", size)
+		}
+		s.maxBodyBytes = size
+		return nil
+	}
+}
+
+// WithMaxImportBytes configures the maximum size of a snapshot
+// imported with the admin api, which is not limited by
+// WithMaxBodyBytes. Larger snapshots are rejected with status
+// code 413.
+func WithMaxImportBytes(size int64) Option {
+	return func(s *Server) error {
+		if size <= 0 {
+			return fmt.Errorf("max import bytes must be greater than zero: %d", size)
+		}
+		s.maxImportBytes = size
+		return nil
+	}
+}
+
+// WithMaxOffline configures how long clients may trust a successful
+// subscription validation while the server is unavailable. Zero
+// requires clients to validate online.
+func WithMaxOffline(d time.Duration) Option {
+	return func(s *Server) error {
+		if d < 0 {
+			return fmt.Errorf("max offline cannot be negative: %s", d)
+		}
+		s.maxOffline = d
+		return nil
+	}
+}
+
+// WithAdminToken enables the admin api, which requires token
+// as a bearer token. The admin api is disabled when no token
+// is configured.
+func WithAdminToken(token string) Option {
+	return func(s *Server) error {
+		if len(token) < minAdminTokenLength {
+			return fmt.Errorf("admin token must be at least %d characters", minAdminTokenLength)
+		}
+		s.adminToken = token
+		return nil
+	}
+}
+
+// WithEventHeartbeat configures the interval between heartbeats
+// sent on idle event streams.
+func WithEventHeartbeat(interval time.Duration) Option {
+	return func(s *Server) error {
+		if interval <= 0 {
+			return fmt.Errorf("event heartbeat must be greater than zero: %s", interval)
+		}
+		s.eventHeartbeat = interval
+		return nil
+	}
+}
+
+// WithWebhooks enables the webhook endpoints, which manage the
+// account's webhooks with m. The caller is responsible for running m.
+func WithWebhooks(m *webhook.Manager) Option {
+	return func(s *Server) error {
+		if m == nil {
+			return errors.New("webhook manager cannot be nil")
+		}
+		s.webhooks = m
+		return nil
+	}
+}
+
+// WithTLS configures the server to serve HTTPS using the
+// given certificate and private key files.
+func WithTLS(certFile, keyFile string) Option {
+	return func(s *Server) error {
+		if certFile == "" || keyFile == "" {
+			return errors.New("tls requires both a certificate file and a private key file")
+		}
+		s.tlsCertFile = certFile
+		s.tlsKeyFile = keyFile
+		return nil
+	}
+}
+
+// WithStore configures the store interface with the
+// given storage backend.
+func WithStore(st store.Store) Option {
+	return func(s *Server) error {
+		if st == nil {
+			return errors.New("store cannot be nil")
+		}
+		s.store = st
+		return nil
+	}
+}
+
 // WithMemoryStore configures the store interface with
 // an in memory storage backend. If seed is true, the memory
 // store will be seeded with test data.
@@ -77,18 +266,33 @@ func New(logger *zap.Logger, ops ...Option) (*Server, error) {
 	}
 
 	s := &Server{
-		logger: logger,
+		logger:         logger,
+		maxBodyBytes:   DefaultMaxBodyBytes,
+		maxImportBytes: DefaultMaxImportBytes,
+		maxOffline:     DefaultMaxOffline,
+		eventHeartbeat: DefaultEventHeartbeat,
+		idempotency:    newIdempotencyCache(),
+		signatures:     newSignatureCache(),
+		done:           make(chan struct{}),
 	}
 
-	// TODO(jsirianni): Add timeout options to option functions
-	// in order to allow the user to override default values.
+	// Defaults can be overridden with Option functions.
 	s.server.ReadTimeout = DefaultTimeout
 	s.server.ReadHeaderTimeout = DefaultTimeout
 	s.server.WriteTimeout = DefaultTimeout
+	s.server.IdleTimeout = DefaultIdleTimeout
+	s.server.MaxHeaderBytes = DefaultMaxHeaderBytes
+	s.server.ConnContext = withConn
 
 	s.Router = gin.New()
+	// Forwarded headers are ignored unless the proxy is trusted
+	// with WithTrustedProxies.
+	if err := s.Router.SetTrustedProxies(nil); err != nil {
+		return nil, fmt.Errorf("failed to configure trusted proxies: %w", err)
+	}
 	s.Router.Use(ginzap.Ginzap(logger, "", false))
 	s.Router.Use(ginzap.RecoveryWithZap(logger, true))
+	s.Router.Use(requestID)
 
 	for _, op := range ops {
 		if err := op(s); err != nil {
@@ -100,9 +304,44 @@ func New(logger *zap.Logger, ops ...Option) (*Server, error) {
 		return nil, fmt.Errorf("server must be configured with a storage backend")
 	}
 
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	// Preflight requests match no route, so cors is used by the
+	// router rather than the /v1 groups.
+	if s.corsPolicy != nil {
+		s.Router.Use(s.cors)
+	}
+	s.Router.Use(maxBodyBytes(s.maxBodyBytes))
+	s.addRoutes()
+
 	return s, nil
 }
 
+// validate returns an error if the server's options
+// conflict with each other.
+func (s *Server) validate() error {
+	readTimeout := s.server.ReadTimeout
+	headerTimeout := s.server.ReadHeaderTimeout
+
+	// http.Server falls back to the read timeout when the read
+	// header timeout is zero, so only compare explicit values.
+	if readTimeout > 0 && headerTimeout > readTimeout {
+		return fmt.Errorf("read header timeout %s cannot be greater than read timeout %s", headerTimeout, readTimeout)
+	}
+
+	if s.maxBodyBytes <= 0 {
+		return fmt.Errorf("max body bytes must be greater than zero: %d", s.maxBodyBytes)
+	}
+
+	if lifetime := streamDuration(s.server.WriteTimeout); lifetime > 0 && s.eventHeartbeat >= lifetime {
+		return fmt.Errorf("event heartbeat %s must be shorter than the event stream lifetime %s, which is 90%% of the write timeout", s.eventHeartbeat, lifetime)
+	}
+
+	return nil
+}
+
 // Server is an http server for serving the http api.
 type Server struct {
 	// Router is the handler for the embedded http.Server's
@@ -113,14 +352,48 @@ type Server struct {
 	logger *zap.Logger
 	server http.Server
 	store  store.Store
+
+	// webhooks is nil when webhooks are disabled
+	webhooks *webhook.Manager
+
+	// auditSink is nil when auditing is disabled
+	auditSink audit.Sink
+
+	idempotency *idempotencyCache
+	signatures  *signatureCache
+
+	// lockouts is nil when brute force protection is disabled
+	lockouts *lockouts
+
+	// corsPolicy is nil when cross origin requests are not allowed
+	corsPolicy *CORSPolicy
+
+	// deviceAuth is nil when the device authorization grant is
+	// disabled
+	deviceAuth *deviceAuthorizations
+
+	maxBodyBytes   int64
+	maxImportBytes int64
+	maxOffline     time.Duration
+	eventHeartbeat time.Duration
+	adminToken     string
+	tlsCertFile    string
+	tlsKeyFile     string
+
+	// done is closed by Stop to end long running requests,
+	// such as event streams, which Shutdown would wait for.
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // Start starts the server with net/http's ListenAndServer
-// method. Runtime errors are returned and should be handled
-// by the caller.
+// method, or ListenAndServeTLS when TLS is configured. Runtime
+// errors are returned and should be handled by the caller.
 func (s *Server) Start() error {
-	s.addRoutes()
 	s.server.Handler = s.Router
+	if s.tlsCertFile != "" {
+		return s.server.ListenAndServeTLS(s.tlsCertFile, s.tlsKeyFile)
+	}
 	return s.server.ListenAndServe()
 }
 
@@ -131,6 +404,8 @@ func (s *Server) Stop(timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
+	s.stopOnce.Do(func() { close(s.done) })
+
 	if err := s.server.Shutdown(ctx); err != nil {
 		return fmt.Errorf("failed to stop server: %s", err)
 	}
@@ -149,9 +424,76 @@ func (s *Server) addRoutes() {
 
 	// /v1/accounts requests
 	v1 := s.Router.Group("/v1/accounts")
-	v1.POST(":account/validate", s.checkSubscriptionHandler)
+	if s.auditSink != nil {
+		v1.Use(s.auditRequest)
+	}
+	v1.Use(s.authenticate)
+	v1.POST(":account/validate", s.requireActive, s.checkSubscriptionHandler)
 	v1.GET(":account", s.accountHandler)
 	v1.GET(":account/devices", s.devicesHandler)
 	v1.GET(":account/devices/:device", s.deviceHandler)
-	v1.PUT(":account/device", s.registerDeviceHandler)
+	v1.PATCH(":account/devices/:device", s.idempotent, s.requireActive, s.patchDeviceHandler)
+	v1.POST(":account/devices:action", s.idempotent, s.requireActive, s.devicesActionHandler)
+	v1.PUT(":account/device", s.idempotent, s.requireActive, s.registerDeviceHandler)
+	v1.GET(":account/events", s.eventsHandler)
+	v1.POST(":account/tokens", s.idempotent, s.createTokenHandler)
+	v1.GET(":account/tokens", s.tokensHandler)
+	v1.DELETE(":account/tokens/:token", s.idempotent, s.deleteTokenHandler)
+
+	// Enrollment authenticates with an enrollment token rather
+	// than the account key.
+	enroll := s.Router.Group("/v1/accounts")
+	if s.auditSink != nil {
+		enroll.Use(s.auditRequest)
+	}
+	enroll.POST(":account/enroll", s.authenticateEnrollment, s.idempotent, s.requireActive, s.enrollHandler)
+
+	if s.deviceAuth != nil {
+		// The device code and token endpoints are unauthenticated,
+		// as the device has no credentials until it is approved.
+		oauth := s.Router.Group("/v1/oauth")
+		oauth.POST("device/code", s.deviceCodeHandler)
+		oauth.POST("token", s.tokenHandler)
+
+		v1.GET(":account/device-authorizations/:user_code", s.deviceAuthorizationHandler)
+		v1.POST(":account/device-authorizations/:user_code/approve", s.idempotent, s.requireActive, s.approveDeviceHandler)
+		v1.POST(":account/device-authorizations/:user_code/deny", s.idempotent, s.denyDeviceHandler)
+	}
+
+	if s.webhooks != nil {
+		v1.POST(":account/webhooks", s.idempotent, s.createWebhookHandler)
+		v1.GET(":account/webhooks", s.webhooksHandler)
+		v1.DELETE(":account/webhooks/:webhook", s.idempotent, s.deleteWebhookHandler)
+		v1.GET(":account/webhooks/:webhook/deliveries", s.deliveriesHandler)
+		v1.POST(":account/webhooks/:webhook/deliveries/:delivery/replay", s.idempotent, s.replayDeliveryHandler)
+	}
+
+	// /admin/v1 requests
+	if s.adminToken != "" {
+		admin := s.Router.Group("/admin/v1")
+		if s.auditSink != nil {
+			admin.Use(s.auditRequest)
+		}
+		admin.Use(s.authenticateAdmin)
+		admin.GET("snapshot", s.exportHandler)
+		// Snapshot imports are not idempotent requests, as their body
+		// may be up to max_import_bytes. Reapplying a snapshot has the
+		// same result.
+		admin.POST("snapshot", streamBodyBytes(s.maxImportBytes), s.importHandler)
+		admin.POST("accounts/:account/enrollment-tokens", s.idempotent, s.createEnrollmentTokenHandler)
+		admin.GET("accounts/:account/credentials", s.credentialsHandler)
+		admin.DELETE("accounts/:account/credentials/:credential", s.idempotent, s.deleteCredentialHandler)
+		admin.GET("accounts/:account/ip-allowlist", s.allowlistHandler)
+		admin.PUT("accounts/:account/ip-allowlist", s.idempotent, s.putAllowlistHandler)
+
+		if s.auditSink != nil {
+			admin.GET("audit", s.auditHandler)
+		}
+
+		if s.lockouts != nil {
+			admin.GET("lockouts", s.lockoutsHandler)
+			admin.DELETE("lockouts/accounts/:account", s.idempotent, s.clearAccountLockoutHandler)
+			admin.DELETE("lockouts/ips/:ip", s.idempotent, s.clearIPLockoutHandler)
+		}
+	}
 }
@@ -1,7 +1,13 @@
 package server
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
 
 	"github.com/jsirianni/server/logging"
 	"github.com/stretchr/testify/require"
@@ -101,6 +107,49 @@ func TestNew(t *testing.T) {
 			true,
 			"failed to parse 'x.x.x' as an IP address",
 		},
+		{
+			"timeouts",
+			[]Option{
+				WithMemoryStore(false),
+				WithReadTimeout(time.Second * 10),
+				WithReadHeaderTimeout(time.Second * 5),
+				WithWriteTimeout(time.Second * 10),
+				WithIdleTimeout(time.Second * 30),
+				WithEventHeartbeat(time.Second * 5),
+			},
+			false,
+			"",
+		},
+		{
+			"header-timeout-exceeds-read-timeout",
+			[]Option{
+				WithMemoryStore(false),
+				WithReadTimeout(time.Second * 5),
+				WithReadHeaderTimeout(time.Second * 10),
+			},
+			true,
+			"read header timeout 10s cannot be greater than read timeout 5s",
+		},
+		{
+			"header-timeout-without-read-timeout",
+			[]Option{
+				WithMemoryStore(false),
+				WithReadTimeout(0),
+				WithReadHeaderTimeout(time.Second * 10),
+			},
+			false,
+			"",
+		},
+		{
+			"heartbeat-exceeds-stream-lifetime",
+			[]Option{
+				WithMemoryStore(false),
+				WithWriteTimeout(time.Second * 10),
+				WithEventHeartbeat(time.Second * 9),
+			},
+			true,
+			"event heartbeat 9s must be shorter than the event stream lifetime 9s",
+		},
 		{
 			"missing-store",
 			[]Option{
@@ -126,6 +175,92 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestLimitOptions(t *testing.T) {
+	cases := []struct {
+		name      string
+		op        Option
+		expectErr string
+	}{
+		{"read-timeout", WithReadTimeout(time.Second), ""},
+		{"read-timeout-zero", WithReadTimeout(0), ""},
+		{"read-timeout-negative", WithReadTimeout(-time.Second), "read timeout cannot be negative: -1s"},
+		{"read-header-timeout", WithReadHeaderTimeout(time.Second), ""},
+		{"read-header-timeout-negative", WithReadHeaderTimeout(-time.Second), "read header timeout cannot be negative: -1s"},
+		{"write-timeout", WithWriteTimeout(time.Second), ""},
+		{"write-timeout-negative", WithWriteTimeout(-time.Second), "write timeout cannot be negative: -1s"},
+		{"idle-timeout", WithIdleTimeout(time.Second), ""},
+		{"idle-timeout-negative", WithIdleTimeout(-time.Second), "idle timeout cannot be negative: -1s"},
+		{"max-header-bytes", WithMaxHeaderBytes(4096), ""},
+		{"max-header-bytes-zero", WithMaxHeaderBytes(0), "max header bytes must be greater than zero: 0"},
+		{"max-body-bytes", WithMaxBodyBytes(4096), ""},
+		{"max-body-bytes-negative", WithMaxBodyBytes(-1), "max body bytes must be greater than zero: -1"},
+		{"max-offline", WithMaxOffline(time.Hour), ""},
+		{"max-offline-zero", WithMaxOffline(0), ""},
+		{"max-offline-negative", WithMaxOffline(-time.Hour), "max offline cannot be negative: -1h0m0s"},
+		{"event-heartbeat", WithEventHeartbeat(time.Second), ""},
+		{"event-heartbeat-zero", WithEventHeartbeat(0), "event heartbeat must be greater than zero: 0s"},
+		{"tls", WithTLS("cert.pem", "key.pem"), ""},
+		{"tls-missing-key", WithTLS("cert.pem", ""), "tls requires both a certificate file and a private key file"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			err := tc.op(s)
+			if tc.expectErr != "" {
+				require.Error(t, err)
+				require.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	s, err := New(testLogger(t), WithMemoryStore(false))
+	require.NoError(t, err)
+	require.Equal(t, DefaultTimeout, s.server.ReadTimeout)
+	require.Equal(t, DefaultTimeout, s.server.ReadHeaderTimeout)
+	require.Equal(t, DefaultTimeout, s.server.WriteTimeout)
+	require.Equal(t, DefaultIdleTimeout, s.server.IdleTimeout)
+	require.Equal(t, DefaultMaxHeaderBytes, s.server.MaxHeaderBytes)
+	require.Equal(t, int64(DefaultMaxBodyBytes), s.maxBodyBytes)
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	s, err := New(testLogger(t), WithMemoryStore(false), WithMaxBodyBytes(8))
+	require.NoError(t, err)
+	s.Router.POST("/echo", func(c *gin.Context) {
+		c.Writer.WriteHeader(http.StatusOK)
+	})
+
+	cases := []struct {
+		name    string
+		body    string
+		chunked bool
+		expect  int
+	}{
+		{"empty", "", false, http.StatusOK},
+		{"within-limit", "12345678", false, http.StatusOK},
+		{"exceeds-limit", "123456789", false, http.StatusRequestEntityTooLarge},
+		{"chunked-within-limit", "1234", true, http.StatusOK},
+		{"chunked-exceeds-limit", "123456789", true, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(tc.body))
+			if tc.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			s.Router.ServeHTTP(rec, req)
+			require.Equal(t, tc.expect, rec.Code)
+		})
+	}
+}
+
 func TestNewNoLogger(t *testing.T) {
 	_, err := New(nil)
 	require.Error(t, err, "an error is expected when a nil logger is passed")
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/signing"
+	"github.com/jsirianni/server/store"
+)
+
+// DefaultSignatureSkew is the default tolerance between a signed
+// request's date and the server's clock.
+const DefaultSignatureSkew = time.Minute * 5
+
+// WithSignatureSkew configures how far a signed request's date may be
+// from the server's clock. Signatures are remembered for twice the
+// skew to reject replayed requests.
+func WithSignatureSkew(skew time.Duration) Option {
+	return func(s *Server) error {
+		if skew <= 0 {
+			return fmt.Errorf("signature skew must be greater than zero: %s", skew)
+		}
+		s.signatures.skew = skew
+		return nil
+	}
+}
+
+// signatureCache stores the signatures of verified requests until
+// they are outside of the skew tolerance, so that each signature is
+// accepted once.
+type signatureCache struct {
+	skew time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+
+	// order is the signatures by expiry, oldest first
+	order []string
+}
+
+func newSignatureCache() *signatureCache {
+	return &signatureCache{
+		skew:    DefaultSignatureSkew,
+		now:     time.Now,
+		expires: make(map[string]time.Time),
+	}
+}
+
+// use records a verified signature. Returns false if the signature
+// was already used.
+func (sc *signatureCache) use(signature string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.prune(sc.now())
+
+	if _, ok := sc.expires[signature]; ok {
+		return false
+	}
+
+	// A verified request's date is at most the skew in the future,
+	// so its signature is rejected by Verify once twice the skew
+	// has passed. Expiring by arrival keeps order sorted.
+	sc.expires[signature] = sc.now().Add(sc.skew * 2)
+	sc.order = append(sc.order, signature)
+	return true
+}
+
+// prune removes expired signatures. Callers must hold the lock.
+func (sc *signatureCache) prune(now time.Time) {
+	n := 0
+	for _, signature := range sc.order {
+		if sc.expires[signature].After(now) {
+			break
+		}
+		delete(sc.expires, signature)
+		n++
+	}
+	sc.order = sc.order[n:]
+}
+
+// authenticateSigned authenticates a request signed with the account
+// key. The signature must be valid, within the skew tolerance and not
+// previously used. The account is stored in the gin context.
+func (s *Server) authenticateSigned(c *gin.Context, accountID string) {
+	auth, err := signing.Parse(c.GetHeader("Authorization"))
+	if err != nil {
+		s.logger.Sugar().Debugf("invalid signed request: %v", err)
+		abortWithProblem(c, http.StatusUnauthorized, "invalid request signature")
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(auth.AccountID), []byte(accountID)) != 1 {
+		abortWithProblem(c, http.StatusUnauthorized, "request signature credential does not match the account parameter")
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		s.logger.Sugar().Debugf("failed to read request body: %v", err)
+		abortWithProblem(c, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	account, err := s.store.Account(accountID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			s.logger.Sugar().Debugf("failed to lookup account %s: %v", accountID, err)
+			s.rejectCredentials(c, "", "invalid request signature")
+			return
+		}
+		s.logger.Sugar().Errorf("failed to lookup account %s: %v", accountID, err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to lookup account")
+		return
+	}
+
+	if !s.checkAllowlist(c, account) {
+		return
+	}
+
+	if err := auth.Verify(c.Request, body, account.Key, s.signatures.now(), s.signatures.skew); err != nil {
+		s.logger.Sugar().Debugf("invalid signed request for account %s: %v", accountID, err)
+		s.rejectCredentials(c, accountID, err.Error())
+		return
+	}
+
+	if !s.signatures.use(auth.Signature) {
+		s.logger.Sugar().Debugf("replayed signed request for account %s", accountID)
+		abortWithProblem(c, http.StatusUnauthorized, "request signature was already used")
+		return
+	}
+
+	s.lockouts.succeed(account.ID)
+	c.Set(contextKeyAccount, account)
+	c.Next()
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/signing"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedRequests(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		accountID  string
+		key        string
+		signedAt   time.Time
+		expectCode int
+	}{
+		{"validate", http.MethodPost, "/v1/accounts/abc/validate", "", "abc", "xyz", now, http.StatusOK},
+		{"register", http.MethodPut, "/v1/accounts/abc/device", `{"id":"device-c"}`, "abc", "xyz", now, http.StatusOK},
+		{"query", http.MethodGet, "/v1/accounts/abc/devices?selector=env%3Dprod", "", "abc", "xyz", now, http.StatusOK},
+		{"skew", http.MethodGet, "/v1/accounts/abc", "", "abc", "xyz", now.Add(-time.Minute * 4), http.StatusOK},
+		{"expired", http.MethodGet, "/v1/accounts/abc", "", "abc", "xyz", now.Add(-time.Minute * 6), http.StatusUnauthorized},
+		{"wrong-key", http.MethodGet, "/v1/accounts/abc", "", "abc", "wrong", now, http.StatusUnauthorized},
+		{"wrong-account", http.MethodGet, "/v1/accounts/abc", "", "go", "095", now, http.StatusUnauthorized},
+		{"unknown-account", http.MethodGet, "/v1/accounts/missing", "", "missing", "xyz", now, http.StatusUnauthorized},
+		{"inactive", http.MethodPost, "/v1/accounts/go/validate", "", "go", "095", now, http.StatusPaymentRequired},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newSigningServer(t, now)
+
+			req := signedRequest(t, tc.method, tc.path, tc.body, tc.accountID, tc.key, tc.signedAt)
+			rec := httptest.NewRecorder()
+			s.Router.ServeHTTP(rec, req)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+		})
+	}
+}
+
+func TestSignedRequestReplay(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newSigningServer(t, now)
+
+	req := signedRequest(t, http.MethodPut, "/v1/accounts/abc/device", `{"id":"device-c"}`, "abc", "xyz", now)
+	replay := req.Clone(req.Context())
+	replay.Body = io.NopCloser(strings.NewReader(`{"id":"device-c"}`))
+
+	rec := httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, replay)
+	p := requireProblem(t, rec, http.StatusUnauthorized)
+	require.Equal(t, "request signature was already used", p.Detail)
+
+	// Tampered requests do not use the signature.
+	tampered := signedRequest(t, http.MethodGet, "/v1/accounts/abc", "", "abc", "xyz", now)
+	tampered.Header.Set(signing.HeaderNonce, "other")
+	rec = httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, tampered)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestSignatureCache(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	sc := newSignatureCache()
+	sc.now = func() time.Time { return now }
+
+	require.True(t, sc.use("a"))
+	require.False(t, sc.use("a"))
+
+	now = now.Add(DefaultSignatureSkew)
+	require.True(t, sc.use("b"))
+	require.False(t, sc.use("a"))
+
+	// Signatures are forgotten once Verify would reject them.
+	now = now.Add(DefaultSignatureSkew)
+	require.True(t, sc.use("a"))
+	require.False(t, sc.use("b"))
+	require.Len(t, sc.order, 2)
+}
+
+func TestWithSignatureSkew(t *testing.T) {
+	_, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithSignatureSkew(0))
+	require.Error(t, err)
+
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithSignatureSkew(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, s.signatures.skew)
+}
+
+func newSigningServer(t *testing.T, now time.Time) *Server {
+	t.Helper()
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()))
+	require.NoError(t, err)
+	s.signatures.now = func() time.Time { return now }
+	return s
+}
+
+func signedRequest(t *testing.T, method, path, body, accountID, key string, now time.Time) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	require.NoError(t, signing.Sign(req, accountID, key, now))
+	return req
+}
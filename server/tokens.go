@@ -0,0 +1,154 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/model"
+)
+
+// routeScopes names the scope an api token requires for each route in
+// the /v1/accounts group. Routes which are not listed require the
+// account:admin scope.
+var routeScopes = map[string]model.Scope{
+	"POST /v1/accounts/:account/validate":                                 model.ScopeSubscriptionRead,
+	"GET /v1/accounts/:account":                                           model.ScopeSubscriptionRead,
+	"GET /v1/accounts/:account/devices":                                   model.ScopeDevicesRead,
+	"GET /v1/accounts/:account/devices/:device":                           model.ScopeDevicesRead,
+	"GET /v1/accounts/:account/events":                                    model.ScopeDevicesRead,
+	"GET /v1/accounts/:account/device-authorizations/:user_code":          model.ScopeDevicesRead,
+	"PATCH /v1/accounts/:account/devices/:device":                         model.ScopeDevicesWrite,
+	"POST /v1/accounts/:account/devices:action":                           model.ScopeDevicesWrite,
+	"PUT /v1/accounts/:account/device":                                    model.ScopeDevicesWrite,
+	"POST /v1/accounts/:account/device-authorizations/:user_code/approve": model.ScopeDevicesWrite,
+	"POST /v1/accounts/:account/device-authorizations/:user_code/deny":    model.ScopeDevicesWrite,
+}
+
+// TokenRequest is the request body for creating an api token. The
+// token is valid for TTLSeconds, or until it is deleted when zero.
+type TokenRequest struct {
+	Name       string        `json:"name"`
+	Scopes     []model.Scope `json:"scopes"`
+	TTLSeconds int64         `json:"ttl_seconds"`
+}
+
+// routeScope returns the scope an api token requires for the request.
+func routeScope(c *gin.Context) model.Scope {
+	if scope, ok := routeScopes[c.Request.Method+" "+c.FullPath()]; ok {
+		return scope
+	}
+	return model.ScopeAccountAdmin
+}
+
+// createTokenHandler creates an api token for the account. The token
+// is only returned in this response.
+func (s *Server) createTokenHandler(c *gin.Context) {
+	req := TokenRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithProblem(c, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if err := validateScopes(req.Scopes); err != nil {
+		abortWithProblem(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.TTLSeconds < 0 {
+		abortWithProblem(c, http.StatusBadRequest, "ttl_seconds cannot be negative")
+		return
+	}
+
+	now := time.Now()
+	credential, token, err := newCredential(contextAccount(c).ID, model.CredentialToken, now)
+	if err != nil {
+		s.logger.Sugar().Errorf("failed to create api token: %v", err)
+		abortWithProblem(c, http.StatusInternalServerError, "failed to create api token")
+		return
+	}
+	credential.Name = req.Name
+	credential.Scopes = req.Scopes
+	if req.TTLSeconds > 0 {
+		expiresAt := now.Add(time.Duration(req.TTLSeconds) * time.Second).UTC()
+		credential.ExpiresAt = &expiresAt
+	}
+
+	if err := s.store.CreateCredential(credential); err != nil {
+		s.storeError(c, err, "failed to create api token")
+		return
+	}
+
+	c.Set(contextKeyAuditTarget, "token:"+credential.ID)
+	credential.Hash = ""
+	c.JSON(http.StatusCreated, model.IssuedCredential{Credential: credential, Token: token})
+}
+
+// tokensHandler lists the account's api tokens, without their hashes.
+func (s *Server) tokensHandler(c *gin.Context) {
+	credentials, err := s.store.Credentials(contextAccount(c).ID)
+	if err != nil {
+		s.storeError(c, err, "failed to list api tokens")
+		return
+	}
+
+	tokens := make([]model.Credential, 0, len(credentials))
+	for _, credential := range credentials {
+		if credential.Kind != model.CredentialToken {
+			continue
+		}
+		credential.Hash = ""
+		tokens = append(tokens, credential)
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// deleteTokenHandler revokes an api token. Other credentials are
+// managed with the admin api.
+func (s *Server) deleteTokenHandler(c *gin.Context) {
+	accountID := contextAccount(c).ID
+
+	credential, err := s.store.Credential(accountID, c.Param("token"))
+	if err == nil && credential.Kind != model.CredentialToken {
+		abortWithProblem(c, http.StatusNotFound, fmt.Sprintf("api token %s does not exist", c.Param("token")))
+		return
+	}
+	if err == nil {
+		err = s.store.DeleteCredential(accountID, credential.ID)
+	}
+	if err != nil {
+		s.storeError(c, err, "failed to delete api token")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// validateScopes returns an error unless scopes is a non empty list
+// of known scopes.
+func validateScopes(scopes []model.Scope) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+
+	valid := make([]string, 0, len(model.Scopes))
+	for _, s := range model.Scopes {
+		valid = append(valid, string(s))
+	}
+
+	for _, scope := range scopes {
+		known := false
+		for _, s := range model.Scopes {
+			if scope == s {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("invalid scope '%s': must be one of %s", scope, strings.Join(valid, ", "))
+		}
+	}
+	return nil
+}
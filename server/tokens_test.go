@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jsirianni/server/audit"
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenScopes(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	cases := []struct {
+		scopes      string
+		method      string
+		path        string
+		body        string
+		expectCode  int
+		expectScope model.Scope
+	}{
+		{`["subscription:read"]`, http.MethodPost, "/v1/accounts/abc/validate", "", http.StatusOK, ""},
+		{`["subscription:read"]`, http.MethodGet, "/v1/accounts/abc", "", http.StatusOK, ""},
+		{`["subscription:read"]`, http.MethodGet, "/v1/accounts/abc/devices", "", http.StatusForbidden, model.ScopeDevicesRead},
+		{`["devices:read"]`, http.MethodGet, "/v1/accounts/abc/devices", "", http.StatusOK, ""},
+		{`["devices:read"]`, http.MethodGet, "/v1/accounts/abc/devices/device-a", "", http.StatusOK, ""},
+		{`["devices:read"]`, http.MethodPost, "/v1/accounts/abc/validate", "", http.StatusForbidden, model.ScopeSubscriptionRead},
+		{`["devices:read"]`, http.MethodPut, "/v1/accounts/abc/device", `{"id":"device-c"}`, http.StatusForbidden, model.ScopeDevicesWrite},
+		{`["devices:write"]`, http.MethodPut, "/v1/accounts/abc/device", `{"id":"device-c"}`, http.StatusOK, ""},
+		{`["devices:write"]`, http.MethodPatch, "/v1/accounts/abc/devices/device-a", `{"hostname":"a"}`, http.StatusOK, ""},
+		{`["devices:write"]`, http.MethodPost, "/v1/accounts/abc/devices:batch", `[{"id":"device-d"}]`, http.StatusOK, ""},
+		{`["devices:write"]`, http.MethodGet, "/v1/accounts/abc/devices", "", http.StatusForbidden, model.ScopeDevicesRead},
+		{`["devices:read","devices:write"]`, http.MethodGet, "/v1/accounts/abc/tokens", "", http.StatusForbidden, model.ScopeAccountAdmin},
+		{`["devices:write"]`, http.MethodPost, "/v1/accounts/abc/tokens", `{"scopes":["account:admin"]}`, http.StatusForbidden, model.ScopeAccountAdmin},
+		{`["account:admin"]`, http.MethodGet, "/v1/accounts/abc/tokens", "", http.StatusOK, ""},
+		{`["account:admin"]`, http.MethodGet, "/v1/accounts/abc/devices", "", http.StatusOK, ""},
+		{`["account:admin"]`, http.MethodPost, "/v1/accounts/abc/validate", "", http.StatusOK, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.scopes+" "+tc.method+" "+tc.path, func(t *testing.T) {
+			token := createToken(t, s, "abc", "xyz", `{"scopes":`+tc.scopes+`}`)
+
+			rec := doRequest(s, tc.method, tc.path, token.Token, tc.body)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+			if tc.expectCode == http.StatusForbidden {
+				p := requireProblem(t, rec, http.StatusForbidden)
+				require.Equal(t, "api token is missing the "+string(tc.expectScope)+" scope", p.Detail)
+			}
+
+			// Tokens only authenticate their own account.
+			rec = doRequest(s, http.MethodGet, "/v1/accounts/go", token.Token, "")
+			require.Equal(t, http.StatusUnauthorized, rec.Code)
+		})
+	}
+}
+
+func TestCreateToken(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	cases := []struct {
+		name       string
+		key        string
+		body       string
+		expectCode int
+	}{
+		{"scopes", "xyz", `{"name":"ci","scopes":["devices:read","devices:write"]}`, http.StatusCreated},
+		{"ttl", "xyz", `{"scopes":["devices:read"],"ttl_seconds":60}`, http.StatusCreated},
+		{"missing-scopes", "xyz", `{"name":"ci"}`, http.StatusBadRequest},
+		{"unknown-scope", "xyz", `{"scopes":["devices:delete"]}`, http.StatusBadRequest},
+		{"negative-ttl", "xyz", `{"scopes":["devices:read"],"ttl_seconds":-1}`, http.StatusBadRequest},
+		{"invalid-body", "xyz", `[]`, http.StatusBadRequest},
+		{"invalid-key", "wrong", `{"scopes":["devices:read"]}`, http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/tokens", tc.key, tc.body)
+			require.Equal(t, tc.expectCode, rec.Code, rec.Body.String())
+		})
+	}
+
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/tokens", "xyz", `{"scopes":["devices:delete"]}`)
+	p := requireProblem(t, rec, http.StatusBadRequest)
+	require.Equal(t, "invalid scope 'devices:delete': must be one of subscription:read, devices:read, devices:write, account:admin", p.Detail)
+}
+
+func TestTokens(t *testing.T) {
+	s := newAdminServer(t, store.NewTestingMemory())
+
+	token := createToken(t, s, "abc", "xyz", `{"name":"ci","scopes":["devices:read"]}`)
+	require.Equal(t, model.CredentialToken, token.Kind)
+	require.Equal(t, "ci", token.Name)
+	require.Equal(t, []model.Scope{model.ScopeDevicesRead}, token.Scopes)
+	require.Nil(t, token.ExpiresAt)
+	require.Empty(t, token.Hash)
+
+	// Enrollment tokens are managed with the admin api and are not
+	// listed or deleted with the tokens endpoints.
+	enrollment := createEnrollmentToken(t, s, "abc", `{}`)
+
+	rec := doRequest(s, http.MethodGet, "/v1/accounts/abc/tokens", "xyz", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	tokens := []model.Credential{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tokens))
+	require.Len(t, tokens, 1)
+	require.Equal(t, token.ID, tokens[0].ID)
+	require.Empty(t, tokens[0].Hash)
+
+	rec = doRequest(s, http.MethodDelete, "/v1/accounts/abc/tokens/"+enrollment.ID, "xyz", "")
+	requireProblem(t, rec, http.StatusNotFound)
+
+	// An admin token may revoke other tokens, including itself.
+	admin := createToken(t, s, "abc", "xyz", `{"scopes":["account:admin"]}`)
+	rec = doRequest(s, http.MethodDelete, "/v1/accounts/abc/tokens/"+token.ID, admin.Token, "")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc/devices", token.Token, "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = doRequest(s, http.MethodDelete, "/v1/accounts/abc/tokens/"+admin.ID, admin.Token, "")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	rec = doRequest(s, http.MethodDelete, "/v1/accounts/abc/tokens/"+admin.ID, "xyz", "")
+	requireProblem(t, rec, http.StatusNotFound)
+}
+
+func TestTokenAudit(t *testing.T) {
+	sink := audit.NewMemorySink(0)
+	s, err := New(testLogger(t), WithStore(store.NewTestingMemory()), WithAuditSink(sink))
+	require.NoError(t, err)
+
+	token := createToken(t, s, "abc", "xyz", `{"scopes":["devices:read"]}`)
+	rec := doRequest(s, http.MethodPut, "/v1/accounts/abc/device", token.Token, `{"id":"device-c"}`)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	entries, err := sink.Query(audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, audit.Actor{Type: audit.ActorToken, ID: "abc/" + token.ID}, entries[0].Actor)
+	require.Equal(t, audit.ResultFailure, entries[0].Result)
+	require.Equal(t, "token.create", entries[1].Action)
+	require.Equal(t, audit.Actor{Type: audit.ActorAccount, ID: "abc"}, entries[1].Actor)
+	require.Equal(t, "account:abc/token:"+token.ID, entries[1].Target)
+}
+
+// createToken creates an api token with the given account key.
+func createToken(t *testing.T, s *Server, accountID, key, body string) model.IssuedCredential {
+	t.Helper()
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/"+accountID+"/tokens", key, body)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	token := model.IssuedCredential{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &token))
+	return token
+}
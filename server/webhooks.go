@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jsirianni/server/webhook"
+)
+
+// WebhookRequest is the request payload for creating a
+// webhook endpoint.
+type WebhookRequest struct {
+	URL string `json:"url"`
+
+	// Events are the event types sent to the endpoint.
+	// All events are sent when empty.
+	Events []string `json:"events"`
+}
+
+// createWebhookHandler registers a webhook endpoint for the account.
+// The response includes the secret used to sign deliveries, which
+// is not returned again.
+func (s *Server) createWebhookHandler(c *gin.Context) {
+	req := WebhookRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithProblem(c, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	endpoint, err := s.webhooks.CreateEndpoint(contextAccount(c).ID, req.URL, req.Events)
+	if err != nil {
+		s.webhookError(c, err, "failed to create webhook")
+		return
+	}
+	c.JSON(http.StatusCreated, endpoint)
+}
+
+// webhooksHandler lists the account's webhook endpoints.
+func (s *Server) webhooksHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, s.webhooks.Endpoints(contextAccount(c).ID))
+}
+
+// deleteWebhookHandler removes a webhook endpoint and its deliveries.
+func (s *Server) deleteWebhookHandler(c *gin.Context) {
+	if err := s.webhooks.DeleteEndpoint(contextAccount(c).ID, c.Param("webhook")); err != nil {
+		s.webhookError(c, err, "failed to delete webhook")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// deliveriesHandler lists a webhook endpoint's deliveries,
+// newest first.
+func (s *Server) deliveriesHandler(c *gin.Context) {
+	deliveries, err := s.webhooks.Deliveries(contextAccount(c).ID, c.Param("webhook"))
+	if err != nil {
+		s.webhookError(c, err, "failed to list deliveries")
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// replayDeliveryHandler queues a delivery to be attempted again.
+func (s *Server) replayDeliveryHandler(c *gin.Context) {
+	delivery, err := s.webhooks.Replay(contextAccount(c).ID, c.Param("webhook"), c.Param("delivery"))
+	if err != nil {
+		s.webhookError(c, err, "failed to replay delivery")
+		return
+	}
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+// webhookError writes a problem response for a webhook error.
+func (s *Server) webhookError(c *gin.Context, err error, msg string) {
+	switch {
+	case errors.Is(err, webhook.ErrNotFound):
+		abortWithProblem(c, http.StatusNotFound, err.Error())
+	case errors.Is(err, webhook.ErrInvalidEndpoint):
+		abortWithProblem(c, http.StatusBadRequest, err.Error())
+	default:
+		s.logger.Sugar().Errorf("%s: %v", msg, err)
+		abortWithProblem(c, http.StatusInternalServerError, msg)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jsirianni/server/store"
+	"github.com/jsirianni/server/webhook"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestWebhooks(t *testing.T) {
+	received := make(chan string, 10)
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(webhook.HeaderID)
+	}))
+	defer receiver.Close()
+
+	st := watchedStore{Store: store.NewTestingMemory(), watching: make(chan struct{})}
+	m, err := webhook.New(zap.NewNop(), st, webhook.WithHTTPClient(receiver.Client()))
+	require.NoError(t, err)
+
+	s, err := New(testLogger(t), WithStore(st), WithWebhooks(m))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/webhooks", "xyz", `{"url":"`+receiver.URL+`","events":["device.registered"]}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	endpoint := webhook.Endpoint{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &endpoint))
+	require.NotEmpty(t, endpoint.Secret)
+	require.Equal(t, []string{"device.registered"}, endpoint.Events)
+
+	rec = doRequest(s, http.MethodGet, "/v1/accounts/abc/webhooks", "xyz", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	endpoints := []webhook.Endpoint{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &endpoints))
+	require.Len(t, endpoints, 1)
+	require.Empty(t, endpoints[0].Secret)
+
+	// Registering a device is delivered once the manager is
+	// watching the store.
+	<-st.watching
+	rec = doRequest(s, http.MethodPut, "/v1/accounts/abc/device", "xyz", `{"id":"device-c","hostname":"c"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	deliveryID := <-received
+
+	path := "/v1/accounts/abc/webhooks/" + endpoint.ID + "/deliveries"
+	rec = doRequest(s, http.MethodGet, path, "xyz", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	deliveries := []webhook.Delivery{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &deliveries))
+	require.Len(t, deliveries, 1)
+	require.Equal(t, deliveryID, deliveries[0].ID)
+
+	rec = doRequest(s, http.MethodPost, path+"/"+deliveryID+"/replay", "xyz", "")
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	require.Equal(t, deliveryID, <-received, "expected the delivery to be replayed")
+
+	rec = doRequest(s, http.MethodPost, path+"/missing/replay", "xyz", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	requireProblem(t, rec, http.StatusNotFound)
+
+	rec = doRequest(s, http.MethodDelete, "/v1/accounts/go/webhooks/"+endpoint.ID, "095", "")
+	require.Equal(t, http.StatusNotFound, rec.Code, "expected other accounts' webhooks to be hidden")
+
+	rec = doRequest(s, http.MethodDelete, "/v1/accounts/abc/webhooks/"+endpoint.ID, "xyz", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	rec = doRequest(s, http.MethodGet, path, "xyz", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestWebhooksErrors(t *testing.T) {
+	st := store.NewTestingMemory()
+	m, err := webhook.New(zap.NewNop(), st)
+	require.NoError(t, err)
+	s, err := New(testLogger(t), WithStore(st), WithWebhooks(m))
+	require.NoError(t, err)
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"invalid-body", `{"url":`, http.StatusBadRequest},
+		{"insecure-url", `{"url":"http://example.com"}`, http.StatusBadRequest},
+		{"unknown-event", `{"url":"https://example.com","events":["device.exploded"]}`, http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := doRequest(s, http.MethodPost, "/v1/accounts/abc/webhooks", "xyz", tc.body)
+			require.Equal(t, tc.status, rec.Code)
+			requireProblem(t, rec, tc.status)
+		})
+	}
+
+	disabled, err := New(testLogger(t), WithStore(st))
+	require.NoError(t, err)
+	rec := doRequest(disabled, http.MethodGet, "/v1/accounts/abc/webhooks", "xyz", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	_, err = New(testLogger(t), WithStore(st), WithWebhooks(nil))
+	require.ErrorContains(t, err, "webhook manager cannot be nil")
+}
+
+// watchedStore closes watching once the store is watched.
+type watchedStore struct {
+	store.Store
+	watching chan struct{}
+}
+
+func (s watchedStore) Watch(ctx context.Context, fromRevision uint64) (<-chan store.Event, error) {
+	events, err := s.Store.Watch(ctx, fromRevision)
+	close(s.watching)
+	return events, err
+}
@@ -0,0 +1,271 @@
+// Package signing signs and verifies api requests with an HMAC of
+// the account key, as an alternative to sending the key as a bearer
+// token. The scheme is modeled on AWS Signature Version 4.
+//
+// The signature is the hex encoded HMAC-SHA256, keyed with the account
+// key, of the string to sign:
+//
+//	HMAC-SHA256
+//	<X-Signature-Date>
+//	<hex sha256 of the canonical request>
+//
+// The canonical request is the method, escaped path, sorted query
+// string, signed headers as 'name:value' lines, the semicolon
+// separated signed header names and the hex sha256 of the body, each
+// on its own line. The Authorization header is:
+//
+//	HMAC-SHA256 Credential=<account id>, SignedHeaders=host;x-signature-date;x-signature-nonce, Signature=<hex>
+//
+// The server rejects requests signed more than its skew tolerance
+// away from its clock, and signatures which were already used.
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Algorithm is the Authorization header scheme of signed
+	// requests.
+	Algorithm = "HMAC-SHA256"
+
+	// HeaderDate is the time at which the request was signed,
+	// formatted with DateFormat.
+	HeaderDate = "X-Signature-Date"
+
+	// HeaderNonce is a random value which makes the signatures of
+	// identical requests signed in the same second unique.
+	HeaderNonce = "X-Signature-Nonce"
+
+	// DateFormat is the ISO 8601 basic format of HeaderDate.
+	DateFormat = "20060102T150405Z"
+)
+
+// requiredHeaders must be signed by every request.
+var requiredHeaders = []string{"host", strings.ToLower(HeaderDate), strings.ToLower(HeaderNonce)}
+
+// ErrInvalidSignature is returned by Verify when a signature does not
+// match or has expired.
+var ErrInvalidSignature = errors.New("invalid request signature")
+
+// Authorization is a parsed signed request Authorization header.
+type Authorization struct {
+	// AccountID is the account whose key signed the request.
+	AccountID string
+
+	// SignedHeaders are the lower case names of the signed
+	// headers, in the order they were signed.
+	SignedHeaders []string
+
+	// Signature is the hex encoded signature.
+	Signature string
+}
+
+// IsSigned returns true if the request's Authorization header uses
+// the signing scheme.
+func IsSigned(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Authorization"), Algorithm+" ")
+}
+
+// Sign signs req for the account at now, setting the date, nonce and
+// Authorization headers. The host, date and nonce headers are signed,
+// along with any headers named in extraHeaders. The request body is read
+// and replaced so that it can still be sent.
+func Sign(req *http.Request, accountID, key string, now time.Time, extraHeaders ...string) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	req.Header.Set(HeaderDate, now.UTC().Format(DateFormat))
+	req.Header.Set(HeaderNonce, hex.EncodeToString(nonce))
+
+	signed := append([]string{}, requiredHeaders...)
+	for _, h := range extraHeaders {
+		signed = append(signed, strings.ToLower(h))
+	}
+	signed = dedupe(signed)
+
+	signature := signature(key, req, signed, body)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, SignedHeaders=%s, Signature=%s",
+		Algorithm, accountID, strings.Join(signed, ";"), signature))
+	return nil
+}
+
+// Parse parses the Authorization header of a signed request.
+func Parse(header string) (Authorization, error) {
+	if !strings.HasPrefix(header, Algorithm+" ") {
+		return Authorization{}, fmt.Errorf("%w: unsupported authorization scheme", ErrInvalidSignature)
+	}
+	params := strings.TrimPrefix(header, Algorithm+" ")
+
+	auth := Authorization{}
+	for _, param := range strings.Split(params, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return Authorization{}, fmt.Errorf("%w: malformed authorization parameter '%s'", ErrInvalidSignature, param)
+		}
+		switch name {
+		case "Credential":
+			auth.AccountID = value
+		case "SignedHeaders":
+			auth.SignedHeaders = strings.Split(value, ";")
+		case "Signature":
+			auth.Signature = value
+		default:
+			return Authorization{}, fmt.Errorf("%w: unknown authorization parameter '%s'", ErrInvalidSignature, name)
+		}
+	}
+
+	if auth.AccountID == "" || auth.Signature == "" || len(auth.SignedHeaders) == 0 {
+		return Authorization{}, fmt.Errorf("%w: Credential, SignedHeaders and Signature are required", ErrInvalidSignature)
+	}
+
+	for _, h := range requiredHeaders {
+		if !contains(auth.SignedHeaders, h) {
+			return Authorization{}, fmt.Errorf("%w: the %s header must be signed", ErrInvalidSignature, h)
+		}
+	}
+	return auth, nil
+}
+
+// Verify returns ErrInvalidSignature if auth's signature is not the
+// signature of req and body with key, or if the request was signed
+// more than tolerance away from now. The caller passes the request
+// body, which it has read from req.
+func (a Authorization) Verify(req *http.Request, body []byte, key string, now time.Time, tolerance time.Duration) error {
+	date, err := time.Parse(DateFormat, req.Header.Get(HeaderDate))
+	if err != nil {
+		return fmt.Errorf("%w: invalid %s header '%s'", ErrInvalidSignature, HeaderDate, req.Header.Get(HeaderDate))
+	}
+
+	if req.Header.Get(HeaderNonce) == "" {
+		return fmt.Errorf("%w: missing %s header", ErrInvalidSignature, HeaderNonce)
+	}
+
+	age := now.Sub(date)
+	if age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: %s is outside of the %s tolerance", ErrInvalidSignature, HeaderDate, tolerance)
+	}
+
+	expected := signature(key, req, a.SignedHeaders, body)
+	if !hmac.Equal([]byte(expected), []byte(a.Signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// signature returns the hex encoded signature of the request.
+func signature(key string, req *http.Request, signedHeaders []string, body []byte) string {
+	canonical := sha256.Sum256([]byte(canonicalRequest(req, signedHeaders, body)))
+	stringToSign := Algorithm + "\n" + req.Header.Get(HeaderDate) + "\n" + hex.EncodeToString(canonical[:])
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalRequest returns the canonical form of the request which
+// is hashed into the string to sign.
+func canonicalRequest(req *http.Request, signedHeaders []string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	b := strings.Builder{}
+	b.WriteString(req.Method + "\n")
+	b.WriteString(req.URL.EscapedPath() + "\n")
+	b.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+	for _, h := range signedHeaders {
+		b.WriteString(h + ":" + headerValue(req, h) + "\n")
+	}
+	b.WriteString(strings.Join(signedHeaders, ";") + "\n")
+	b.WriteString(hex.EncodeToString(bodyHash[:]))
+	return b.String()
+}
+
+// canonicalQuery returns the query parameters sorted by name and
+// value, with spaces escaped as '%20'.
+func canonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, escape(name)+"="+escape(v))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// headerValue returns the comma joined, trimmed values of a header.
+// The host header is read from the request's host.
+func headerValue(req *http.Request, name string) string {
+	if name == "host" {
+		if req.Host != "" {
+			return req.Host
+		}
+		return req.URL.Host
+	}
+
+	values := make([]string, 0, 1)
+	for _, v := range req.Header.Values(name) {
+		values = append(values, strings.TrimSpace(v))
+	}
+	return strings.Join(values, ",")
+}
+
+// readBody returns the request body and replaces it with a reader of
+// the same bytes.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// dedupe returns the sorted, unique names.
+func dedupe(names []string) []string {
+	sort.Strings(names)
+	out := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package signing
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name      string
+		modify    func(*http.Request) []byte
+		key       string
+		now       time.Time
+		expectErr bool
+	}{
+		{"valid", nil, "xyz", now, false},
+		{"skew", nil, "xyz", now.Add(time.Minute * 4), false},
+		{"wrong-key", nil, "abc", now, true},
+		{"expired", nil, "xyz", now.Add(time.Minute * 6), true},
+		{"future", nil, "xyz", now.Add(-time.Minute * 6), true},
+		{"body", func(r *http.Request) []byte { return []byte(`{"id":"device-b"}`) }, "xyz", now, true},
+		{"method", func(r *http.Request) []byte { r.Method = http.MethodPost; return nil }, "xyz", now, true},
+		{"path", func(r *http.Request) []byte { r.URL.Path = "/v1/accounts/abc/devices/device-b"; return nil }, "xyz", now, true},
+		{"query", func(r *http.Request) []byte { r.URL.RawQuery = "mode=atomic"; return nil }, "xyz", now, true},
+		{"host", func(r *http.Request) []byte { r.Host = "other.example.com"; return nil }, "xyz", now, true},
+		{"signed-header", func(r *http.Request) []byte { r.Header.Set("Content-Type", "text/plain"); return nil }, "xyz", now, true},
+		{"unsigned-header", func(r *http.Request) []byte { r.Header.Set("Accept", "text/plain"); return nil }, "xyz", now, false},
+		{"date", func(r *http.Request) []byte {
+			r.Header.Set(HeaderDate, now.Add(time.Second).Format(DateFormat))
+			return nil
+		}, "xyz", now, true},
+		{"nonce", func(r *http.Request) []byte { r.Header.Set(HeaderNonce, "other"); return nil }, "xyz", now, true},
+		{"missing-nonce", func(r *http.Request) []byte { r.Header.Del(HeaderNonce); return nil }, "xyz", now, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"id":"device-a"}`
+			req := httptest.NewRequest(http.MethodPut, "https://api.example.com/v1/accounts/abc/device?b=2&a=1", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			require.NoError(t, Sign(req, "abc", "xyz", now, "Content-Type"))
+
+			// The body can still be read after signing.
+			b, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.Equal(t, body, string(b))
+
+			if tc.modify != nil {
+				if modified := tc.modify(req); modified != nil {
+					b = modified
+				}
+			}
+
+			auth, err := Parse(req.Header.Get("Authorization"))
+			require.NoError(t, err)
+			require.Equal(t, "abc", auth.AccountID)
+			require.Equal(t, []string{"content-type", "host", "x-signature-date", "x-signature-nonce"}, auth.SignedHeaders)
+
+			err = auth.Verify(req, b, tc.key, tc.now, time.Minute*5)
+			if tc.expectErr {
+				require.ErrorIs(t, err, ErrInvalidSignature)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSignUnique(t *testing.T) {
+	now := time.Now()
+	first := httptest.NewRequest(http.MethodGet, "/v1/accounts/abc", nil)
+	second := httptest.NewRequest(http.MethodGet, "/v1/accounts/abc", nil)
+	require.NoError(t, Sign(first, "abc", "xyz", now))
+	require.NoError(t, Sign(second, "abc", "xyz", now))
+	require.NotEqual(t, first.Header.Get("Authorization"), second.Header.Get("Authorization"))
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    string
+		expectErr string
+	}{
+		{"valid", "HMAC-SHA256 Credential=abc, SignedHeaders=host;x-signature-date;x-signature-nonce, Signature=00", ""},
+		{"bearer", "Bearer xyz", "unsupported authorization scheme"},
+		{"missing-signature", "HMAC-SHA256 Credential=abc, SignedHeaders=host;x-signature-date;x-signature-nonce", "Credential, SignedHeaders and Signature are required"},
+		{"unsigned-date", "HMAC-SHA256 Credential=abc, SignedHeaders=host;x-signature-nonce, Signature=00", "the x-signature-date header must be signed"},
+		{"unsigned-host", "HMAC-SHA256 Credential=abc, SignedHeaders=x-signature-date;x-signature-nonce, Signature=00", "the host header must be signed"},
+		{"unknown-parameter", "HMAC-SHA256 Credential=abc, Region=us, SignedHeaders=host, Signature=00", "unknown authorization parameter 'Region'"},
+		{"malformed", "HMAC-SHA256 Credential", "malformed authorization parameter"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(tc.header)
+			if tc.expectErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrInvalidSignature)
+			require.Contains(t, err.Error(), tc.expectErr)
+		})
+	}
+}
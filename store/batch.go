@@ -0,0 +1,150 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jsirianni/server/model"
+)
+
+// BatchMode determines how RegisterDevices handles failed devices.
+type BatchMode string
+
+const (
+	// BatchAtomic registers every device or none of them.
+	BatchAtomic BatchMode = "atomic"
+
+	// BatchPerItem registers every device which does not fail.
+	BatchPerItem BatchMode = "per-item"
+)
+
+// ParseBatchMode returns the batch mode with the given name.
+func ParseBatchMode(s string) (BatchMode, error) {
+	switch mode := BatchMode(s); mode {
+	case BatchAtomic, BatchPerItem:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid batch mode '%s': must be one of %s or %s", s, BatchAtomic, BatchPerItem)
+	}
+}
+
+// BatchStatus is the outcome of a device in a batch.
+type BatchStatus string
+
+const (
+	// BatchCreated devices were registered.
+	BatchCreated BatchStatus = "created"
+
+	// BatchUpdated devices replaced an existing device.
+	BatchUpdated BatchStatus = "updated"
+
+	// BatchFailed devices were not registered. The result's
+	// error describes why.
+	BatchFailed BatchStatus = "failed"
+
+	// BatchAborted devices were valid, but were not registered
+	// because another device in an atomic batch failed.
+	BatchAborted BatchStatus = "aborted"
+)
+
+// BatchResult is the outcome of a single device in a batch.
+type BatchResult struct {
+	DeviceID string
+	Status   BatchStatus
+	Err      error
+
+	// Conflict is set when the device's fingerprint differs from
+	// the registered device with the same id.
+	Conflict *model.FingerprintConflict
+}
+
+// ErrDuplicateDevice is returned for a device which appears more
+// than once in a batch.
+var ErrDuplicateDevice = errors.New("duplicate device in batch")
+
+// RegisterDevices registers devices with a single write. Device limits
+// are enforced across the whole batch, in order.
+func (m *Memory) RegisterDevices(accountID, accountKey string, devices []model.Device, mode BatchMode) ([]BatchResult, error) {
+	if _, err := ParseBatchMode(string(mode)); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account, err := m.validateAccount(accountID, accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("subscription validation failed: %w", err)
+	}
+
+	results := make([]BatchResult, len(devices))
+	accepted := make([]model.Device, 0, len(devices))
+	events := make([]EventType, 0, len(devices))
+	seen := make(map[string]bool, len(devices))
+	count := len(m.devices[accountID])
+	failed := false
+
+	for i, device := range devices {
+		device.AccountID = accountID
+		results[i].DeviceID = device.ID
+
+		invalid := validateDevice(device)
+		if device.ID != "" && invalid == nil {
+			device, results[i].Conflict, invalid = m.resolveFingerprint(account, device)
+		}
+
+		_, exists := m.devices[accountID][device.ID]
+		switch {
+		case device.ID == "":
+			results[i].Err = fmt.Errorf("%w: device id is required", ErrInvalidDevice)
+		case invalid != nil:
+			results[i].Err = invalid
+		case seen[device.ID]:
+			results[i].Err = fmt.Errorf("%w: device with id %s", ErrDuplicateDevice, device.ID)
+		case !exists && account.MaxDevices > 0 && count >= account.MaxDevices:
+			results[i].Err = fmt.Errorf("%w: account with id %s may register %d devices", ErrDeviceLimit, accountID, account.MaxDevices)
+		}
+
+		if results[i].Err != nil {
+			results[i].Status = BatchFailed
+			failed = true
+			continue
+		}
+
+		seen[device.ID] = true
+		results[i].Status = BatchUpdated
+		event := EventDeviceUpdated
+		if !exists {
+			count++
+			results[i].Status = BatchCreated
+			event = EventDeviceRegistered
+		}
+		accepted = append(accepted, device)
+		events = append(events, event)
+	}
+
+	if mode == BatchAtomic && failed {
+		for i := range results {
+			if results[i].Status != BatchFailed {
+				results[i].Status = BatchAborted
+			}
+		}
+		return results, nil
+	}
+
+	if len(accepted) == 0 {
+		return results, nil
+	}
+
+	err = m.write(walRecord{Op: walPutDevices, Devices: accepted}, func() {
+		for i := range accepted {
+			device := accepted[i]
+			m.putDevice(device)
+			m.feed.publish(Event{Type: events[i], AccountID: accountID, Device: &device})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
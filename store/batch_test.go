@@ -0,0 +1,137 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/jsirianni/server/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterDevices(t *testing.T) {
+	cases := []struct {
+		name          string
+		mode          BatchMode
+		devices       []model.Device
+		expectStatus  []BatchStatus
+		expectErr     []error
+		expectDevices []string
+	}{
+		{
+			"atomic",
+			BatchAtomic,
+			[]model.Device{{ID: "a"}, {ID: "c"}},
+			[]BatchStatus{BatchUpdated, BatchCreated},
+			[]error{nil, nil},
+			[]string{"a", "b", "c"},
+		},
+		{
+			"atomic-limit",
+			BatchAtomic,
+			[]model.Device{{ID: "c"}, {ID: "d"}},
+			[]BatchStatus{BatchAborted, BatchFailed},
+			[]error{nil, ErrDeviceLimit},
+			[]string{"a", "b"},
+		},
+		{
+			"atomic-invalid",
+			BatchAtomic,
+			[]model.Device{{ID: "a"}, {ID: ""}},
+			[]BatchStatus{BatchAborted, BatchFailed},
+			[]error{nil, ErrInvalidDevice},
+			[]string{"a", "b"},
+		},
+		{
+			"per-item-limit",
+			BatchPerItem,
+			[]model.Device{{ID: "c"}, {ID: "d"}, {ID: "a"}},
+			[]BatchStatus{BatchCreated, BatchFailed, BatchUpdated},
+			[]error{nil, ErrDeviceLimit, nil},
+			[]string{"a", "b", "c"},
+		},
+		{
+			"per-item-duplicate",
+			BatchPerItem,
+			[]model.Device{{ID: "c"}, {ID: "c"}},
+			[]BatchStatus{BatchCreated, BatchFailed},
+			[]error{nil, ErrDuplicateDevice},
+			[]string{"a", "b", "c"},
+		},
+		{
+			"per-item-all-failed",
+			BatchPerItem,
+			[]model.Device{{ID: ""}},
+			[]BatchStatus{BatchFailed},
+			[]error{ErrInvalidDevice},
+			[]string{"a", "b"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewMemory()
+			require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, MaxDevices: 3}))
+			_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "a"})
+			require.NoError(t, err)
+			_, err = m.RegisterDevice("abc", "xyz", model.Device{ID: "b"})
+			require.NoError(t, err)
+
+			results, err := m.RegisterDevices("abc", "xyz", tc.devices, tc.mode)
+			require.NoError(t, err)
+			require.Len(t, results, len(tc.devices))
+			for i, r := range results {
+				require.Equal(t, tc.devices[i].ID, r.DeviceID)
+				require.Equal(t, tc.expectStatus[i], r.Status, "device %d", i)
+				if tc.expectErr[i] == nil {
+					require.NoError(t, r.Err)
+				} else {
+					require.ErrorIs(t, r.Err, tc.expectErr[i])
+				}
+			}
+
+			devices, err := m.Devices("abc", nil)
+			require.NoError(t, err)
+			ids := []string{}
+			for _, d := range devices {
+				require.Equal(t, "abc", d.AccountID)
+				ids = append(ids, d.ID)
+			}
+			require.Equal(t, tc.expectDevices, ids)
+		})
+	}
+}
+
+func TestRegisterDevicesFingerprint(t *testing.T) {
+	m := NewMemory()
+	require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, FingerprintPolicy: model.FingerprintFork}))
+	_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "a", Fingerprint: &model.Fingerprint{MachineID: "a"}})
+	require.NoError(t, err)
+
+	clone := &model.Fingerprint{MachineID: "b"}
+	results, err := m.RegisterDevices("abc", "xyz", []model.Device{{ID: "a", Fingerprint: clone}, {ID: "a", Fingerprint: clone}}, BatchPerItem)
+	require.NoError(t, err)
+	require.Equal(t, BatchCreated, results[0].Status)
+	require.Equal(t, forkedID("a", *clone), results[0].Conflict.ForkedID)
+	require.ErrorIs(t, results[1].Err, ErrDuplicateDevice)
+
+	require.NoError(t, m.UpdateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, FingerprintPolicy: model.FingerprintReject}))
+	results, err = m.RegisterDevices("abc", "xyz", []model.Device{{ID: "b"}, {ID: "a", Fingerprint: &model.Fingerprint{MachineID: "c"}}}, BatchAtomic)
+	require.NoError(t, err)
+	require.Equal(t, BatchAborted, results[0].Status)
+	require.Equal(t, BatchFailed, results[1].Status)
+	require.Equal(t, "a", results[1].DeviceID)
+	require.ErrorIs(t, results[1].Err, ErrFingerprintConflict)
+	require.Equal(t, model.FingerprintReject, results[1].Conflict.Policy)
+}
+
+func TestRegisterDevicesErrors(t *testing.T) {
+	m := NewTestingMemory()
+
+	_, err := m.RegisterDevices("abc", "bad", []model.Device{{ID: "a"}}, BatchAtomic)
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+
+	_, err = m.RegisterDevices("abc", "xyz", []model.Device{{ID: "a"}}, BatchMode("best-effort"))
+	require.ErrorContains(t, err, "invalid batch mode 'best-effort'")
+
+	_, err = ParseBatchMode("per-item")
+	require.NoError(t, err)
+}
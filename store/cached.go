@@ -0,0 +1,452 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jsirianni/server/labels"
+	"github.com/jsirianni/server/model"
+)
+
+const (
+	// DefaultCacheMaxEntries is the default maximum number of
+	// cached entries.
+	DefaultCacheMaxEntries = 100000
+)
+
+// CachedOption is a function that configures a Cached option.
+type CachedOption func(*Cached) error
+
+// WithMaxEntries configures the maximum number of cached entries.
+// The least recently used entry is evicted when the limit is reached.
+func WithMaxEntries(n int) CachedOption {
+	return func(c *Cached) error {
+		if n <= 0 {
+			return fmt.Errorf("max entries must be greater than zero: %d", n)
+		}
+		c.maxEntries = n
+		return nil
+	}
+}
+
+// WithNegativeTTL configures how long failed lookups, such as
+// missing accounts and invalid account keys, are cached. Zero
+// disables negative caching. Backend errors are never cached.
+func WithNegativeTTL(ttl time.Duration) CachedOption {
+	return func(c *Cached) error {
+		if ttl < 0 {
+			return fmt.Errorf("negative ttl cannot be negative: %s", ttl)
+		}
+		c.negativeTTL = ttl
+		return nil
+	}
+}
+
+// NewCached returns a Store which caches account lookups and
+// subscription checks from s for ttl. Writes made through the
+// returned Store invalidate the affected entries. Writes made to s
+// directly are not visible until the cached entries expire.
+func NewCached(s Store, ttl time.Duration, ops ...CachedOption) (*Cached, error) {
+	if s == nil {
+		return nil, errors.New("store cannot be nil")
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl must be greater than zero: %s", ttl)
+	}
+
+	c := &Cached{
+		store:         s,
+		ttl:           ttl,
+		negativeTTL:   ttl,
+		maxEntries:    DefaultCacheMaxEntries,
+		now:           time.Now,
+		lru:           list.New(),
+		accounts:      make(map[string]*list.Element),
+		subscriptions: make(map[string]map[[sha256.Size]byte]*list.Element),
+		invalidated:   make(map[string]uint64),
+	}
+
+	for _, op := range ops {
+		if err := op(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Cached is a read through cache decorator for a Store.
+type Cached struct {
+	store       Store
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	now         func() time.Time
+
+	mu sync.Mutex
+
+	// generation is incremented by every invalidation. A result is
+	// not cached if its account was invalidated at a later generation
+	// than the lookup started, because it may predate the write which
+	// caused the invalidation.
+	generation uint64
+
+	// invalidated is the generation each account was last invalidated
+	// at, and cleared is the generation of the last invalidateAll.
+	// invalidated is emptied whenever no lookups are in flight.
+	invalidated map[string]uint64
+	cleared     uint64
+	inflight    int
+
+	// lru holds every *cacheEntry, most recently used first
+	lru *list.List
+
+	// accounts is indexed with account id
+	accounts map[string]*list.Element
+
+	// subscriptions is indexed with account id and then a
+	// hash of the account key, so that invalidating an
+	// account drops all of its entries.
+	subscriptions map[string]map[[sha256.Size]byte]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+// cacheEntry is a cached account lookup or, when subscription is
+// true, a cached subscription check.
+type cacheEntry struct {
+	accountID    string
+	subscription bool
+	keyHash      [sha256.Size]byte
+
+	account model.Account
+	sub     model.Subscription
+	err     error
+	expires time.Time
+}
+
+// CacheStats are cache statistics.
+type CacheStats struct {
+	// Hits is the number of lookups served from the cache.
+	Hits uint64 `json:"hits"`
+
+	// Misses is the number of lookups passed to the store.
+	Misses uint64 `json:"misses"`
+
+	// Entries is the number of cached entries, including
+	// expired entries which have not been evicted.
+	Entries int `json:"entries"`
+}
+
+var (
+	_ Store       = (*Cached)(nil)
+	_ Snapshotter = (*Cached)(nil)
+)
+
+// Stats returns the cache statistics.
+func (c *Cached) Stats() CacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: entries,
+	}
+}
+
+// CheckSubscription returns the subscription status of the given
+// account. Active subscriptions are not cached beyond their expiry.
+func (c *Cached) CheckSubscription(accountID, accountKey string) (model.Subscription, error) {
+	keyHash := sha256.Sum256([]byte(accountKey))
+	now := c.now()
+
+	if entry, ok := c.lookup(accountID, &keyHash, now); ok {
+		return entry.sub, entry.err
+	}
+
+	generation := c.begin()
+	sub, err := c.store.CheckSubscription(accountID, accountKey)
+
+	ttl, cacheable := c.entryTTL(err, ErrInvalidCredentials)
+	entry := &cacheEntry{accountID: accountID, subscription: true, keyHash: keyHash, sub: sub, err: err, expires: now.Add(ttl)}
+	if sub.Active() && sub.ExpiresAt != nil && sub.ExpiresAt.Before(entry.expires) {
+		entry.expires = *sub.ExpiresAt
+	}
+	c.end(generation, entry, cacheable)
+
+	return sub, err
+}
+
+// RegisterDevice registers the device with the underlying store
+// and invalidates the account's cached entries.
+func (c *Cached) RegisterDevice(accountID, accountKey string, device model.Device) (model.DeviceRegistration, error) {
+	defer c.invalidate(accountID)
+	return c.store.RegisterDevice(accountID, accountKey, device)
+}
+
+// RegisterDevices registers the devices with the underlying store
+// and invalidates the account's cached entries.
+func (c *Cached) RegisterDevices(accountID, accountKey string, devices []model.Device, mode BatchMode) ([]BatchResult, error) {
+	defer c.invalidate(accountID)
+	return c.store.RegisterDevices(accountID, accountKey, devices, mode)
+}
+
+// Account returns an account
+func (c *Cached) Account(accountID string) (model.Account, error) {
+	now := c.now()
+
+	if entry, ok := c.lookup(accountID, nil, now); ok {
+		return entry.account, entry.err
+	}
+
+	generation := c.begin()
+	account, err := c.store.Account(accountID)
+
+	ttl, cacheable := c.entryTTL(err, ErrNotFound)
+	c.end(generation, &cacheEntry{accountID: accountID, account: account, err: err, expires: now.Add(ttl)}, cacheable)
+
+	return account, err
+}
+
+// Devices returns the devices for a given account whose
+// labels match selector.
+func (c *Cached) Devices(accountID string, selector labels.Selector) ([]model.Device, error) {
+	return c.store.Devices(accountID, selector)
+}
+
+// Device returns a device from a given account
+func (c *Cached) Device(accountID, deviceID string) (model.Device, error) {
+	return c.store.Device(accountID, deviceID)
+}
+
+// CreateAccount stores a new account and invalidates any
+// negative entries for the account.
+func (c *Cached) CreateAccount(account model.Account) error {
+	defer c.invalidate(account.ID)
+	return c.store.CreateAccount(account)
+}
+
+// Accounts returns all accounts ordered by id.
+func (c *Cached) Accounts() ([]model.Account, error) {
+	return c.store.Accounts()
+}
+
+// UpdateAccount replaces an existing account and invalidates
+// the account's cached entries.
+func (c *Cached) UpdateAccount(account model.Account) error {
+	defer c.invalidate(account.ID)
+	return c.store.UpdateAccount(account)
+}
+
+// PatchDevice updates a device in the underlying store and
+// invalidates the account's cached entries.
+func (c *Cached) PatchDevice(accountID, deviceID string, patch model.DevicePatch) (model.Device, error) {
+	defer c.invalidate(accountID)
+	return c.store.PatchDevice(accountID, deviceID, patch)
+}
+
+// DeleteDevice removes a device from a given account and
+// invalidates the account's cached entries.
+func (c *Cached) DeleteDevice(accountID, deviceID string) error {
+	defer c.invalidate(accountID)
+	return c.store.DeleteDevice(accountID, deviceID)
+}
+
+// CreateCredential stores the credential in the underlying store.
+func (c *Cached) CreateCredential(credential model.Credential) error {
+	return c.store.CreateCredential(credential)
+}
+
+// Credential returns a credential from the underlying store.
+// Credentials are not cached, so that revocations take effect
+// immediately.
+func (c *Cached) Credential(accountID, credentialID string) (model.Credential, error) {
+	return c.store.Credential(accountID, credentialID)
+}
+
+// Credentials returns the account's credentials from the
+// underlying store.
+func (c *Cached) Credentials(accountID string) ([]model.Credential, error) {
+	return c.store.Credentials(accountID)
+}
+
+// DeleteCredential revokes a credential in the underlying store.
+func (c *Cached) DeleteCredential(accountID, credentialID string) error {
+	return c.store.DeleteCredential(accountID, credentialID)
+}
+
+// Enroll enrolls the device with the underlying store and
+// invalidates the account's cached entries.
+func (c *Cached) Enroll(accountID, enrollmentID string, device model.Device, credential model.Credential) (model.DeviceRegistration, error) {
+	defer c.invalidate(accountID)
+	return c.store.Enroll(accountID, enrollmentID, device, credential)
+}
+
+// Watch returns a channel of changes made to the underlying store.
+func (c *Cached) Watch(ctx context.Context, fromRevision uint64) (<-chan Event, error) {
+	return c.store.Watch(ctx, fromRevision)
+}
+
+// Export writes a snapshot of the underlying store to w.
+func (c *Cached) Export(w io.Writer) error {
+	return Export(c.store, w)
+}
+
+// Import applies a snapshot to the underlying store and clears
+// the cache.
+func (c *Cached) Import(r io.Reader, mode ImportMode) (ImportStats, error) {
+	defer c.invalidateAll()
+	return Import(c.store, r, mode)
+}
+
+// Close closes the underlying store.
+func (c *Cached) Close() error {
+	return Close(c.store)
+}
+
+// lookup returns a copy of the account's entry, or its subscription
+// entry for keyHash when set, if it has not expired. The entry is
+// marked as recently used. Hits and misses are counted.
+func (c *Cached) lookup(accountID string, keyHash *[sha256.Size]byte, now time.Time) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var el *list.Element
+	if keyHash != nil {
+		el = c.subscriptions[accountID][*keyHash]
+	} else {
+		el = c.accounts[accountID]
+	}
+
+	if el != nil {
+		entry := el.Value.(*cacheEntry)
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(el)
+			atomic.AddUint64(&c.hits, 1)
+			return *entry, true
+		}
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return cacheEntry{}, false
+}
+
+// begin records the start of a lookup in the underlying store and
+// returns the current generation, which is passed to end.
+func (c *Cached) begin() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inflight++
+	return c.generation
+}
+
+// end records the end of a lookup which started at generation, and
+// caches entry if it is cacheable and its account was not
+// invalidated since the lookup started.
+func (c *Cached) end(generation uint64, entry *cacheEntry, cacheable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inflight--
+	stale := c.cleared > generation || c.invalidated[entry.accountID] > generation
+	if c.inflight == 0 && len(c.invalidated) > 0 {
+		c.invalidated = make(map[string]uint64)
+	}
+	if !cacheable || stale {
+		return
+	}
+
+	if entry.subscription {
+		if el, ok := c.subscriptions[entry.accountID][entry.keyHash]; ok {
+			c.remove(el)
+		}
+	} else if el, ok := c.accounts[entry.accountID]; ok {
+		c.remove(el)
+	}
+
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+
+	el := c.lru.PushFront(entry)
+	if !entry.subscription {
+		c.accounts[entry.accountID] = el
+		return
+	}
+
+	keys, ok := c.subscriptions[entry.accountID]
+	if !ok {
+		keys = make(map[[sha256.Size]byte]*list.Element)
+		c.subscriptions[entry.accountID] = keys
+	}
+	keys[entry.keyHash] = el
+}
+
+// remove removes the entry of el from the cache. Callers must hold
+// the lock.
+func (c *Cached) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	if !entry.subscription {
+		delete(c.accounts, entry.accountID)
+		return
+	}
+
+	keys := c.subscriptions[entry.accountID]
+	delete(keys, entry.keyHash)
+	if len(keys) == 0 {
+		delete(c.subscriptions, entry.accountID)
+	}
+}
+
+// invalidateAll removes all cached entries.
+func (c *Cached) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.cleared = c.generation
+	c.lru.Init()
+	c.accounts = make(map[string]*list.Element)
+	c.subscriptions = make(map[string]map[[sha256.Size]byte]*list.Element)
+}
+
+// invalidate removes all cached entries for an account.
+func (c *Cached) invalidate(accountID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if c.inflight > 0 {
+		c.invalidated[accountID] = c.generation
+	}
+	if el, ok := c.accounts[accountID]; ok {
+		c.remove(el)
+	}
+	for _, el := range c.subscriptions[accountID] {
+		c.remove(el)
+	}
+}
+
+// entryTTL returns the ttl for a result with the given error and
+// whether or not it should be cached. Successful results and errors
+// matching negative are cached.
+func (c *Cached) entryTTL(err, negative error) (time.Duration, bool) {
+	if err == nil {
+		return c.ttl, true
+	}
+	if errors.Is(err, negative) && c.negativeTTL > 0 {
+		return c.negativeTTL, true
+	}
+	return 0, false
+}
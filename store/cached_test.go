@@ -0,0 +1,294 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCached(t *testing.T) {
+	_, err := NewCached(nil, time.Minute)
+	require.ErrorContains(t, err, "store cannot be nil")
+
+	_, err = NewCached(NewMemory(), 0)
+	require.ErrorContains(t, err, "ttl must be greater than zero")
+
+	_, err = NewCached(NewMemory(), time.Minute, WithNegativeTTL(-time.Second))
+	require.ErrorContains(t, err, "negative ttl cannot be negative")
+
+	_, err = NewCached(NewMemory(), time.Minute, WithMaxEntries(0))
+	require.ErrorContains(t, err, "max entries must be greater than zero")
+}
+
+func TestCachedAccount(t *testing.T) {
+	c, now := newTestCached(t, NewTestingMemory())
+
+	account, err := c.Account("abc")
+	require.NoError(t, err)
+	require.Equal(t, "abc", account.ID)
+	require.Equal(t, CacheStats{Hits: 0, Misses: 1, Entries: 1}, c.Stats())
+
+	account, err = c.Account("abc")
+	require.NoError(t, err)
+	require.Equal(t, "abc", account.ID)
+	require.Equal(t, CacheStats{Hits: 1, Misses: 1, Entries: 1}, c.Stats())
+
+	// Entries expire after the ttl.
+	*now = now.Add(time.Minute)
+	_, err = c.Account("abc")
+	require.NoError(t, err)
+	require.Equal(t, CacheStats{Hits: 1, Misses: 2, Entries: 1}, c.Stats())
+}
+
+func TestCachedNegative(t *testing.T) {
+	c, now := newTestCached(t, NewTestingMemory(), WithNegativeTTL(time.Second*10))
+
+	_, err := c.Account("missing")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = c.Account("missing")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, uint64(1), c.Stats().Hits)
+
+	_, err = c.CheckSubscription("abc", "bad")
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = c.CheckSubscription("abc", "bad")
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	require.Equal(t, uint64(2), c.Stats().Hits)
+
+	// Negative entries use the negative ttl.
+	*now = now.Add(time.Second * 10)
+	_, err = c.Account("missing")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, uint64(2), c.Stats().Hits)
+
+	// Creating the account invalidates the negative entry.
+	require.NoError(t, c.CreateAccount(model.Account{ID: "missing", Key: "key"}))
+	account, err := c.Account("missing")
+	require.NoError(t, err)
+	require.Equal(t, "missing", account.ID)
+}
+
+func TestCachedNegativeDisabled(t *testing.T) {
+	c, _ := newTestCached(t, NewTestingMemory(), WithNegativeTTL(0))
+
+	_, err := c.Account("missing")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = c.Account("missing")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, CacheStats{Hits: 0, Misses: 2, Entries: 0}, c.Stats())
+}
+
+func TestCachedBackendErrorsNotCached(t *testing.T) {
+	backend := &failingStore{Store: NewTestingMemory(), err: errors.New("connection refused")}
+	c, _ := newTestCached(t, backend)
+
+	_, err := c.Account("abc")
+	require.ErrorContains(t, err, "connection refused")
+
+	backend.err = nil
+	account, err := c.Account("abc")
+	require.NoError(t, err)
+	require.Equal(t, "abc", account.ID)
+	require.Equal(t, CacheStats{Hits: 0, Misses: 2, Entries: 1}, c.Stats())
+}
+
+func TestCachedCheckSubscription(t *testing.T) {
+	c, _ := newTestCached(t, NewTestingMemory())
+
+	sub, err := c.CheckSubscription("abc", "xyz")
+	require.NoError(t, err)
+	require.True(t, sub.Active())
+	sub, err = c.CheckSubscription("abc", "xyz")
+	require.NoError(t, err)
+	require.True(t, sub.Active())
+	require.Equal(t, CacheStats{Hits: 1, Misses: 1, Entries: 1}, c.Stats())
+
+	// Keys are cached separately.
+	_, err = c.CheckSubscription("abc", "other")
+	require.Error(t, err)
+	require.Equal(t, CacheStats{Hits: 1, Misses: 2, Entries: 2}, c.Stats())
+}
+
+func TestCachedSubscriptionExpiry(t *testing.T) {
+	m := NewMemory()
+	c, now := newTestCached(t, m)
+	m.now = func() time.Time { return *now }
+
+	expires := now.Add(time.Second)
+	require.NoError(t, c.CreateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, ExpiresAt: &expires}))
+
+	sub, err := c.CheckSubscription("abc", "xyz")
+	require.NoError(t, err)
+	require.True(t, sub.Active())
+
+	// The entry is not used beyond the subscription's expiry,
+	// even though the ttl has not passed.
+	*now = now.Add(time.Second)
+	sub, err = c.CheckSubscription("abc", "xyz")
+	require.NoError(t, err)
+	require.Equal(t, model.SubscriptionExpired, sub.State)
+}
+
+func TestCachedInvalidation(t *testing.T) {
+	c, _ := newTestCached(t, NewTestingMemory())
+
+	account, err := c.Account("abc")
+	require.NoError(t, err)
+	require.True(t, account.Active)
+	_, err = c.CheckSubscription("abc", "xyz")
+	require.NoError(t, err)
+
+	account.Key = "rotated"
+	account.Active = false
+	require.NoError(t, c.UpdateAccount(account))
+	require.Equal(t, 0, c.Stats().Entries)
+
+	account, err = c.Account("abc")
+	require.NoError(t, err)
+	require.False(t, account.Active)
+	_, err = c.CheckSubscription("abc", "xyz")
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	sub, err := c.CheckSubscription("abc", "rotated")
+	require.NoError(t, err)
+	require.Equal(t, model.SubscriptionInactive, sub.State)
+
+	_, err = c.RegisterDevice("abc", "rotated", model.Device{ID: "new"})
+	require.NoError(t, err)
+	require.Equal(t, 0, c.Stats().Entries)
+
+	_, err = c.Account("abc")
+	require.NoError(t, err)
+	require.NoError(t, c.DeleteDevice("abc", "new"))
+	require.Equal(t, 0, c.Stats().Entries)
+}
+
+func TestCachedMaxEntries(t *testing.T) {
+	c, _ := newTestCached(t, NewTestingMemory(), WithMaxEntries(2), WithNegativeTTL(time.Second))
+
+	_, err := c.Account("abc")
+	require.NoError(t, err)
+	_, err = c.Account("go")
+	require.NoError(t, err)
+	require.Equal(t, 2, c.Stats().Entries)
+
+	// abc is used again, so go is the least recently used.
+	_, err = c.Account("abc")
+	require.NoError(t, err)
+
+	// Missing accounts evict one entry rather than clearing the cache.
+	for i := 0; i < 10; i++ {
+		_, err = c.Account(fmt.Sprintf("missing-%d", i))
+		require.ErrorIs(t, err, ErrNotFound)
+		_, err = c.Account("abc")
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, c.Stats().Entries)
+	require.Equal(t, uint64(11), c.Stats().Hits, "expected abc to stay cached")
+
+	_, err = c.Account("go")
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), c.Stats().Hits, "expected go to be evicted")
+}
+
+func TestCachedInvalidationDuringLookup(t *testing.T) {
+	cases := []struct {
+		name        string
+		invalidate  string
+		expectCache bool
+	}{
+		{"same-account", "abc", false},
+		{"other-account", "go", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocking := &blockingStore{Store: NewTestingMemory(), fetched: make(chan struct{}), release: make(chan struct{})}
+			c, _ := newTestCached(t, blocking)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_, err := c.Account("abc")
+				require.NoError(t, err)
+			}()
+
+			<-blocking.fetched
+			c.invalidate(tc.invalidate)
+			close(blocking.release)
+			<-done
+
+			require.Equal(t, tc.expectCache, c.Stats().Entries == 1)
+		})
+	}
+}
+
+func TestCachedConcurrentAccess(t *testing.T) {
+	c, err := NewCached(NewTestingMemory(), time.Millisecond)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				_, err := c.Account("abc")
+				require.NoError(t, err)
+				_, err = c.CheckSubscription("abc", "xyz")
+				require.NoError(t, err)
+				if j%10 == 0 {
+					_, err := c.RegisterDevice("abc", "xyz", model.Device{ID: fmt.Sprintf("device-%d", i)})
+					require.NoError(t, err)
+				}
+				_ = c.Stats()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	require.Equal(t, uint64(8*200*2), stats.Hits+stats.Misses)
+}
+
+func newTestCached(t *testing.T, s Store, ops ...CachedOption) (*Cached, *time.Time) {
+	t.Helper()
+	c, err := NewCached(s, time.Minute, ops...)
+	require.NoError(t, err)
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+// failingStore returns err from Account when err is set.
+type failingStore struct {
+	Store
+	err error
+}
+
+func (f *failingStore) Account(accountID string) (model.Account, error) {
+	if f.err != nil {
+		return model.Account{}, f.err
+	}
+	return f.Store.Account(accountID)
+}
+
+// blockingStore signals fetched from Account and then waits for
+// release before returning.
+type blockingStore struct {
+	Store
+	fetched chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) Account(accountID string) (model.Account, error) {
+	account, err := b.Store.Account(accountID)
+	b.fetched <- struct{}{}
+	<-b.release
+	return account, err
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jsirianni/server/model"
+)
+
+// CreateCredential stores a new credential. Device credentials must
+// be bound to an existing device.
+func (m *Memory) CreateCredential(credential model.Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.accounts[credential.AccountID]; !ok {
+		return fmt.Errorf("%w: account with id %s does not exist", ErrNotFound, credential.AccountID)
+	}
+
+	if _, ok := m.credentials[credential.AccountID][credential.ID]; ok {
+		return fmt.Errorf("%w: credential with id %s", ErrAlreadyExists, credential.ID)
+	}
+
+	if credential.Kind == model.CredentialDevice {
+		if _, ok := m.devices[credential.AccountID][credential.DeviceID]; !ok {
+			return fmt.Errorf("%w: account with id %s does not have device with id %s", ErrNotFound, credential.AccountID, credential.DeviceID)
+		}
+	}
+
+	return m.write(walRecord{Op: walPutCredential, Credential: &credential}, func() {
+		m.putCredential(credential)
+	})
+}
+
+// Credential returns a credential for a given account.
+func (m *Memory) Credential(accountID, credentialID string) (model.Credential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	credential, ok := m.credentials[accountID][credentialID]
+	if !ok {
+		return model.Credential{}, fmt.Errorf("%w: account with id %s does not have credential with id %s", ErrNotFound, accountID, credentialID)
+	}
+	return credential, nil
+}
+
+// Credentials returns the credentials for a given account,
+// ordered by id.
+func (m *Memory) Credentials(accountID string) ([]model.Credential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.accounts[accountID]; !ok {
+		return nil, fmt.Errorf("%w: account with id %s does not exist", ErrNotFound, accountID)
+	}
+
+	credentials := make([]model.Credential, 0, len(m.credentials[accountID]))
+	for _, c := range m.credentials[accountID] {
+		credentials = append(credentials, c)
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].ID < credentials[j].ID
+	})
+	return credentials, nil
+}
+
+// DeleteCredential revokes a credential.
+func (m *Memory) DeleteCredential(accountID, credentialID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	credential, ok := m.credentials[accountID][credentialID]
+	if !ok {
+		return fmt.Errorf("%w: account with id %s does not have credential with id %s", ErrNotFound, accountID, credentialID)
+	}
+
+	return m.write(walRecord{Op: walDeleteCredential, Credential: &credential}, func() {
+		m.deleteCredential(accountID, credentialID)
+	})
+}
+
+// Enroll uses the enrollment credential to register the device and
+// stores credential as the device's credential. Returns
+// ErrInvalidCredentials if the enrollment credential does not exist,
+// has expired or has no uses left, and ErrAlreadyExists if the device
+// is registered with a different or no fingerprint. A device which
+// enrolls again with the same fingerprint replaces its credentials.
+func (m *Memory) Enroll(accountID, enrollmentID string, device model.Device, credential model.Credential) (model.DeviceRegistration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account, ok := m.accounts[accountID]
+	if !ok {
+		return model.DeviceRegistration{}, fmt.Errorf("%w: %s", ErrInvalidCredentials, accountID)
+	}
+
+	enrollment, ok := m.credentials[accountID][enrollmentID]
+	switch {
+	case !ok || enrollment.Kind != model.CredentialEnrollment:
+		return model.DeviceRegistration{}, fmt.Errorf("%w: enrollment token %s does not exist", ErrInvalidCredentials, enrollmentID)
+	case enrollment.ExpiresAt != nil && !m.now().Before(*enrollment.ExpiresAt):
+		return model.DeviceRegistration{}, fmt.Errorf("%w: enrollment token %s has expired", ErrInvalidCredentials, enrollmentID)
+	case enrollment.MaxUses > 0 && enrollment.Uses >= enrollment.MaxUses:
+		return model.DeviceRegistration{}, fmt.Errorf("%w: enrollment token %s has no uses left", ErrInvalidCredentials, enrollmentID)
+	}
+
+	device, conflict, event, err := m.prepareDevice(account, device)
+	if err != nil {
+		return model.DeviceRegistration{}, err
+	}
+	if existing, ok := m.devices[accountID][device.ID]; ok && !sameFingerprint(device.Fingerprint, existing.Fingerprint) {
+		return model.DeviceRegistration{}, fmt.Errorf("%w: device with id %s is registered with a different fingerprint", ErrAlreadyExists, device.ID)
+	}
+
+	enrollment.Uses++
+	credential.AccountID = accountID
+	credential.Kind = model.CredentialDevice
+	credential.DeviceID = device.ID
+	credentials := []model.Credential{enrollment, credential}
+
+	err = m.write(walRecord{Op: walEnroll, Device: &device, Credentials: credentials}, func() {
+		m.enroll(device, credentials)
+		m.feed.publish(Event{Type: event, AccountID: accountID, Device: &device})
+	})
+	if err != nil {
+		return model.DeviceRegistration{}, err
+	}
+	return model.DeviceRegistration{Device: device, Conflict: conflict}, nil
+}
+
+// sameFingerprint returns true if f and other are both set and
+// identify the same hardware.
+func sameFingerprint(f, other *model.Fingerprint) bool {
+	return !f.Empty() && !other.Empty() && *f == *other
+}
+
+// enroll stores an enrolled device and its credentials, replacing
+// the device's previous credentials. Callers must hold the write lock.
+func (m *Memory) enroll(device model.Device, credentials []model.Credential) {
+	m.putDevice(device)
+	m.deleteDeviceCredentials(device.AccountID, device.ID)
+	for _, c := range credentials {
+		m.putCredential(c)
+	}
+}
+
+// putCredential indexes a credential under its account. Callers
+// must hold the write lock.
+func (m *Memory) putCredential(credential model.Credential) {
+	accountCredentials, ok := m.credentials[credential.AccountID]
+	if !ok {
+		accountCredentials = make(map[string]model.Credential)
+		m.credentials[credential.AccountID] = accountCredentials
+	}
+	accountCredentials[credential.ID] = credential
+}
+
+// deleteCredential removes a credential if it exists. Callers must
+// hold the write lock.
+func (m *Memory) deleteCredential(accountID, credentialID string) {
+	delete(m.credentials[accountID], credentialID)
+	if len(m.credentials[accountID]) == 0 {
+		delete(m.credentials, accountID)
+	}
+}
+
+// deleteDeviceCredentials removes the credentials bound to a device.
+// Callers must hold the write lock.
+func (m *Memory) deleteDeviceCredentials(accountID, deviceID string) {
+	for id, c := range m.credentials[accountID] {
+		if c.Kind == model.CredentialDevice && c.DeviceID == deviceID {
+			m.deleteCredential(accountID, id)
+		}
+	}
+}
+
+// sortedCredentials returns each account's credentials ordered by id.
+func sortedCredentials(credentials map[string]map[string]model.Credential) map[string][]model.Credential {
+	sorted := make(map[string][]model.Credential, len(credentials))
+	for accountID, accountCredentials := range credentials {
+		list := make([]model.Credential, 0, len(accountCredentials))
+		for _, c := range accountCredentials {
+			list = append(list, c)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].ID < list[j].ID
+		})
+		sorted[accountID] = list
+	}
+	return sorted
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateCredential(t *testing.T) {
+	m := NewTestingMemory()
+
+	enrollment := model.Credential{ID: "e", AccountID: "abc", Kind: model.CredentialEnrollment, Hash: "hash", MaxUses: 1}
+	require.NoError(t, m.CreateCredential(enrollment))
+	require.ErrorIs(t, m.CreateCredential(enrollment), ErrAlreadyExists)
+
+	require.NoError(t, m.CreateCredential(model.Credential{ID: "d", AccountID: "abc", Kind: model.CredentialDevice, DeviceID: "device-a"}))
+	err := m.CreateCredential(model.Credential{ID: "x", AccountID: "abc", Kind: model.CredentialDevice, DeviceID: "missing"})
+	require.ErrorIs(t, err, ErrNotFound)
+	err = m.CreateCredential(model.Credential{ID: "x", AccountID: "missing", Kind: model.CredentialEnrollment})
+	require.ErrorIs(t, err, ErrNotFound)
+
+	c, err := m.Credential("abc", "e")
+	require.NoError(t, err)
+	require.Equal(t, enrollment, c)
+
+	credentials, err := m.Credentials("abc")
+	require.NoError(t, err)
+	require.Len(t, credentials, 2)
+	require.Equal(t, "d", credentials[0].ID)
+
+	require.NoError(t, m.DeleteCredential("abc", "e"))
+	require.ErrorIs(t, m.DeleteCredential("abc", "e"), ErrNotFound)
+	_, err = m.Credential("abc", "e")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = m.Credentials("missing")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestEnroll(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Second)
+	m := NewTestingMemory()
+	m.now = func() time.Time { return now }
+	require.NoError(t, m.CreateCredential(model.Credential{ID: "e", AccountID: "abc", Kind: model.CredentialEnrollment, MaxUses: 3}))
+	require.NoError(t, m.CreateCredential(model.Credential{ID: "expired", AccountID: "abc", Kind: model.CredentialEnrollment, MaxUses: 1, ExpiresAt: &expired}))
+	require.NoError(t, m.CreateCredential(model.Credential{ID: "old", AccountID: "abc", Kind: model.CredentialDevice, DeviceID: "device-a"}))
+
+	// Existing devices are not replaced, and keep their credentials.
+	_, err := m.Enroll("abc", "e", model.Device{ID: "device-a", Hostname: "enrolled"}, model.Credential{ID: "new"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+	_, err = m.Credential("abc", "old")
+	require.NoError(t, err)
+
+	fingerprint := &model.Fingerprint{MachineID: "m1"}
+	registration, err := m.Enroll("abc", "e", model.Device{ID: "device-c", Hostname: "enrolled", Fingerprint: fingerprint}, model.Credential{ID: "new", Hash: "hash"})
+	require.NoError(t, err)
+	require.Equal(t, model.Device{AccountID: "abc", ID: "device-c", Hostname: "enrolled", Fingerprint: fingerprint}, registration.Device)
+
+	c, err := m.Credential("abc", "new")
+	require.NoError(t, err)
+	require.Equal(t, model.Credential{ID: "new", AccountID: "abc", Kind: model.CredentialDevice, DeviceID: "device-c", Hash: "hash"}, c)
+
+	_, err = m.Enroll("abc", "e", model.Device{ID: "device-c", Fingerprint: &model.Fingerprint{MachineID: "m2"}}, model.Credential{ID: "x"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+	_, err = m.Enroll("abc", "e", model.Device{ID: "device-c"}, model.Credential{ID: "x"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	// The same device enrolling again replaces its credential.
+	_, err = m.Enroll("abc", "e", model.Device{ID: "device-c", Fingerprint: fingerprint}, model.Credential{ID: "renewed"})
+	require.NoError(t, err)
+	_, err = m.Credential("abc", "new")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	c, err = m.Credential("abc", "e")
+	require.NoError(t, err)
+	require.Equal(t, 2, c.Uses)
+
+	_, err = m.Enroll("abc", "e", model.Device{ID: "device-e"}, model.Credential{ID: "c"})
+	require.NoError(t, err)
+	_, err = m.Enroll("abc", "e", model.Device{ID: "device-d"}, model.Credential{ID: "d"})
+	require.ErrorIs(t, err, ErrInvalidCredentials, "expected the token to have no uses left")
+
+	_, err = m.Enroll("abc", "expired", model.Device{ID: "device-d"}, model.Credential{ID: "d"})
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = m.Enroll("abc", "renewed", model.Device{ID: "device-d"}, model.Credential{ID: "d"})
+	require.ErrorIs(t, err, ErrInvalidCredentials, "expected device credentials to not enroll devices")
+	_, err = m.Enroll("missing", "e", model.Device{ID: "device-d"}, model.Credential{ID: "d"})
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+
+	_, err = m.Device("abc", "device-d")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Deleting a device revokes its credentials.
+	require.NoError(t, m.DeleteDevice("abc", "device-c"))
+	_, err = m.Credential("abc", "renewed")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestEnrollFork(t *testing.T) {
+	m := NewMemory()
+	require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, FingerprintPolicy: model.FingerprintFork}))
+	require.NoError(t, m.CreateCredential(model.Credential{ID: "e", AccountID: "abc", Kind: model.CredentialEnrollment, MaxUses: 2}))
+
+	_, err := m.Enroll("abc", "e", model.Device{ID: "vm", Fingerprint: &model.Fingerprint{MachineID: "a"}}, model.Credential{ID: "first"})
+	require.NoError(t, err)
+	registration, err := m.Enroll("abc", "e", model.Device{ID: "vm", Fingerprint: &model.Fingerprint{MachineID: "b"}}, model.Credential{ID: "clone"})
+	require.NoError(t, err)
+	require.NotNil(t, registration.Conflict)
+
+	// The clone's credential is bound to the forked device, and the
+	// original device keeps its credential.
+	c, err := m.Credential("abc", "clone")
+	require.NoError(t, err)
+	require.Equal(t, registration.Conflict.ForkedID, c.DeviceID)
+	c, err = m.Credential("abc", "first")
+	require.NoError(t, err)
+	require.Equal(t, "vm", c.DeviceID)
+}
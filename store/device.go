@@ -0,0 +1,114 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/jsirianni/server/labels"
+	"github.com/jsirianni/server/model"
+)
+
+// validateDevice returns ErrInvalidDevice if the device's labels
+// or annotations are invalid.
+func validateDevice(device model.Device) error {
+	if err := labels.Validate(device.Labels); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDevice, err)
+	}
+	if err := labels.ValidateAnnotations(device.Annotations); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDevice, err)
+	}
+	return nil
+}
+
+// ParseFingerprintPolicy returns the fingerprint policy with the
+// given name. An empty name is FingerprintAllow.
+func ParseFingerprintPolicy(s string) (model.FingerprintPolicy, error) {
+	switch policy := model.FingerprintPolicy(s); policy {
+	case "":
+		return model.FingerprintAllow, nil
+	case model.FingerprintAllow, model.FingerprintReject, model.FingerprintFork:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid fingerprint policy '%s': must be one of %s, %s or %s", s, model.FingerprintAllow, model.FingerprintReject, model.FingerprintFork)
+	}
+}
+
+// resolveFingerprint applies the account's fingerprint policy to a
+// device whose id may already be registered with a different
+// fingerprint. It returns the device to store, which has a forked id
+// under FingerprintFork, and the conflict if there is one. Callers
+// must hold the lock.
+func (m *Memory) resolveFingerprint(account model.Account, device model.Device) (model.Device, *model.FingerprintConflict, error) {
+	existing, ok := m.devices[account.ID][device.ID]
+	if !ok || !device.Fingerprint.Conflicts(existing.Fingerprint) {
+		return device, nil, nil
+	}
+
+	conflict := &model.FingerprintConflict{
+		DeviceID: device.ID,
+		Policy:   account.FingerprintPolicy,
+		Existing: *existing.Fingerprint,
+	}
+	if conflict.Policy == "" {
+		conflict.Policy = model.FingerprintAllow
+	}
+
+	switch conflict.Policy {
+	case model.FingerprintReject:
+		return device, conflict, fmt.Errorf("%w: device with id %s is registered with a different fingerprint", ErrFingerprintConflict, device.ID)
+	case model.FingerprintFork:
+		conflict.ForkedID = forkedID(device.ID, *device.Fingerprint)
+		forked, ok := m.devices[account.ID][conflict.ForkedID]
+		if ok && device.Fingerprint.Conflicts(forked.Fingerprint) {
+			return device, conflict, fmt.Errorf("%w: forked device with id %s is registered with a different fingerprint", ErrFingerprintConflict, conflict.ForkedID)
+		}
+		device.ID = conflict.ForkedID
+	}
+
+	return device, conflict, nil
+}
+
+// forkedID returns the id of a device forked from id. The same
+// fingerprint always forks to the same id, so a forked device
+// which registers again replaces its earlier registration.
+func forkedID(id string, fingerprint model.Fingerprint) string {
+	sum := sha256.Sum256([]byte(fingerprint.MachineID + "\x00" + fingerprint.MACHash))
+	return id + "-" + hex.EncodeToString(sum[:4])
+}
+
+// applyPatch returns a copy of device with patch applied.
+func applyPatch(device model.Device, patch model.DevicePatch) model.Device {
+	if patch.Hostname != nil {
+		device.Hostname = *patch.Hostname
+	}
+	device.Labels = patchMap(device.Labels, patch.Labels)
+	device.Annotations = patchMap(device.Annotations, patch.Annotations)
+	return device
+}
+
+// patchMap returns a copy of m with the keys in patch set, or
+// removed when their value is nil. Returns nil when the result
+// is empty.
+func patchMap(m map[string]string, patch map[string]*string) map[string]string {
+	if len(patch) == 0 {
+		return m
+	}
+
+	patched := make(map[string]string, len(m)+len(patch))
+	for k, v := range m {
+		patched[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(patched, k)
+			continue
+		}
+		patched[k] = *v
+	}
+
+	if len(patched) == 0 {
+		return nil
+	}
+	return patched
+}
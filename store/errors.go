@@ -0,0 +1,35 @@
+package store
+
+import "errors"
+
+var (
+	// ErrNotFound is returned when an account or device
+	// does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrAlreadyExists is returned when creating an account or
+	// credential, or enrolling a device, which already exists.
+	ErrAlreadyExists = errors.New("already exists")
+
+	// ErrInvalidCredentials is returned when an account does not
+	// exist or the account key is invalid.
+	ErrInvalidCredentials = errors.New("account does not exist or account key is invalid")
+
+	// ErrDeviceLimit is returned when registering a device would
+	// exceed the account's device limit.
+	ErrDeviceLimit = errors.New("device limit reached")
+
+	// ErrInvalidDevice is returned when registering a device
+	// without an id.
+	ErrInvalidDevice = errors.New("invalid device")
+
+	// ErrFingerprintConflict is returned when a device re-registers
+	// with a different fingerprint and the account's policy is
+	// to reject it.
+	ErrFingerprintConflict = errors.New("fingerprint conflict")
+
+	// ErrTooLarge is returned when a write is too large to be
+	// stored, such as a device larger than a write-ahead log
+	// record.
+	ErrTooLarge = errors.New("too large")
+)
@@ -0,0 +1,35 @@
+//go:build !unix
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockDir takes an exclusive lock on dir by creating a lock file,
+// which is removed by unlockDir. A lock file left behind by a crash
+// must be removed by the operator.
+func lockDir(dir string) (*os.File, error) {
+	path := filepath.Join(dir, walLockFileName)
+	// #nosec G304 the wal directory is provided by the operator
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("%w: %s: remove %s if no other process is running", ErrWALLocked, dir, path)
+		}
+		return nil, fmt.Errorf("failed to lock wal directory: %w", err)
+	}
+	return f, nil
+}
+
+// unlockDir releases a lock taken by lockDir.
+func unlockDir(f *os.File) error {
+	err := f.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDir takes an exclusive lock on dir, which is held until the
+// returned file is passed to unlockDir or the process exits.
+func lockDir(dir string) (*os.File, error) {
+	path := filepath.Join(dir, walLockFileName)
+	// #nosec G304 the wal directory is provided by the operator
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal lock: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrWALLocked, dir)
+		}
+		return nil, fmt.Errorf("failed to lock wal directory: %w", err)
+	}
+	return f, nil
+}
+
+// unlockDir releases a lock taken by lockDir.
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
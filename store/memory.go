@@ -1,17 +1,26 @@
 package store
 
 import (
+	"context"
+	"crypto/subtle"
 	"fmt"
+	"io"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/jsirianni/server/labels"
 	"github.com/jsirianni/server/model"
 )
 
 // NewMemory returns a new memory store.
 func NewMemory() *Memory {
 	return &Memory{
-		accounts: []model.Account{},
-		devices:  make(map[string][]model.Device),
+		accounts:    make(map[string]model.Account),
+		devices:     make(map[string]map[string]model.Device),
+		credentials: make(map[string]map[string]model.Credential),
+		feed:        newFeed(),
+		now:         time.Now,
 	}
 }
 
@@ -19,169 +28,389 @@ func NewMemory() *Memory {
 // for development use.
 func NewTestingMemory() *Memory {
 	m := NewMemory()
-	m.accounts = []model.Account{
-		{
-			ID:     "abc",
-			Key:    "xyz",
-			Active: true,
-		},
-		{
-			ID:     "go",
-			Key:    "095",
-			Active: false,
-		},
-	}
-	m.devices = map[string][]model.Device{
-		"abc": {
-			{
-				ID:        "device-a",
-				AccountID: "abc",
-				Hostname:  "testname",
-			},
-			{
-				ID:        "device-b",
-				AccountID: "abc",
-				Hostname:  "testname-b",
-			},
-		},
+	accounts, devices := seedData()
+	for _, a := range accounts {
+		m.accounts[a.ID] = a
+	}
+	for _, d := range devices {
+		m.putDevice(d)
 	}
 	return m
 }
 
-// Memory is an in memory store.
+// Memory is an in memory store. Accounts and devices are indexed
+// by id so that lookups do not depend on the number of accounts
+// or devices. Reads share a read lock and do not block each other.
+// Stores returned by OpenMemory are durable.
 type Memory struct {
-	// accounts are stored as slices
-	// because we do not care about performance for
-	// testing.
-	accounts []model.Account
+	// accounts is indexed with account id
+	accounts map[string]model.Account
+
+	// devices is indexed with account id and then device id
+	devices map[string]map[string]model.Device
+
+	// credentials is indexed with account id and then credential id
+	credentials map[string]map[string]model.Credential
 
-	// device map is indexed with account id
-	devices map[string][]model.Device
+	// wal is nil unless the store was returned by OpenMemory
+	wal *wal
 
-	mu sync.Mutex
+	// feed delivers change events to watchers
+	feed *feed
+
+	// now determines whether subscriptions have expired
+	now func() time.Time
+
+	mu sync.RWMutex
 }
 
-var _ Store = (*Memory)(nil)
+var (
+	_ Store       = (*Memory)(nil)
+	_ Snapshotter = (*Memory)(nil)
+)
 
-// CheckSubscription returns an error if the given account
-// is invalid.
-func (m *Memory) CheckSubscription(accountID, accountKey string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// CheckSubscription returns the subscription status of the given
+// account. Returns ErrInvalidCredentials if the account does not exist
+// or the key is invalid.
+func (m *Memory) CheckSubscription(accountID, accountKey string) (model.Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	if _, err := m.validateAccount(accountID, accountKey); err != nil {
-		return fmt.Errorf("subscription validation failed for account with id %s: %v", accountID, err)
+	account, err := m.validateAccount(accountID, accountKey)
+	if err != nil {
+		return model.Subscription{}, fmt.Errorf("subscription validation failed for account with id %s: %w", accountID, err)
 	}
-	return nil
+	return SubscriptionStatus(account, m.now()), nil
 }
 
 // RegisterDevice takes an accountID, accountKey, deviceInfo and stores
-// the device if the account is valid.
-func (m *Memory) RegisterDevice(accountID, accountKey string, device model.Device) error {
+// the device if the account is valid. An existing device with the same
+// id is replaced, unless its fingerprint differs and the account's
+// fingerprint policy rejects or forks the device.
+func (m *Memory) RegisterDevice(accountID, accountKey string, device model.Device) (model.DeviceRegistration, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, err := m.validateAccount(accountID, accountKey); err != nil {
-		return fmt.Errorf("subscription validation failed: %v", err)
+	account, err := m.validateAccount(accountID, accountKey)
+	if err != nil {
+		return model.DeviceRegistration{}, fmt.Errorf("subscription validation failed: %w", err)
 	}
 
-	// If account not in device map, index it and add the device.
-	if _, ok := m.devices[accountID]; !ok {
-		m.devices[accountID] = []model.Device{device}
+	device, conflict, event, err := m.prepareDevice(account, device)
+	if err != nil {
+		return model.DeviceRegistration{}, err
 	}
 
-	// If account in device map, check if device already exists
-	for i, d := range m.devices[accountID] {
-		// This should always be the case because devices are indexed
-		// under accountID, but check to be sure.
-		if d.AccountID == accountID {
-			if d.ID == device.ID {
-				// replace device in slice.
-				m.devices[accountID][i] = device
-				return nil
-			}
-		}
+	err = m.write(walRecord{Op: walPutDevice, Device: &device}, func() {
+		m.putDevice(device)
+		m.feed.publish(Event{Type: event, AccountID: accountID, Device: &device})
+	})
+	if err != nil {
+		return model.DeviceRegistration{}, err
 	}
+	return model.DeviceRegistration{Device: device, Conflict: conflict}, nil
+}
 
-	// If device did not exist already, append it
-	m.devices[accountID] = append(m.devices[accountID], device)
+// prepareDevice validates a device registration and applies the
+// account's fingerprint policy and device limit. It returns the device
+// to store and the event for storing it. Callers must hold the lock.
+func (m *Memory) prepareDevice(account model.Account, device model.Device) (model.Device, *model.FingerprintConflict, EventType, error) {
+	if err := validateDevice(device); err != nil {
+		return model.Device{}, nil, "", err
+	}
 
-	return nil
+	device.AccountID = account.ID
+	device, conflict, err := m.resolveFingerprint(account, device)
+	if err != nil {
+		return model.Device{}, nil, "", err
+	}
+
+	if _, ok := m.devices[account.ID][device.ID]; ok {
+		return device, conflict, EventDeviceUpdated, nil
+	}
+	if account.MaxDevices > 0 && len(m.devices[account.ID]) >= account.MaxDevices {
+		return model.Device{}, nil, "", fmt.Errorf("%w: account with id %s may register %d devices", ErrDeviceLimit, account.ID, account.MaxDevices)
+	}
+	return device, conflict, EventDeviceRegistered, nil
 }
 
 // Account returns an account
 func (m *Memory) Account(accountID string) (model.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, ok := m.accounts[accountID]
+	if !ok {
+		return model.Account{}, fmt.Errorf("%w: account with id %s does not exist", ErrNotFound, accountID)
+	}
+	return a, nil
+}
+
+// CreateAccount stores a new account.
+func (m *Memory) CreateAccount(account model.Account) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if _, ok := m.accounts[account.ID]; ok {
+		return fmt.Errorf("%w: account with id %s", ErrAlreadyExists, account.ID)
+	}
+
+	return m.write(walRecord{Op: walPutAccount, Account: &account}, func() {
+		m.accounts[account.ID] = account
+		m.feed.publish(Event{Type: EventAccountCreated, AccountID: account.ID, Account: &account})
+	})
+}
+
+// Accounts returns all accounts ordered by id.
+func (m *Memory) Accounts() ([]model.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	accounts := make([]model.Account, 0, len(m.accounts))
 	for _, a := range m.accounts {
-		if a.ID == accountID {
-			return a, nil
-		}
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].ID < accounts[j].ID
+	})
+	return accounts, nil
+}
+
+// UpdateAccount replaces an existing account.
+func (m *Memory) UpdateAccount(account model.Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.accounts[account.ID]; !ok {
+		return fmt.Errorf("%w: account with id %s does not exist", ErrNotFound, account.ID)
 	}
 
-	return model.Account{}, fmt.Errorf("account with id %s does not exist", accountID)
+	return m.write(walRecord{Op: walPutAccount, Account: &account}, func() {
+		m.accounts[account.ID] = account
+		m.feed.publish(Event{Type: EventAccountUpdated, AccountID: account.ID, Account: &account})
+	})
 }
 
-// Devices returns all devices for a given account
-func (m *Memory) Devices(accountID string) ([]model.Device, error) {
+// PatchDevice applies patch to an existing device.
+func (m *Memory) PatchDevice(accountID, deviceID string, patch model.DevicePatch) (model.Device, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	accountDevices, ok := m.devices[accountID]
+	device, ok := m.devices[accountID][deviceID]
 	if !ok {
-		return nil, fmt.Errorf("account with id %s does not exist in device map", accountID)
+		return model.Device{}, fmt.Errorf("%w: account with id %s does not have device with id %s", ErrNotFound, accountID, deviceID)
+	}
+
+	device = applyPatch(device, patch)
+	if err := validateDevice(device); err != nil {
+		return model.Device{}, err
 	}
 
-	devices := []model.Device{}
+	err := m.write(walRecord{Op: walPutDevice, Device: &device}, func() {
+		m.putDevice(device)
+		m.feed.publish(Event{Type: EventDeviceUpdated, AccountID: accountID, Device: &device})
+	})
+	if err != nil {
+		return model.Device{}, err
+	}
+	return device, nil
+}
+
+// DeleteDevice removes a device from a given account.
+func (m *Memory) DeleteDevice(accountID, deviceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[accountID][deviceID]; !ok {
+		return fmt.Errorf("%w: account with id %s does not have device with id %s", ErrNotFound, accountID, deviceID)
+	}
+
+	device := model.Device{AccountID: accountID, ID: deviceID}
+	return m.write(walRecord{Op: walDeleteDevice, Device: &device}, func() {
+		m.deleteDevice(accountID, deviceID)
+		m.feed.publish(Event{Type: EventDeviceDeleted, AccountID: accountID, Device: &device})
+	})
+}
+
+// Devices returns the devices for a given account whose labels match
+// selector, ordered by device id. An empty slice is returned when no
+// devices match.
+func (m *Memory) Devices(accountID string, selector labels.Selector) ([]model.Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.accounts[accountID]; !ok {
+		return nil, fmt.Errorf("%w: account with id %s does not exist", ErrNotFound, accountID)
+	}
+
+	accountDevices := m.devices[accountID]
+	devices := make([]model.Device, 0, len(accountDevices))
 	for _, device := range accountDevices {
-		if device.AccountID == accountID {
+		if selector.Matches(device.Labels) {
 			devices = append(devices, device)
 		}
 	}
-
-	if len(devices) == 0 {
-		return nil, fmt.Errorf("account with id %s does not have any devices", accountID)
-	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
 
 	return devices, nil
 }
 
 // Device returns a device for a given account
 func (m *Memory) Device(accountID, deviceID string) (model.Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.accounts[accountID]; !ok {
+		return model.Device{}, fmt.Errorf("%w: account with id %s does not exist", ErrNotFound, accountID)
+	}
+
+	device, ok := m.devices[accountID][deviceID]
+	if !ok {
+		return model.Device{}, fmt.Errorf("%w: account with id %s does not have device with id %s", ErrNotFound, accountID, deviceID)
+	}
+
+	return device, nil
+}
+
+// Watch returns a channel of changes made after fromRevision. The
+// channel is closed when ctx is done.
+func (m *Memory) Watch(ctx context.Context, fromRevision uint64) (<-chan Event, error) {
+	return m.feed.watch(ctx, fromRevision), nil
+}
+
+// Export writes the contents of the store to w as a snapshot.
+func (m *Memory) Export(w io.Writer) error {
+	m.mu.RLock()
+	accounts, devices := sortedContents(m.accounts, m.devices)
+	credentials := sortedCredentials(m.credentials)
+	m.mu.RUnlock()
+
+	return writeSnapshot(w, 0, 0, accounts, devices, credentials)
+}
+
+// Import reads a snapshot from r and applies it to the store.
+func (m *Memory) Import(r io.Reader, mode ImportMode) (ImportStats, error) {
+	if _, err := ParseImportMode(string(mode)); err != nil {
+		return ImportStats{}, err
+	}
+
+	// Records are staged without holding the lock, as the
+	// snapshot may be read from a slow client.
+	snap, err := readSnapshot(r, true)
+	if err != nil {
+		return ImportStats{}, err
+	}
+
+	stats := ImportStats{
+		Mode:        mode,
+		Accounts:    snap.accounts,
+		Devices:     snap.devices,
+		Credentials: snap.credentials,
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	accountDevices, ok := m.devices[accountID]
-	if !ok {
-		return model.Device{}, fmt.Errorf("account with id %s does not exist in device map", accountID)
+	// Devices and credentials may only belong to existing
+	// accounts when merging.
+	exists := func(accountID string) bool {
+		_, ok := m.accounts[accountID]
+		return ok && mode != ImportReplace
+	}
+	if err := snap.checkAccounts(exists); err != nil {
+		return ImportStats{}, err
 	}
 
-	for _, device := range accountDevices {
-		if device.AccountID == accountID {
-			if device.ID == deviceID {
-				return device, nil
+	if mode == ImportDryRun {
+		return stats, nil
+	}
+
+	// The staged snapshot becomes the store, so that the store is
+	// unchanged if it cannot be applied. When merging, records
+	// which are not in the snapshot are kept.
+	next := snap.staged
+	if mode == ImportMerge {
+		for id, a := range m.accounts {
+			if _, ok := next.accounts[id]; !ok {
+				next.accounts[id] = a
+			}
+		}
+		for _, accountDevices := range m.devices {
+			for _, d := range accountDevices {
+				if _, ok := next.devices[d.AccountID][d.ID]; !ok {
+					next.putDevice(d)
+				}
+			}
+		}
+		for _, accountCredentials := range m.credentials {
+			for _, c := range accountCredentials {
+				if _, ok := next.credentials[c.AccountID][c.ID]; !ok {
+					next.putCredential(c)
+				}
 			}
 		}
 	}
 
-	return model.Device{}, fmt.Errorf("account with id %s does not have device with id %s", accountID, deviceID)
+	if err := m.replace(next.accounts, next.devices, next.credentials); err != nil {
+		return ImportStats{}, err
+	}
+	m.feed.publish(Event{Type: EventResync})
+	return stats, nil
 }
 
-func (m *Memory) validateAccount(id, key string) (model.Account, error) {
-	account := model.Account{}
-	found := false
+// putDevice indexes a device under its account. Callers
+// must hold the write lock.
+func (m *Memory) putDevice(device model.Device) {
+	accountDevices, ok := m.devices[device.AccountID]
+	if !ok {
+		accountDevices = make(map[string]model.Device)
+		m.devices[device.AccountID] = accountDevices
+	}
+	accountDevices[device.ID] = device
+}
 
-	for _, a := range m.accounts {
-		if a.ID == id && a.Key == key {
-			account = a
-			found = true
-			break
+// deleteDevice removes a device and its credentials if it exists.
+// Callers must hold the write lock.
+func (m *Memory) deleteDevice(accountID, deviceID string) {
+	m.deleteDeviceCredentials(accountID, deviceID)
+	delete(m.devices[accountID], deviceID)
+	if len(m.devices[accountID]) == 0 {
+		delete(m.devices, accountID)
+	}
+}
+
+// sortedContents returns accounts ordered by id and each account's
+// devices ordered by device id.
+func sortedContents(accounts map[string]model.Account, devices map[string]map[string]model.Device) ([]model.Account, map[string][]model.Device) {
+	sortedAccounts := make([]model.Account, 0, len(accounts))
+	for _, a := range accounts {
+		sortedAccounts = append(sortedAccounts, a)
+	}
+	sort.Slice(sortedAccounts, func(i, j int) bool {
+		return sortedAccounts[i].ID < sortedAccounts[j].ID
+	})
+
+	sortedDevices := make(map[string][]model.Device, len(devices))
+	for accountID, accountDevices := range devices {
+		list := make([]model.Device, 0, len(accountDevices))
+		for _, d := range accountDevices {
+			list = append(list, d)
 		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].ID < list[j].ID
+		})
+		sortedDevices[accountID] = list
 	}
 
-	if !found {
-		return model.Account{}, fmt.Errorf("account does not exist or account key is invalid: %s", id)
+	return sortedAccounts, sortedDevices
+}
+
+func (m *Memory) validateAccount(id, key string) (model.Account, error) {
+	account, ok := m.accounts[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(account.Key), []byte(key)) != 1 {
+		return model.Account{}, fmt.Errorf("%w: %s", ErrInvalidCredentials, id)
 	}
 
 	return account, nil
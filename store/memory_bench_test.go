@@ -0,0 +1,179 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/jsirianni/server/model"
+)
+
+const (
+	benchAccounts          = 100000
+	benchDevicesPerAccount = 10
+)
+
+// benchStore is the subset of Store exercised by the benchmarks.
+type benchStore interface {
+	CheckSubscription(accountID, accountKey string) (model.Subscription, error)
+	Account(accountID string) (model.Account, error)
+	Device(accountID, deviceID string) (model.Device, error)
+}
+
+// linearMemory is the previous slice based memory store, kept
+// as a baseline for the indexed implementation.
+type linearMemory struct {
+	accounts []model.Account
+	devices  map[string][]model.Device
+	mu       sync.Mutex
+}
+
+func (m *linearMemory) CheckSubscription(accountID, accountKey string) (model.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range m.accounts {
+		if a.ID == accountID && a.Key == accountKey {
+			return model.Subscription{AccountID: a.ID, State: model.SubscriptionActive}, nil
+		}
+	}
+	return model.Subscription{}, fmt.Errorf("account does not exist or account key is invalid: %s", accountID)
+}
+
+func (m *linearMemory) Account(accountID string) (model.Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range m.accounts {
+		if a.ID == accountID {
+			return a, nil
+		}
+	}
+	return model.Account{}, fmt.Errorf("account with id %s does not exist", accountID)
+}
+
+func (m *linearMemory) Device(accountID, deviceID string) (model.Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range m.devices[accountID] {
+		if d.ID == deviceID {
+			return d, nil
+		}
+	}
+	return model.Device{}, fmt.Errorf("account with id %s does not have device with id %s", accountID, deviceID)
+}
+
+var (
+	benchStoresOnce sync.Once
+	benchStoresMap  map[string]benchStore
+)
+
+// benchStores returns the indexed and linear stores populated
+// with the same accounts and devices. The stores are shared
+// between benchmarks and must not be modified.
+func benchStores(b *testing.B) map[string]benchStore {
+	b.Helper()
+	benchStoresOnce.Do(func() {
+		benchStoresMap = newBenchStores(b)
+	})
+	return benchStoresMap
+}
+
+func newBenchStores(b *testing.B) map[string]benchStore {
+	indexed := NewMemory()
+	linear := &linearMemory{devices: make(map[string][]model.Device)}
+
+	for i := 0; i < benchAccounts; i++ {
+		a := model.Account{
+			ID:     fmt.Sprintf("account-%d", i),
+			Key:    "key",
+			Active: true,
+		}
+		if err := indexed.CreateAccount(a); err != nil {
+			b.Fatal(err)
+		}
+		linear.accounts = append(linear.accounts, a)
+
+		for j := 0; j < benchDevicesPerAccount; j++ {
+			d := model.Device{
+				ID:        fmt.Sprintf("device-%d", j),
+				AccountID: a.ID,
+			}
+			if _, err := indexed.RegisterDevice(a.ID, a.Key, d); err != nil {
+				b.Fatal(err)
+			}
+			linear.devices[a.ID] = append(linear.devices[a.ID], d)
+		}
+	}
+
+	return map[string]benchStore{
+		"indexed": indexed,
+		"linear":  linear,
+	}
+}
+
+// benchAccountID returns the id of the i'th account. Accounts
+// are visited in a scattered order so that lookups are not
+// biased towards the front of the linear store.
+func benchAccountID(i int) string {
+	return fmt.Sprintf("account-%d", (i*7919)%benchAccounts)
+}
+
+func BenchmarkCheckSubscription(b *testing.B) {
+	for name, s := range benchStores(b) {
+		b.Run(name, func(b *testing.B) {
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.CheckSubscription(benchAccountID(i), "key"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAccount(b *testing.B) {
+	for name, s := range benchStores(b) {
+		b.Run(name, func(b *testing.B) {
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Account(benchAccountID(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDevice(b *testing.B) {
+	for name, s := range benchStores(b) {
+		b.Run(name, func(b *testing.B) {
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				deviceID := fmt.Sprintf("device-%d", i%benchDevicesPerAccount)
+				if _, err := s.Device(benchAccountID(i), deviceID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCheckSubscriptionParallel(b *testing.B) {
+	for name, s := range benchStores(b) {
+		b.Run(name, func(b *testing.B) {
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if _, err := s.CheckSubscription(benchAccountID(i), "key"); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package store
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jsirianni/server/labels"
 	"github.com/jsirianni/server/model"
 	"github.com/stretchr/testify/require"
 )
@@ -18,26 +22,50 @@ func TestNewMemory(t *testing.T) {
 func TestCheckSubscription(t *testing.T) {
 	m := NewTestingMemory()
 
-	require.NoError(t, m.CheckSubscription("abc", "xyz"))
-	require.NoError(t, m.CheckSubscription("go", "095"))
-	require.Error(t, m.CheckSubscription("bad", "sub"), "expected an error when an invalid account id was given")
-	require.Error(t, m.CheckSubscription("abc", "invalid"), "expected an error when a valid account is given with the wrong key")
+	now := time.Unix(1700000000, 0).UTC()
+	m.now = func() time.Time { return now }
+	expired := now.Add(-time.Second)
+	future := now.Add(time.Hour)
+	require.NoError(t, m.CreateAccount(model.Account{ID: "expired", Key: "key", Active: true, Plan: "pro", ExpiresAt: &expired}))
+	require.NoError(t, m.CreateAccount(model.Account{ID: "future", Key: "key", Active: true, Plan: "pro", ExpiresAt: &future}))
+
+	cases := []struct {
+		name      string
+		accountID string
+		key       string
+		expect    model.Subscription
+	}{
+		{"active", "abc", "xyz", model.Subscription{AccountID: "abc", State: model.SubscriptionActive}},
+		{"inactive", "go", "095", model.Subscription{AccountID: "go", State: model.SubscriptionInactive, Reason: "subscription is not active"}},
+		{"expired", "expired", "key", model.Subscription{AccountID: "expired", State: model.SubscriptionExpired, Plan: "pro", ExpiresAt: &expired, Reason: "subscription expired at 2023-11-14T22:13:19Z"}},
+		{"not-expired", "future", "key", model.Subscription{AccountID: "future", State: model.SubscriptionActive, Plan: "pro", ExpiresAt: &future}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sub, err := m.CheckSubscription(tc.accountID, tc.key)
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, sub)
+		})
+	}
+
+	_, err := m.CheckSubscription("bad", "sub")
+	require.ErrorIs(t, err, ErrInvalidCredentials, "expected an error when an invalid account id was given")
+	_, err = m.CheckSubscription("abc", "invalid")
+	require.ErrorIs(t, err, ErrInvalidCredentials, "expected an error when a valid account is given with the wrong key")
 }
 
 func TestRegisterDevice(t *testing.T) {
 	m := NewTestingMemory()
 
 	// Add to device map
-	d := []model.Device{
-		{
-			AccountID: "abc",
-			ID:        "test-device",
-			Hostname:  "orig",
-		},
+	m.devices["abc"]["test-device"] = model.Device{
+		AccountID: "abc",
+		ID:        "test-device",
+		Hostname:  "orig",
 	}
-	m.devices["abc"] = d
 
-	err := m.RegisterDevice("abc", "xyz", model.Device{
+	_, err := m.RegisterDevice("abc", "xyz", model.Device{
 		ID:        "test-device",
 		AccountID: "abc",
 		Hostname:  "new",
@@ -53,11 +81,220 @@ func TestRegisterDevice(t *testing.T) {
 	}
 	require.True(t, found, "expected found to be true, because we seeded the 'test-device'. This should never fail.")
 
-	err = m.RegisterDevice("invalidaccount", "ttt", model.Device{})
+	_, err = m.RegisterDevice("invalidaccount", "ttt", model.Device{})
 	require.Error(t, err, "expected an error when registering a device using an invalid account key")
 	require.ErrorContains(t, err, "subscription validation failed")
 }
 
+func TestRegisterDeviceLimit(t *testing.T) {
+	m := NewMemory()
+	require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, MaxDevices: 1}))
+
+	_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "a"})
+	require.NoError(t, err)
+	_, err = m.RegisterDevice("abc", "xyz", model.Device{ID: "a", Hostname: "new"})
+	require.NoError(t, err, "expected existing devices to be replaced at the limit")
+
+	_, err = m.RegisterDevice("abc", "xyz", model.Device{ID: "b"})
+	require.ErrorIs(t, err, ErrDeviceLimit)
+	_, err = m.Device("abc", "b")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRegisterDeviceFingerprint(t *testing.T) {
+	original := &model.Fingerprint{MachineID: "machine", MACHash: "mac-a"}
+	clone := &model.Fingerprint{MachineID: "machine", MACHash: "mac-b"}
+	forked := forkedID("device", *clone)
+
+	cases := []struct {
+		name           string
+		policy         model.FingerprintPolicy
+		fingerprint    *model.Fingerprint
+		expectErr      error
+		expectID       string
+		expectConflict *model.FingerprintConflict
+		expectIDs      []string
+	}{
+		{"same", model.FingerprintReject, original, nil, "device", nil, []string{"device"}},
+		{"unset", model.FingerprintReject, nil, nil, "device", nil, []string{"device"}},
+		{
+			"default-allow",
+			"",
+			clone,
+			nil,
+			"device",
+			&model.FingerprintConflict{DeviceID: "device", Policy: model.FingerprintAllow, Existing: *original},
+			[]string{"device"},
+		},
+		{
+			"reject",
+			model.FingerprintReject,
+			clone,
+			ErrFingerprintConflict,
+			"",
+			nil,
+			[]string{"device"},
+		},
+		{
+			"fork",
+			model.FingerprintFork,
+			clone,
+			nil,
+			forked,
+			&model.FingerprintConflict{DeviceID: "device", Policy: model.FingerprintFork, Existing: *original, ForkedID: forked},
+			[]string{"device", forked},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewMemory()
+			require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, FingerprintPolicy: tc.policy}))
+			_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "device", Fingerprint: original})
+			require.NoError(t, err)
+
+			registration, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "device", Hostname: "clone", Fingerprint: tc.fingerprint})
+			if tc.expectErr != nil {
+				require.ErrorIs(t, err, tc.expectErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expectID, registration.ID)
+				require.Equal(t, tc.fingerprint, registration.Fingerprint)
+				require.Equal(t, tc.expectConflict, registration.Conflict)
+			}
+
+			devices, err := m.Devices("abc", nil)
+			require.NoError(t, err)
+			ids := []string{}
+			for _, d := range devices {
+				ids = append(ids, d.ID)
+			}
+			require.Equal(t, tc.expectIDs, ids)
+		})
+	}
+}
+
+func TestRegisterDeviceFork(t *testing.T) {
+	m := NewMemory()
+	require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz", Active: true, FingerprintPolicy: model.FingerprintFork, MaxDevices: 2}))
+	_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "device", Fingerprint: &model.Fingerprint{MachineID: "a"}})
+	require.NoError(t, err)
+
+	// The same clone always forks to the same id.
+	first, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "device", Hostname: "first", Fingerprint: &model.Fingerprint{MachineID: "b"}})
+	require.NoError(t, err)
+	second, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "device", Hostname: "second", Fingerprint: &model.Fingerprint{MachineID: "b"}})
+	require.NoError(t, err)
+	require.Equal(t, first.ID, second.ID)
+
+	// Forks count towards the device limit.
+	_, err = m.RegisterDevice("abc", "xyz", model.Device{ID: "device", Fingerprint: &model.Fingerprint{MachineID: "c"}})
+	require.ErrorIs(t, err, ErrDeviceLimit)
+}
+
+func TestParseFingerprintPolicy(t *testing.T) {
+	policy, err := ParseFingerprintPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, model.FingerprintAllow, policy)
+
+	policy, err = ParseFingerprintPolicy("fork")
+	require.NoError(t, err)
+	require.Equal(t, model.FingerprintFork, policy)
+
+	_, err = ParseFingerprintPolicy("merge")
+	require.Error(t, err)
+}
+
+func TestDevicesSelector(t *testing.T) {
+	m := NewTestingMemory()
+	_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "web", Labels: map[string]string{"env": "prod", "role": "web"}})
+	require.NoError(t, err)
+	_, err = m.RegisterDevice("abc", "xyz", model.Device{ID: "db", Labels: map[string]string{"env": "prod", "role": "db"}})
+	require.NoError(t, err)
+	_, err = m.RegisterDevice("abc", "xyz", model.Device{ID: "dev", Labels: map[string]string{"env": "dev"}})
+	require.NoError(t, err)
+
+	cases := []struct {
+		selector  string
+		expectIDs []string
+	}{
+		{"", []string{"db", "dev", "device-a", "device-b", "web"}},
+		{"env=prod", []string{"db", "web"}},
+		{"env=prod,role!=db", []string{"web"}},
+		{"role", []string{"db", "web"}},
+		{"!env", []string{"device-a", "device-b"}},
+		{"env in (dev,test)", []string{"dev"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.selector, func(t *testing.T) {
+			selector, err := labels.Parse(tc.selector)
+			require.NoError(t, err)
+			devices, err := m.Devices("abc", selector)
+			require.NoError(t, err)
+
+			ids := []string{}
+			for _, d := range devices {
+				ids = append(ids, d.ID)
+			}
+			require.Equal(t, tc.expectIDs, ids)
+		})
+	}
+}
+
+func TestRegisterDeviceInvalidLabels(t *testing.T) {
+	m := NewTestingMemory()
+
+	_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "a", Labels: map[string]string{"bad key": "v"}})
+	require.ErrorIs(t, err, ErrInvalidDevice)
+	_, err = m.RegisterDevice("abc", "xyz", model.Device{ID: "a", Annotations: map[string]string{"-bad": "v"}})
+	require.ErrorIs(t, err, ErrInvalidDevice)
+
+	results, err := m.RegisterDevices("abc", "xyz", []model.Device{{ID: "a", Labels: map[string]string{"env": "bad value"}}}, BatchPerItem)
+	require.NoError(t, err)
+	require.ErrorIs(t, results[0].Err, ErrInvalidDevice)
+}
+
+func TestPatchDevice(t *testing.T) {
+	m := NewTestingMemory()
+	_, err := m.RegisterDevice("abc", "xyz", model.Device{
+		ID:          "web",
+		Hostname:    "web-1",
+		Labels:      map[string]string{"env": "dev", "role": "web"},
+		Annotations: map[string]string{"owner": "ops"},
+	})
+	require.NoError(t, err)
+
+	hostname := "web-2"
+	prod := "prod"
+	device, err := m.PatchDevice("abc", "web", model.DevicePatch{
+		Hostname:    &hostname,
+		Labels:      map[string]*string{"env": &prod, "role": nil},
+		Annotations: map[string]*string{"owner": nil},
+	})
+	require.NoError(t, err)
+	require.Equal(t, model.Device{AccountID: "abc", ID: "web", Hostname: "web-2", Labels: map[string]string{"env": "prod"}}, device)
+
+	stored, err := m.Device("abc", "web")
+	require.NoError(t, err)
+	require.Equal(t, device, stored)
+
+	// An empty patch leaves the device unchanged.
+	device, err = m.PatchDevice("abc", "web", model.DevicePatch{})
+	require.NoError(t, err)
+	require.Equal(t, stored, device)
+
+	bad := "bad value"
+	_, err = m.PatchDevice("abc", "web", model.DevicePatch{Labels: map[string]*string{"env": &bad}})
+	require.ErrorIs(t, err, ErrInvalidDevice)
+	stored, err = m.Device("abc", "web")
+	require.NoError(t, err)
+	require.Equal(t, "prod", stored.Labels["env"], "expected an invalid patch to not be applied")
+
+	_, err = m.PatchDevice("abc", "missing", model.DevicePatch{})
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
 func TestAccount(t *testing.T) {
 	m := NewTestingMemory()
 
@@ -77,12 +314,16 @@ func TestAccount(t *testing.T) {
 func TestDevices(t *testing.T) {
 	m := NewTestingMemory()
 
-	devices, err := m.Devices("abc")
+	devices, err := m.Devices("abc", nil)
 	require.NoError(t, err)
 	require.NotNil(t, devices)
 	require.Len(t, devices, 2, "expected exactly two devices for account 'abc'")
 
-	_, err = m.Devices("badaccount")
+	devices, err = m.Devices("go", nil)
+	require.NoError(t, err)
+	require.Empty(t, devices, "expected no devices for account 'go'")
+
+	_, err = m.Devices("badaccount", nil)
 	require.Error(t, err, "expected an error when looking up devices for an account that does not exist")
 }
 
@@ -106,3 +347,106 @@ func TestDevice(t *testing.T) {
 	require.Error(t, err)
 	require.ErrorContains(t, err, "account with id abc does not have device with id invalid")
 }
+
+func TestCreateAccount(t *testing.T) {
+	m := NewTestingMemory()
+
+	err := m.CreateAccount(model.Account{ID: "new", Key: "key", Active: true})
+	require.NoError(t, err)
+
+	account, err := m.Account("new")
+	require.NoError(t, err)
+	require.Equal(t, model.Account{ID: "new", Key: "key", Active: true}, account)
+
+	err = m.CreateAccount(model.Account{ID: "abc", Key: "other"})
+	require.Error(t, err, "expected an error when creating an account that already exists")
+	require.ErrorIs(t, err, ErrAlreadyExists)
+}
+
+func TestAccounts(t *testing.T) {
+	m := NewTestingMemory()
+	require.NoError(t, m.CreateAccount(model.Account{ID: "aaa"}))
+
+	accounts, err := m.Accounts()
+	require.NoError(t, err)
+	require.Len(t, accounts, 3)
+	require.Equal(t, "aaa", accounts[0].ID)
+	require.Equal(t, "abc", accounts[1].ID)
+	require.Equal(t, "go", accounts[2].ID)
+}
+
+func TestUpdateAccount(t *testing.T) {
+	m := NewTestingMemory()
+
+	err := m.UpdateAccount(model.Account{ID: "abc", Key: "xyz", Active: false})
+	require.NoError(t, err)
+
+	account, err := m.Account("abc")
+	require.NoError(t, err)
+	require.False(t, account.Active)
+
+	err = m.UpdateAccount(model.Account{ID: "invalid"})
+	require.Error(t, err)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestDeleteDevice(t *testing.T) {
+	m := NewTestingMemory()
+
+	require.NoError(t, m.DeleteDevice("abc", "device-a"))
+
+	_, err := m.Device("abc", "device-a")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	devices, err := m.Devices("abc", nil)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+
+	err = m.DeleteDevice("abc", "device-a")
+	require.Error(t, err, "expected an error when deleting a device that does not exist")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSeed(t *testing.T) {
+	m := NewMemory()
+	require.NoError(t, Seed(m))
+
+	// Seeding is safe to repeat.
+	require.NoError(t, Seed(m))
+
+	accounts, err := m.Accounts()
+	require.NoError(t, err)
+	require.Len(t, accounts, 2)
+
+	devices, err := m.Devices("abc", nil)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+}
+
+func TestMemoryConcurrentAccess(t *testing.T) {
+	m := NewTestingMemory()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				deviceID := fmt.Sprintf("device-%d-%d", i, j)
+				_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: deviceID})
+				require.NoError(t, err)
+				_, err = m.CheckSubscription("abc", "xyz")
+				require.NoError(t, err)
+				_, err = m.Device("abc", deviceID)
+				require.NoError(t, err)
+				_, err = m.Devices("abc", nil)
+				require.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	devices, err := m.Devices("abc", nil)
+	require.NoError(t, err)
+	require.Len(t, devices, 802)
+}
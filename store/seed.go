@@ -0,0 +1,71 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jsirianni/server/model"
+)
+
+// Seed stores the development seed data in s. Accounts
+// and devices which already exist are left unchanged.
+func Seed(s Store) error {
+	accounts, devices := seedData()
+
+	for _, account := range accounts {
+		err := s.CreateAccount(account)
+		if err != nil && !errors.Is(err, ErrAlreadyExists) {
+			return fmt.Errorf("failed to seed account %s: %w", account.ID, err)
+		}
+	}
+
+	keys := make(map[string]string, len(accounts))
+	for _, account := range accounts {
+		keys[account.ID] = account.Key
+	}
+
+	for _, device := range devices {
+		_, err := s.Device(device.AccountID, device.ID)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to seed device %s: %w", device.ID, err)
+		}
+		if _, err := s.RegisterDevice(device.AccountID, keys[device.AccountID], device); err != nil {
+			return fmt.Errorf("failed to seed device %s: %w", device.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// seedData returns the accounts and devices used for
+// development and testing.
+func seedData() ([]model.Account, []model.Device) {
+	accounts := []model.Account{
+		{
+			ID:     "abc",
+			Key:    "xyz",
+			Active: true,
+		},
+		{
+			ID:     "go",
+			Key:    "095",
+			Active: false,
+		},
+	}
+	devices := []model.Device{
+		{
+			ID:        "device-a",
+			AccountID: "abc",
+			Hostname:  "testname",
+		},
+		{
+			ID:        "device-b",
+			AccountID: "abc",
+			Hostname:  "testname-b",
+		},
+	}
+	return accounts, devices
+}
@@ -0,0 +1,323 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jsirianni/server/model"
+)
+
+const (
+	// SnapshotVersion is the version of the snapshot format
+	// written by Export.
+	SnapshotVersion = 1
+
+	// maxSnapshotLine is the maximum size of a single
+	// snapshot record.
+	maxSnapshotLine = 1 << 20
+)
+
+// ImportMode controls how a snapshot is applied to a store.
+type ImportMode string
+
+const (
+	// ImportMerge creates or replaces the snapshot's accounts and
+	// devices, leaving other accounts and devices unchanged.
+	ImportMerge ImportMode = "merge"
+
+	// ImportReplace replaces the entire contents of the store
+	// with the snapshot.
+	ImportReplace ImportMode = "replace"
+
+	// ImportDryRun validates the snapshot as if it were merged
+	// without modifying the store.
+	ImportDryRun ImportMode = "dry-run"
+)
+
+// ParseImportMode returns the ImportMode for s.
+func ParseImportMode(s string) (ImportMode, error) {
+	switch m := ImportMode(s); m {
+	case ImportMerge, ImportReplace, ImportDryRun:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid import mode '%s': must be one of merge, replace or dry-run", s)
+	}
+}
+
+// ImportStats describes the result of an import.
+type ImportStats struct {
+	// Mode is the import mode.
+	Mode ImportMode `json:"mode"`
+
+	// Accounts is the number of accounts in the snapshot.
+	Accounts int `json:"accounts"`
+
+	// Devices is the number of devices in the snapshot.
+	Devices int `json:"devices"`
+
+	// Credentials is the number of credentials in the snapshot.
+	Credentials int `json:"credentials"`
+}
+
+// Snapshotter is implemented by stores which support exporting
+// and importing their contents.
+type Snapshotter interface {
+	// Export writes the contents of the store to w as a snapshot.
+	Export(w io.Writer) error
+
+	// Import reads a snapshot from r and applies it to the store.
+	// The store is not modified if the snapshot is invalid.
+	Import(r io.Reader, mode ImportMode) (ImportStats, error)
+}
+
+var (
+	// ErrSnapshotUnsupported is returned when a store does not
+	// implement Snapshotter.
+	ErrSnapshotUnsupported = errors.New("store does not support snapshots")
+
+	// ErrInvalidSnapshot is returned when importing a snapshot
+	// which cannot be decoded or applied.
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+)
+
+// Export writes a snapshot of s to w. Returns ErrSnapshotUnsupported
+// if s does not implement Snapshotter.
+func Export(s Store, w io.Writer) error {
+	snap, ok := s.(Snapshotter)
+	if !ok {
+		return ErrSnapshotUnsupported
+	}
+	return snap.Export(w)
+}
+
+// Import applies the snapshot read from r to s. Returns
+// ErrSnapshotUnsupported if s does not implement Snapshotter.
+func Import(s Store, r io.Reader, mode ImportMode) (ImportStats, error) {
+	snap, ok := s.(Snapshotter)
+	if !ok {
+		return ImportStats{}, ErrSnapshotUnsupported
+	}
+	return snap.Import(r, mode)
+}
+
+// Snapshot records are written as JSON Lines. The first line is
+// a header record followed by account, device and credential records.
+// Devices and credentials follow the account they belong to.
+const (
+	recordHeader     = "header"
+	recordAccount    = "account"
+	recordDevice     = "device"
+	recordCredential = "credential"
+)
+
+// snapshotRecord is a single line of a snapshot.
+type snapshotRecord struct {
+	Kind    string         `json:"kind"`
+	Version int            `json:"version,omitempty"`
+	Account *model.Account `json:"account,omitempty"`
+	Device  *model.Device  `json:"device,omitempty"`
+
+	Credential *model.Credential `json:"credential,omitempty"`
+
+	// Sequence is the last write-ahead log sequence included
+	// in the snapshot, and Revision is the watch revision at that
+	// sequence. They are only set by WAL compaction.
+	Sequence uint64 `json:"sequence,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// snapshot is the contents of a snapshot, staged in a store as each
+// record is decoded.
+type snapshot struct {
+	staged      *Memory
+	accounts    int
+	devices     int
+	credentials int
+	sequence    uint64
+	revision    uint64
+
+	// external is the first device or credential of each account
+	// which was not in the snapshot when the record was decoded
+	external map[string]string
+}
+
+// checkAccounts returns an error if a device or credential belongs to
+// an account which is not in the snapshot and for which exists returns
+// false.
+func (snap *snapshot) checkAccounts(exists func(accountID string) bool) error {
+	for accountID, record := range snap.external {
+		if _, ok := snap.staged.accounts[accountID]; !ok && !exists(accountID) {
+			return fmt.Errorf("%w: %s belongs to unknown account %s", ErrInvalidSnapshot, record, accountID)
+		}
+	}
+	return nil
+}
+
+// reference records the account of a device or credential if it is
+// not yet in the snapshot.
+func (snap *snapshot) reference(accountID, record string) {
+	if _, ok := snap.staged.accounts[accountID]; ok {
+		return
+	}
+	if _, ok := snap.external[accountID]; !ok {
+		snap.external[accountID] = record
+	}
+}
+
+// writeSnapshot writes accounts, devices and credentials to w. Devices
+// and credentials are indexed by account id.
+func writeSnapshot(w io.Writer, sequence, revision uint64, accounts []model.Account, devices map[string][]model.Device, credentials map[string][]model.Credential) error {
+	bw := bufio.NewWriter(w)
+	e := json.NewEncoder(bw)
+
+	if err := e.Encode(snapshotRecord{Kind: recordHeader, Version: SnapshotVersion, Sequence: sequence, Revision: revision}); err != nil {
+		return fmt.Errorf("failed to write snapshot header: %w", err)
+	}
+
+	for i := range accounts {
+		if err := e.Encode(snapshotRecord{Kind: recordAccount, Account: &accounts[i]}); err != nil {
+			return fmt.Errorf("failed to write account %s: %w", accounts[i].ID, err)
+		}
+		accountDevices := devices[accounts[i].ID]
+		for j := range accountDevices {
+			if err := e.Encode(snapshotRecord{Kind: recordDevice, Device: &accountDevices[j]}); err != nil {
+				return fmt.Errorf("failed to write device %s: %w", accountDevices[j].ID, err)
+			}
+		}
+		accountCredentials := credentials[accounts[i].ID]
+		for j := range accountCredentials {
+			if err := e.Encode(snapshotRecord{Kind: recordCredential, Credential: &accountCredentials[j]}); err != nil {
+				return fmt.Errorf("failed to write credential %s: %w", accountCredentials[j].ID, err)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// readSnapshot decodes and validates a snapshot, staging each record
+// as it is decoded. Devices are validated as they are on registration
+// when validateDevices is true. Device and credential account ids must
+// be checked against the store with checkAccounts.
+func readSnapshot(r io.Reader, validateDevices bool) (*snapshot, error) {
+	snap, err := decodeSnapshot(r, validateDevices)
+	if err != nil {
+		// Failing to read the snapshot does not make it invalid,
+		// and the caller may need the reader's error.
+		var readErr snapshotReadError
+		if errors.As(err, &readErr) {
+			return nil, fmt.Errorf("failed to read snapshot: %w", readErr.err)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	return snap, nil
+}
+
+// snapshotReadError is an error reading a snapshot, rather than
+// decoding it.
+type snapshotReadError struct {
+	err error
+}
+
+func (e snapshotReadError) Error() string {
+	return e.err.Error()
+}
+
+func decodeSnapshot(r io.Reader, validateDevices bool) (*snapshot, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSnapshotLine)
+
+	staged := &Memory{
+		accounts:    make(map[string]model.Account),
+		devices:     make(map[string]map[string]model.Device),
+		credentials: make(map[string]map[string]model.Credential),
+	}
+	snap := &snapshot{staged: staged, external: make(map[string]string)}
+	line := 0
+	header := false
+
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		rec := snapshotRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: invalid record: %w", line, err)
+		}
+
+		if !header {
+			if rec.Kind != recordHeader {
+				return nil, fmt.Errorf("line %d: expected snapshot header", line)
+			}
+			if rec.Version != SnapshotVersion {
+				return nil, fmt.Errorf("line %d: unsupported snapshot version %d", line, rec.Version)
+			}
+			header = true
+			snap.sequence = rec.Sequence
+			snap.revision = rec.Revision
+			continue
+		}
+
+		switch rec.Kind {
+		case recordAccount:
+			if rec.Account == nil || rec.Account.ID == "" {
+				return nil, fmt.Errorf("line %d: account record requires an account id", line)
+			}
+			if _, ok := staged.accounts[rec.Account.ID]; ok {
+				return nil, fmt.Errorf("line %d: duplicate account %s", line, rec.Account.ID)
+			}
+			staged.accounts[rec.Account.ID] = *rec.Account
+			snap.accounts++
+
+		case recordDevice:
+			if rec.Device == nil || rec.Device.ID == "" || rec.Device.AccountID == "" {
+				return nil, fmt.Errorf("line %d: device record requires a device id and account id", line)
+			}
+			d := rec.Device
+			if _, ok := staged.devices[d.AccountID][d.ID]; ok {
+				return nil, fmt.Errorf("line %d: duplicate device %s for account %s", line, d.ID, d.AccountID)
+			}
+			if validateDevices {
+				if err := validateDevice(*d); err != nil {
+					return nil, fmt.Errorf("line %d: device %s: %v", line, d.ID, err)
+				}
+			}
+			snap.reference(d.AccountID, "device "+d.ID)
+			staged.putDevice(*d)
+			snap.devices++
+
+		case recordCredential:
+			if rec.Credential == nil || rec.Credential.ID == "" || rec.Credential.AccountID == "" {
+				return nil, fmt.Errorf("line %d: credential record requires a credential id and account id", line)
+			}
+			c := rec.Credential
+			if _, ok := staged.credentials[c.AccountID][c.ID]; ok {
+				return nil, fmt.Errorf("line %d: duplicate credential %s for account %s", line, c.ID, c.AccountID)
+			}
+			snap.reference(c.AccountID, "credential "+c.ID)
+			staged.putCredential(*c)
+			snap.credentials++
+
+		default:
+			return nil, fmt.Errorf("line %d: unknown record kind '%s'", line, rec.Kind)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("line %d: record exceeds %d bytes", line+1, maxSnapshotLine)
+		}
+		return nil, snapshotReadError{err}
+	}
+
+	if !header {
+		return nil, errors.New("snapshot is empty")
+	}
+
+	return snap, nil
+}
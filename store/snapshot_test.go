@@ -0,0 +1,165 @@
+package store
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/stretchr/testify/require"
+)
+
+const testSnapshot = `{"kind":"header","version":1}
+{"kind":"account","account":{"id":"abc","key":"xyz","active":true}}
+{"kind":"device","device":{"account_id":"abc","id":"device-a","hostname":"testname"}}
+{"kind":"device","device":{"account_id":"abc","id":"device-b","hostname":"testname-b"}}
+{"kind":"account","account":{"id":"go","key":"095","active":false}}
+`
+
+func TestExport(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, Export(NewTestingMemory(), buf))
+	require.Equal(t, testSnapshot, buf.String())
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := NewTestingMemory()
+	_, err := src.RegisterDevice("go", "095", model.Device{ID: "device-c"})
+	require.NoError(t, err)
+	require.NoError(t, src.CreateCredential(model.Credential{ID: "e", AccountID: "go", Kind: model.CredentialEnrollment, Hash: "hash", MaxUses: 1}))
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, Export(src, buf))
+
+	dst := NewMemory()
+	stats, err := Import(dst, buf, ImportReplace)
+	require.NoError(t, err)
+	require.Equal(t, ImportStats{Mode: ImportReplace, Accounts: 2, Devices: 3, Credentials: 1}, stats)
+	require.Equal(t, src.accounts, dst.accounts)
+	require.Equal(t, src.devices, dst.devices)
+	require.Equal(t, src.credentials, dst.credentials)
+}
+
+func TestImportModes(t *testing.T) {
+	snap := `{"kind":"header","version":1}
+{"kind":"account","account":{"id":"abc","key":"new","active":false}}
+{"kind":"account","account":{"id":"new","key":"key","active":true}}
+{"kind":"device","device":{"account_id":"new","id":"device-n"}}
+{"kind":"device","device":{"account_id":"go","id":"device-g"}}
+`
+
+	t.Run("merge", func(t *testing.T) {
+		m := NewTestingMemory()
+		stats, err := m.Import(strings.NewReader(snap), ImportMerge)
+		require.NoError(t, err)
+		require.Equal(t, ImportStats{Mode: ImportMerge, Accounts: 2, Devices: 2}, stats)
+
+		accounts, err := m.Accounts()
+		require.NoError(t, err)
+		require.Len(t, accounts, 3)
+		require.Equal(t, "new", m.accounts["abc"].Key)
+
+		// Existing devices are kept.
+		devices, err := m.Devices("abc", nil)
+		require.NoError(t, err)
+		require.Len(t, devices, 2)
+
+		_, err = m.Device("go", "device-g")
+		require.NoError(t, err)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		m := NewTestingMemory()
+		_, err := m.Import(strings.NewReader(snap), ImportReplace)
+		require.Error(t, err, "expected an error because device-g belongs to an account that is not in the snapshot")
+		require.ErrorIs(t, err, ErrInvalidSnapshot)
+		require.Len(t, m.accounts, 2, "expected the store to be unchanged")
+
+		replace := strings.Replace(snap, `{"kind":"device","device":{"account_id":"go","id":"device-g"}}`+"\n", "", 1)
+		stats, err := m.Import(strings.NewReader(replace), ImportReplace)
+		require.NoError(t, err)
+		require.Equal(t, ImportStats{Mode: ImportReplace, Accounts: 2, Devices: 1}, stats)
+
+		accounts, err := m.Accounts()
+		require.NoError(t, err)
+		require.Len(t, accounts, 2)
+		require.Equal(t, "abc", accounts[0].ID)
+		require.Equal(t, "new", accounts[1].ID)
+
+		devices, err := m.Devices("abc", nil)
+		require.NoError(t, err)
+		require.Empty(t, devices)
+	})
+
+	t.Run("dry-run", func(t *testing.T) {
+		m := NewTestingMemory()
+		before := &bytes.Buffer{}
+		require.NoError(t, m.Export(before))
+
+		stats, err := m.Import(strings.NewReader(snap), ImportDryRun)
+		require.NoError(t, err)
+		require.Equal(t, ImportStats{Mode: ImportDryRun, Accounts: 2, Devices: 2}, stats)
+
+		after := &bytes.Buffer{}
+		require.NoError(t, m.Export(after))
+		require.Equal(t, before.String(), after.String())
+	})
+}
+
+func TestImportInvalid(t *testing.T) {
+	cases := []struct {
+		name      string
+		snapshot  string
+		expectErr string
+	}{
+		{"empty", "", "snapshot is empty"},
+		{"missing-header", `{"kind":"account","account":{"id":"abc"}}`, "line 1: expected snapshot header"},
+		{"unsupported-version", `{"kind":"header","version":2}`, "line 1: unsupported snapshot version 2"},
+		{"invalid-json", "{\"kind\":\"header\",\"version\":1}\n{", "line 2: invalid record"},
+		{"unknown-kind", "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"user\"}", "line 2: unknown record kind 'user'"},
+		{"missing-account-id", "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"account\",\"account\":{}}", "line 2: account record requires an account id"},
+		{"duplicate-account", "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"account\",\"account\":{\"id\":\"a\"}}\n{\"kind\":\"account\",\"account\":{\"id\":\"a\"}}", "line 3: duplicate account a"},
+		{"missing-device-id", "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"device\",\"device\":{\"account_id\":\"abc\"}}", "line 2: device record requires a device id and account id"},
+		{"unknown-account", "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"device\",\"device\":{\"account_id\":\"zzz\",\"id\":\"d\"}}", "device d belongs to unknown account zzz"},
+		{"invalid-device", "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"device\",\"device\":{\"account_id\":\"abc\",\"id\":\"d\",\"labels\":{\"-bad\":\"x\"}}}", "line 2: device d: invalid device"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewTestingMemory()
+			_, err := m.Import(strings.NewReader(tc.snapshot), ImportMerge)
+			require.Error(t, err)
+			require.ErrorIs(t, err, ErrInvalidSnapshot)
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+
+	_, err := NewMemory().Import(strings.NewReader(testSnapshot), ImportMode("upsert"))
+	require.ErrorContains(t, err, "invalid import mode 'upsert'")
+}
+
+func TestCachedImportInvalidates(t *testing.T) {
+	c, err := NewCached(NewTestingMemory(), time.Minute)
+	require.NoError(t, err)
+
+	account, err := c.Account("abc")
+	require.NoError(t, err)
+	require.True(t, account.Active)
+
+	snap := "{\"kind\":\"header\",\"version\":1}\n{\"kind\":\"account\",\"account\":{\"id\":\"abc\",\"key\":\"xyz\"}}\n"
+	_, err = Import(c, strings.NewReader(snap), ImportMerge)
+	require.NoError(t, err)
+
+	account, err = c.Account("abc")
+	require.NoError(t, err)
+	require.False(t, account.Active)
+}
+
+func TestSnapshotUnsupported(t *testing.T) {
+	s := &failingStore{Store: NewMemory()}
+	require.ErrorIs(t, Export(s, &bytes.Buffer{}), ErrSnapshotUnsupported)
+
+	_, err := Import(s, strings.NewReader(testSnapshot), ImportMerge)
+	require.ErrorIs(t, err, ErrSnapshotUnsupported)
+}
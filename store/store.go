@@ -1,22 +1,102 @@
 package store
 
-import "github.com/jsirianni/server/model"
+import (
+	"context"
+	"io"
 
+	"github.com/jsirianni/server/labels"
+	"github.com/jsirianni/server/model"
+)
+
+// Store is the storage backend for accounts and devices.
 type Store interface {
-	// CheckSubscription returns an error if the given account
-	// is invalid.
-	CheckSubscription(accountID, accountKey string) error
+	// CheckSubscription returns the subscription status of the given
+	// account. Inactive and expired subscriptions are not errors.
+	// Returns ErrInvalidCredentials if the account does not exist or
+	// the key is invalid.
+	CheckSubscription(accountID, accountKey string) (model.Subscription, error)
 
 	// RegisterDevice takes an accountID, accountKey, deviceID, deviceInfo and stores
-	// the device if the account is valid.
-	RegisterDevice(accountID, accountKey string, device model.Device) error
+	// the device if the account is valid. A device which re-registers with
+	// a different fingerprint is handled with the account's fingerprint
+	// policy, and the conflict is returned with the stored device.
+	RegisterDevice(accountID, accountKey string, device model.Device) (model.DeviceRegistration, error)
+
+	// RegisterDevices registers devices in a single operation and
+	// returns a result for each device, in order. In BatchAtomic mode
+	// no devices are registered if any device fails.
+	RegisterDevices(accountID, accountKey string, devices []model.Device, mode BatchMode) ([]BatchResult, error)
 
 	// Account returns an account
 	Account(accountID string) (model.Account, error)
 
-	// Devices returns all devices for a given account
-	Devices(accountID string) ([]model.Device, error)
+	// Devices returns the devices for a given account whose labels
+	// match selector. An empty selector matches all devices.
+	Devices(accountID string, selector labels.Selector) ([]model.Device, error)
 
 	// Device returns a device from a given account
 	Device(accountID, deviceID string) (model.Device, error)
+
+	// CreateAccount stores a new account. Returns ErrAlreadyExists
+	// if an account with the same id exists.
+	CreateAccount(account model.Account) error
+
+	// Accounts returns all accounts ordered by id.
+	Accounts() ([]model.Account, error)
+
+	// UpdateAccount replaces an existing account. Returns ErrNotFound
+	// if the account does not exist.
+	UpdateAccount(account model.Account) error
+
+	// PatchDevice applies patch to an existing device and returns
+	// the updated device. Returns ErrNotFound if the device does
+	// not exist.
+	PatchDevice(accountID, deviceID string, patch model.DevicePatch) (model.Device, error)
+
+	// DeleteDevice removes a device from a given account. Returns
+	// ErrNotFound if the device does not exist.
+	DeleteDevice(accountID, deviceID string) error
+
+	// CreateCredential stores a new credential. Returns ErrNotFound
+	// if the account, or a device credential's device, does not exist
+	// and ErrAlreadyExists if the credential id is in use.
+	CreateCredential(credential model.Credential) error
+
+	// Credential returns a credential from a given account.
+	Credential(accountID, credentialID string) (model.Credential, error)
+
+	// Credentials returns the credentials for a given account.
+	Credentials(accountID string) ([]model.Credential, error)
+
+	// DeleteCredential revokes a credential. Returns ErrNotFound if
+	// the credential does not exist.
+	DeleteCredential(accountID, credentialID string) error
+
+	// Enroll uses an enrollment credential to register device, and
+	// stores credential as the device's only credential. Returns
+	// ErrInvalidCredentials if the enrollment credential does not
+	// exist, has expired or has no uses left, and ErrAlreadyExists
+	// if the device is registered without the same fingerprint.
+	Enroll(accountID, enrollmentID string, device model.Device, credential model.Credential) (model.DeviceRegistration, error)
+
+	// Watch returns a channel of changes made after fromRevision,
+	// ordered by revision. Watching starts at the current revision
+	// when fromRevision is zero. EventResync is sent when events
+	// are missed. The channel is closed when ctx is done.
+	Watch(ctx context.Context, fromRevision uint64) (<-chan Event, error)
+}
+
+// Migrator is implemented by stores which require schema
+// migrations before use.
+type Migrator interface {
+	// Migrate applies pending migrations.
+	Migrate() error
+}
+
+// Close closes s if it implements io.Closer.
+func Close(s Store) error {
+	if c, ok := s.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
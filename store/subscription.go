@@ -0,0 +1,29 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jsirianni/server/model"
+)
+
+// SubscriptionStatus returns the status of the account's
+// subscription at now.
+func SubscriptionStatus(account model.Account, now time.Time) model.Subscription {
+	sub := model.Subscription{
+		AccountID: account.ID,
+		State:     model.SubscriptionActive,
+		Plan:      account.Plan,
+		ExpiresAt: account.ExpiresAt,
+	}
+
+	switch {
+	case !account.Active:
+		sub.State = model.SubscriptionInactive
+		sub.Reason = "subscription is not active"
+	case account.ExpiresAt != nil && !now.Before(*account.ExpiresAt):
+		sub.State = model.SubscriptionExpired
+		sub.Reason = fmt.Sprintf("subscription expired at %s", account.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	return sub
+}
@@ -0,0 +1,612 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jsirianni/server/model"
+)
+
+const (
+	// DefaultCompactThreshold is the default number of write-ahead
+	// log records after which the log is compacted into a snapshot.
+	DefaultCompactThreshold = 10000
+
+	walFileName          = "wal.log"
+	walSnapshotFileName  = "snapshot.jsonl"
+	walSnapshotTempName  = "snapshot.jsonl.tmp"
+	walLockFileName      = "LOCK"
+	walRecordHeaderBytes = 8
+	maxWALRecord         = 1 << 20
+)
+
+// ErrCorruptWAL is returned when opening a write-ahead log which
+// contains an invalid record before its final record.
+var ErrCorruptWAL = errors.New("corrupt write-ahead log")
+
+// ErrWALLocked is returned when opening a write-ahead log which is
+// open in another process.
+var ErrWALLocked = errors.New("write-ahead log is in use by another process")
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WALOption is a function that configures a write-ahead log.
+type WALOption func(*wal) error
+
+// WithCompactThreshold configures the number of records after
+// which the write-ahead log is compacted into a snapshot.
+func WithCompactThreshold(records int) WALOption {
+	return func(w *wal) error {
+		if records <= 0 {
+			return fmt.Errorf("compact threshold must be greater than zero: %d", records)
+		}
+		w.compactThreshold = records
+		return nil
+	}
+}
+
+// Write-ahead log operations. Replaying an operation more than
+// once has the same result as replaying it once.
+const (
+	walPutAccount       = "put_account"
+	walPutDevice        = "put_device"
+	walPutDevices       = "put_devices"
+	walDeleteDevice     = "delete_device"
+	walPutCredential    = "put_credential"
+	walDeleteCredential = "delete_credential"
+	walEnroll           = "enroll"
+)
+
+// walRecord is a single write-ahead log entry. Records are framed
+// with the big endian length and crc32 checksum of the encoded
+// record. A put devices record larger than maxWALRecord is split
+// into records with the same sequence, all but the last of which
+// set More, and is applied once the last record is read.
+type walRecord struct {
+	Sequence uint64 `json:"seq"`
+
+	// Revision is the watch revision before the record was
+	// applied, so that revisions continue after recovery.
+	Revision uint64 `json:"rev,omitempty"`
+
+	Op          string             `json:"op"`
+	More        bool               `json:"more,omitempty"`
+	Account     *model.Account     `json:"account,omitempty"`
+	Device      *model.Device      `json:"device,omitempty"`
+	Devices     []model.Device     `json:"devices,omitempty"`
+	Credential  *model.Credential  `json:"credential,omitempty"`
+	Credentials []model.Credential `json:"credentials,omitempty"`
+}
+
+// wal is an append-only log of store mutations stored in dir
+// alongside the most recent snapshot.
+type wal struct {
+	dir              string
+	f                *os.File
+	lock             *os.File
+	compactThreshold int
+
+	// offset is the size of the log's valid records
+	offset int64
+
+	// records is the number of records since the last compaction
+	records int
+
+	// sequence is the sequence of the last record
+	sequence uint64
+
+	// revision is the watch revision after the last record
+	// which was recovered
+	revision uint64
+
+	// err is set when the log can no longer be written safely
+	err error
+}
+
+// OpenMemory returns a memory store which records every mutation
+// in a write-ahead log in dir before applying it. The store is
+// recovered from the log and the most recent snapshot in dir. A
+// torn final record, left by a crash during a write, is discarded.
+// Watch revisions continue from the recovered log, so that watchers
+// resuming from a revision of an earlier run are sent EventResync
+// unless they saw every event. Only one process may open dir at a
+// time; ErrWALLocked is returned while another process has it open.
+// The store must be closed with Close.
+func OpenMemory(dir string, ops ...WALOption) (*Memory, error) {
+	w := &wal{
+		dir:              dir,
+		compactThreshold: DefaultCompactThreshold,
+	}
+	for _, op := range ops {
+		if err := op(w); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	w.lock = lock
+
+	m, err := w.recover()
+	if err != nil {
+		_ = w.close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// recover returns the store recovered from the snapshot and log,
+// and opens the log for appending.
+func (w *wal) recover() (*Memory, error) {
+	dir := w.dir
+
+	// A temporary snapshot is left behind by a crash during
+	// compaction and was never part of the store.
+	if err := os.Remove(filepath.Join(dir, walSnapshotTempName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove temporary snapshot: %w", err)
+	}
+
+	m := NewMemory()
+	if err := w.loadSnapshot(m); err != nil {
+		return nil, err
+	}
+	if err := w.open(m); err != nil {
+		return nil, err
+	}
+
+	m.wal = w
+	m.feed.reset(w.revision)
+	return m, nil
+}
+
+// Close closes the store's write-ahead log. It is a no-op for
+// stores without a write-ahead log.
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.wal == nil {
+		return nil
+	}
+	return m.wal.close()
+}
+
+// Compact writes the store to a snapshot and truncates its
+// write-ahead log. It is a no-op for stores without a
+// write-ahead log.
+func (m *Memory) Compact() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.wal == nil {
+		return nil
+	}
+	return m.wal.compact(m.wal.sequence, m.feed.current(), m.accounts, m.devices, m.credentials)
+}
+
+// write logs rec before calling apply. The log is compacted once it
+// reaches the compact threshold. Callers must hold the write lock.
+func (m *Memory) write(rec walRecord, apply func()) error {
+	if m.wal == nil {
+		apply()
+		return nil
+	}
+
+	rec.Revision = m.feed.current()
+	if err := m.wal.append(rec); err != nil {
+		return err
+	}
+	apply()
+
+	if m.wal.records >= m.wal.compactThreshold {
+		// The mutation is durable in the log, so a failed
+		// compaction is retried by the next write.
+		_ = m.wal.compact(m.wal.sequence, m.feed.current(), m.accounts, m.devices, m.credentials)
+	}
+	return nil
+}
+
+// replace swaps the store's contents for accounts, devices and
+// credentials. Stores with a write-ahead log write the new contents
+// to a snapshot first, at the revision of the EventResync which
+// callers publish after replacing. Callers must hold the write lock.
+func (m *Memory) replace(accounts map[string]model.Account, devices map[string]map[string]model.Device, credentials map[string]map[string]model.Credential) error {
+	if m.wal != nil {
+		if err := m.wal.compact(m.wal.sequence+1, m.feed.current()+1, accounts, devices, credentials); err != nil {
+			return err
+		}
+	}
+
+	m.accounts = accounts
+	m.devices = devices
+	m.credentials = credentials
+	return nil
+}
+
+// applyRecord applies a replayed record to m.
+func (m *Memory) applyRecord(rec walRecord) error {
+	switch rec.Op {
+	case walPutAccount:
+		if rec.Account == nil {
+			return errors.New("put account record requires an account")
+		}
+		m.accounts[rec.Account.ID] = *rec.Account
+	case walPutDevice:
+		if rec.Device == nil {
+			return errors.New("put device record requires a device")
+		}
+		m.putDevice(*rec.Device)
+	case walPutDevices:
+		for _, d := range rec.Devices {
+			m.putDevice(d)
+		}
+	case walDeleteDevice:
+		if rec.Device == nil {
+			return errors.New("delete device record requires a device")
+		}
+		m.deleteDevice(rec.Device.AccountID, rec.Device.ID)
+	case walPutCredential:
+		if rec.Credential == nil {
+			return errors.New("put credential record requires a credential")
+		}
+		m.putCredential(*rec.Credential)
+	case walDeleteCredential:
+		if rec.Credential == nil {
+			return errors.New("delete credential record requires a credential")
+		}
+		m.deleteCredential(rec.Credential.AccountID, rec.Credential.ID)
+	case walEnroll:
+		if rec.Device == nil {
+			return errors.New("enroll record requires a device")
+		}
+		m.enroll(*rec.Device, rec.Credentials)
+	default:
+		return fmt.Errorf("unknown operation '%s'", rec.Op)
+	}
+	return nil
+}
+
+// loadSnapshot reads the most recent snapshot into m.
+func (w *wal) loadSnapshot(m *Memory) error {
+	f, err := os.Open(filepath.Join(w.dir, walSnapshotFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	// Devices were validated before they were written, so they
+	// are loaded even if validation has since changed.
+	snap, err := readSnapshot(f, false)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if err := snap.checkAccounts(func(string) bool { return false }); err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	m.accounts = snap.staged.accounts
+	m.devices = snap.staged.devices
+	m.credentials = snap.staged.credentials
+	w.sequence = snap.sequence
+	w.revision = snap.revision
+	return nil
+}
+
+// open replays the log into m and opens it for appending.
+func (w *wal) open(m *Memory) error {
+	path := filepath.Join(w.dir, walFileName)
+	// #nosec G304 the wal directory is provided by the operator
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open wal: %w", err)
+	}
+
+	if err := w.replay(f, m); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	// Discard a torn final record, if any, so that new
+	// records are appended after the last valid record.
+	if err := f.Truncate(w.offset); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to truncate wal: %w", err)
+	}
+	if _, err := f.Seek(w.offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to seek wal: %w", err)
+	}
+
+	w.f = f
+	return nil
+}
+
+// replay applies the records in f to m. Records included in the
+// snapshot are skipped. Replay stops at a torn final record, and
+// discards a split record whose last part was not written.
+func (w *wal) replay(f *os.File, m *Memory) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read wal: %w", err)
+	}
+	size := info.Size()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, walRecordHeaderBytes)
+
+	// offset is the read position, which is ahead of w.offset
+	// while reading the parts of a split record.
+	offset := w.offset
+	var parts []walRecord
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read wal: %w", err)
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		end := offset + walRecordHeaderBytes + length
+		if end > size {
+			return nil
+		}
+		if length > maxWALRecord {
+			return fmt.Errorf("%w: record at offset %d exceeds %d bytes", ErrCorruptWAL, offset, maxWALRecord)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return fmt.Errorf("failed to read wal: %w", err)
+		}
+
+		if crc32.Checksum(payload, walTable) != checksum {
+			if end == size {
+				return nil
+			}
+			return fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorruptWAL, offset)
+		}
+
+		rec := walRecord{}
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return fmt.Errorf("%w: invalid record at offset %d: %v", ErrCorruptWAL, offset, err)
+		}
+
+		if len(parts) > 0 && (rec.Op != parts[0].Op || rec.Sequence != parts[0].Sequence) {
+			return fmt.Errorf("%w: record at offset %d interrupts a split record", ErrCorruptWAL, offset)
+		}
+		offset = end
+		if rec.More {
+			parts = append(parts, rec)
+			continue
+		}
+		if len(parts) > 0 {
+			rec = joinRecords(append(parts, rec))
+			w.records += len(parts)
+			parts = nil
+		}
+
+		if rec.Sequence > w.sequence {
+			if err := m.applyRecord(rec); err != nil {
+				return fmt.Errorf("%w: record at offset %d: %v", ErrCorruptWAL, w.offset, err)
+			}
+			w.sequence = rec.Sequence
+			if rec.Revision > 0 {
+				w.revision = rec.Revision
+			}
+			w.revision += rec.events()
+		}
+
+		w.offset = end
+		w.records++
+	}
+}
+
+// events returns the number of watch events published when rec
+// is applied.
+func (rec walRecord) events() uint64 {
+	switch rec.Op {
+	case walPutDevices:
+		return uint64(len(rec.Devices))
+	case walPutCredential, walDeleteCredential:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// joinRecords returns the record which was split into parts.
+func joinRecords(parts []walRecord) walRecord {
+	rec := parts[len(parts)-1]
+	devices := []model.Device{}
+	for _, part := range parts {
+		devices = append(devices, part.Devices...)
+	}
+	rec.Devices = devices
+	return rec
+}
+
+// append writes rec to the log and syncs it to disk. ErrTooLarge is
+// returned, without writing, if rec cannot be encoded in records of
+// at most maxWALRecord bytes.
+func (w *wal) append(rec walRecord) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	rec.Sequence = w.sequence + 1
+	payloads, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, payload := range payloads {
+		header := make([]byte, walRecordHeaderBytes)
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, walTable))
+		buf = append(buf, header...)
+		buf = append(buf, payload...)
+	}
+
+	if _, err := w.f.Write(buf); err != nil {
+		// Remove the partial record so that later records
+		// are not written after it.
+		if terr := w.f.Truncate(w.offset); terr != nil {
+			w.err = fmt.Errorf("wal is unusable after failed write: %w", err)
+			return w.err
+		}
+		if _, serr := w.f.Seek(w.offset, io.SeekStart); serr != nil {
+			w.err = fmt.Errorf("wal is unusable after failed write: %w", err)
+			return w.err
+		}
+		return fmt.Errorf("failed to write wal: %w", err)
+	}
+
+	// Whether the record reached the disk is unknown after a
+	// failed sync, so the log cannot be written safely.
+	if err := w.f.Sync(); err != nil {
+		w.err = fmt.Errorf("wal is unusable after failed sync: %w", err)
+		return w.err
+	}
+
+	w.offset += int64(len(buf))
+	w.records += len(payloads)
+	w.sequence = rec.Sequence
+	return nil
+}
+
+// encodeRecord returns the encoded parts of rec. A put devices record
+// larger than maxWALRecord is split in half until each part fits.
+func encodeRecord(rec walRecord) ([][]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode wal record: %w", err)
+	}
+	if len(payload) <= maxWALRecord {
+		return [][]byte{payload}, nil
+	}
+
+	if rec.Op != walPutDevices || len(rec.Devices) < 2 {
+		return nil, fmt.Errorf("%w: wal record of %d bytes exceeds %d bytes", ErrTooLarge, len(payload), maxWALRecord)
+	}
+
+	half := len(rec.Devices) / 2
+	first, last := rec, rec
+	first.Devices, first.More = rec.Devices[:half], true
+	last.Devices = rec.Devices[half:]
+
+	firstPayloads, err := encodeRecord(first)
+	if err != nil {
+		return nil, err
+	}
+	lastPayloads, err := encodeRecord(last)
+	if err != nil {
+		return nil, err
+	}
+	return append(firstPayloads, lastPayloads...), nil
+}
+
+// compact writes accounts, devices and credentials to a new snapshot
+// which includes all records up to sequence, and watch revisions up to
+// revision, then truncates the log.
+func (w *wal) compact(sequence, revision uint64, accounts map[string]model.Account, devices map[string]map[string]model.Device, credentials map[string]map[string]model.Credential) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	tmp := filepath.Join(w.dir, walSnapshotTempName)
+	// #nosec G304 the wal directory is provided by the operator
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	sortedAccounts, sortedDevices := sortedContents(accounts, devices)
+	if err := writeSnapshot(f, sequence, revision, sortedAccounts, sortedDevices, sortedCredentials(credentials)); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmp, filepath.Join(w.dir, walSnapshotFileName)); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+
+	// Records remaining after a failed truncate are included in
+	// the snapshot and skipped by replay, so the snapshot is valid
+	// either way.
+	w.sequence = sequence
+	if err := w.f.Truncate(0); err != nil {
+		w.err = fmt.Errorf("wal is unusable after failed truncate: %w", err)
+		return w.err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		w.err = fmt.Errorf("wal is unusable after failed truncate: %w", err)
+		return w.err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.err = fmt.Errorf("wal is unusable after failed sync: %w", err)
+		return w.err
+	}
+
+	w.offset = 0
+	w.records = 0
+	return nil
+}
+
+func (w *wal) close() error {
+	var err error
+	if w.f != nil {
+		err = w.f.Close()
+		w.f = nil
+	}
+	if w.lock != nil {
+		if lockErr := unlockDir(w.lock); err == nil {
+			err = lockErr
+		}
+		w.lock = nil
+	}
+	w.err = errors.New("wal is closed")
+	return err
+}
+
+// syncDir syncs a directory so that renames within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open wal directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jsirianni/server/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenMemoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	m := openTestWAL(t, dir)
+	require.NoError(t, Seed(m))
+	require.NoError(t, m.UpdateAccount(model.Account{ID: "go", Key: "095", Active: true}))
+	require.NoError(t, m.DeleteDevice("abc", "device-b"))
+	_, err := m.RegisterDevice("go", "095", model.Device{ID: "device-c", Hostname: "c"})
+	require.NoError(t, err)
+	_, err = m.RegisterDevices("go", "095", []model.Device{{ID: "device-d"}, {ID: "device-e"}}, BatchAtomic)
+	require.NoError(t, err)
+	require.NoError(t, m.CreateCredential(model.Credential{ID: "e", AccountID: "go", Kind: model.CredentialEnrollment, MaxUses: 2}))
+	require.NoError(t, m.CreateCredential(model.Credential{ID: "revoked", AccountID: "go", Kind: model.CredentialEnrollment}))
+	require.NoError(t, m.DeleteCredential("go", "revoked"))
+	_, err = m.Enroll("go", "e", model.Device{ID: "device-f", Fingerprint: &model.Fingerprint{MachineID: "f"}}, model.Credential{ID: "f"})
+	require.NoError(t, err)
+	_, err = m.Enroll("go", "e", model.Device{ID: "device-f", Fingerprint: &model.Fingerprint{MachineID: "f"}}, model.Credential{ID: "f2"})
+	require.NoError(t, err)
+
+	// The store is not closed, simulating a crash.
+	recovered := reopenTestWAL(t, m, dir)
+	require.Equal(t, m.accounts, recovered.accounts)
+	require.Equal(t, m.devices, recovered.devices)
+	require.Equal(t, m.credentials, recovered.credentials)
+	require.Len(t, recovered.credentials["go"], 2)
+
+	// Credentials are kept when the log is compacted.
+	require.NoError(t, recovered.Compact())
+	recovered = reopenTestWAL(t, recovered, dir)
+	require.Equal(t, m.credentials, recovered.credentials)
+}
+
+func TestOpenMemoryTornRecord(t *testing.T) {
+	cases := []struct {
+		name string
+		torn func(record []byte) []byte
+	}{
+		{"partial-header", func(record []byte) []byte { return record[:3] }},
+		{"partial-payload", func(record []byte) []byte { return record[:len(record)-5] }},
+		{"bad-checksum", func(record []byte) []byte {
+			record[len(record)-2] ^= 0xff
+			return record
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, walFileName)
+
+			m := openTestWAL(t, dir)
+			require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz"}))
+			valid := readFile(t, path)
+
+			// Simulate a crash while writing the second record.
+			require.NoError(t, m.CreateAccount(model.Account{ID: "torn", Key: "key"}))
+			record := readFile(t, path)[len(valid):]
+			require.NoError(t, os.WriteFile(path, append(valid, tc.torn(record)...), 0o600))
+
+			recovered := reopenTestWAL(t, m, dir)
+			_, err := recovered.Account("abc")
+			require.NoError(t, err)
+			_, err = recovered.Account("torn")
+			require.ErrorIs(t, err, ErrNotFound)
+			require.Equal(t, valid, readFile(t, path), "expected the torn record to be truncated")
+
+			require.NoError(t, recovered.CreateAccount(model.Account{ID: "next", Key: "key"}))
+			recovered = reopenTestWAL(t, recovered, dir)
+			_, err = recovered.Account("next")
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestOpenMemoryLargeBatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFileName)
+
+	m := openTestWAL(t, dir)
+	require.NoError(t, Seed(m))
+	valid := readFile(t, path)
+
+	devices := make([]model.Device, 10000)
+	for i := range devices {
+		devices[i] = model.Device{
+			ID:          fmt.Sprintf("device-%05d", i),
+			Hostname:    fmt.Sprintf("host-%05d", i),
+			Annotations: map[string]string{"notes": strings.Repeat("x", 200)},
+		}
+	}
+	_, err := m.RegisterDevices("abc", "xyz", devices, BatchAtomic)
+	require.NoError(t, err)
+	batch := readFile(t, path)[len(valid):]
+	require.Greater(t, len(batch), maxWALRecord, "expected the batch to be split")
+
+	recovered := reopenTestWAL(t, m, dir)
+	require.Equal(t, m.devices, recovered.devices)
+	require.Len(t, recovered.devices["abc"], 10002)
+
+	// A crash before the last part is written discards the batch.
+	require.NoError(t, os.WriteFile(path, append(valid, batch[:len(batch)/2]...), 0o600))
+	recovered = reopenTestWAL(t, recovered, dir)
+	require.Len(t, recovered.devices["abc"], 2)
+	require.Equal(t, valid, readFile(t, path), "expected the partial batch to be truncated")
+
+	// A device which does not fit in a record is rejected.
+	labels := make(map[string]string, 20000)
+	for i := 0; i < 20000; i++ {
+		labels[fmt.Sprintf("key-%05d", i)] = strings.Repeat("v", 60)
+	}
+	_, err = recovered.RegisterDevice("abc", "xyz", model.Device{ID: "huge", Labels: labels})
+	require.ErrorIs(t, err, ErrTooLarge)
+	require.Equal(t, valid, readFile(t, path))
+	_, err = recovered.Device("abc", "huge")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestOpenMemoryCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFileName)
+
+	m := openTestWAL(t, dir)
+	require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz"}))
+	require.NoError(t, m.CreateAccount(model.Account{ID: "def", Key: "xyz"}))
+
+	data := readFile(t, path)
+	data[walRecordHeaderBytes+2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	crashTestWAL(m)
+	_, err := OpenMemory(dir)
+	require.ErrorIs(t, err, ErrCorruptWAL)
+}
+
+func TestOpenMemoryCompaction(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFileName)
+
+	m := openTestWAL(t, dir, WithCompactThreshold(3))
+	require.NoError(t, Seed(m))
+	require.FileExists(t, filepath.Join(dir, walSnapshotFileName))
+	require.Equal(t, 1, m.wal.records)
+	require.Less(t, len(readFile(t, path)), 200)
+
+	recovered := reopenTestWAL(t, m, dir)
+	require.Equal(t, m.accounts, recovered.accounts)
+	require.Equal(t, m.devices, recovered.devices)
+
+	require.NoError(t, recovered.Compact())
+	require.Empty(t, readFile(t, path))
+	recovered = reopenTestWAL(t, recovered, dir)
+	require.Equal(t, m.accounts, recovered.accounts)
+}
+
+func TestOpenMemoryCrashDuringCompaction(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFileName)
+
+	m := openTestWAL(t, dir)
+	require.NoError(t, Seed(m))
+	log := readFile(t, path)
+
+	// Crash after writing a temporary snapshot.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, walSnapshotTempName), []byte("partial"), 0o600))
+	recovered := reopenTestWAL(t, m, dir)
+	require.Equal(t, m.accounts, recovered.accounts)
+	require.NoFileExists(t, filepath.Join(dir, walSnapshotTempName))
+
+	// Crash after replacing the snapshot but before truncating
+	// the log. Records already in the snapshot must not be
+	// replayed over it.
+	_, err := recovered.Import(strings.NewReader(`{"kind":"header","version":1}
+{"kind":"account","account":{"id":"new","key":"key","active":true}}
+`), ImportReplace)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, log, 0o600))
+
+	recovered = reopenTestWAL(t, recovered, dir)
+	require.Len(t, recovered.accounts, 1)
+	require.Empty(t, recovered.devices)
+
+	require.NoError(t, recovered.CreateAccount(model.Account{ID: "abc", Key: "xyz"}))
+	recovered = reopenTestWAL(t, recovered, dir)
+	require.Len(t, recovered.accounts, 2)
+}
+
+func TestOpenMemoryClosed(t *testing.T) {
+	m, err := OpenMemory(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	err = m.CreateAccount(model.Account{ID: "abc"})
+	require.ErrorContains(t, err, "wal is closed")
+	_, err = m.Account("abc")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, NewMemory().Close())
+}
+
+func TestOpenMemoryLocked(t *testing.T) {
+	dir := t.TempDir()
+	m := openTestWAL(t, dir)
+
+	_, err := OpenMemory(dir)
+	require.ErrorIs(t, err, ErrWALLocked)
+	require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz"}), "expected the failed open to not affect the store")
+
+	require.NoError(t, m.Close())
+	recovered := openTestWAL(t, dir)
+	_, err = recovered.Account("abc")
+	require.NoError(t, err)
+}
+
+func TestWithCompactThreshold(t *testing.T) {
+	_, err := OpenMemory(t.TempDir(), WithCompactThreshold(0))
+	require.ErrorContains(t, err, "compact threshold must be greater than zero")
+}
+
+func openTestWAL(t *testing.T, dir string, ops ...WALOption) *Memory {
+	t.Helper()
+	m, err := OpenMemory(dir, ops...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
+
+// reopenTestWAL opens dir again after simulating a crash of m.
+func reopenTestWAL(t *testing.T, m *Memory, dir string, ops ...WALOption) *Memory {
+	t.Helper()
+	crashTestWAL(m)
+	return openTestWAL(t, dir, ops...)
+}
+
+// crashTestWAL releases m's lock on its directory without closing
+// its log, as happens when a process exits.
+func crashTestWAL(m *Memory) {
+	if m.wal.lock != nil {
+		_ = unlockDir(m.wal.lock)
+		m.wal.lock = nil
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jsirianni/server/model"
+)
+
+const (
+	// watchHistory is the number of events kept for watchers
+	// which resume from an earlier revision.
+	watchHistory = 1024
+
+	// watchBuffer is the number of events buffered for a watcher
+	// before it is sent EventResync.
+	watchBuffer = 1024
+)
+
+// EventType is the type of a change event.
+type EventType string
+
+const (
+	// EventAccountCreated is sent when an account is created.
+	EventAccountCreated EventType = "account.created"
+
+	// EventAccountUpdated is sent when an account is replaced.
+	EventAccountUpdated EventType = "account.updated"
+
+	// EventDeviceRegistered is sent when a new device is registered.
+	EventDeviceRegistered EventType = "device.registered"
+
+	// EventDeviceUpdated is sent when an existing device is
+	// registered again.
+	EventDeviceUpdated EventType = "device.updated"
+
+	// EventDeviceDeleted is sent when a device is deleted.
+	EventDeviceDeleted EventType = "device.deleted"
+
+	// EventResync is sent when events were missed, either because
+	// the watcher fell behind or because the requested revision is
+	// no longer available. Watchers must reload any state derived
+	// from the store. Events which follow have later revisions.
+	EventResync EventType = "resync"
+)
+
+// Event is a change to a store.
+type Event struct {
+	// Revision increases by one with every change.
+	Revision uint64 `json:"revision"`
+
+	// Type is the type of change.
+	Type EventType `json:"type"`
+
+	// AccountID is the changed account, or the account of the
+	// changed device. It is empty for EventResync.
+	AccountID string `json:"account_id,omitempty"`
+
+	// Account is set for account events. The account key
+	// is omitted.
+	Account *model.Account `json:"account,omitempty"`
+
+	// Device is set for device events.
+	Device *model.Device `json:"device,omitempty"`
+}
+
+// feed assigns revisions to events and delivers them to watchers.
+type feed struct {
+	mu sync.Mutex
+
+	// revision is the revision of the latest event
+	revision uint64
+
+	// history holds the latest events, with the event for
+	// revision r at index r % len(history)
+	history []Event
+
+	// count is the number of events in history
+	count int
+
+	// buffer is the size of each watcher's queue
+	buffer int
+
+	watchers map[*watcher]struct{}
+}
+
+func newFeed() *feed {
+	return &feed{
+		history:  make([]Event, watchHistory),
+		buffer:   watchBuffer,
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// publish assigns the next revision to e and delivers it to all
+// watchers. Callers must publish events in the order the changes
+// were applied.
+func (f *feed) publish(e Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.revision++
+	e.Revision = f.revision
+	if e.Account != nil {
+		account := *e.Account
+		account.Key = ""
+		e.Account = &account
+	}
+
+	f.history[f.revision%uint64(len(f.history))] = e
+	if f.count < len(f.history) {
+		f.count++
+	}
+
+	for w := range f.watchers {
+		w.push(e)
+	}
+}
+
+// current returns the revision of the latest event.
+func (f *feed) current() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.revision
+}
+
+// reset sets the current revision and clears the history.
+func (f *feed) reset(revision uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.revision = revision
+	f.count = 0
+}
+
+// watch returns a channel of events after fromRevision. Watching
+// starts at the current revision when fromRevision is zero.
+func (f *feed) watch(ctx context.Context, fromRevision uint64) <-chan Event {
+	w := &watcher{
+		ch:     make(chan Event),
+		notify: make(chan struct{}, 1),
+		max:    f.buffer,
+	}
+
+	f.mu.Lock()
+	switch oldest := f.revision - uint64(f.count); {
+	case fromRevision == 0:
+	case fromRevision < oldest || fromRevision > f.revision:
+		w.push(Event{Revision: f.revision, Type: EventResync})
+	default:
+		for r := fromRevision + 1; r <= f.revision; r++ {
+			w.push(f.history[r%uint64(len(f.history))])
+		}
+	}
+	f.watchers[w] = struct{}{}
+	f.mu.Unlock()
+
+	go func() {
+		w.run(ctx)
+
+		f.mu.Lock()
+		delete(f.watchers, w)
+		f.mu.Unlock()
+		close(w.ch)
+	}()
+
+	return w.ch
+}
+
+// watcher queues events for a single consumer.
+type watcher struct {
+	ch     chan Event
+	notify chan struct{}
+	max    int
+
+	mu    sync.Mutex
+	queue []Event
+}
+
+// push queues e. When the queue is full it is replaced with
+// EventResync at e's revision.
+func (w *watcher) push(e Event) {
+	w.mu.Lock()
+	if len(w.queue) >= w.max {
+		w.queue = w.queue[:0]
+		e = Event{Revision: e.Revision, Type: EventResync}
+	}
+	w.queue = append(w.queue, e)
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued events until ctx is done.
+func (w *watcher) run(ctx context.Context) {
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			select {
+			case <-w.notify:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		e := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.ch <- e:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := NewMemory()
+	events, err := m.Watch(ctx, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, Seed(m))
+	_, err = m.RegisterDevice("abc", "xyz", model.Device{ID: "device-a", Hostname: "renamed"})
+	require.NoError(t, err)
+	require.NoError(t, m.UpdateAccount(model.Account{ID: "go", Key: "095", Active: true}))
+	require.NoError(t, m.DeleteDevice("abc", "device-b"))
+	_, err = m.Import(strings.NewReader(testSnapshot), ImportMerge)
+	require.NoError(t, err)
+
+	expect := []struct {
+		eventType EventType
+		accountID string
+		id        string
+	}{
+		{EventAccountCreated, "abc", "abc"},
+		{EventAccountCreated, "go", "go"},
+		{EventDeviceRegistered, "abc", "device-a"},
+		{EventDeviceRegistered, "abc", "device-b"},
+		{EventDeviceUpdated, "abc", "device-a"},
+		{EventAccountUpdated, "go", "go"},
+		{EventDeviceDeleted, "abc", "device-b"},
+		{EventResync, "", ""},
+	}
+
+	for i, e := range expect {
+		event := receive(t, events)
+		require.Equal(t, uint64(i+1), event.Revision)
+		require.Equal(t, e.eventType, event.Type)
+		require.Equal(t, e.accountID, event.AccountID)
+		switch {
+		case event.Account != nil:
+			require.Equal(t, e.id, event.Account.ID)
+			require.Empty(t, event.Account.Key, "expected the account key to be omitted")
+		case event.Device != nil:
+			require.Equal(t, e.id, event.Device.ID)
+		default:
+			require.Empty(t, e.id)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchFromRevision(t *testing.T) {
+	m := NewMemory()
+	require.NoError(t, Seed(m))
+
+	cases := []struct {
+		name      string
+		from      uint64
+		expectRev uint64
+		expectTyp EventType
+	}{
+		{"history", 2, 3, EventDeviceRegistered},
+		{"current", 4, 5, EventAccountUpdated},
+		{"ahead", 10, 5, EventResync},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			events, err := m.Watch(ctx, tc.from)
+			require.NoError(t, err)
+			if tc.expectTyp == EventAccountUpdated {
+				require.NoError(t, m.UpdateAccount(model.Account{ID: "go", Key: "095"}))
+			}
+
+			event := receive(t, events)
+			require.Equal(t, tc.expectRev, event.Revision)
+			require.Equal(t, tc.expectTyp, event.Type)
+		})
+	}
+}
+
+func TestWatchExpiredRevision(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := NewMemory()
+	require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz"}))
+	for i := 0; i <= watchHistory; i++ {
+		_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "device"})
+		require.NoError(t, err)
+	}
+
+	events, err := m.Watch(ctx, 1)
+	require.NoError(t, err)
+	event := receive(t, events)
+	require.Equal(t, EventResync, event.Type)
+	require.Equal(t, uint64(watchHistory+2), event.Revision)
+
+	events, err = m.Watch(ctx, 2)
+	require.NoError(t, err)
+	event = receive(t, events)
+	require.Equal(t, EventDeviceUpdated, event.Type)
+	require.Equal(t, uint64(3), event.Revision)
+}
+
+func TestWatchSlowConsumer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := NewMemory()
+	m.feed.buffer = 2
+	require.NoError(t, m.CreateAccount(model.Account{ID: "abc", Key: "xyz"}))
+
+	events, err := m.Watch(ctx, 0)
+	require.NoError(t, err)
+
+	// The watcher is not reading, so its queue overflows.
+	for i := 0; i < 10; i++ {
+		_, err := m.RegisterDevice("abc", "xyz", model.Device{ID: "device"})
+		require.NoError(t, err)
+	}
+	require.NoError(t, m.DeleteDevice("abc", "device"))
+
+	// Events are dropped in favour of a resync, but the
+	// watcher still reaches the latest revision.
+	resync := false
+	for event := receive(t, events); ; event = receive(t, events) {
+		resync = resync || event.Type == EventResync
+		if event.Revision == 12 {
+			break
+		}
+	}
+	require.True(t, resync)
+}
+
+func TestWatchCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := NewMemory()
+	events, err := m.Watch(ctx, 0)
+	require.NoError(t, err)
+	cancel()
+
+	select {
+	case _, ok := <-events:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("expected the channel to be closed")
+	}
+
+	require.Eventually(t, func() bool {
+		m.feed.mu.Lock()
+		defer m.feed.mu.Unlock()
+		return len(m.feed.watchers) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestWatchWALRevision(t *testing.T) {
+	dir := t.TempDir()
+	m := openTestWAL(t, dir)
+	require.NoError(t, Seed(m))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recovered := reopenTestWAL(t, m, dir)
+	events, err := recovered.Watch(ctx, 2)
+	require.NoError(t, err)
+	event := receive(t, events)
+	require.Equal(t, EventResync, event.Type, "history is not recovered")
+	require.Equal(t, uint64(4), event.Revision)
+
+	require.NoError(t, recovered.DeleteDevice("abc", "device-a"))
+	event = receive(t, events)
+	require.Equal(t, uint64(5), event.Revision)
+}
+
+func TestWatchWALRevisionRecovered(t *testing.T) {
+	dir := t.TempDir()
+	m := openTestWAL(t, dir)
+	require.NoError(t, Seed(m))
+	_, err := m.RegisterDevices("abc", "xyz", []model.Device{{ID: "c"}, {ID: "d"}, {ID: "e"}}, BatchAtomic)
+	require.NoError(t, err)
+	require.NoError(t, m.CreateCredential(model.Credential{ID: "t", AccountID: "abc", Kind: model.CredentialToken}))
+	require.Equal(t, uint64(7), m.feed.current())
+
+	// A batch publishes an event per device and credentials publish
+	// none, so the revision differs from the log's sequence.
+	recovered := reopenTestWAL(t, m, dir)
+	require.Equal(t, uint64(7), recovered.feed.current())
+	require.NoError(t, recovered.Compact())
+
+	recovered = reopenTestWAL(t, recovered, dir)
+	require.Equal(t, uint64(7), recovered.feed.current())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A watcher which saw every event continues without a resync.
+	events, err := recovered.Watch(ctx, 7)
+	require.NoError(t, err)
+	require.NoError(t, recovered.DeleteDevice("abc", "c"))
+	event := receive(t, events)
+	require.Equal(t, EventDeviceDeleted, event.Type)
+	require.Equal(t, uint64(8), event.Revision)
+
+	_, err = recovered.Import(strings.NewReader(`{"kind":"header","version":1}
+{"kind":"account","account":{"id":"new","key":"key","active":true}}
+`), ImportReplace)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), recovered.feed.current())
+
+	recovered = reopenTestWAL(t, recovered, dir)
+	require.Equal(t, uint64(9), recovered.feed.current())
+}
+
+func TestCachedWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, err := NewCached(NewMemory(), time.Minute)
+	require.NoError(t, err)
+
+	events, err := c.Watch(ctx, 0)
+	require.NoError(t, err)
+	require.NoError(t, c.CreateAccount(model.Account{ID: "abc"}))
+	require.Equal(t, EventAccountCreated, receive(t, events).Type)
+}
+
+func receive(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		require.True(t, ok, "expected an event")
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+		return Event{}
+	}
+}
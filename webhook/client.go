@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+)
+
+// ErrDestinationNotAllowed is returned when a delivery would connect
+// to a loopback, private, link-local or unspecified address.
+var ErrDestinationNotAllowed = errors.New("webhook destination address is not allowed")
+
+// sharedAddressSpace is the carrier-grade NAT range, RFC 6598, which
+// is not covered by netip.Addr.IsPrivate.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// newHTTPClient returns the default client used for deliveries. It
+// refuses to connect to addresses within the server's network and
+// does not follow redirects, so that endpoints can not be used to
+// reach internal services. Proxies from the environment are not used,
+// as the address checked would be the proxy's.
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: DefaultTimeout,
+		Control: checkDestination,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:       DefaultTimeout,
+		Transport:     transport,
+		CheckRedirect: refuseRedirect,
+	}
+}
+
+// checkDestination is a net.Dialer Control function which refuses
+// connections to addresses which are not publicly routable. It runs
+// after the host is resolved, so it also applies to host names.
+func checkDestination(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !allowedDestination(addr) {
+		return fmt.Errorf("%w: %s", ErrDestinationNotAllowed, addr)
+	}
+	return nil
+}
+
+// allowedDestination returns false for loopback, private, link-local,
+// multicast and unspecified addresses.
+func allowedDestination(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	switch {
+	case addr.IsLoopback(), addr.IsPrivate(), addr.IsUnspecified(),
+		addr.IsLinkLocalUnicast(), addr.IsLinkLocalMulticast(),
+		addr.IsInterfaceLocalMulticast(), addr.IsMulticast(),
+		sharedAddressSpace.Contains(addr):
+		return false
+	}
+	return true
+}
+
+// refuseRedirect is an http.Client CheckRedirect function which
+// refuses to follow redirects, as a redirect could lead to an
+// address which the endpoint's url does not.
+func refuseRedirect(req *http.Request, _ []*http.Request) error {
+	return fmt.Errorf("%w: endpoint redirected to %s", ErrDestinationNotAllowed, req.URL.Redacted())
+}
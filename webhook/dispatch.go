@@ -0,0 +1,354 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jsirianni/server/store"
+	"go.uber.org/zap"
+)
+
+// payload is the body of a delivery.
+type payload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	AccountID string      `json:"account_id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// subscriptionData is the data of a subscription.changed event.
+type subscriptionData struct {
+	AccountID string `json:"account_id"`
+	Active    bool   `json:"active"`
+}
+
+// Run queues deliveries for store events and delivers them until
+// ctx is done. Deliveries queued before a restart are resumed.
+func (m *Manager) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := m.store.Watch(ctx, 0)
+	if err != nil {
+		return fmt.Errorf("failed to watch store: %w", err)
+	}
+	if err := m.loadAccounts(); err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.dispatch(ctx)
+	}()
+	defer wg.Wait()
+
+	for e := range events {
+		if e.Type == store.EventResync {
+			if err := m.loadAccounts(); err != nil {
+				m.logger.Error("failed to reload accounts", zap.Error(err))
+			}
+			continue
+		}
+
+		event, data, ok := m.convert(e)
+		if !ok {
+			continue
+		}
+		if err := m.enqueue(e.AccountID, event, data); err != nil {
+			m.logger.Error("failed to queue webhook delivery", zap.String("account", e.AccountID), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// loadAccounts records the subscription state of every account.
+func (m *Manager) loadAccounts() error {
+	accounts, err := m.store.Accounts()
+	if err != nil {
+		return fmt.Errorf("failed to list accounts: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.active = make(map[string]bool, len(accounts))
+	for _, a := range accounts {
+		m.active[a.ID] = a.Active
+	}
+	return nil
+}
+
+// convert returns the webhook event and data for e. Returns false
+// when e is not delivered to endpoints.
+func (m *Manager) convert(e store.Event) (string, interface{}, bool) {
+	switch e.Type {
+	case store.EventDeviceRegistered:
+		return EventDeviceRegistered, e.Device, true
+	case store.EventDeviceUpdated:
+		return EventDeviceUpdated, e.Device, true
+	case store.EventDeviceDeleted:
+		return EventDeviceDeleted, e.Device, true
+	case store.EventAccountCreated, store.EventAccountUpdated:
+		m.mu.Lock()
+		previous, known := m.active[e.AccountID]
+		m.active[e.AccountID] = e.Account.Active
+		m.mu.Unlock()
+
+		if e.Type == store.EventAccountCreated || (known && previous == e.Account.Active) {
+			return "", nil, false
+		}
+		return EventSubscriptionChanged, subscriptionData{AccountID: e.AccountID, Active: e.Account.Active}, true
+	default:
+		return "", nil, false
+	}
+}
+
+// enqueue queues a delivery of event to each of the account's
+// endpoints which subscribe to it. Deliveries to an endpoint with
+// maxPendingDeliveries pending are dead lettered.
+func (m *Manager) enqueue(accountID, event string, data interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now().UTC()
+	queued := []queueRecord{}
+	for _, endpoint := range m.endpoints {
+		if endpoint.AccountID != accountID || !subscribes(endpoint, event) {
+			continue
+		}
+
+		id, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+
+		body, err := json.Marshal(payload{ID: id, Event: event, AccountID: accountID, CreatedAt: now, Data: data})
+		if err != nil {
+			return fmt.Errorf("failed to encode webhook payload: %w", err)
+		}
+
+		d := Delivery{
+			ID:          id,
+			EndpointID:  endpoint.ID,
+			AccountID:   accountID,
+			Event:       event,
+			Payload:     body,
+			State:       StatePending,
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if len(m.pending[endpoint.ID]) >= maxPendingDeliveries {
+			d.State = StateDead
+			d.NextAttempt = time.Time{}
+			d.LastError = "endpoint has too many pending deliveries"
+			m.logger.Warn("webhook delivery is dead", zap.String("delivery", d.ID), zap.String("endpoint", d.EndpointID), zap.String("reason", d.LastError))
+		}
+		queued = append(queued, queueRecord{Delivery: &d})
+	}
+
+	if len(queued) == 0 {
+		return nil
+	}
+
+	if err := m.persist(queued...); err != nil {
+		return err
+	}
+	for _, rec := range queued {
+		m.putDelivery(*rec.Delivery)
+	}
+	m.pruneCompleted()
+
+	m.notify()
+	return nil
+}
+
+func subscribes(endpoint Endpoint, event string) bool {
+	if len(endpoint.Events) == 0 {
+		return true
+	}
+	for _, e := range endpoint.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch attempts due deliveries until ctx is done, and waits
+// for attempts in progress to return.
+func (m *Manager) dispatch(ctx context.Context) {
+	workers := sync.WaitGroup{}
+	defer workers.Wait()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+		case <-timer.C:
+		}
+
+		next := m.startDue(ctx, &workers)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next > 0 {
+			timer.Reset(next)
+		}
+	}
+}
+
+// startDue attempts the oldest pending delivery of each endpoint
+// when it is due, with at most one attempt per endpoint and
+// maxConcurrentDeliveries attempts in progress. Returns the delay
+// until the next delivery is due, or zero when none is waiting on
+// its backoff. The dispatcher is notified when an attempt returns.
+func (m *Manager) startDue(ctx context.Context, workers *sync.WaitGroup) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var next time.Duration
+	now := m.now()
+	for endpointID, ids := range m.pending {
+		if m.inflight[endpointID] {
+			continue
+		}
+
+		d := m.deliveries[ids[0]]
+		if wait := d.NextAttempt.Sub(now); wait > 0 {
+			if next == 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		if len(m.inflight) >= maxConcurrentDeliveries {
+			continue
+		}
+
+		m.inflight[endpointID] = true
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			m.attempt(ctx, d)
+
+			m.mu.Lock()
+			delete(m.inflight, d.EndpointID)
+			m.mu.Unlock()
+			m.notify()
+		}()
+	}
+	return next
+}
+
+// attempt delivers d once and records the result.
+func (m *Manager) attempt(ctx context.Context, d Delivery) {
+	m.mu.Lock()
+	endpoint, ok := m.endpoints[d.EndpointID]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	status, err := m.send(ctx, endpoint, d)
+	if ctx.Err() != nil {
+		// Shutting down, the delivery is attempted
+		// again after a restart.
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.deliveries[d.ID]
+	if !ok || !current.UpdatedAt.Equal(d.UpdatedAt) {
+		// The delivery was replayed or removed while
+		// it was being attempted.
+		return
+	}
+
+	now := m.now().UTC()
+	d.Attempts++
+	d.LastStatus = status
+	d.UpdatedAt = now
+	d.LastError = ""
+
+	switch {
+	case err == nil:
+		d.State = StateSucceeded
+		d.NextAttempt = time.Time{}
+	case d.Attempts >= m.maxAttempts:
+		d.State = StateDead
+		d.NextAttempt = time.Time{}
+		d.LastError = err.Error()
+		m.logger.Warn("webhook delivery is dead", zap.String("delivery", d.ID), zap.String("endpoint", d.EndpointID), zap.Error(err))
+	default:
+		d.NextAttempt = now.Add(m.backoff(d.Attempts))
+		d.LastError = err.Error()
+	}
+
+	// The result is kept in memory when it cannot be saved, so
+	// that a failing queue file does not cause repeated attempts.
+	if err := m.persist(queueRecord{Delivery: &d}); err != nil {
+		m.logger.Error("failed to save webhook delivery", zap.String("delivery", d.ID), zap.Error(err))
+	}
+	m.putDelivery(d)
+	m.pruneCompleted()
+}
+
+// send posts the delivery's payload to the endpoint. A response
+// status other than 2xx is an error.
+func (m *Manager) send(ctx context.Context, endpoint Endpoint, d Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	timestamp := m.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, d.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, timestamp, d.Payload))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the delay after the given number of attempts.
+func (m *Manager) backoff(attempts int) time.Duration {
+	delay := m.minBackoff
+	for i := 1; i < attempts && delay < m.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > m.maxBackoff {
+		delay = m.maxBackoff
+	}
+	return delay
+}
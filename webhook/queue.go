@@ -0,0 +1,268 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxPendingDeliveries is the number of pending deliveries
+	// queued for an endpoint. Later deliveries are dead lettered
+	// until the endpoint catches up.
+	maxPendingDeliveries = 1000
+
+	// minCompactRecords is the number of queue file records
+	// appended before the file is compacted.
+	minCompactRecords = 1000
+)
+
+// queueRecord is a line of the queue file. The file starts with the
+// endpoints and deliveries at its last compaction, followed by the
+// changes since, each of which replaces the earlier endpoint or
+// delivery with the same id.
+type queueRecord struct {
+	Endpoints  []Endpoint `json:"endpoints,omitempty"`
+	Deliveries []Delivery `json:"deliveries,omitempty"`
+
+	Endpoint        *Endpoint `json:"endpoint,omitempty"`
+	Delivery        *Delivery `json:"delivery,omitempty"`
+	DeletedEndpoint string    `json:"deleted_endpoint,omitempty"`
+}
+
+// load reads the queue file, if configured and present, and
+// compacts it.
+func (m *Manager) load() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read webhook queue: %w", err)
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		rec := queueRecord{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if i == len(lines)-1 {
+				// A record torn by a crash while it was
+				// appended was never applied.
+				m.logger.Warn("discarding torn webhook queue record", zap.String("path", m.path))
+				break
+			}
+			return fmt.Errorf("failed to parse webhook queue %s: %w", m.path, err)
+		}
+		m.apply(rec)
+	}
+
+	m.pruneCompleted()
+	return m.compact()
+}
+
+// apply applies a queue file record. Callers must hold the lock.
+func (m *Manager) apply(rec queueRecord) {
+	for _, e := range rec.Endpoints {
+		m.endpoints[e.ID] = e
+	}
+	for _, d := range rec.Deliveries {
+		m.putDelivery(d)
+	}
+	if rec.Endpoint != nil {
+		m.endpoints[rec.Endpoint.ID] = *rec.Endpoint
+	}
+	if rec.Delivery != nil {
+		m.putDelivery(*rec.Delivery)
+	}
+	if rec.DeletedEndpoint != "" {
+		m.removeEndpoint(rec.DeletedEndpoint)
+	}
+}
+
+// persist appends records to the queue file, if configured, before
+// they are applied. The file is first compacted once it has more
+// records than endpoints and deliveries. Callers must hold the lock.
+func (m *Manager) persist(recs ...queueRecord) error {
+	if m.path == "" {
+		return nil
+	}
+
+	if m.records >= minCompactRecords && m.records >= len(m.endpoints)+len(m.deliveries) {
+		if err := m.compact(); err != nil {
+			return err
+		}
+	}
+
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return fmt.Errorf("failed to encode webhook queue record: %w", err)
+		}
+	}
+
+	// #nosec G304 the queue file is provided by the operator
+	f, err := os.OpenFile(m.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open webhook queue: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write webhook queue: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync webhook queue: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write webhook queue: %w", err)
+	}
+
+	m.records += len(recs)
+	return nil
+}
+
+// compact replaces the queue file with a single record of the
+// endpoints and deliveries. Callers must hold the lock.
+func (m *Manager) compact() error {
+	q := queueRecord{
+		Endpoints:  make([]Endpoint, 0, len(m.endpoints)),
+		Deliveries: make([]Delivery, 0, len(m.deliveries)),
+	}
+	for _, e := range m.endpoints {
+		q.Endpoints = append(q.Endpoints, e)
+	}
+	for _, d := range m.deliveries {
+		q.Deliveries = append(q.Deliveries, d)
+	}
+	sortNewestFirst(q.Deliveries)
+
+	data, err := json.Marshal(q)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook queue: %w", err)
+	}
+	data = append(data, '\n')
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write webhook queue: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write webhook queue: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync webhook queue: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write webhook queue: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return fmt.Errorf("failed to replace webhook queue: %w", err)
+	}
+
+	m.records = 0
+	return nil
+}
+
+// putDelivery stores a delivery and indexes it as pending for its
+// endpoint or as completed. Callers must hold the lock.
+func (m *Manager) putDelivery(d Delivery) {
+	previous, ok := m.deliveries[d.ID]
+	m.deliveries[d.ID] = d
+
+	wasPending := ok && previous.State == StatePending
+	switch {
+	case !wasPending && d.State == StatePending:
+		m.pending[d.EndpointID] = append(m.pending[d.EndpointID], d.ID)
+		if ok {
+			m.completed--
+		}
+	case wasPending && d.State != StatePending:
+		m.removePending(d.EndpointID, d.ID)
+		m.completed++
+	case !ok && d.State != StatePending:
+		m.completed++
+	}
+}
+
+// removePending removes a delivery from its endpoint's pending
+// deliveries. Callers must hold the lock.
+func (m *Manager) removePending(endpointID, deliveryID string) {
+	ids := m.pending[endpointID]
+	for i, id := range ids {
+		if id == deliveryID {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(m.pending, endpointID)
+		return
+	}
+	m.pending[endpointID] = ids
+}
+
+// removeEndpoint removes an endpoint and its deliveries. Callers
+// must hold the lock.
+func (m *Manager) removeEndpoint(endpointID string) {
+	delete(m.endpoints, endpointID)
+	delete(m.pending, endpointID)
+	for id, d := range m.deliveries {
+		if d.EndpointID != endpointID {
+			continue
+		}
+		if d.State != StatePending {
+			m.completed--
+		}
+		delete(m.deliveries, id)
+	}
+}
+
+// pruneCompleted discards the oldest succeeded and dead deliveries
+// once there are a quarter more than maxCompleted. Callers must hold
+// the lock.
+func (m *Manager) pruneCompleted() {
+	if m.completed <= maxCompleted+maxCompleted/4 {
+		return
+	}
+
+	completed := make([]Delivery, 0, m.completed)
+	for _, d := range m.deliveries {
+		if d.State != StatePending {
+			completed = append(completed, d)
+		}
+	}
+
+	sortNewestFirst(completed)
+	for _, d := range completed[maxCompleted:] {
+		delete(m.deliveries, d.ID)
+	}
+	m.completed = maxCompleted
+}
+
+func sortNewestFirst(deliveries []Delivery) {
+	sort.Slice(deliveries, func(i, j int) bool {
+		if deliveries[i].CreatedAt.Equal(deliveries[j].CreatedAt) {
+			return deliveries[i].ID > deliveries[j].ID
+		}
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+}
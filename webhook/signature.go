@@ -0,0 +1,68 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderID is the delivery id header. Receivers should use it
+	// to ignore deliveries they have already processed.
+	HeaderID = "Webhook-Id"
+
+	// HeaderTimestamp is the unix time at which the delivery
+	// was signed.
+	HeaderTimestamp = "Webhook-Timestamp"
+
+	// HeaderSignature is the HMAC-SHA256 signature of the
+	// timestamp and body, with the form 'sha256=<hex>'.
+	HeaderSignature = "Webhook-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+// ErrInvalidSignature is returned by Verify when a signature
+// does not match or has expired.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Sign returns the signature header value for body signed
+// with secret at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns ErrInvalidSignature if signature is not the
+// signature of body and timestamp, or if timestamp is more than
+// tolerance away from now. Receivers pass the values of the
+// timestamp and signature headers.
+func Verify(secret, timestamp, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp '%s'", ErrInvalidSignature, timestamp)
+	}
+
+	age := now.Sub(time.Unix(ts, 0))
+	if age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: timestamp is outside of the %s tolerance", ErrInvalidSignature, tolerance)
+	}
+
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return fmt.Errorf("%w: unsupported signature scheme", ErrInvalidSignature)
+	}
+
+	expected := Sign(secret, ts, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
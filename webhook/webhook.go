@@ -0,0 +1,410 @@
+// Package webhook delivers account and device events to
+// endpoints registered by accounts.
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jsirianni/server/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMaxAttempts is the default number of delivery
+	// attempts before a delivery is dead lettered.
+	DefaultMaxAttempts = 8
+
+	// DefaultMinBackoff is the default delay before the
+	// first retry.
+	DefaultMinBackoff = time.Second * 10
+
+	// DefaultMaxBackoff is the default maximum delay
+	// between retries.
+	DefaultMaxBackoff = time.Hour
+
+	// DefaultTimeout is the default timeout of a delivery.
+	DefaultTimeout = time.Second * 10
+
+	// maxCompleted is the number of succeeded and dead deliveries
+	// kept for replay. Older deliveries are discarded.
+	maxCompleted = 1000
+
+	// maxConcurrentDeliveries is the number of deliveries
+	// attempted at once, each to a different endpoint.
+	maxConcurrentDeliveries = 16
+)
+
+// Event types delivered to endpoints.
+const (
+	EventDeviceRegistered    = "device.registered"
+	EventDeviceUpdated       = "device.updated"
+	EventDeviceDeleted       = "device.deleted"
+	EventSubscriptionChanged = "subscription.changed"
+)
+
+var eventTypes = map[string]bool{
+	EventDeviceRegistered:    true,
+	EventDeviceUpdated:       true,
+	EventDeviceDeleted:       true,
+	EventSubscriptionChanged: true,
+}
+
+// State is the state of a delivery.
+type State string
+
+const (
+	// StatePending deliveries are waiting to be attempted.
+	StatePending State = "pending"
+
+	// StateSucceeded deliveries were accepted by the endpoint.
+	StateSucceeded State = "succeeded"
+
+	// StateDead deliveries failed every attempt. They are
+	// retried only when replayed.
+	StateDead State = "dead"
+)
+
+var (
+	// ErrNotFound is returned when an endpoint or delivery
+	// does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrInvalidEndpoint is returned when creating an endpoint
+	// with an invalid url or event type.
+	ErrInvalidEndpoint = errors.New("invalid webhook endpoint")
+)
+
+// Endpoint is a url which receives an account's events.
+type Endpoint struct {
+	ID        string `json:"id"`
+	AccountID string `json:"account_id"`
+	URL       string `json:"url"`
+
+	// Secret signs deliveries. It is only returned
+	// when the endpoint is created.
+	Secret string `json:"secret,omitempty"`
+
+	// Events are the event types sent to the endpoint.
+	// All events are sent when empty.
+	Events []string `json:"events,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Delivery is an event queued for an endpoint.
+type Delivery struct {
+	ID          string          `json:"id"`
+	EndpointID  string          `json:"endpoint_id"`
+	AccountID   string          `json:"account_id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	State       State           `json:"state"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastStatus  int             `json:"last_status,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// Option is a function that configures a Manager option.
+type Option func(*Manager) error
+
+// WithQueueFile persists endpoints and deliveries to path so that
+// queued deliveries survive restarts. Endpoints and deliveries are
+// kept in memory when not set.
+func WithQueueFile(path string) Option {
+	return func(m *Manager) error {
+		if path == "" {
+			return errors.New("queue file cannot be empty")
+		}
+		m.path = path
+		return nil
+	}
+}
+
+// WithMaxAttempts configures the number of delivery attempts
+// before a delivery is dead lettered.
+func WithMaxAttempts(attempts int) Option {
+	return func(m *Manager) error {
+		if attempts <= 0 {
+			return fmt.Errorf("max attempts must be greater than zero: %d", attempts)
+		}
+		m.maxAttempts = attempts
+		return nil
+	}
+}
+
+// WithBackoff configures the delay before the first retry and the
+// maximum delay between retries. The delay doubles with each attempt.
+func WithBackoff(initial, limit time.Duration) Option {
+	return func(m *Manager) error {
+		if initial <= 0 || limit < initial {
+			return fmt.Errorf("invalid backoff: min %s must be greater than zero and not greater than max %s", initial, limit)
+		}
+		m.minBackoff = initial
+		m.maxBackoff = limit
+		return nil
+	}
+}
+
+// WithHTTPClient configures the http client used for deliveries.
+// The default client refuses to connect to addresses within the
+// server's network and does not follow redirects; client is used
+// as is.
+func WithHTTPClient(client *http.Client) Option {
+	return func(m *Manager) error {
+		if client == nil {
+			return errors.New("http client cannot be nil")
+		}
+		m.client = client
+		return nil
+	}
+}
+
+// WithInsecureURLs allows endpoints with http urls. Only https
+// urls are allowed by default.
+func WithInsecureURLs() Option {
+	return func(m *Manager) error {
+		m.allowInsecure = true
+		return nil
+	}
+}
+
+// Manager manages webhook endpoints and delivers store
+// events to them.
+type Manager struct {
+	store         store.Store
+	logger        *zap.Logger
+	client        *http.Client
+	path          string
+	maxAttempts   int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	allowInsecure bool
+	now           func() time.Time
+
+	// wake is signaled when a delivery is queued
+	wake chan struct{}
+
+	mu sync.Mutex
+
+	// endpoints is indexed with endpoint id
+	endpoints map[string]Endpoint
+
+	// deliveries is indexed with delivery id
+	deliveries map[string]Delivery
+
+	// pending is each endpoint's pending delivery ids, in the
+	// order they are attempted
+	pending map[string][]string
+
+	// inflight is the endpoints with a delivery being attempted
+	inflight map[string]bool
+
+	// completed is the number of succeeded and dead deliveries
+	completed int
+
+	// records is the number of records appended to the queue
+	// file since it was compacted
+	records int
+
+	// active is each account's last known subscription state
+	active map[string]bool
+}
+
+// New returns a Manager which delivers events from st. Deliveries
+// start when Run is called.
+func New(logger *zap.Logger, st store.Store, ops ...Option) (*Manager, error) {
+	if logger == nil {
+		return nil, errors.New("a zap logger is required")
+	}
+	if st == nil {
+		return nil, errors.New("store cannot be nil")
+	}
+
+	m := &Manager{
+		store:       st,
+		logger:      logger,
+		client:      newHTTPClient(),
+		maxAttempts: DefaultMaxAttempts,
+		minBackoff:  DefaultMinBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+		now:         time.Now,
+		wake:        make(chan struct{}, 1),
+		endpoints:   make(map[string]Endpoint),
+		deliveries:  make(map[string]Delivery),
+		pending:     make(map[string][]string),
+		inflight:    make(map[string]bool),
+		active:      make(map[string]bool),
+	}
+
+	for _, op := range ops {
+		if err := op(m); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// CreateEndpoint registers an endpoint for an account. The returned
+// endpoint includes the secret used to sign its deliveries.
+func (m *Manager) CreateEndpoint(accountID, rawURL string, events []string) (Endpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return Endpoint{}, fmt.Errorf("%w: url must be absolute", ErrInvalidEndpoint)
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && m.allowInsecure:
+	default:
+		return Endpoint{}, fmt.Errorf("%w: url scheme '%s' is not allowed", ErrInvalidEndpoint, u.Scheme)
+	}
+
+	for _, e := range events {
+		if !eventTypes[e] {
+			return Endpoint{}, fmt.Errorf("%w: unknown event type '%s'", ErrInvalidEndpoint, e)
+		}
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	endpoint := Endpoint{
+		ID:        id,
+		AccountID: accountID,
+		URL:       u.String(),
+		Secret:    secret,
+		Events:    events,
+		CreatedAt: m.now().UTC(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.persist(queueRecord{Endpoint: &endpoint}); err != nil {
+		return Endpoint{}, err
+	}
+	m.endpoints[id] = endpoint
+	return endpoint, nil
+}
+
+// Endpoints returns an account's endpoints ordered by creation
+// time, without their secrets.
+func (m *Manager) Endpoints(accountID string) []Endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	endpoints := []Endpoint{}
+	for _, e := range m.endpoints {
+		if e.AccountID == accountID {
+			e.Secret = ""
+			endpoints = append(endpoints, e)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].CreatedAt.Equal(endpoints[j].CreatedAt) {
+			return endpoints[i].ID < endpoints[j].ID
+		}
+		return endpoints[i].CreatedAt.Before(endpoints[j].CreatedAt)
+	})
+	return endpoints
+}
+
+// DeleteEndpoint removes an account's endpoint and its deliveries.
+func (m *Manager) DeleteEndpoint(accountID, endpointID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	endpoint, ok := m.endpoints[endpointID]
+	if !ok || endpoint.AccountID != accountID {
+		return fmt.Errorf("%w: account with id %s does not have webhook with id %s", ErrNotFound, accountID, endpointID)
+	}
+
+	if err := m.persist(queueRecord{DeletedEndpoint: endpointID}); err != nil {
+		return err
+	}
+	m.removeEndpoint(endpointID)
+	return nil
+}
+
+// Deliveries returns an endpoint's deliveries, newest first.
+func (m *Manager) Deliveries(accountID, endpointID string) ([]Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	endpoint, ok := m.endpoints[endpointID]
+	if !ok || endpoint.AccountID != accountID {
+		return nil, fmt.Errorf("%w: account with id %s does not have webhook with id %s", ErrNotFound, accountID, endpointID)
+	}
+
+	deliveries := []Delivery{}
+	for _, d := range m.deliveries {
+		if d.EndpointID == endpointID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sortNewestFirst(deliveries)
+	return deliveries, nil
+}
+
+// Replay queues a delivery to be attempted again, regardless
+// of its state, with a new set of attempts.
+func (m *Manager) Replay(accountID, endpointID, deliveryID string) (Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.deliveries[deliveryID]
+	if !ok || d.AccountID != accountID || d.EndpointID != endpointID {
+		return Delivery{}, fmt.Errorf("%w: webhook with id %s does not have delivery with id %s", ErrNotFound, endpointID, deliveryID)
+	}
+
+	now := m.now().UTC()
+	d.State = StatePending
+	d.Attempts = 0
+	d.NextAttempt = now
+	d.UpdatedAt = now
+	if err := m.persist(queueRecord{Delivery: &d}); err != nil {
+		return Delivery{}, err
+	}
+	m.putDelivery(d)
+
+	m.notify()
+	return d, nil
+}
+
+// notify wakes the dispatcher.
+func (m *Manager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,434 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jsirianni/server/model"
+	"github.com/jsirianni/server/store"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDeliver(t *testing.T) {
+	st := store.NewTestingMemory()
+	r := newReceiver(t)
+	m := newTestManager(t, st, r)
+
+	endpoint, err := m.CreateEndpoint("abc", r.URL, nil)
+	require.NoError(t, err)
+	require.Len(t, endpoint.Secret, 64)
+	r.secret = endpoint.Secret
+
+	runManager(t, m)
+	_, err = st.RegisterDevice("abc", "xyz", model.Device{ID: "device-c", Hostname: "c"})
+	require.NoError(t, err)
+	_, err = st.RegisterDevice("go", "095", model.Device{ID: "other"})
+	require.NoError(t, err)
+
+	got := r.next(t)
+	require.Equal(t, EventDeviceRegistered, got.Event)
+	require.Equal(t, "abc", got.AccountID)
+	require.JSONEq(t, `{"account_id":"abc","id":"device-c","hostname":"c"}`, string(got.Data))
+
+	require.Eventually(t, func() bool {
+		deliveries, err := m.Deliveries("abc", endpoint.ID)
+		require.NoError(t, err)
+		return len(deliveries) == 1 && deliveries[0].State == StateSucceeded
+	}, time.Second, time.Millisecond*5)
+
+	deliveries, err := m.Deliveries("abc", endpoint.ID)
+	require.NoError(t, err)
+	require.Equal(t, got.ID, deliveries[0].ID)
+	require.Equal(t, 1, deliveries[0].Attempts)
+	require.Equal(t, http.StatusNoContent, deliveries[0].LastStatus)
+	r.requireNone(t)
+}
+
+func TestDeliverSubscriptionChanged(t *testing.T) {
+	st := store.NewTestingMemory()
+	r := newReceiver(t)
+	m := newTestManager(t, st, r)
+
+	endpoint, err := m.CreateEndpoint("go", r.URL, []string{EventSubscriptionChanged})
+	require.NoError(t, err)
+	r.secret = endpoint.Secret
+
+	runManager(t, m)
+	_, err = st.RegisterDevice("go", "095", model.Device{ID: "device"})
+	require.NoError(t, err)
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "go", Key: "rotated", Active: false}))
+	require.NoError(t, st.UpdateAccount(model.Account{ID: "go", Key: "rotated", Active: true}))
+
+	got := r.next(t)
+	require.Equal(t, EventSubscriptionChanged, got.Event)
+	require.JSONEq(t, `{"account_id":"go","active":true}`, string(got.Data))
+	r.requireNone(t)
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	st := store.NewTestingMemory()
+	r := newReceiver(t)
+	r.status = http.StatusServiceUnavailable
+	m := newTestManager(t, st, r, WithMaxAttempts(3))
+
+	endpoint, err := m.CreateEndpoint("abc", r.URL, nil)
+	require.NoError(t, err)
+	r.secret = endpoint.Secret
+
+	runManager(t, m)
+	require.NoError(t, st.DeleteDevice("abc", "device-a"))
+
+	first := r.next(t)
+	require.Equal(t, first.ID, r.next(t).ID, "expected the same delivery to be retried")
+	require.Equal(t, first.ID, r.next(t).ID)
+
+	var dead Delivery
+	require.Eventually(t, func() bool {
+		deliveries, err := m.Deliveries("abc", endpoint.ID)
+		require.NoError(t, err)
+		dead = deliveries[0]
+		return dead.State == StateDead
+	}, time.Second, time.Millisecond*5)
+	require.Equal(t, 3, dead.Attempts)
+	require.Equal(t, http.StatusServiceUnavailable, dead.LastStatus)
+	require.Equal(t, "endpoint returned status code 503", dead.LastError)
+	r.requireNone(t)
+
+	r.setStatus(http.StatusOK)
+	replayed, err := m.Replay("abc", endpoint.ID, dead.ID)
+	require.NoError(t, err)
+	require.Equal(t, StatePending, replayed.State)
+	require.Equal(t, first.ID, r.next(t).ID)
+
+	require.Eventually(t, func() bool {
+		deliveries, err := m.Deliveries("abc", endpoint.ID)
+		require.NoError(t, err)
+		return deliveries[0].State == StateSucceeded
+	}, time.Second, time.Millisecond*5)
+}
+
+func TestQueueFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	st := store.NewTestingMemory()
+	r := newReceiver(t)
+
+	m := newTestManager(t, st, r, WithQueueFile(path))
+	endpoint, err := m.CreateEndpoint("abc", r.URL, nil)
+	require.NoError(t, err)
+	r.secret = endpoint.Secret
+
+	// Queue a delivery without running the manager, as if
+	// it stopped before the delivery was attempted.
+	require.NoError(t, m.enqueue("abc", EventDeviceDeleted, model.Device{AccountID: "abc", ID: "device-a"}))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 2, bytes.Count(data, []byte("\n")), "expected a record appended for each change")
+
+	// A record torn by a crash is discarded.
+	require.NoError(t, os.WriteFile(path, append(data, `{"delivery":{"id":`...), 0o600))
+
+	restarted := newTestManager(t, st, r, WithQueueFile(path))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, bytes.Count(data, []byte("\n")), "expected the queue file to be compacted")
+	endpoints := restarted.Endpoints("abc")
+	require.Len(t, endpoints, 1)
+	require.Empty(t, endpoints[0].Secret, "expected the secret to be omitted")
+
+	runManager(t, restarted)
+	got := r.next(t)
+	require.Equal(t, EventDeviceDeleted, got.Event)
+
+	require.NoError(t, restarted.DeleteEndpoint("abc", endpoint.ID))
+	restarted = newTestManager(t, st, r, WithQueueFile(path))
+	require.Empty(t, restarted.Endpoints("abc"))
+}
+
+func TestPendingLimit(t *testing.T) {
+	m, err := New(zap.NewNop(), store.NewMemory())
+	require.NoError(t, err)
+
+	endpoint, err := m.CreateEndpoint("abc", "https://example.com/hook", nil)
+	require.NoError(t, err)
+	for i := 0; i <= maxPendingDeliveries; i++ {
+		require.NoError(t, m.enqueue("abc", EventDeviceDeleted, model.Device{AccountID: "abc", ID: "device-a"}))
+	}
+
+	deliveries, err := m.Deliveries("abc", endpoint.ID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, maxPendingDeliveries+1)
+	require.Len(t, m.pending[endpoint.ID], maxPendingDeliveries)
+
+	dead := 0
+	for _, d := range deliveries {
+		if d.State == StateDead {
+			dead++
+			require.Equal(t, "endpoint has too many pending deliveries", d.LastError)
+		}
+	}
+	require.Equal(t, 1, dead)
+}
+
+func TestSlowEndpoint(t *testing.T) {
+	st := store.NewTestingMemory()
+	r := newReceiver(t)
+	m := newTestManager(t, st, r)
+
+	endpoint, err := m.CreateEndpoint("abc", r.URL, nil)
+	require.NoError(t, err)
+	r.secret = endpoint.Secret
+
+	// slow accepts a request and blocks until released.
+	requests := make(chan struct{}, 10)
+	release := make(chan struct{})
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	_, err = m.CreateEndpoint("abc", slow.URL, nil)
+	require.NoError(t, err)
+
+	runManager(t, m)
+	require.NoError(t, st.DeleteDevice("abc", "device-a"))
+	require.NoError(t, st.DeleteDevice("abc", "device-b"))
+
+	// The other endpoint receives both deliveries while the
+	// slow endpoint is attempted one delivery at a time.
+	require.Equal(t, EventDeviceDeleted, r.next(t).Event)
+	require.Equal(t, EventDeviceDeleted, r.next(t).Event)
+	<-requests
+	select {
+	case <-requests:
+		t.Fatal("expected one delivery in progress per endpoint")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestEndpointErrors(t *testing.T) {
+	m, err := New(zap.NewNop(), store.NewMemory())
+	require.NoError(t, err)
+
+	cases := []struct {
+		name      string
+		url       string
+		events    []string
+		expectErr string
+	}{
+		{"relative", "/hook", nil, "url must be absolute"},
+		{"insecure", "http://example.com/hook", nil, "url scheme 'http' is not allowed"},
+		{"scheme", "ftp://example.com/hook", nil, "url scheme 'ftp' is not allowed"},
+		{"event", "https://example.com/hook", []string{"device.exploded"}, "unknown event type 'device.exploded'"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := m.CreateEndpoint("abc", tc.url, tc.events)
+			require.ErrorIs(t, err, ErrInvalidEndpoint)
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+
+	endpoint, err := m.CreateEndpoint("abc", "https://example.com/hook", nil)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, m.DeleteEndpoint("xyz", endpoint.ID), ErrNotFound)
+	_, err = m.Deliveries("xyz", endpoint.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = m.Replay("abc", endpoint.ID, "missing")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestOptions(t *testing.T) {
+	cases := []struct {
+		name      string
+		op        Option
+		expectErr string
+	}{
+		{"max-attempts", WithMaxAttempts(0), "max attempts must be greater than zero: 0"},
+		{"backoff", WithBackoff(time.Second, time.Millisecond), "invalid backoff"},
+		{"http-client", WithHTTPClient(nil), "http client cannot be nil"},
+		{"queue-file", WithQueueFile(""), "queue file cannot be empty"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(zap.NewNop(), store.NewMemory(), tc.op)
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+}
+
+func TestDestination(t *testing.T) {
+	cases := []struct {
+		addr   string
+		expect bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"::ffff:10.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.addr, func(t *testing.T) {
+			require.Equal(t, tc.expect, allowedDestination(netip.MustParseAddr(tc.addr)))
+		})
+	}
+
+	// The default client refuses internal addresses and redirects.
+	r := newReceiver(t)
+	client := newHTTPClient()
+	_, err := client.Post(r.URL, "application/json", strings.NewReader("{}"))
+	require.ErrorIs(t, err, ErrDestinationNotAllowed)
+
+	req := httptest.NewRequest(http.MethodPost, "http://169.254.169.254/latest", nil)
+	require.ErrorIs(t, client.CheckRedirect(req, nil), ErrDestinationNotAllowed)
+}
+
+func TestBackoff(t *testing.T) {
+	m := &Manager{minBackoff: time.Second, maxBackoff: time.Second * 5}
+	require.Equal(t, time.Second, m.backoff(1))
+	require.Equal(t, time.Second*2, m.backoff(2))
+	require.Equal(t, time.Second*4, m.backoff(3))
+	require.Equal(t, time.Second*5, m.backoff(4))
+	require.Equal(t, time.Second*5, m.backoff(40))
+}
+
+func TestSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"1"}`)
+	signature := Sign("secret", now.Unix(), body)
+
+	require.NoError(t, Verify("secret", "1700000000", signature, body, now, time.Minute))
+	require.ErrorIs(t, Verify("other", "1700000000", signature, body, now, time.Minute), ErrInvalidSignature)
+	require.ErrorIs(t, Verify("secret", "1700000000", signature, []byte(`{"id":"2"}`), now, time.Minute), ErrInvalidSignature)
+	require.ErrorIs(t, Verify("secret", "1700000000", signature, body, now.Add(time.Hour), time.Minute), ErrInvalidSignature)
+	require.ErrorIs(t, Verify("secret", "now", signature, body, now, time.Minute), ErrInvalidSignature)
+	require.ErrorIs(t, Verify("secret", "1700000000", "md5=abc", body, now, time.Minute), ErrInvalidSignature)
+}
+
+// receiver is a webhook endpoint which verifies signatures and
+// records payloads.
+type receiver struct {
+	*httptest.Server
+	secret   string
+	payloads chan payloadJSON
+
+	mu     sync.Mutex
+	status int
+}
+
+type payloadJSON struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	AccountID string          `json:"account_id"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+
+	r := &receiver{payloads: make(chan payloadJSON, 10), status: http.StatusNoContent}
+	r.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+
+		err = Verify(r.secret, req.Header.Get(HeaderTimestamp), req.Header.Get(HeaderSignature), body, time.Now(), time.Minute)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		p := payloadJSON{}
+		require.NoError(t, json.Unmarshal(body, &p))
+		require.Equal(t, p.ID, req.Header.Get(HeaderID))
+		r.payloads <- p
+
+		r.mu.Lock()
+		w.WriteHeader(r.status)
+		r.mu.Unlock()
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) setStatus(status int) {
+	r.mu.Lock()
+	r.status = status
+	r.mu.Unlock()
+}
+
+func (r *receiver) next(t *testing.T) payloadJSON {
+	t.Helper()
+	select {
+	case p := <-r.payloads:
+		return p
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for a delivery")
+		return payloadJSON{}
+	}
+}
+
+func (r *receiver) requireNone(t *testing.T) {
+	t.Helper()
+	select {
+	case p := <-r.payloads:
+		t.Fatalf("unexpected delivery %s", p.Event)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func newTestManager(t *testing.T, st store.Store, r *receiver, ops ...Option) *Manager {
+	t.Helper()
+	ops = append([]Option{WithHTTPClient(r.Client()), WithBackoff(time.Millisecond, time.Millisecond*5)}, ops...)
+	m, err := New(zap.NewNop(), st, ops...)
+	require.NoError(t, err)
+	return m
+}
+
+// runManager runs m until the test completes.
+func runManager(t *testing.T, m *Manager) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	// Wait for the manager to watch the store.
+	require.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.active) > 0
+	}, time.Second, time.Millisecond)
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+}